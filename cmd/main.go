@@ -1,42 +1,195 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"flag"
 	"fmt"
-	"log"
-	"net"
+	"io"
+	"log/slog"
+	"os"
+	"os/signal"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/elmq0022/pub-sub/internal/broker"
 	"github.com/elmq0022/pub-sub/internal/config"
+	"github.com/elmq0022/pub-sub/internal/monitor"
+	"github.com/elmq0022/pub-sub/internal/server"
 	"github.com/elmq0022/pub-sub/internal/sessioncontroller"
 	"github.com/elmq0022/pub-sub/internal/subjectregistry"
 )
 
+// reloadTimeout bounds how long a reload waits for the broker loop.
+const reloadTimeout = 5 * time.Second
+
 func main() {
-	r := subjectregistry.NewSubjectRegistry()
-	cfg, err := config.NewConfig()
+	configPath := flag.String("config", os.Getenv("PUBSUB_CONFIG"), "read settings from the JSON config `file`")
+	overrides := make(map[string]string)
+	flag.Func("set", "override a setting as `key=value`, using config file keys; may be repeated", func(kv string) error {
+		key, value, ok := strings.Cut(kv, "=")
+		if !ok {
+			return errors.New("expected key=value")
+		}
+		overrides[key] = value
+		return nil
+	})
+	flag.Parse()
+
+	cfg, err := config.Load(*configPath, overrides)
 	if err != nil {
-		log.Fatal(err)
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
 	}
+	level := new(slog.LevelVar)
+	level.Set(cfg.LogLevel)
+	logger := newLogger(os.Stderr, cfg.LogFormat, level)
+	slog.SetDefault(logger)
+
+	r := subjectregistry.NewSubjectRegistryWithCache(cfg.LookupCacheSize)
 
 	b := broker.NewBroker(r, cfg)
+	b.SetLogger(logger)
+
+	s := sessioncontroller.NewSessionController(b.Input(), cfg)
+	s.SetLogger(logger)
+	s.RoutePublishes(b)
+	s.RouteControl(b.ControlInput())
+
+	srv := server.NewServer(cfg, s)
+	srv.SetLogger(logger)
+
+	b.SetWriterStats(s.WriterStats())
+	b.SetRateLimitStats(s.RateLimitStats())
+	b.SetAcceptStats(srv.AcceptStats())
 	go b.Run()
 
-	s := sessioncontroller.NewSessionController(b.Input())
+	// The monitor starts first so probes are answered, as not ready, while
+	// the client listeners open.
+	var m *monitor.Server
+	if cfg.MonitorAddr != "" {
+		m = monitor.NewServer(cfg.MonitorAddr, b)
+		if cfg.MonitorAdmin {
+			m.SetAdminToken(cfg.MonitorAdminToken)
+			m.EnableAdmin(b)
+			m.EnableTrace(s)
+		}
+		if err := m.Listen(); err != nil {
+			fatal(logger, "monitor listen", err)
+		}
+		defer m.Close()
+		logger.Info("monitoring", "url", fmt.Sprintf("http://%s", m.Addr()), "admin", cfg.MonitorAdmin)
+		go func() {
+			if err := m.Serve(); err != nil {
+				logger.Error("monitor", "err", err)
+			}
+		}()
+	}
 
-	ln, err := net.Listen("tcp", net.JoinHostPort("", cfg.Port))
-	if err != nil {
-		log.Fatal(err)
+	if err := srv.Listen(); err != nil {
+		fatal(logger, "listen", err)
+	}
+	defer srv.Close()
+
+	for _, addr := range srv.Addrs() {
+		logger.Info("listening", "network", addr.Network(), "addr", addr.String())
+	}
+	if m != nil {
+		m.SetReady(true)
 	}
-	defer ln.Close()
 
-	fmt.Printf("listening on :%s", cfg.Port)
+	rl := &reloader{
+		path:      *configPath,
+		overrides: overrides,
+		cur:       cfg,
+		level:     level,
+		broker:    b,
+		sessions:  s,
+		server:    srv,
+		logger:    logger,
+	}
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			rl.reload()
+		}
+	}()
 
-	for {
-		conn, err := ln.Accept()
-		if err != nil {
-			log.Println("accept error")
-			continue
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		// Report not ready and keep serving for the grace period, so load
+		// balancers stop routing here before the listeners close.
+		if m != nil {
+			m.SetReady(false)
 		}
-		s.Start(conn)
+		logger.Info("shutting down", "grace", cfg.ShutdownGrace)
+		time.Sleep(cfg.ShutdownGrace)
+		_ = srv.Close()
+	}()
+
+	srv.Serve()
+}
+
+// newLogger writes records at level and above to w in format.
+func newLogger(w io.Writer, format config.LogFormat, level slog.Leveler) *slog.Logger {
+	opts := &slog.HandlerOptions{Level: level}
+	if format == config.LogFormatJSON {
+		return slog.New(slog.NewJSONHandler(w, opts))
+	}
+	return slog.New(slog.NewTextHandler(w, opts))
+}
+
+// fatal logs err and exits, like log.Fatal. Deferred calls do not run.
+func fatal(logger *slog.Logger, msg string, err error) {
+	logger.Error(msg, "err", err)
+	os.Exit(1)
+}
+
+// reloader reads the configuration again on SIGHUP and applies the settings
+// that can change while running. Settings that need a restart are logged
+// and keep their running values.
+type reloader struct {
+	path      string
+	overrides map[string]string
+	cur       config.Config
+
+	level    *slog.LevelVar
+	broker   *broker.Broker
+	sessions *sessioncontroller.SessionController
+	server   *server.Server
+	logger   *slog.Logger
+}
+
+// reload keeps the running configuration when the new one does not load.
+func (r *reloader) reload() {
+	next, err := config.Load(r.path, r.overrides)
+	if err != nil {
+		r.logger.Error("reload", "err", err)
+		return
+	}
+	applied, changes := config.Reload(r.cur, next)
+
+	ctx, cancel := context.WithTimeout(context.Background(), reloadTimeout)
+	defer cancel()
+	if err := r.broker.Reload(ctx, applied); err != nil {
+		r.logger.Error("reload", "err", err)
+		return
+	}
+	r.sessions.Reload(applied)
+	if slices.Contains(changes.Live, "Trace") {
+		r.sessions.SetTrace(applied.Trace)
+	}
+	r.server.Reload(applied)
+	r.level.Set(applied.LogLevel)
+	r.cur = applied
+
+	r.logger.Info("config reloaded", "applied", changes.Live, "new_connections", changes.NewConns)
+	if len(changes.Restart) > 0 {
+		r.logger.Warn("config changes need a restart", "settings", changes.Restart)
 	}
 }
@@ -0,0 +1,292 @@
+package broker
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/elmq0022/pub-sub/internal/codec"
+	"github.com/elmq0022/pub-sub/internal/config"
+)
+
+// Admin request subjects. System sessions publish to them with a reply
+// subject and the broker answers there with JSON, instead of delivering the
+// request to subscribers.
+const (
+	SysReqPing  = "$SYS.REQ.SERVER.PING"
+	SysReqConnz = "$SYS.REQ.SERVER.CONNZ"
+	SysReqSubsz = "$SYS.REQ.SERVER.SUBSZ"
+	SysReqKick  = "$SYS.REQ.SERVER.KICK"
+	SysReqDrain = "$SYS.REQ.SERVER.DRAIN"
+)
+
+var sysReqPrefix = []byte("$SYS.REQ.")
+
+// ErrUnknownCID is returned for an admin operation on a CID that has no
+// session.
+var ErrUnknownCID = errors.New("unknown cid")
+
+// KickRequest is the payload of a KICK request. Reason, if set, is sent to
+// the client as an -ERR before it is disconnected.
+type KickRequest struct {
+	CID    int64  `json:"cid"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// DrainRequest is the payload of a DRAIN request.
+type DrainRequest struct {
+	CID int64 `json:"cid"`
+}
+
+// RequestError is the reply to an admin request that failed.
+type RequestError struct {
+	Error string `json:"error"`
+}
+
+func isSystemRequest(subject []byte) bool {
+	return bytes.HasPrefix(subject, sysReqPrefix)
+}
+
+// handleSystemRequest answers an admin request from a system session on its
+// reply subject. Requests without one are dropped since nobody would see
+// the answer.
+func (b *Broker) handleSystemRequest(pub codec.Pub) {
+	defer pub.Release()
+	if len(pub.Reply) == 0 {
+		return
+	}
+	reply, err := b.systemRequest(string(pub.Subject), pub.Payload)
+	if err != nil {
+		reply = RequestError{Error: err.Error()}
+	}
+	b.publishSystem(string(pub.Reply), reply)
+}
+
+func (b *Broker) systemRequest(subject string, payload []byte) (any, error) {
+	switch subject {
+	case SysReqPing:
+		return b.completeVarz(b.varz()), nil
+	case SysReqConnz:
+		var opts ConnzOptions
+		if err := decodeRequest(payload, &opts); err != nil {
+			return nil, err
+		}
+		key, err := connzKey(opts.Sort)
+		if err != nil {
+			return nil, err
+		}
+		return newConnz(b.conns(), opts, key), nil
+	case SysReqSubsz:
+		var opts SubszOptions
+		if err := decodeRequest(payload, &opts); err != nil {
+			return nil, err
+		}
+		return newSubsz(b.subsz(opts.Subscriptions), opts), nil
+	case SysReqKick:
+		var req KickRequest
+		if err := decodeRequest(payload, &req); err != nil {
+			return nil, err
+		}
+		return b.kick(req.CID, req.Reason)
+	case SysReqDrain:
+		var req DrainRequest
+		if err := decodeRequest(payload, &req); err != nil {
+			return nil, err
+		}
+		return b.drain(req.CID)
+	}
+	return nil, fmt.Errorf("unknown request %s", subject)
+}
+
+// decodeRequest reads JSON options into v. An empty payload keeps the
+// defaults.
+func decodeRequest(payload []byte, v any) error {
+	if len(bytes.TrimSpace(payload)) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(payload, v); err != nil {
+		return fmt.Errorf("bad request: %v", err)
+	}
+	return nil
+}
+
+type adminResult struct {
+	info ConnInfo
+	err  error
+}
+
+// Kick disconnects cid at once, discarding the messages still queued for
+// it. A non-empty reason is sent to the client as an -ERR first.
+func (b *Broker) Kick(ctx context.Context, cid int64, reason string) (ConnInfo, error) {
+	res, err := query(ctx, b.control, func(b *Broker) adminResult {
+		info, err := b.kick(cid, reason)
+		return adminResult{info, err}
+	})
+	if err != nil {
+		return ConnInfo{}, err
+	}
+	return res.info, res.err
+}
+
+// Drain removes cid's subscriptions so it gets no new messages, and closes
+// the connection once the messages already queued have been written.
+func (b *Broker) Drain(ctx context.Context, cid int64) (ConnInfo, error) {
+	res, err := query(ctx, b.control, func(b *Broker) adminResult {
+		info, err := b.drain(cid)
+		return adminResult{info, err}
+	})
+	if err != nil {
+		return ConnInfo{}, err
+	}
+	return res.info, res.err
+}
+
+// Reload applies the broker's live settings from cfg, as chosen by
+// config.Reload. New credentials and limits apply to the next CONNECT or
+// SUB. When the system user or password changes, sessions that logged in
+// with the old ones are disconnected. Pending limits apply to sessions that
+// start after the reload.
+func (b *Broker) Reload(ctx context.Context, cfg config.Config) error {
+	_, err := query(ctx, b.control, func(b *Broker) struct{} {
+		b.reload(cfg)
+		return struct{}{}
+	})
+	return err
+}
+
+func (b *Broker) reload(cfg config.Config) {
+	b.config.AuthTimeout = cfg.AuthTimeout
+	b.config.HeartbeatTimeout = cfg.HeartbeatTimeout
+	b.config.MaxPendingBytes = cfg.MaxPendingBytes
+	b.config.SlowConsumerPolicy = cfg.SlowConsumerPolicy
+	b.config.MaxPendingPerSub = cfg.MaxPendingPerSub
+	b.config.MaxSubscriptions = cfg.MaxSubscriptions
+
+	if cfg.SystemUser != b.config.SystemUser || cfg.SystemPassword != b.config.SystemPassword {
+		b.config.SystemUser = cfg.SystemUser
+		b.config.SystemPassword = cfg.SystemPassword
+		b.revokeSystemSessions()
+	}
+	if !reflect.DeepEqual(cfg.Users, b.config.Users) {
+		old := b.config.Users
+		b.config.Users = cfg.Users
+		b.perms = compilePermissions(cfg.Users)
+		b.reloadUsers(old)
+	}
+}
+
+// revokeSystemSessions disconnects every system session, so rotating a
+// leaked credential also cuts off whoever logged in with it.
+func (b *Broker) revokeSystemSessions() {
+	for cid, session := range b.sessions {
+		if session.System {
+			b.revoke(cid, session)
+		}
+	}
+}
+
+// reloadUsers applies a new user list to connected sessions. A session is
+// disconnected if its user was removed or given a new password, or if it
+// connected without credentials and users are now required. The others
+// get their user's new permissions and lose the subscriptions those no
+// longer allow.
+func (b *Broker) reloadUsers(old []config.User) {
+	for cid, session := range b.sessions {
+		if session.State != StateConnected || session.System {
+			continue
+		}
+		if !b.loginStillValid(session.User, old) {
+			b.revoke(cid, session)
+			continue
+		}
+		session.perms = b.perms[session.User]
+		b.sessions[cid] = session
+	}
+
+	for _, sub := range b.registry.Subscriptions() {
+		session, ok := b.sessions[sub.CID]
+		if !ok || session.perms.canSubscribe([]byte(sub.Subject)) {
+			continue
+		}
+		_ = b.registry.RemoveSub(sub.CID, sub.SID)
+		session.Subs--
+		session.outbox.removeSub(sub.SID)
+		b.sessions[sub.CID] = session
+		b.send(sub.CID, session, codec.Err{Message: permissionsErr("Subscription", []byte(sub.Subject))})
+	}
+	b.dirty = true
+	b.sessionsDirty = true
+}
+
+func (b *Broker) loginStillValid(user string, old []config.User) bool {
+	if user == "" {
+		return len(b.config.Users) == 0
+	}
+	u, ok := findUser(b.config.Users, user)
+	if !ok {
+		return false
+	}
+	prev, _ := findUser(old, user)
+	return u.Password == prev.Password
+}
+
+// revoke disconnects a session whose login is no longer valid.
+func (b *Broker) revoke(cid int64, session ClientSession) {
+	session.outbox.trySend(codec.Err{Message: authorizationErr})
+	b.disconnectCID(cid, session, ReasonAuthViolation)
+}
+
+func (b *Broker) kick(cid int64, reason string) (ConnInfo, error) {
+	session, ok := b.sessions[cid]
+	if !ok {
+		return ConnInfo{}, fmt.Errorf("%w %d", ErrUnknownCID, cid)
+	}
+	info := session.info(cid)
+	session.outbox.closeNow(kickErr(reason))
+	b.disconnectCID(cid, session, ReasonKicked)
+	return info, nil
+}
+
+// maxKickReason bounds the reason a kicked client is sent, in bytes.
+const maxKickReason = 128
+
+// kickErr turns an admin supplied reason into an -ERR message. Quotes are
+// dropped and control characters become spaces, so the reason can neither
+// end the quoted message nor the line, and it is cut to maxKickReason.
+func kickErr(reason string) string {
+	if reason == "" {
+		return ""
+	}
+	var sb strings.Builder
+	for _, r := range reason {
+		switch {
+		case r == '\'':
+			continue
+		case unicode.IsControl(r):
+			r = ' '
+		}
+		if sb.Len()+utf8.RuneLen(r) > maxKickReason {
+			break
+		}
+		sb.WriteRune(r)
+	}
+	return "'" + sb.String() + "'"
+}
+
+// drain relies on the writer flushing everything queued before it closes
+// the connection, which is what closing the outbox already does.
+func (b *Broker) drain(cid int64) (ConnInfo, error) {
+	session, ok := b.sessions[cid]
+	if !ok {
+		return ConnInfo{}, fmt.Errorf("%w %d", ErrUnknownCID, cid)
+	}
+	info := session.info(cid)
+	b.disconnectCID(cid, session, ReasonDrained)
+	return info, nil
+}
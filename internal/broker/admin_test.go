@@ -0,0 +1,328 @@
+package broker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/elmq0022/pub-sub/internal/codec"
+	"github.com/elmq0022/pub-sub/internal/config"
+	"github.com/elmq0022/pub-sub/internal/subjectregistry"
+)
+
+// adminSession connects cid as the system user subscribed to its inbox.
+func adminSession(t *testing.T, b *Broker, cid int64) chan codec.OutboundCommands {
+	t.Helper()
+
+	outbound := make(chan codec.OutboundCommands, 16)
+	b.handleSessionUpEvent(SessionUpEvent{CID: cid, Outbound: outbound})
+	b.handleCmdEvent(CmdEvent{CID: cid, Cmd: codec.Connect{User: "sys", Pass: "secret"}})
+	assertOutboundOK(t, outbound)
+	b.handleCmdEvent(CmdEvent{CID: cid, Cmd: codec.Sub{Subject: []byte("_INBOX.admin"), SID: 1}})
+	assertOutboundOK(t, outbound)
+	return outbound
+}
+
+func request(t *testing.T, b *Broker, cid int64, outbound <-chan codec.OutboundCommands, subject, payload string, v any) {
+	t.Helper()
+
+	b.handleCmdEvent(CmdEvent{CID: cid, Cmd: codec.Pub{
+		Subject: []byte(subject),
+		Reply:   []byte("_INBOX.admin"),
+		Payload: []byte(payload),
+	}})
+	cmd, _ := readOutbound(t, outbound)
+	msg, ok := cmd.(codec.Msg)
+	if !ok || string(msg.Subject) != "_INBOX.admin" {
+		t.Fatalf("expected reply on _INBOX.admin, got %#v", cmd)
+	}
+	if err := json.Unmarshal(msg.Payload, v); err != nil {
+		t.Fatalf("bad reply payload %q: %v", msg.Payload, err)
+	}
+}
+
+func TestSystemRequestPingAndConnz(t *testing.T) {
+	b := NewBroker(subjectregistry.NewSubjectRegistry(), systemConfig())
+	admin := adminSession(t, b, 1)
+	for cid := int64(2); cid <= 3; cid++ {
+		b.handleSessionUpEvent(SessionUpEvent{CID: cid, Outbound: make(chan codec.OutboundCommands, 4)})
+		connect(t, b, cid)
+	}
+
+	var v Varz
+	request(t, b, 1, admin, SysReqPing, "", &v)
+	if v.Connections != 3 || v.Subscriptions != 1 {
+		t.Fatalf("unexpected ping reply %+v", v)
+	}
+
+	var c Connz
+	request(t, b, 1, admin, SysReqConnz, `{"offset":1,"limit":1}`, &c)
+	if c.Total != 3 || len(c.Conns) != 1 || c.Conns[0].CID != 2 {
+		t.Fatalf("unexpected connz reply %+v", c)
+	}
+
+	var e RequestError
+	request(t, b, 1, admin, SysReqConnz, `{"sort":"color"}`, &e)
+	if e.Error != `unknown sort "color"` {
+		t.Fatalf("unexpected error reply %+v", e)
+	}
+}
+
+func TestSystemRequestSubsz(t *testing.T) {
+	b := NewBroker(subjectregistry.NewSubjectRegistry(), systemConfig())
+	admin := adminSession(t, b, 1)
+
+	var sz Subsz
+	request(t, b, 1, admin, SysReqSubsz, `{"subs":true}`, &sz)
+	if sz.NumSubscriptions != 1 || len(sz.Subscriptions) != 1 || sz.Subscriptions[0].Subject != "_INBOX.admin" {
+		t.Fatalf("unexpected subsz reply %+v", sz)
+	}
+}
+
+func TestSystemRequestKick(t *testing.T) {
+	b := NewBroker(subjectregistry.NewSubjectRegistry(), systemConfig())
+	admin := adminSession(t, b, 1)
+	outbound := make(chan codec.OutboundCommands, 4)
+	b.handleSessionUpEvent(SessionUpEvent{CID: 2, Outbound: outbound})
+	connect(t, b, 2)
+	sys := systemSession(t, b, 3)
+
+	var info ConnInfo
+	request(t, b, 1, admin, SysReqKick, `{"cid":2,"reason":"misbehaving"}`, &info)
+	if info.CID != 2 {
+		t.Fatalf("unexpected kick reply %+v", info)
+	}
+	msg, _ := readOutbound(t, outbound)
+	if e, ok := msg.(codec.Err); !ok || e.Message != "'misbehaving'" {
+		t.Fatalf("expected kick reason, got %#v", msg)
+	}
+	assertClosed(t, outbound)
+
+	ev := readClientEvent(t, sys, SysClientDisconnect)
+	if ev.Client.CID != 2 || ev.Reason != ReasonKicked {
+		t.Fatalf("unexpected disconnect event %+v", ev)
+	}
+
+	var e RequestError
+	request(t, b, 1, admin, SysReqKick, `{"cid":2}`, &e)
+	if e.Error != "unknown cid 2" {
+		t.Fatalf("unexpected error reply %+v", e)
+	}
+}
+
+func TestSystemRequestWithoutReplyIsDropped(t *testing.T) {
+	b := NewBroker(subjectregistry.NewSubjectRegistry(), systemConfig())
+	admin := adminSession(t, b, 1)
+
+	b.handleCmdEvent(CmdEvent{CID: 1, Cmd: codec.Pub{Subject: []byte(SysReqPing)}})
+	if len(admin) != 0 {
+		t.Fatalf("expected no reply, got %d messages", len(admin))
+	}
+}
+
+func TestSystemRequestReplySkipsRegularWildcardSubscribers(t *testing.T) {
+	b := NewBroker(subjectregistry.NewSubjectRegistry(), systemConfig())
+	admin := adminSession(t, b, 1)
+
+	outbound := make(chan codec.OutboundCommands, 4)
+	b.handleSessionUpEvent(SessionUpEvent{CID: 2, Outbound: outbound})
+	connect(t, b, 2)
+	b.handleCmdEvent(CmdEvent{CID: 2, Cmd: codec.Sub{Subject: []byte(">"), SID: 1}})
+	assertOutboundOK(t, outbound)
+
+	var c Connz
+	request(t, b, 1, admin, SysReqConnz, "", &c)
+	if len(outbound) != 0 {
+		msg, _ := readOutbound(t, outbound)
+		t.Fatalf("expected regular subscriber to get nothing, got %#v", msg)
+	}
+}
+
+func TestRegularClientCannotMakeSystemRequests(t *testing.T) {
+	b := NewBroker(subjectregistry.NewSubjectRegistry(), systemConfig())
+
+	outbound := make(chan codec.OutboundCommands, 4)
+	b.handleSessionUpEvent(SessionUpEvent{CID: 1, Outbound: outbound})
+	connect(t, b, 1)
+	b.handleCmdEvent(CmdEvent{CID: 1, Cmd: codec.Sub{Subject: []byte("_INBOX.x"), SID: 1}})
+	assertOutboundOK(t, outbound)
+
+	b.handleCmdEvent(CmdEvent{CID: 1, Cmd: codec.Pub{Subject: []byte(SysReqKick), Reply: []byte("_INBOX.x"), Payload: []byte(`{"cid":1}`)}})
+	msg, _ := readOutbound(t, outbound)
+	if e, ok := msg.(codec.Err); !ok || e.Message != "'Permissions Violation for Publish to $SYS.REQ.SERVER.KICK'" {
+		t.Fatalf("expected publish permissions error, got %#v", msg)
+	}
+	if _, ok := b.sessions[1]; !ok {
+		t.Fatal("expected session to stay connected")
+	}
+}
+
+// queueMsgs subscribes cid to "foo" and publishes n messages to it without
+// reading them.
+func queueMsgs(t *testing.T, b *Broker, cid int64, outbound <-chan codec.OutboundCommands, n int) {
+	t.Helper()
+
+	b.handleCmdEvent(CmdEvent{CID: cid, Cmd: codec.Sub{Subject: []byte("foo"), SID: 1}})
+	assertOutboundOK(t, outbound)
+	for range n {
+		b.handleCmdEvent(CmdEvent{CID: cid, Cmd: codec.Pub{Subject: []byte("foo"), Payload: []byte("x")}})
+	}
+}
+
+func TestKickDiscardsQueuedMessages(t *testing.T) {
+	b := NewBroker(subjectregistry.NewSubjectRegistry(), testConfig())
+	outbound := make(chan codec.OutboundCommands, 8)
+	b.handleSessionUpEvent(SessionUpEvent{CID: 1, Outbound: outbound})
+	connect(t, b, 1)
+	queueMsgs(t, b, 1, outbound, 3)
+
+	if _, err := b.kick(1, "go 'away'"); err != nil {
+		t.Fatalf("kick returned error: %v", err)
+	}
+	msg, _ := readOutbound(t, outbound)
+	if e, ok := msg.(codec.Err); !ok || e.Message != "'go away'" {
+		t.Fatalf("expected kick reason first, got %#v", msg)
+	}
+	assertClosed(t, outbound)
+}
+
+func TestKickReasonCannotInjectProtocolLines(t *testing.T) {
+	b := NewBroker(subjectregistry.NewSubjectRegistry(), testConfig())
+	outbound := make(chan codec.OutboundCommands, 8)
+	b.handleSessionUpEvent(SessionUpEvent{CID: 1, Outbound: outbound})
+	connect(t, b, 1)
+
+	if _, err := b.kick(1, "bye'\r\nMSG foo 1 2\r\nhi\r\n"+strings.Repeat("x", 200)); err != nil {
+		t.Fatalf("kick returned error: %v", err)
+	}
+	msg, _ := readOutbound(t, outbound)
+	e, ok := msg.(codec.Err)
+	if !ok {
+		t.Fatalf("expected kick reason, got %#v", msg)
+	}
+	if strings.ContainsAny(e.Message, "\r\n") {
+		t.Fatalf("expected no line breaks in kick reason, got %q", e.Message)
+	}
+	if !strings.HasPrefix(e.Message, "'bye  MSG foo 1 2  hi  x") {
+		t.Fatalf("expected control characters replaced, got %q", e.Message)
+	}
+	if len(e.Message) != maxKickReason+2 {
+		t.Fatalf("expected reason cut to %d bytes, got %d", maxKickReason, len(e.Message)-2)
+	}
+	assertClosed(t, outbound)
+}
+
+func TestDrainFlushesQueuedMessagesThenCloses(t *testing.T) {
+	registry := subjectregistry.NewSubjectRegistry()
+	b := NewBroker(registry, testConfig())
+	outbound := make(chan codec.OutboundCommands, 8)
+	b.handleSessionUpEvent(SessionUpEvent{CID: 1, Outbound: outbound})
+	connect(t, b, 1)
+	queueMsgs(t, b, 1, outbound, 2)
+
+	if _, err := b.drain(1); err != nil {
+		t.Fatalf("drain returned error: %v", err)
+	}
+	if subs, _ := registry.Lookup("foo"); len(subs) != 0 {
+		t.Fatalf("expected subscriptions removed, got %d", len(subs))
+	}
+	for range 2 {
+		if msg, _ := readOutbound(t, outbound); msg == nil {
+			t.Fatal("expected queued MSG to be kept")
+		} else if _, ok := msg.(codec.Msg); !ok {
+			t.Fatalf("expected queued MSG, got %#v", msg)
+		}
+	}
+	assertClosed(t, outbound)
+}
+
+func TestKickAndDrainUnknownCID(t *testing.T) {
+	b := NewBroker(subjectregistry.NewSubjectRegistry(), testConfig())
+	go b.Run()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if _, err := b.Kick(ctx, 9, ""); !errors.Is(err, ErrUnknownCID) {
+		t.Fatalf("expected ErrUnknownCID from Kick, got %v", err)
+	}
+	if _, err := b.Drain(ctx, 9); !errors.Is(err, ErrUnknownCID) {
+		t.Fatalf("expected ErrUnknownCID from Drain, got %v", err)
+	}
+}
+
+func TestReloadAppliesCredentialsAndLimits(t *testing.T) {
+	b := NewBroker(subjectregistry.NewSubjectRegistry(), testConfig())
+	go b.Run()
+
+	cfg := systemConfig()
+	cfg.MaxSubscriptions = 1
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := b.Reload(ctx, cfg); err != nil {
+		t.Fatalf("Reload returned error: %v", err)
+	}
+	got, err := query(ctx, b.control, func(b *Broker) config.Config { return b.config })
+	if err != nil {
+		t.Fatalf("query returned error: %v", err)
+	}
+	if got.SystemUser != "sys" || got.SystemPassword != "secret" || got.MaxSubscriptions != 1 {
+		t.Fatalf("settings not reloaded: %+v", got)
+	}
+}
+
+func TestReloadedLimitsApplyToNextCommand(t *testing.T) {
+	b := NewBroker(subjectregistry.NewSubjectRegistry(), testConfig())
+	outbound := make(chan codec.OutboundCommands, 8)
+	b.handleSessionUpEvent(SessionUpEvent{CID: 1, Outbound: outbound})
+	connect(t, b, 1)
+
+	cfg := systemConfig()
+	cfg.MaxSubscriptions = 1
+	b.reload(cfg)
+
+	b.handleCmdEvent(CmdEvent{CID: 1, Cmd: codec.Sub{Subject: []byte("foo"), SID: 1}})
+	assertOutboundOK(t, outbound)
+	b.handleCmdEvent(CmdEvent{CID: 1, Cmd: codec.Sub{Subject: []byte("bar"), SID: 2}})
+	if msg, _ := readOutbound(t, outbound); msg == nil {
+		t.Fatal("expected an error for the second SUB")
+	} else if e, ok := msg.(codec.Err); !ok || e.Message != maxSubscriptionsErr {
+		t.Fatalf("expected max subscriptions error, got %#v", msg)
+	}
+
+	adminSession(t, b, 2)
+	if !b.sessions[2].System {
+		t.Fatal("expected reloaded credentials to authenticate the system user")
+	}
+}
+
+func TestReloadWithNewSystemCredentialsDisconnectsSystemSessions(t *testing.T) {
+	b := NewBroker(subjectregistry.NewSubjectRegistry(), systemConfig())
+	admin := adminSession(t, b, 1)
+	outbound := make(chan codec.OutboundCommands, 4)
+	b.handleSessionUpEvent(SessionUpEvent{CID: 2, Outbound: outbound})
+	connect(t, b, 2)
+
+	cfg := systemConfig()
+	cfg.MaxSubscriptions = 5
+	b.reload(cfg)
+	if _, ok := b.sessions[1]; !ok {
+		t.Fatal("expected system session to survive a reload with the same credentials")
+	}
+
+	cfg.SystemPassword = "rotated"
+	b.reload(cfg)
+	msg, _ := readOutbound(t, admin)
+	if e, ok := msg.(codec.Err); !ok || e.Message != authorizationErr {
+		t.Fatalf("expected authorization error, got %#v", msg)
+	}
+	assertClosed(t, admin)
+	if _, ok := b.sessions[1]; ok {
+		t.Fatal("expected system session to be removed")
+	}
+	if _, ok := b.sessions[2]; !ok {
+		t.Fatal("expected regular session to stay connected")
+	}
+}
@@ -1,57 +1,246 @@
 package broker
 
 import (
+	"log/slog"
+	"net"
+	"sync/atomic"
 	"time"
 
 	"github.com/elmq0022/pub-sub/internal/codec"
 	"github.com/elmq0022/pub-sub/internal/config"
+	"github.com/elmq0022/pub-sub/internal/stats"
 	"github.com/elmq0022/pub-sub/internal/subjectregistry"
 )
 
+// SessionState is where a session is in the connection handshake.
+type SessionState uint8
+
+const (
+	// StateAwaitingConnect accepts only CONNECT; anything else is a
+	// protocol violation.
+	StateAwaitingConnect SessionState = iota
+	StateConnected
+)
+
 type ClientSession struct {
-	Outbound     chan<- codec.OutboundCommands
+	// RemoteAddr is the client's address, taken from the PROXY header when
+	// the connection arrived through a load balancer.
+	RemoteAddr   net.Addr
+	State        SessionState
+	Stats        *stats.Conn
 	AwaitingPong bool
 	PingSentAt   time.Time
+	// Name is the client name from CONNECT. Start is when the session came
+	// up, RTT the time the last PING took to be answered and RTTAvg the
+	// moving average of those times.
+	Name   string
+	Start  time.Time
+	RTT    time.Duration
+	RTTAvg time.Duration
+	// System is set for sessions that logged in as the system user and may
+	// use $SYS subjects. User is the name a session logged in with, if any.
+	System bool
+	User   string
+	// Subs counts the session's subscriptions against MaxSubscriptions.
+	Subs int
+
+	outbox       *outbox
+	connectTimer *time.Timer
+	// perms limits what a configured user may publish and subscribe to. It
+	// is nil, allowing everything, for every other session.
+	perms *permissions
+	// rttWaiters are RTT probes waiting for the outstanding PING's PONG.
+	rttWaiters []chan<- RTTProbe
 }
 
+// stopConnectTimer cancels the auth timeout, if one is pending.
+func (s ClientSession) stopConnectTimer() {
+	if s.connectTimer != nil {
+		s.connectTimer.Stop()
+	}
+}
+
+// maxSubscriptionsErr rejects a SUB past MaxSubscriptions. The connection
+// stays open and keeps its existing subscriptions.
+const maxSubscriptionsErr = "'Maximum Subscriptions Exceeded'"
+
+// sidInUseErr rejects a SUB whose SID the connection is already using. The
+// existing subscription is kept. invalidSubscriptionErr rejects one the
+// registry refused.
+const (
+	sidInUseErr            = "'Invalid Subscription: SID In Use'"
+	invalidSubscriptionErr = "'Invalid Subscription'"
+)
+
+// connectRequiredErr is sent before disconnecting a session whose first
+// command was not CONNECT, and authTimeoutErr when it sent none in time.
+const (
+	connectRequiredErr = "'CONNECT Required'"
+	authTimeoutErr     = "'Authentication Timeout'"
+)
+
+// rateLimitErr is sent before closing a connection over its rate limit under
+// the disconnect policy.
+const rateLimitErr = "'Rate Limit Exceeded'"
+
 type Broker struct {
 	registry subjectregistry.Registry
 	sessions map[int64]ClientSession
 	inbox    chan BrokerEvent
 	config   config.Config
+	// perms holds the compiled permissions of each configured user.
+	perms map[string]*permissions
+
+	// control carries lifecycle events (session up/down, protocol errors,
+	// heartbeats, slow consumers). Run drains it before the inbox so a
+	// publish storm cannot delay disconnects or keepalive checks.
+	control chan BrokerEvent
+
+	// Parallel fanout mode. workers is nil in the default single broker mode.
+	// dirty is set when the registry changed since the last snapshot and
+	// sessionsDirty when the connected sessions or their permissions did.
+	workers       []chan BrokerEvent
+	snapshot      atomic.Pointer[routingSnapshot]
+	dirty         bool
+	sessionsDirty bool
+
+	// Reported by monitoring. stats is updated by the broker and the fanout
+	// workers, writerStats and rateStats by the session controller and
+	// acceptStats by the server; the rest is only touched on the broker loop.
+	stats       stats.Broker
+	writerStats *stats.Writer
+	rateStats   *stats.RateLimit
+	acceptStats *stats.Accept
+	start       time.Time
+	totalConns  int64
+
+	logger *slog.Logger
 }
 
 func NewBroker(r subjectregistry.Registry, config config.Config) *Broker {
-	return &Broker{
-		registry: r,
-		sessions: make(map[int64]ClientSession),
-		inbox:    make(chan BrokerEvent),
-		config:   config,
+	b := &Broker{
+		registry:    r,
+		sessions:    make(map[int64]ClientSession),
+		inbox:       make(chan BrokerEvent),
+		control:     make(chan BrokerEvent),
+		config:      config,
+		perms:       compilePermissions(config.Users),
+		writerStats: &stats.Writer{},
+		rateStats:   &stats.RateLimit{},
+		acceptStats: &stats.Accept{},
+		start:       time.Now(),
+		logger:      slog.New(slog.DiscardHandler),
+	}
+	for i := 0; i < config.FanoutWorkers; i++ {
+		b.workers = append(b.workers, make(chan BrokerEvent, fanoutWorkerQueue))
 	}
+	if b.parallel() {
+		b.publishSnapshot()
+	}
+	return b
 }
 
 func (b *Broker) Input() chan<- BrokerEvent {
 	return b.inbox
 }
 
+// SetLogger replaces the logger, which discards everything by default. It
+// must be called before Run.
+func (b *Broker) SetLogger(l *slog.Logger) {
+	b.logger = l
+}
+
+// SetWriterStats makes Varz and Metrics report ws, the flush counters kept
+// by the session controller. It must be called before Run.
+func (b *Broker) SetWriterStats(ws *stats.Writer) {
+	b.writerStats = ws
+}
+
+// SetRateLimitStats makes Varz and Metrics report rs, the rate limiting
+// counters kept by the session controller. It must be called before Run.
+func (b *Broker) SetRateLimitStats(rs *stats.RateLimit) {
+	b.rateStats = rs
+}
+
+// SetAcceptStats makes Varz and Metrics report as, the server's counters of
+// refused connections. It must be called before Run.
+func (b *Broker) SetAcceptStats(as *stats.Accept) {
+	b.acceptStats = as
+}
+
+// Stats returns the broker-wide message counters.
+func (b *Broker) Stats() *stats.Broker {
+	return &b.stats
+}
+
 func (b *Broker) Run() {
 	if b.config.HeartbeatTickInterval > 0 {
 		go b.startHeartbeat()
 	}
 
-	for msg := range b.inbox {
-		switch ev := msg.(type) {
-		case CmdEvent:
-			b.handleCmdEvent(ev)
-		case ProtocolErrorEvent:
-			b.handleProtocolErrorEvent(ev)
-		case SessionUpEvent:
-			b.handleSessionUpEvent(ev)
-		case SessionDownEvent:
-			b.handleSessionDownEvent(ev)
-		case HeartbeatTickEvent:
-			b.handleHeartbeatTickEvent(ev)
+	for _, w := range b.workers {
+		go b.fanoutWorker(w)
+	}
+
+	for {
+		msg, ok := b.nextEvent()
+		if !ok {
+			return
 		}
+		b.handle(msg)
+	}
+}
+
+// ControlInput returns the priority channel for lifecycle events. Any event
+// is accepted on either channel; only the ordering differs.
+func (b *Broker) ControlInput() chan<- BrokerEvent {
+	return b.control
+}
+
+// nextEvent returns a pending control event if there is one and otherwise
+// waits on both channels. It reports false once the inbox is closed.
+func (b *Broker) nextEvent() (BrokerEvent, bool) {
+	select {
+	case msg := <-b.control:
+		return msg, true
+	default:
+	}
+
+	select {
+	case msg := <-b.control:
+		return msg, true
+	case msg, ok := <-b.inbox:
+		return msg, ok
+	}
+}
+
+func (b *Broker) handle(msg BrokerEvent) {
+	switch ev := msg.(type) {
+	case CmdEvent:
+		b.handleCmdEvent(ev)
+	case SlowConsumerEvent:
+		b.handleSlowConsumerEvent(ev)
+	case ProtocolErrorEvent:
+		b.handleProtocolErrorEvent(ev)
+	case RateLimitEvent:
+		b.handleRateLimitEvent(ev)
+	case SessionUpEvent:
+		b.handleSessionUpEvent(ev)
+	case SessionDownEvent:
+		b.handleSessionDownEvent(ev)
+	case HeartbeatTickEvent:
+		b.handleHeartbeatTickEvent(ev)
+	case AuthTimeoutEvent:
+		b.handleAuthTimeoutEvent(ev)
+	case QueryEvent:
+		ev.fn(b)
+	}
+
+	if b.parallel() && (b.dirty || b.sessionsDirty) {
+		b.publishSnapshot()
+	}
+	if ev, ok := msg.(CmdEvent); ok && ev.Done != nil {
+		close(ev.Done)
 	}
 }
 
@@ -60,108 +249,233 @@ func (b *Broker) startHeartbeat() {
 	defer ticker.Stop()
 
 	for range ticker.C {
-		b.inbox <- HeartbeatTickEvent{}
+		b.control <- HeartbeatTickEvent{}
 	}
 }
 
 func (b *Broker) handleSessionUpEvent(ev SessionUpEvent) {
-	b.sessions[ev.CID] = ClientSession{
-		Outbound:     ev.Outbound,
+	session := ClientSession{
+		RemoteAddr:   ev.RemoteAddr,
+		State:        StateAwaitingConnect,
+		Stats:        ev.Stats,
 		AwaitingPong: false,
+		Start:        time.Now(),
+		outbox:       newOutbox(ev.Outbound, ev.Stats, b.config),
+	}
+	session.outbox.logger = b.logger.With("cid", ev.CID)
+	if b.config.AuthTimeout > 0 {
+		cid := ev.CID
+		session.connectTimer = time.AfterFunc(b.config.AuthTimeout, func() {
+			b.control <- AuthTimeoutEvent{CID: cid}
+		})
+	}
+	b.sessions[ev.CID] = session
+	b.totalConns++
+	b.logger.Info("session up", "cid", ev.CID, "addr", addrString(ev.RemoteAddr))
+}
+
+// handleAuthTimeoutEvent closes a session that is still waiting for CONNECT.
+// The timer is stopped on CONNECT, but it may already have fired, so the
+// state is checked again here.
+func (b *Broker) handleAuthTimeoutEvent(ev AuthTimeoutEvent) {
+	session, ok := b.sessions[ev.CID]
+	if !ok || session.State != StateAwaitingConnect {
+		return
 	}
+	session.outbox.trySend(codec.Err{Message: authTimeoutErr})
+	b.disconnectCID(ev.CID, session, ReasonAuthTimeout)
 }
 
 func (b *Broker) handleSessionDownEvent(ev SessionDownEvent) {
-	if session, ok := b.sessions[ev.CID]; ok {
-		close(session.Outbound)
+	session, ok := b.sessions[ev.CID]
+	if ok {
+		session.stopConnectTimer()
+		session.outbox.close()
 		delete(b.sessions, ev.CID)
 	}
 	b.registry.RemoveCID(ev.CID)
+	b.dirty = true
+	b.sessionsDirty = true
+	if ok {
+		b.sessionDown(ev.CID, session, ReasonClientClosed)
+	}
 }
 
-func (b *Broker) disconnectCID(cid int64, session ClientSession) {
-	close(session.Outbound)
+// disconnectCID closes a session the broker decided to drop, for reason.
+func (b *Broker) disconnectCID(cid int64, session ClientSession, reason string) {
+	session.stopConnectTimer()
+	session.outbox.close()
 	delete(b.sessions, cid)
 	b.registry.RemoveCID(cid)
+	b.dirty = true
+	b.sessionsDirty = true
+	b.sessionDown(cid, session, reason)
+}
+
+// sessionDown logs and announces a session that has just been removed.
+func (b *Broker) sessionDown(cid int64, session ClientSession, reason string) {
+	b.logger.Info("session down", "cid", cid, "reason", reason)
+	b.publishDisconnect(cid, session, reason)
+}
+
+func addrString(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	return addr.String()
+}
+
+// send queues cmd for cid through its outbox. A session that is over its
+// pending limits under the disconnect policy is dropped as a slow consumer.
+func (b *Broker) send(cid int64, session ClientSession, cmd codec.OutboundCommands) bool {
+	queued, full := session.outbox.trySend(cmd)
+	if full {
+		b.disconnectSlowConsumer(cid, session)
+	}
+	return queued
+}
+
+// disconnectSlowConsumer tells the client why before closing its outbox.
+func (b *Broker) disconnectSlowConsumer(cid int64, session ClientSession) {
+	b.stats.SlowConsumers.Add(1)
+	b.logger.Warn("slow consumer",
+		"cid", cid,
+		"pending", len(session.outbox.ch),
+		"pending_bytes", session.outbox.stats.PendingBytes.Load(),
+	)
+	session.stopConnectTimer()
+	session.outbox.closeSlow()
+	delete(b.sessions, cid)
+	b.registry.RemoveCID(cid)
+	b.dirty = true
+	b.sessionsDirty = true
+	b.sessionDown(cid, session, ReasonSlowConsumer)
 }
 
 func (b *Broker) handleCmdEvent(ev CmdEvent) {
-	switch cmd := ev.Cmd.(type) {
-	case codec.Ping:
-		session, ok := b.sessions[ev.CID]
-		if !ok {
-			break
+	// A session's down event can overtake commands its reader had already
+	// queued. Drop them so a late SUB cannot register a dead CID.
+	session, ok := b.sessions[ev.CID]
+	if !ok {
+		if pub, ok := ev.Cmd.(codec.Pub); ok {
+			pub.Release()
 		}
-		select {
-		case session.Outbound <- codec.Pong{}:
-		default:
-			b.disconnectCID(ev.CID, session)
+		return
+	}
+	if _, isConnect := ev.Cmd.(codec.Connect); !isConnect && session.State == StateAwaitingConnect {
+		if pub, ok := ev.Cmd.(codec.Pub); ok {
+			pub.Release()
 		}
+		b.stats.ProtocolErrors.Add(1)
+		session.outbox.trySend(codec.Err{Message: connectRequiredErr})
+		b.disconnectCID(ev.CID, session, ReasonProtocolError)
+		return
+	}
+
+	switch cmd := ev.Cmd.(type) {
+	case codec.Ping:
+		b.send(ev.CID, session, codec.Pong{})
 	case codec.Pong:
-		if session, ok := b.sessions[ev.CID]; ok {
-			session.AwaitingPong = false
+		b.handlePong(ev.CID, session)
+	case codec.Connect:
+		announce := false
+		if session.State == StateAwaitingConnect {
+			system, user, ok := b.authenticate(cmd)
+			if !ok {
+				session.outbox.trySend(codec.Err{Message: authorizationErr})
+				b.disconnectCID(ev.CID, session, ReasonAuthViolation)
+				return
+			}
+			session.stopConnectTimer()
+			session.connectTimer = nil
+			session.State = StateConnected
+			session.Name = cmd.Name
+			session.System = system
+			session.User = user
+			session.perms = b.perms[user]
 			b.sessions[ev.CID] = session
+			b.sessionsDirty = true
+			announce = true
 		}
-	case codec.Connect:
-		session, ok := b.sessions[ev.CID]
-		if !ok {
-			break
+		if !b.send(ev.CID, session, codec.OK{}) {
+			return
 		}
-		select {
-		case session.Outbound <- codec.OK{}:
-		default:
-			b.disconnectCID(ev.CID, session)
+		if announce {
+			b.publishConnect(ev.CID, session)
 		}
+		if !cmd.Binary {
+			break
+		}
+		// The reader has already switched to binary framing; the writer
+		// switches once the text +OK above has been written.
+		b.send(ev.CID, session, codec.SwitchFraming{Framing: codec.FramingBinary})
 	case codec.Sub:
-		b.registry.AddSub(
+		if (isSystemSubject(cmd.Subject) && !session.System) || !session.perms.canSubscribe(cmd.Subject) {
+			b.send(ev.CID, session, codec.Err{Message: permissionsErr("Subscription", cmd.Subject)})
+			break
+		}
+		if b.registry.HasSub(ev.CID, cmd.SID) {
+			b.send(ev.CID, session, codec.Err{Message: sidInUseErr})
+			break
+		}
+		if b.config.MaxSubscriptions > 0 && session.Subs >= b.config.MaxSubscriptions {
+			b.send(ev.CID, session, codec.Err{Message: maxSubscriptionsErr})
+			break
+		}
+		err := b.registry.AddSub(
 			string(cmd.Subject),
 			subjectregistry.Sub{
 				CID: ev.CID,
 				SID: cmd.SID,
 			},
 		)
-		session, ok := b.sessions[ev.CID]
-		if !ok {
+		if err != nil {
+			b.logger.Error("add subscription", "cid", ev.CID, "sid", cmd.SID, "err", err)
+			b.send(ev.CID, session, codec.Err{Message: invalidSubscriptionErr})
 			break
 		}
-		select {
-		case session.Outbound <- codec.OK{}:
-		default:
-			b.disconnectCID(ev.CID, session)
-		}
+		b.dirty = true
+		session.Subs++
+		b.sessions[ev.CID] = session
+		session.outbox.addSub(cmd.SID)
+		b.send(ev.CID, session, codec.OK{})
 	case codec.Pub:
+		system := isSystemSubject(cmd.Subject)
+		if (system && !session.System) || !session.perms.canPublish(cmd.Subject) {
+			cmd.Release()
+			b.send(ev.CID, session, codec.Err{Message: permissionsErr("Publish", cmd.Subject)})
+			break
+		}
+		if system && isSystemRequest(cmd.Subject) {
+			b.handleSystemRequest(cmd)
+			break
+		}
 		subs, err := b.registry.Lookup(string(cmd.Subject))
 		if err != nil {
+			cmd.Release()
 			break
 		}
-		for _, sub := range subs {
-			session, ok := b.sessions[sub.CID]
+		if system {
+			subs = b.systemSubs(subs)
+		}
+		n := fanout(cmd, subs, func(cid int64, msg codec.Msg) bool {
+			sub, ok := b.sessions[cid]
 			if !ok {
-				continue
+				return false
 			}
-			msg := codec.Msg{
-				Subject: cmd.Subject,
-				SID:     sub.SID,
-				Payload: cmd.Payload,
-			}
-			select {
-			case session.Outbound <- msg:
-			default:
-				b.disconnectCID(sub.CID, session)
-			}
-		}
+			return b.send(cid, sub, msg)
+		})
+		b.countPub(session.outbox.stats, cmd, len(subs), n)
 
 	case codec.Unsub:
-		_ = b.registry.RemoveSub(ev.CID, cmd.SID)
-		session, ok := b.sessions[ev.CID]
-		if !ok {
-			break
-		}
-		select {
-		case session.Outbound <- codec.OK{}:
-		default:
-			b.disconnectCID(ev.CID, session)
+		err := b.registry.RemoveSub(ev.CID, cmd.SID)
+		b.dirty = true
+		if err == nil && session.Subs > 0 {
+			session.Subs--
+			b.sessions[ev.CID] = session
 		}
+		session.outbox.removeSub(cmd.SID)
+		b.send(ev.CID, session, codec.OK{})
 	}
 }
 
@@ -172,12 +486,23 @@ func (b *Broker) handleProtocolErrorEvent(ev ProtocolErrorEvent) {
 		return
 	}
 
-	select {
-	case session.Outbound <- codec.Err{Message: ev.Msg}:
-	default:
+	b.stats.ProtocolErrors.Add(1)
+	session.outbox.trySend(codec.Err{Message: ev.Msg})
+
+	b.disconnectCID(ev.CID, session, ReasonProtocolError)
+}
+
+// handleRateLimitEvent closes a session its reader refused over the rate
+// limit. It is not a protocol error, so only stats.RateLimit counts it.
+func (b *Broker) handleRateLimitEvent(ev RateLimitEvent) {
+	session, ok := b.sessions[ev.CID]
+	if !ok {
+		b.registry.RemoveCID(ev.CID)
+		return
 	}
 
-	b.disconnectCID(ev.CID, session)
+	session.outbox.trySend(codec.Err{Message: rateLimitErr})
+	b.disconnectCID(ev.CID, session, ReasonRateLimit)
 }
 
 func (b *Broker) handleHeartbeatTickEvent(ev HeartbeatTickEvent) {
@@ -185,20 +510,23 @@ func (b *Broker) handleHeartbeatTickEvent(ev HeartbeatTickEvent) {
 	now := time.Now()
 
 	for cid, session := range b.sessions {
+		// A PONG before CONNECT would be refused, so the auth timeout
+		// covers unconnected sessions instead.
+		if session.State != StateConnected {
+			continue
+		}
 		if session.AwaitingPong {
 			if now.Sub(session.PingSentAt) >= b.config.HeartbeatTimeout {
-				b.disconnectCID(cid, session)
+				b.stats.HeartbeatTimeouts.Add(1)
+				b.disconnectCID(cid, session, ReasonHeartbeatTimeout)
 			}
 			continue
 		}
 
-		select {
-		case session.Outbound <- codec.Ping{}:
+		if b.send(cid, session, codec.Ping{}) {
 			session.AwaitingPong = true
 			session.PingSentAt = now
 			b.sessions[cid] = session
-		default:
-			b.disconnectCID(cid, session)
 		}
 	}
 }
@@ -1,6 +1,7 @@
 package broker
 
 import (
+	"bytes"
 	"testing"
 	"time"
 
@@ -18,6 +19,7 @@ func TestHandleSessionDownEventRemovesSessionAndSubscriptions(t *testing.T) {
 		CID:      42,
 		Outbound: outbound,
 	})
+	connect(t, b, 42)
 
 	b.handleCmdEvent(CmdEvent{
 		CID: 42,
@@ -51,6 +53,7 @@ func TestHandleSessionDownEventDuplicateIsIdempotent(t *testing.T) {
 		CID:      7,
 		Outbound: outbound,
 	})
+	connect(t, b, 7)
 
 	b.handleCmdEvent(CmdEvent{
 		CID: 7,
@@ -92,6 +95,7 @@ func TestHandleProtocolErrorEventDisconnectsSessionAndRemovesSubscriptions(t *te
 		CID:      9,
 		Outbound: outbound,
 	})
+	connect(t, b, 9)
 
 	b.handleCmdEvent(CmdEvent{
 		CID: 9,
@@ -162,6 +166,7 @@ func TestHandleCmdEventUnsubUnknownSIDAckAndKeepsSession(t *testing.T) {
 		CID:      11,
 		Outbound: outbound,
 	})
+	connect(t, b, 11)
 
 	b.handleCmdEvent(CmdEvent{
 		CID: 11,
@@ -184,6 +189,119 @@ func TestHandleCmdEventUnsubUnknownSIDAckAndKeepsSession(t *testing.T) {
 	}
 }
 
+func TestHandleCmdEventConnectBinarySwitchesWriterAfterOK(t *testing.T) {
+	registry := subjectregistry.NewSubjectRegistry()
+	b := NewBroker(registry, testConfig())
+
+	outbound := make(chan codec.OutboundCommands, 2)
+	b.handleSessionUpEvent(SessionUpEvent{
+		CID:      5,
+		Outbound: outbound,
+	})
+
+	b.handleCmdEvent(CmdEvent{
+		CID: 5,
+		Cmd: codec.Connect{Binary: true},
+	})
+
+	assertOutboundOK(t, outbound)
+	msg, ok := readOutbound(t, outbound)
+	if !ok {
+		t.Fatal("expected SwitchFraming before channel close")
+	}
+	sw, ok := msg.(codec.SwitchFraming)
+	if !ok {
+		t.Fatalf("expected codec.SwitchFraming, got %T", msg)
+	}
+	if sw.Framing != codec.FramingBinary {
+		t.Fatalf("expected binary framing, got %v", sw.Framing)
+	}
+}
+
+func TestHandleCmdEventPubRetainsPayloadPerDeliveredMsg(t *testing.T) {
+	registry := subjectregistry.NewSubjectRegistry()
+	b := NewBroker(registry, testConfig())
+
+	first := make(chan codec.OutboundCommands, 2)
+	second := make(chan codec.OutboundCommands, 2)
+	b.handleSessionUpEvent(SessionUpEvent{CID: 1, Outbound: first})
+	connect(t, b, 1)
+	b.handleSessionUpEvent(SessionUpEvent{CID: 2, Outbound: second})
+	connect(t, b, 2)
+	b.handleCmdEvent(CmdEvent{CID: 1, Cmd: codec.Sub{Subject: []byte("foo"), SID: 1}})
+	b.handleCmdEvent(CmdEvent{CID: 2, Cmd: codec.Sub{Subject: []byte("foo"), SID: 1}})
+	assertOutboundOK(t, first)
+	assertOutboundOK(t, second)
+
+	pub := decodePub(t, "PUB foo 5\r\nhello\r\n")
+	if pub.Buffer == nil {
+		t.Fatal("expected pooled payload buffer")
+	}
+
+	b.handleCmdEvent(CmdEvent{CID: 1, Cmd: pub})
+
+	if refs := pub.Buffer.Refs(); refs != 2 {
+		t.Fatalf("expected one reference per delivered Msg, got %d", refs)
+	}
+
+	for _, ch := range []chan codec.OutboundCommands{first, second} {
+		msg, _ := readOutbound(t, ch)
+		m, ok := msg.(codec.Msg)
+		if !ok {
+			t.Fatalf("expected codec.Msg, got %T", msg)
+		}
+		if m.Buffer != pub.Buffer {
+			t.Fatal("expected Msg to share the publisher's buffer")
+		}
+		m.Release()
+	}
+
+	if refs := pub.Buffer.Refs(); refs != 0 {
+		t.Fatalf("expected buffer to be fully released, got %d references", refs)
+	}
+}
+
+func TestHandleCmdEventPubWithoutSubscribersReleasesPayload(t *testing.T) {
+	b := NewBroker(subjectregistry.NewSubjectRegistry(), testConfig())
+
+	pub := decodePub(t, "PUB nobody 5\r\nhello\r\n")
+	b.handleCmdEvent(CmdEvent{CID: 1, Cmd: pub})
+
+	if refs := pub.Buffer.Refs(); refs != 0 {
+		t.Fatalf("expected buffer to be released, got %d references", refs)
+	}
+}
+
+// connect completes CONNECT for a session added with handleSessionUpEvent and
+// consumes its +OK.
+func connect(t *testing.T, b *Broker, cid int64) {
+	t.Helper()
+
+	b.handleCmdEvent(CmdEvent{CID: cid, Cmd: codec.Connect{}})
+	msg, ok := <-b.sessions[cid].outbox.ch
+	if _, isOK := msg.(codec.OK); !ok || !isOK {
+		t.Fatalf("expected +OK for CONNECT, got %#v", msg)
+	}
+}
+
+func decodePub(t *testing.T, input string) codec.Pub {
+	t.Helper()
+
+	c, err := codec.NewCodec(bytes.NewBufferString(input))
+	if err != nil {
+		t.Fatalf("NewCodec returned error: %v", err)
+	}
+	cmd, err := c.Decode()
+	if err != nil {
+		t.Fatalf("Decode returned error: %v", err)
+	}
+	pub, ok := cmd.(codec.Pub)
+	if !ok {
+		t.Fatalf("expected codec.Pub, got %T", cmd)
+	}
+	return pub
+}
+
 func readOutbound(t *testing.T, ch <-chan codec.OutboundCommands) (codec.OutboundCommands, bool) {
 	t.Helper()
 
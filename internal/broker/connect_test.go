@@ -0,0 +1,137 @@
+package broker
+
+import (
+	"testing"
+	"time"
+
+	"github.com/elmq0022/pub-sub/internal/codec"
+	"github.com/elmq0022/pub-sub/internal/subjectregistry"
+)
+
+// assertErrThenClosed waits for -ERR want followed by the outbound channel
+// being closed.
+func assertErrThenClosed(t *testing.T, outbound <-chan codec.OutboundCommands, want string) {
+	t.Helper()
+
+	select {
+	case msg := <-outbound:
+		if e, ok := msg.(codec.Err); !ok || e.Message != want {
+			t.Fatalf("expected -ERR %s, got %#v", want, msg)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("timed out waiting for -ERR %s", want)
+	}
+	select {
+	case msg, ok := <-outbound:
+		if ok {
+			t.Fatalf("expected outbound channel to be closed, got %#v", msg)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for outbound channel to close")
+	}
+}
+
+func TestCmdBeforeConnectIsRejectedAndDisconnects(t *testing.T) {
+	registry := subjectregistry.NewSubjectRegistry()
+	b := NewBroker(registry, testConfig())
+
+	outbound := make(chan codec.OutboundCommands, 4)
+	b.handleSessionUpEvent(SessionUpEvent{CID: 1, Outbound: outbound})
+
+	b.handleCmdEvent(CmdEvent{CID: 1, Cmd: codec.Sub{Subject: []byte("foo"), SID: 1}})
+
+	assertErrThenClosed(t, outbound, connectRequiredErr)
+	if _, ok := b.sessions[1]; ok {
+		t.Fatal("expected session to be removed")
+	}
+	if subs, _ := registry.Lookup("foo"); len(subs) != 0 {
+		t.Fatalf("expected SUB before CONNECT not to be registered, got %d", len(subs))
+	}
+}
+
+func TestUnconnectedSessionIsNotRoutedTo(t *testing.T) {
+	registry := subjectregistry.NewSubjectRegistry()
+	b := NewBroker(registry, testConfig())
+
+	outbound := make(chan codec.OutboundCommands, 4)
+	b.handleSessionUpEvent(SessionUpEvent{CID: 1, Outbound: outbound})
+	b.publishSnapshot()
+
+	if _, ok := b.snapshot.Load().outboxes[1]; ok {
+		t.Fatal("expected unconnected session to be left out of the snapshot")
+	}
+
+	connect(t, b, 1)
+	b.publishSnapshot()
+	if _, ok := b.snapshot.Load().outboxes[1]; !ok {
+		t.Fatal("expected connected session in the snapshot")
+	}
+}
+
+func TestHeartbeatSkipsUnconnectedSession(t *testing.T) {
+	b := NewBroker(subjectregistry.NewSubjectRegistry(), testConfig())
+
+	outbound := make(chan codec.OutboundCommands, 4)
+	b.handleSessionUpEvent(SessionUpEvent{CID: 1, Outbound: outbound})
+	b.handleHeartbeatTickEvent(HeartbeatTickEvent{})
+
+	if len(outbound) != 0 {
+		t.Fatalf("expected no PING before CONNECT, got %#v", <-outbound)
+	}
+	if b.sessions[1].AwaitingPong {
+		t.Fatal("expected unconnected session not to await a PONG")
+	}
+
+	connect(t, b, 1)
+	b.handleHeartbeatTickEvent(HeartbeatTickEvent{})
+	if msg, _ := readOutbound(t, outbound); msg != (codec.Ping{}) {
+		t.Fatalf("expected PING after CONNECT, got %#v", msg)
+	}
+}
+
+func TestAuthTimeoutClosesUnconnectedSession(t *testing.T) {
+	cfg := testConfig()
+	cfg.AuthTimeout = 20 * time.Millisecond
+	b := NewBroker(subjectregistry.NewSubjectRegistry(), cfg)
+	go b.Run()
+
+	outbound := make(chan codec.OutboundCommands, 4)
+	b.Input() <- SessionUpEvent{CID: 1, Outbound: outbound}
+
+	assertErrThenClosed(t, outbound, authTimeoutErr)
+}
+
+func TestAuthTimeoutIsCancelledByConnect(t *testing.T) {
+	cfg := testConfig()
+	cfg.AuthTimeout = 20 * time.Millisecond
+	b := NewBroker(subjectregistry.NewSubjectRegistry(), cfg)
+	go b.Run()
+
+	outbound := sessionUp(b, 1, 4)
+
+	select {
+	case cmd, ok := <-outbound:
+		t.Fatalf("expected connected session to stay open, got %#v (open=%v)", cmd, ok)
+	case <-time.After(5 * cfg.AuthTimeout):
+	}
+}
+
+func TestParallelPubBeforeConnectIsRejectedByBroker(t *testing.T) {
+	b := NewBroker(subjectregistry.NewSubjectRegistry(), parallelConfig(2))
+	go b.Run()
+
+	sub := sessionUp(b, 1, 4)
+	apply(b, 1, codec.Sub{Subject: []byte("foo"), SID: 1})
+	assertOutboundOKWithin(t, sub)
+
+	pub := make(chan codec.OutboundCommands, 4)
+	b.Input() <- SessionUpEvent{CID: 2, Outbound: pub}
+	b.PublishInput(2) <- CmdEvent{CID: 2, Cmd: codec.Pub{Subject: []byte("foo"), Payload: []byte("x")}}
+
+	assertErrThenClosed(t, pub, connectRequiredErr)
+	select {
+	case cmd := <-sub:
+		t.Fatalf("expected PUB before CONNECT not to be delivered, got %#v", cmd)
+	default:
+	}
+}
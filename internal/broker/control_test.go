@@ -0,0 +1,107 @@
+package broker
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/elmq0022/pub-sub/internal/codec"
+	"github.com/elmq0022/pub-sub/internal/subjectregistry"
+)
+
+func TestNextEventPrefersControlOverQueuedPublishes(t *testing.T) {
+	b := NewBroker(subjectregistry.NewSubjectRegistry(), testConfig())
+
+	stop := make(chan struct{})
+	defer close(stop)
+	for i := 0; i < 8; i++ {
+		go func() {
+			for {
+				select {
+				case b.Input() <- CmdEvent{CID: 1, Cmd: codec.Pub{Subject: []byte("load")}}:
+				case <-stop:
+					return
+				}
+			}
+		}()
+	}
+	go func() { b.ControlInput() <- SessionDownEvent{CID: 1} }()
+
+	// Let every sender block so both channels are ready at once.
+	time.Sleep(20 * time.Millisecond)
+
+	msg, ok := b.nextEvent()
+	if !ok {
+		t.Fatal("expected an event")
+	}
+	if _, ok := msg.(SessionDownEvent); !ok {
+		t.Fatalf("expected SessionDownEvent first, got %T", msg)
+	}
+}
+
+func TestRunProcessesSessionDownPromptlyUnderPublishLoad(t *testing.T) {
+	b := NewBroker(subjectregistry.NewSubjectRegistry(), testConfig())
+	go b.Run()
+
+	sub := sessionUp(b, 1, 1<<16)
+	apply(b, 1, codec.Sub{Subject: []byte("load"), SID: 1})
+	assertOutboundOKWithin(t, sub)
+	go func() {
+		for cmd := range sub {
+			if msg, ok := cmd.(codec.Msg); ok {
+				msg.Release()
+			}
+		}
+	}()
+
+	victim := sessionUp(b, 2, 1)
+
+	stop := make(chan struct{})
+	var publishers sync.WaitGroup
+	for p := int64(0); p < 8; p++ {
+		cid := 100 + p
+		sessionUp(b, cid, 1)
+		publishers.Add(1)
+		go func() {
+			defer publishers.Done()
+			for {
+				select {
+				case b.Input() <- CmdEvent{CID: cid, Cmd: codec.Pub{Subject: []byte("load")}}:
+				case <-stop:
+					return
+				}
+			}
+		}()
+	}
+	defer func() {
+		close(stop)
+		publishers.Wait()
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+	b.ControlInput() <- SessionDownEvent{CID: 2}
+
+	select {
+	case _, ok := <-victim:
+		if ok {
+			t.Fatal("expected victim outbound to be closed")
+		}
+	case <-time.After(100 * time.Millisecond):
+		t.Fatal("session down was not processed under publish load")
+	}
+}
+
+func TestHandleCmdEventFromUnknownSessionIsDropped(t *testing.T) {
+	registry := subjectregistry.NewSubjectRegistry()
+	b := NewBroker(registry, testConfig())
+
+	b.handleCmdEvent(CmdEvent{CID: 9, Cmd: codec.Sub{Subject: []byte("foo"), SID: 1}})
+
+	subs, err := registry.Lookup("foo")
+	if err != nil {
+		t.Fatalf("lookup failed: %v", err)
+	}
+	if len(subs) != 0 {
+		t.Fatalf("expected late SUB to be dropped, got %d subscriptions", len(subs))
+	}
+}
@@ -1,12 +1,21 @@
 package broker
 
-import "github.com/elmq0022/pub-sub/internal/codec"
+import (
+	"net"
+
+	"github.com/elmq0022/pub-sub/internal/codec"
+	"github.com/elmq0022/pub-sub/internal/stats"
+)
 
 type BrokerEvent interface{ isBrokerEvent() }
 
+// CmdEvent carries one decoded command. When Done is set, the broker closes
+// it once the command has been applied, which lets a reader in parallel
+// fanout mode wait before sending anything that depends on it.
 type CmdEvent struct {
-	CID int64
-	Cmd codec.InboundCommands
+	CID  int64
+	Cmd  codec.InboundCommands
+	Done chan struct{}
 }
 
 func (CmdEvent) isBrokerEvent() {}
@@ -18,9 +27,22 @@ type ProtocolErrorEvent struct {
 
 func (ProtocolErrorEvent) isBrokerEvent() {}
 
+// RateLimitEvent is sent by a reader that refused a command under the
+// disconnect rate limit policy. The reader has already counted it in
+// stats.RateLimit.
+type RateLimitEvent struct {
+	CID int64
+}
+
+func (RateLimitEvent) isBrokerEvent() {}
+
 type SessionUpEvent struct {
-	CID      int64
-	Outbound chan<- codec.OutboundCommands
+	CID        int64
+	RemoteAddr net.Addr
+	// Outbound is bidirectional so the drop_oldest slow-consumer policy can
+	// take queued messages back out.
+	Outbound chan codec.OutboundCommands
+	Stats    *stats.Conn
 }
 
 func (SessionUpEvent) isBrokerEvent() {}
@@ -34,3 +56,19 @@ func (SessionDownEvent) isBrokerEvent() {}
 type HeartbeatTickEvent struct{}
 
 func (HeartbeatTickEvent) isBrokerEvent() {}
+
+// SlowConsumerEvent is sent by a fanout worker when a subscriber's outbound
+// queue was full, so the broker can disconnect it.
+type SlowConsumerEvent struct {
+	CID int64
+}
+
+func (SlowConsumerEvent) isBrokerEvent() {}
+
+// AuthTimeoutEvent is sent by a session's connect timer when AuthTimeout
+// passes, so the broker can close it if it still has not sent CONNECT.
+type AuthTimeoutEvent struct {
+	CID int64
+}
+
+func (AuthTimeoutEvent) isBrokerEvent() {}
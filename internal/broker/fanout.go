@@ -0,0 +1,223 @@
+package broker
+
+import (
+	"github.com/elmq0022/pub-sub/internal/codec"
+	"github.com/elmq0022/pub-sub/internal/stats"
+	"github.com/elmq0022/pub-sub/internal/subjectregistry"
+)
+
+// fanoutWorkerQueue is the buffer between readers and each fanout worker.
+const fanoutWorkerQueue = 64
+
+// routingSnapshot is the read-only state fanout workers publish against.
+// The broker replaces it after every change to sessions or subscriptions.
+// Snapshots share maps with their predecessors, so they are never changed.
+// outboxes only holds connected sessions, perms those of them that have
+// restricted permissions and system those that are system sessions.
+type routingSnapshot struct {
+	registry subjectregistry.Lookuper
+	outboxes map[int64]*outbox
+	perms    map[int64]*permissions
+	system   map[int64]bool
+}
+
+func (b *Broker) parallel() bool {
+	return len(b.workers) > 0
+}
+
+// PublishInput returns the channel a reader should send PUB commands for cid
+// to. In parallel fanout mode every CID maps to one worker, which keeps each
+// publisher's messages in order; otherwise it is the broker inbox.
+func (b *Broker) PublishInput(cid int64) chan<- BrokerEvent {
+	if !b.parallel() {
+		return b.inbox
+	}
+	return b.workers[uint64(cid)%uint64(len(b.workers))]
+}
+
+// Parallel reports whether PUBs bypass the broker loop. Readers must then wait
+// for every other command to be applied before reading the next one, so a
+// SUB followed by a PUB on the same connection is routed in order.
+func (b *Broker) Parallel() bool {
+	return b.parallel()
+}
+
+// publishSnapshot stores a new routing snapshot. The registry snapshot
+// costs constant time; the session maps are only rebuilt when sessions
+// changed, so SUB and UNSUB churn does not walk every session.
+func (b *Broker) publishSnapshot() {
+	snap := &routingSnapshot{registry: b.registry.Snapshot()}
+	if prev := b.snapshot.Load(); prev != nil && !b.sessionsDirty {
+		snap.outboxes, snap.perms, snap.system = prev.outboxes, prev.perms, prev.system
+	} else {
+		snap.outboxes = make(map[int64]*outbox, len(b.sessions))
+		snap.perms = make(map[int64]*permissions)
+		snap.system = make(map[int64]bool)
+		for cid, session := range b.sessions {
+			if session.State != StateConnected {
+				continue
+			}
+			snap.outboxes[cid] = session.outbox
+			if session.perms != nil {
+				snap.perms[cid] = session.perms
+			}
+			if session.System {
+				snap.system[cid] = true
+			}
+		}
+	}
+	b.snapshot.Store(snap)
+	b.dirty = false
+	b.sessionsDirty = false
+}
+
+// fanoutWorker routes PUBs against the latest snapshot. Permission and
+// $SYS checks are made here too, so a publisher's PUBs are all handled in
+// the order they arrived. Only the ones that need broker state are handed
+// to the broker, and the worker waits for each to be applied before it
+// moves on.
+func (b *Broker) fanoutWorker(in <-chan BrokerEvent) {
+	var slow []int64
+	for ev := range in {
+		cmdEv, ok := ev.(CmdEvent)
+		if !ok {
+			continue
+		}
+		pub, ok := cmdEv.Cmd.(codec.Pub)
+		if !ok {
+			continue
+		}
+
+		snap := b.snapshot.Load()
+		publisher, ok := snap.outboxes[cmdEv.CID]
+		if !ok {
+			// The publisher has not completed CONNECT, or is gone. Its
+			// reader waited for CONNECT to be applied before sending any
+			// PUB, so the broker decides what to do with it.
+			b.applyInBroker(cmdEv)
+			continue
+		}
+
+		slow = slow[:0]
+		system := isSystemSubject(pub.Subject)
+		switch {
+		case (system && !snap.system[cmdEv.CID]) || !snap.perms[cmdEv.CID].canPublish(pub.Subject):
+			pub.Release()
+			if _, full := publisher.trySend(codec.Err{Message: permissionsErr("Publish", pub.Subject)}); full {
+				slow = append(slow, cmdEv.CID)
+			}
+		case system && isSystemRequest(pub.Subject):
+			// Admin requests read broker state.
+			b.applyInBroker(cmdEv)
+		default:
+			b.routePub(snap, publisher, pub, system, &slow)
+		}
+
+		// Disconnecting mutates broker state, so hand it to the broker.
+		for _, cid := range slow {
+			b.control <- SlowConsumerEvent{CID: cid}
+		}
+	}
+}
+
+// applyInBroker hands a PUB to the broker and waits until it is applied,
+// so the publisher's next PUB cannot overtake it.
+func (b *Broker) applyInBroker(ev CmdEvent) {
+	done := make(chan struct{})
+	ev.Done = done
+	b.inbox <- ev
+	<-done
+}
+
+// routePub fans pub out to the subscribers in snap, which are only system
+// sessions for a $SYS subject, and adds the CIDs whose outbox was full to
+// slow.
+func (b *Broker) routePub(snap *routingSnapshot, publisher *outbox, pub codec.Pub, system bool, slow *[]int64) {
+	subs, err := snap.registry.Lookup(string(pub.Subject))
+	if err != nil {
+		pub.Release()
+		return
+	}
+	if system {
+		subs = snap.systemSubs(subs)
+	}
+
+	n := fanout(pub, subs, func(cid int64, msg codec.Msg) bool {
+		box, ok := snap.outboxes[cid]
+		if !ok {
+			return false
+		}
+		queued, full := box.trySend(msg)
+		if full {
+			*slow = append(*slow, cid)
+		}
+		return queued
+	})
+	b.countPub(publisher.stats, pub, len(subs), n)
+}
+
+// systemSubs keeps the subscriptions of system sessions, like
+// Broker.systemSubs.
+func (snap *routingSnapshot) systemSubs(subs []subjectregistry.Sub) []subjectregistry.Sub {
+	var res []subjectregistry.Sub
+	for _, sub := range subs {
+		if snap.system[sub.CID] {
+			res = append(res, sub)
+		}
+	}
+	return res
+}
+
+// fanout delivers pub to every sub through send, which reports whether the
+// Msg was queued, and returns how many were. Each queued Msg holds its own
+// reference on the payload buffer and the publisher's reference is dropped
+// once fanout is done.
+func fanout(pub codec.Pub, subs []subjectregistry.Sub, send func(cid int64, msg codec.Msg) bool) int {
+	defer pub.Release()
+	if len(subs) == 0 {
+		return 0
+	}
+
+	frame := codec.NewFrame(pub.Subject, pub.Reply, pub.Payload)
+	n := 0
+	for _, sub := range subs {
+		msg := codec.Msg{
+			Subject: pub.Subject,
+			Reply:   pub.Reply,
+			SID:     sub.SID,
+			Payload: pub.Payload,
+			Buffer:  pub.Buffer,
+			Frame:   frame,
+		}
+		pub.Buffer.Retain()
+		if send(sub.CID, msg) {
+			n++
+		} else {
+			msg.Release()
+		}
+	}
+	return n
+}
+
+// countPub records a PUB from the connection with stats that matched
+// matched subscriptions and was queued for n of them. It only reads the
+// payload length, so it is safe to call after fanout has released the
+// payload.
+func (b *Broker) countPub(publisher *stats.Conn, pub codec.Pub, matched, n int) {
+	if matched == 0 {
+		b.stats.NoSubscribers.Add(1)
+	}
+	size := int64(len(pub.Payload))
+	publisher.InMsgs.Add(1)
+	publisher.InBytes.Add(size)
+	b.stats.InMsgs.Add(1)
+	b.stats.InBytes.Add(size)
+	b.stats.OutMsgs.Add(int64(n))
+	b.stats.OutBytes.Add(int64(n) * size)
+}
+
+func (b *Broker) handleSlowConsumerEvent(ev SlowConsumerEvent) {
+	if session, ok := b.sessions[ev.CID]; ok {
+		b.disconnectSlowConsumer(ev.CID, session)
+	}
+}
@@ -0,0 +1,222 @@
+package broker
+
+import (
+	"fmt"
+	"runtime"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/elmq0022/pub-sub/internal/codec"
+	"github.com/elmq0022/pub-sub/internal/config"
+	"github.com/elmq0022/pub-sub/internal/subjectregistry"
+)
+
+func parallelConfig(workers int) config.Config {
+	return config.Config{FanoutWorkers: workers}
+}
+
+// apply sends ev to the broker and waits until it has been processed.
+func apply(b *Broker, cid int64, cmd codec.InboundCommands) {
+	done := make(chan struct{})
+	b.Input() <- CmdEvent{CID: cid, Cmd: cmd, Done: done}
+	<-done
+}
+
+// sessionUp registers cid with the running broker and completes CONNECT,
+// consuming its +OK.
+func sessionUp(b *Broker, cid int64, size int) chan codec.OutboundCommands {
+	outbound := make(chan codec.OutboundCommands, size)
+	b.Input() <- SessionUpEvent{CID: cid, Outbound: outbound}
+	apply(b, cid, codec.Connect{})
+	<-outbound
+	return outbound
+}
+
+func TestParallelFanoutPreservesPerPublisherOrder(t *testing.T) {
+	b := NewBroker(subjectregistry.NewSubjectRegistry(), parallelConfig(4))
+	go b.Run()
+
+	sub := sessionUp(b, 1, 4096)
+	apply(b, 1, codec.Sub{Subject: []byte("foo.>"), SID: 9})
+	assertOutboundOKWithin(t, sub)
+
+	const publishers, perPublisher = 4, 200
+	for p := int64(0); p < publishers; p++ {
+		sessionUp(b, 100+p, 1)
+	}
+	var wg sync.WaitGroup
+	for p := int64(0); p < publishers; p++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			subject := []byte("foo." + strconv.FormatInt(p, 10))
+			in := b.PublishInput(100 + p)
+			for i := 0; i < perPublisher; i++ {
+				payload := []byte(strconv.Itoa(i))
+				in <- CmdEvent{CID: 100 + p, Cmd: codec.Pub{Subject: subject, Len: int64(len(payload)), Payload: payload}}
+			}
+		}()
+	}
+	wg.Wait()
+
+	next := make(map[string]int)
+	for i := 0; i < publishers*perPublisher; i++ {
+		select {
+		case cmd := <-sub:
+			msg := cmd.(codec.Msg)
+			n, _ := strconv.Atoi(string(msg.Payload))
+			if want := next[string(msg.Subject)]; n != want {
+				t.Fatalf("subject %s: got message %d, want %d", msg.Subject, n, want)
+			}
+			next[string(msg.Subject)]++
+		case <-time.After(time.Second):
+			t.Fatalf("timed out after %d messages", i)
+		}
+	}
+}
+
+func TestParallelFanoutDisconnectsSlowConsumerThroughBroker(t *testing.T) {
+	cfg := parallelConfig(2)
+	cfg.MaxPendingMsgs = 1
+	b := NewBroker(subjectregistry.NewSubjectRegistry(), cfg)
+	go b.Run()
+
+	// One slot past the limit is left for the Slow Consumer error.
+	sub := sessionUp(b, 1, 2)
+	apply(b, 1, codec.Sub{Subject: []byte("foo"), SID: 1})
+	sessionUp(b, 2, 1)
+
+	// The +OK reaches the limit, so the first MSG finds the queue full.
+	b.PublishInput(2) <- CmdEvent{CID: 2, Cmd: codec.Pub{Subject: []byte("foo"), Payload: []byte("x")}}
+
+	deadline := time.After(time.Second)
+	for {
+		if _, ok := b.snapshot.Load().outboxes[1]; !ok {
+			break
+		}
+		select {
+		case <-deadline:
+			t.Fatal("slow consumer was not disconnected")
+		case <-time.After(time.Millisecond):
+		}
+	}
+
+	assertOutboundOK(t, sub)
+	assertSlowConsumerErr(t, sub)
+	assertClosed(t, sub)
+}
+
+func TestOutboxSendAfterCloseIsDropped(t *testing.T) {
+	ch := make(chan codec.OutboundCommands, 1)
+	box := newOutbox(ch, nil, config.Config{})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				box.trySend(codec.Ping{})
+			}
+		}()
+	}
+	box.close()
+	box.close()
+	wg.Wait()
+
+	queued, full := box.trySend(codec.Ping{})
+	if queued || full {
+		t.Fatalf("expected closed outbox to drop the send, got queued=%v full=%v", queued, full)
+	}
+}
+
+func TestPublishInputWithoutWorkersIsInbox(t *testing.T) {
+	b := NewBroker(subjectregistry.NewSubjectRegistry(), testConfig())
+	if b.Parallel() {
+		t.Fatal("expected single broker mode by default")
+	}
+	if b.PublishInput(3) != b.Input() {
+		t.Fatal("expected PUBs to go to the broker inbox")
+	}
+}
+
+func assertOutboundOKWithin(t *testing.T, ch <-chan codec.OutboundCommands) {
+	t.Helper()
+
+	select {
+	case msg := <-ch:
+		if _, ok := msg.(codec.OK); !ok {
+			t.Fatalf("expected codec.OK, got %T", msg)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for codec.OK")
+	}
+}
+
+// BenchmarkPublishFanout publishes from many connections to a subject with
+// several subscribers, comparing the single broker loop with parallel fanout
+// workers at 1, 4 and 16 cores.
+func BenchmarkPublishFanout(b *testing.B) {
+	const subscribers = 8
+
+	for _, cores := range []int{1, 4, 16} {
+		for _, mode := range []struct {
+			name    string
+			workers int
+		}{
+			{name: "single", workers: 0},
+			{name: "parallel", workers: cores},
+		} {
+			b.Run(fmt.Sprintf("cores=%d/%s", cores, mode.name), func(b *testing.B) {
+				prev := runtime.GOMAXPROCS(cores)
+				defer runtime.GOMAXPROCS(prev)
+
+				br := NewBroker(subjectregistry.NewSubjectRegistry(), parallelConfig(mode.workers))
+				go br.Run()
+
+				var drained sync.WaitGroup
+				for cid := int64(0); cid < subscribers; cid++ {
+					out := sessionUp(br, cid, 1<<16)
+					apply(br, cid, codec.Sub{Subject: []byte("bench.*"), SID: 1})
+					drained.Add(1)
+					go func() {
+						defer drained.Done()
+						for cmd := range out {
+							if msg, ok := cmd.(codec.Msg); ok {
+								msg.Release()
+							}
+						}
+					}()
+				}
+
+				var nextCID sync.Mutex
+				cid := int64(subscribers)
+				payload := []byte("hello world")
+
+				b.ReportAllocs()
+				b.ResetTimer()
+				b.RunParallel(func(pb *testing.PB) {
+					nextCID.Lock()
+					cid++
+					mine := cid
+					nextCID.Unlock()
+					sessionUp(br, mine, 1)
+
+					in := br.PublishInput(mine)
+					subject := []byte("bench." + strconv.FormatInt(mine, 10))
+					for pb.Next() {
+						in <- CmdEvent{CID: mine, Cmd: codec.Pub{Subject: subject, Len: int64(len(payload)), Payload: payload}}
+					}
+				})
+				b.StopTimer()
+
+				for cid := int64(0); cid < subscribers; cid++ {
+					br.Input() <- SessionDownEvent{CID: cid}
+				}
+				drained.Wait()
+			})
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package broker
+
+import (
+	"testing"
+
+	"github.com/elmq0022/pub-sub/internal/codec"
+	"github.com/elmq0022/pub-sub/internal/subjectregistry"
+)
+
+func TestSubPastMaxSubscriptionsIsRejectedWithoutDisconnect(t *testing.T) {
+	registry := subjectregistry.NewSubjectRegistry()
+	cfg := testConfig()
+	cfg.MaxSubscriptions = 1
+	b := NewBroker(registry, cfg)
+
+	outbound := make(chan codec.OutboundCommands, 4)
+	b.handleSessionUpEvent(SessionUpEvent{CID: 1, Outbound: outbound})
+	connect(t, b, 1)
+
+	b.handleCmdEvent(CmdEvent{CID: 1, Cmd: codec.Sub{Subject: []byte("foo"), SID: 1}})
+	assertOutboundOK(t, outbound)
+
+	b.handleCmdEvent(CmdEvent{CID: 1, Cmd: codec.Sub{Subject: []byte("bar"), SID: 2}})
+	msg, _ := readOutbound(t, outbound)
+	if e, ok := msg.(codec.Err); !ok || e.Message != "'Maximum Subscriptions Exceeded'" {
+		t.Fatalf("expected max subscriptions error, got %#v", msg)
+	}
+	if subs, _ := registry.Lookup("bar"); len(subs) != 0 {
+		t.Fatalf("expected rejected SUB not to be registered, got %d", len(subs))
+	}
+	if _, ok := b.sessions[1]; !ok {
+		t.Fatal("expected session to stay connected")
+	}
+
+	// Unsubscribing frees a slot.
+	b.handleCmdEvent(CmdEvent{CID: 1, Cmd: codec.Unsub{SID: 1}})
+	assertOutboundOK(t, outbound)
+	b.handleCmdEvent(CmdEvent{CID: 1, Cmd: codec.Sub{Subject: []byte("bar"), SID: 2}})
+	assertOutboundOK(t, outbound)
+}
+
+func TestSubReusingSIDIsRejectedAndNotCounted(t *testing.T) {
+	registry := subjectregistry.NewSubjectRegistry()
+	cfg := testConfig()
+	cfg.MaxSubscriptions = 2
+	b := NewBroker(registry, cfg)
+
+	outbound := make(chan codec.OutboundCommands, 8)
+	b.handleSessionUpEvent(SessionUpEvent{CID: 1, Outbound: outbound})
+	connect(t, b, 1)
+
+	b.handleCmdEvent(CmdEvent{CID: 1, Cmd: codec.Sub{Subject: []byte("foo"), SID: 1}})
+	assertOutboundOK(t, outbound)
+	for _, subject := range []string{"foo", "bar"} {
+		b.handleCmdEvent(CmdEvent{CID: 1, Cmd: codec.Sub{Subject: []byte(subject), SID: 1}})
+		assertErr(t, outbound, "'Invalid Subscription: SID In Use'")
+	}
+	if b.sessions[1].Subs != 1 || registry.Count() != 1 {
+		t.Fatalf("expected 1 subscription, got %d counted and %d registered", b.sessions[1].Subs, registry.Count())
+	}
+	if subs, _ := registry.Lookup("bar"); len(subs) != 0 {
+		t.Fatalf("expected the reused SID not to be registered on bar, got %v", subs)
+	}
+
+	// The rejected SUBs did not use up the limit.
+	b.handleCmdEvent(CmdEvent{CID: 1, Cmd: codec.Sub{Subject: []byte("bar"), SID: 2}})
+	assertOutboundOK(t, outbound)
+	b.handleCmdEvent(CmdEvent{CID: 1, Cmd: codec.Unsub{SID: 1}})
+	assertOutboundOK(t, outbound)
+	if b.sessions[1].Subs != 1 || registry.HasSub(1, 1) {
+		t.Fatalf("expected SID 1 gone after UNSUB, got %d subs", b.sessions[1].Subs)
+	}
+}
@@ -0,0 +1,469 @@
+package broker
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"runtime"
+	"slices"
+	"time"
+)
+
+// DefaultMonitorLimit is how many connections or subscriptions a Connz or
+// Subsz page holds when no limit is given.
+const DefaultMonitorLimit = 1024
+
+// QueryEvent runs fn on the broker loop, where it may read sessions and the
+// registry. Monitoring uses it so the broker stays their only owner.
+type QueryEvent struct {
+	fn func(b *Broker)
+}
+
+func (QueryEvent) isBrokerEvent() {}
+
+// query runs fn on the broker loop and waits for its result, giving up when
+// ctx is done. Queries go through lane, which is the control channel unless
+// the caller wants to measure the inbox.
+func query[T any](ctx context.Context, lane chan<- BrokerEvent, fn func(b *Broker) T) (T, error) {
+	var zero T
+	reply := make(chan T, 1)
+	ev := QueryEvent{fn: func(b *Broker) { reply <- fn(b) }}
+
+	select {
+	case lane <- ev:
+	case <-ctx.Done():
+		return zero, ctx.Err()
+	}
+	select {
+	case v := <-reply:
+		return v, nil
+	case <-ctx.Done():
+		return zero, ctx.Err()
+	}
+}
+
+// Varz is the server-wide summary.
+type Varz struct {
+	Start            time.Time `json:"start"`
+	Now              time.Time `json:"now"`
+	Uptime           string    `json:"uptime"`
+	Mem              uint64    `json:"mem"`
+	HeapAlloc        uint64    `json:"heap_alloc"`
+	Connections      int       `json:"connections"`
+	TotalConnections int64     `json:"total_connections"`
+	Subscriptions    int       `json:"subscriptions"`
+	InMsgs           int64     `json:"in_msgs"`
+	OutMsgs          int64     `json:"out_msgs"`
+	InBytes          int64     `json:"in_bytes"`
+	OutBytes         int64     `json:"out_bytes"`
+	SlowConsumers    int64     `json:"slow_consumers"`
+	// Flushes counts writes to client sockets and WrittenCmds the commands
+	// they carried.
+	Flushes     int64 `json:"flushes"`
+	WrittenCmds int64 `json:"written_cmds"`
+	// RateLimitThrottles counts reader pauses for going over a rate limit,
+	// RateLimitThrottled is their total length and RateLimitDisconnects
+	// counts connections closed for it.
+	RateLimitThrottles   int64  `json:"rate_limit_throttles"`
+	RateLimitThrottled   string `json:"rate_limit_throttled"`
+	RateLimitDisconnects int64  `json:"rate_limit_disconnects"`
+	// The Refused counters count connections closed before a session
+	// started: by the CIDR lists, the per-IP connection rate and
+	// MaxConnections.
+	RefusedDenied         int64 `json:"refused_denied"`
+	RefusedRateLimited    int64 `json:"refused_rate_limited"`
+	RefusedMaxConnections int64 `json:"refused_max_connections"`
+}
+
+// Varz reports uptime, memory, message counters and connection counts.
+func (b *Broker) Varz(ctx context.Context) (Varz, error) {
+	v, err := query(ctx, b.control, (*Broker).varz)
+	if err != nil {
+		return Varz{}, err
+	}
+	return b.completeVarz(v), nil
+}
+
+// varz reads the parts of Varz owned by the broker loop.
+func (b *Broker) varz() Varz {
+	return Varz{
+		Start:            b.start,
+		Connections:      len(b.sessions),
+		TotalConnections: b.totalConns,
+		Subscriptions:    b.registry.Count(),
+	}
+}
+
+// completeVarz fills in the parts of Varz that are safe to read anywhere.
+func (b *Broker) completeVarz(v Varz) Varz {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	v.Now = time.Now()
+	v.Uptime = v.Now.Sub(v.Start).Round(time.Second).String()
+	v.Mem = mem.Sys
+	v.HeapAlloc = mem.HeapAlloc
+	v.InMsgs = b.stats.InMsgs.Load()
+	v.OutMsgs = b.stats.OutMsgs.Load()
+	v.InBytes = b.stats.InBytes.Load()
+	v.OutBytes = b.stats.OutBytes.Load()
+	v.SlowConsumers = b.stats.SlowConsumers.Load()
+	v.Flushes = b.writerStats.Flushes.Load()
+	v.WrittenCmds = b.writerStats.WrittenCmds.Load()
+	v.RateLimitThrottles = b.rateStats.Throttles.Load()
+	v.RateLimitThrottled = time.Duration(b.rateStats.ThrottledNanos.Load()).String()
+	v.RateLimitDisconnects = b.rateStats.Disconnects.Load()
+	v.RefusedDenied = b.acceptStats.Denied.Load()
+	v.RefusedRateLimited = b.acceptStats.RateLimited.Load()
+	v.RefusedMaxConnections = b.acceptStats.MaxConnections.Load()
+	return v
+}
+
+// ConnzSort orders the connections in a Connz page. Every order but
+// SortByCID is largest first, with ties broken by CID.
+type ConnzSort string
+
+const (
+	SortByCID       ConnzSort = "cid"
+	SortBySubs      ConnzSort = "subs"
+	SortByPending   ConnzSort = "pending"
+	SortByMsgsTo    ConnzSort = "msgs_to"
+	SortByMsgsFrom  ConnzSort = "msgs_from"
+	SortByBytesTo   ConnzSort = "bytes_to"
+	SortByBytesFrom ConnzSort = "bytes_from"
+	// SortByRTT orders by the RTT moving average.
+	SortByRTT ConnzSort = "rtt"
+)
+
+// ErrUnknownSort is returned by Connz for a ConnzSort it does not know.
+var ErrUnknownSort = errors.New("unknown sort")
+
+// connzKeys extracts the value each ConnzSort orders by.
+var connzKeys = map[ConnzSort]func(c ConnInfo) int64{
+	SortBySubs:      func(c ConnInfo) int64 { return int64(c.Subscriptions) },
+	SortByPending:   func(c ConnInfo) int64 { return int64(c.Pending) },
+	SortByMsgsTo:    func(c ConnInfo) int64 { return c.OutMsgs },
+	SortByMsgsFrom:  func(c ConnInfo) int64 { return c.InMsgs },
+	SortByBytesTo:   func(c ConnInfo) int64 { return c.OutBytes },
+	SortByBytesFrom: func(c ConnInfo) int64 { return c.InBytes },
+	SortByRTT:       func(c ConnInfo) int64 { return int64(c.rttAvg) },
+}
+
+// ConnzOptions selects a page of connections. A Limit of zero means
+// DefaultMonitorLimit and an empty Sort means SortByCID.
+type ConnzOptions struct {
+	Offset int       `json:"offset"`
+	Limit  int       `json:"limit"`
+	Sort   ConnzSort `json:"sort"`
+}
+
+// ConnInfo describes one session.
+type ConnInfo struct {
+	CID           int64     `json:"cid"`
+	Addr          string    `json:"addr,omitempty"`
+	Name          string    `json:"name,omitempty"`
+	User          string    `json:"user,omitempty"`
+	Start         time.Time `json:"start"`
+	Connected     bool      `json:"connected"`
+	Subscriptions int       `json:"subscriptions"`
+	Pending       int       `json:"pending"`
+	PendingBytes  int64     `json:"pending_bytes"`
+	InMsgs        int64     `json:"in_msgs"`
+	OutMsgs       int64     `json:"out_msgs"`
+	InBytes       int64     `json:"in_bytes"`
+	OutBytes      int64     `json:"out_bytes"`
+	DroppedMsgs   int64     `json:"dropped_msgs"`
+	Flushes       int64     `json:"flushes"`
+	WrittenCmds   int64     `json:"written_cmds"`
+	Throttles     int64     `json:"throttles"`
+	ThrottledTime string    `json:"throttled_time,omitempty"`
+	RTT           string    `json:"rtt,omitempty"`
+	RTTAvg        string    `json:"rtt_avg,omitempty"`
+
+	rttAvg time.Duration
+}
+
+// Connz is one page of connections. Total counts every connection.
+type Connz struct {
+	Now    time.Time  `json:"now"`
+	Total  int        `json:"total"`
+	Offset int        `json:"offset"`
+	Limit  int        `json:"limit"`
+	Conns  []ConnInfo `json:"connections"`
+}
+
+// Connz reports the sessions in the order and page opts asks for. The
+// broker only copies session state; sorting happens on the caller.
+func (b *Broker) Connz(ctx context.Context, opts ConnzOptions) (Connz, error) {
+	key, err := connzKey(opts.Sort)
+	if err != nil {
+		return Connz{}, err
+	}
+	conns, err := query(ctx, b.control, (*Broker).conns)
+	if err != nil {
+		return Connz{}, err
+	}
+	return newConnz(conns, opts, key), nil
+}
+
+// connzKey returns the key sort orders by, which is nil for SortByCID.
+func connzKey(sort ConnzSort) (func(c ConnInfo) int64, error) {
+	if sort == "" || sort == SortByCID {
+		return nil, nil
+	}
+	key, ok := connzKeys[sort]
+	if !ok {
+		return nil, fmt.Errorf("%w %q", ErrUnknownSort, sort)
+	}
+	return key, nil
+}
+
+// conns copies every session's state on the broker loop.
+func (b *Broker) conns() []ConnInfo {
+	conns := make([]ConnInfo, 0, len(b.sessions))
+	for cid, session := range b.sessions {
+		conns = append(conns, session.info(cid))
+	}
+	return conns
+}
+
+// newConnz sorts conns by key and cuts the page opts asks for.
+func newConnz(conns []ConnInfo, opts ConnzOptions, key func(c ConnInfo) int64) Connz {
+	slices.SortFunc(conns, func(x, y ConnInfo) int {
+		if key != nil {
+			if c := cmp.Compare(key(y), key(x)); c != 0 {
+				return c
+			}
+		}
+		return cmp.Compare(x.CID, y.CID)
+	})
+	offset, limit := pageBounds(opts.Offset, opts.Limit)
+	return Connz{
+		Now:    time.Now(),
+		Total:  len(conns),
+		Offset: offset,
+		Limit:  limit,
+		Conns:  page(conns, offset, limit),
+	}
+}
+
+func (s ClientSession) info(cid int64) ConnInfo {
+	st := s.outbox.stats
+	c := ConnInfo{
+		CID:           cid,
+		Name:          s.Name,
+		User:          s.User,
+		Start:         s.Start,
+		Connected:     s.State == StateConnected,
+		Subscriptions: s.Subs,
+		Pending:       len(s.outbox.ch),
+		PendingBytes:  st.PendingBytes.Load(),
+		InMsgs:        st.InMsgs.Load(),
+		OutMsgs:       st.OutMsgs.Load(),
+		InBytes:       st.InBytes.Load(),
+		OutBytes:      st.OutBytes.Load(),
+		DroppedMsgs:   st.DroppedMsgs.Load(),
+		Flushes:       st.Flushes.Load(),
+		WrittenCmds:   st.WrittenCmds.Load(),
+		Throttles:     st.Throttles.Load(),
+		rttAvg:        s.RTTAvg,
+	}
+	if s.RemoteAddr != nil {
+		c.Addr = s.RemoteAddr.String()
+	}
+	if c.Throttles > 0 {
+		c.ThrottledTime = time.Duration(st.ThrottledNanos.Load()).String()
+	}
+	if s.RTT > 0 {
+		c.RTT = s.RTT.String()
+		c.RTTAvg = s.RTTAvg.String()
+	}
+	return c
+}
+
+// SubszOptions selects what Subsz lists. Subscriptions are only listed when
+// Subscriptions is set, ordered by subject, then CID and SID, and paged like
+// Connz.
+type SubszOptions struct {
+	Subscriptions bool `json:"subs"`
+	Offset        int  `json:"offset"`
+	Limit         int  `json:"limit"`
+}
+
+// SubInfo is one subscription.
+type SubInfo struct {
+	Subject string `json:"subject"`
+	CID     int64  `json:"cid"`
+	SID     int64  `json:"sid"`
+}
+
+// Subsz reports the registry size and lookup cache effectiveness.
+type Subsz struct {
+	NumSubscriptions int       `json:"num_subscriptions"`
+	CacheEntries     int       `json:"num_cache"`
+	CacheSize        int       `json:"cache_size"`
+	CacheHits        uint64    `json:"cache_hits"`
+	CacheMisses      uint64    `json:"cache_misses"`
+	CacheHitRate     float64   `json:"cache_hit_rate"`
+	Offset           int       `json:"offset,omitempty"`
+	Limit            int       `json:"limit,omitempty"`
+	Subscriptions    []SubInfo `json:"subscriptions_list,omitempty"`
+}
+
+// Subsz reports the registry and, if asked, a page of its subscriptions.
+func (b *Broker) Subsz(ctx context.Context, opts SubszOptions) (Subsz, error) {
+	res, err := query(ctx, b.control, func(b *Broker) subszResult {
+		return b.subsz(opts.Subscriptions)
+	})
+	if err != nil {
+		return Subsz{}, err
+	}
+	return newSubsz(res, opts), nil
+}
+
+type subszResult struct {
+	subsz Subsz
+	subs  []SubInfo
+}
+
+// subsz reads the registry on the broker loop, copying its subscriptions
+// only if withSubs is set.
+func (b *Broker) subsz(withSubs bool) subszResult {
+	cache := b.registry.CacheStats()
+	r := subszResult{subsz: Subsz{
+		NumSubscriptions: b.registry.Count(),
+		CacheEntries:     cache.Entries,
+		CacheSize:        cache.Size,
+		CacheHits:        cache.Hits,
+		CacheMisses:      cache.Misses,
+	}}
+	if withSubs {
+		for _, s := range b.registry.Subscriptions() {
+			r.subs = append(r.subs, SubInfo{Subject: s.Subject, CID: s.CID, SID: s.SID})
+		}
+	}
+	return r
+}
+
+// newSubsz derives the hit rate and sorts and pages the subscriptions.
+func newSubsz(res subszResult, opts SubszOptions) Subsz {
+	subsz := res.subsz
+	if lookups := subsz.CacheHits + subsz.CacheMisses; lookups > 0 {
+		subsz.CacheHitRate = float64(subsz.CacheHits) / float64(lookups)
+	}
+	if !opts.Subscriptions {
+		return subsz
+	}
+
+	slices.SortFunc(res.subs, func(x, y SubInfo) int {
+		return cmp.Or(
+			cmp.Compare(x.Subject, y.Subject),
+			cmp.Compare(x.CID, y.CID),
+			cmp.Compare(x.SID, y.SID),
+		)
+	})
+	subsz.Offset, subsz.Limit = pageBounds(opts.Offset, opts.Limit)
+	subsz.Subscriptions = page(res.subs, subsz.Offset, subsz.Limit)
+	return subsz
+}
+
+func pageBounds(offset, limit int) (int, int) {
+	if offset < 0 {
+		offset = 0
+	}
+	if limit <= 0 {
+		limit = DefaultMonitorLimit
+	}
+	return offset, limit
+}
+
+func page[T any](items []T, offset, limit int) []T {
+	if offset >= len(items) {
+		return []T{}
+	}
+	return items[offset:min(offset+limit, len(items))]
+}
+
+// Ping sends an empty probe through the inbox and waits for the broker loop
+// to run it. It fails when ctx is done first, which means the loop is wedged
+// or too far behind to serve clients.
+func (b *Broker) Ping(ctx context.Context) error {
+	_, err := query(ctx, b.inbox, func(*Broker) struct{} { return struct{}{} })
+	return err
+}
+
+// Metrics is a point-in-time copy of the broker counters and gauges.
+type Metrics struct {
+	InMsgs            int64
+	InBytes           int64
+	OutMsgs           int64
+	OutBytes          int64
+	NoSubscribers     int64
+	SlowConsumers     int64
+	ProtocolErrors    int64
+	HeartbeatTimeouts int64
+
+	// Flushes and WrittenCmds are the session controller's writer counters.
+	Flushes     int64
+	WrittenCmds int64
+
+	// RateLimitThrottles, RateLimitThrottled and RateLimitDisconnects are
+	// the session controller's rate limiting counters.
+	RateLimitThrottles   int64
+	RateLimitThrottled   time.Duration
+	RateLimitDisconnects int64
+
+	// RefusedDenied, RefusedRateLimited and RefusedMaxConnections are the
+	// server's counters of refused connections.
+	RefusedDenied         int64
+	RefusedRateLimited    int64
+	RefusedMaxConnections int64
+
+	Sessions      int
+	Subscriptions int
+	// InboxLatency is how long a probe waited in the inbox behind commands
+	// before the broker loop ran it.
+	InboxLatency time.Duration
+}
+
+// Metrics reads the counters and sends a probe through the inbox, rather
+// than the control lane, so InboxLatency reflects the publish backlog.
+func (b *Broker) Metrics(ctx context.Context) (Metrics, error) {
+	type gauges struct {
+		sessions, subscriptions int
+		latency                 time.Duration
+	}
+	sent := time.Now()
+	g, err := query(ctx, b.inbox, func(b *Broker) gauges {
+		return gauges{
+			sessions:      len(b.sessions),
+			subscriptions: b.registry.Count(),
+			latency:       time.Since(sent),
+		}
+	})
+	if err != nil {
+		return Metrics{}, err
+	}
+
+	return Metrics{
+		InMsgs:                b.stats.InMsgs.Load(),
+		InBytes:               b.stats.InBytes.Load(),
+		OutMsgs:               b.stats.OutMsgs.Load(),
+		OutBytes:              b.stats.OutBytes.Load(),
+		NoSubscribers:         b.stats.NoSubscribers.Load(),
+		SlowConsumers:         b.stats.SlowConsumers.Load(),
+		ProtocolErrors:        b.stats.ProtocolErrors.Load(),
+		HeartbeatTimeouts:     b.stats.HeartbeatTimeouts.Load(),
+		Flushes:               b.writerStats.Flushes.Load(),
+		WrittenCmds:           b.writerStats.WrittenCmds.Load(),
+		RateLimitThrottles:    b.rateStats.Throttles.Load(),
+		RateLimitThrottled:    time.Duration(b.rateStats.ThrottledNanos.Load()),
+		RateLimitDisconnects:  b.rateStats.Disconnects.Load(),
+		RefusedDenied:         b.acceptStats.Denied.Load(),
+		RefusedRateLimited:    b.acceptStats.RateLimited.Load(),
+		RefusedMaxConnections: b.acceptStats.MaxConnections.Load(),
+		Sessions:              g.sessions,
+		Subscriptions:         g.subscriptions,
+		InboxLatency:          g.latency,
+	}, nil
+}
@@ -0,0 +1,326 @@
+package broker
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/elmq0022/pub-sub/internal/codec"
+	"github.com/elmq0022/pub-sub/internal/stats"
+	"github.com/elmq0022/pub-sub/internal/subjectregistry"
+)
+
+// monitoredBroker runs a broker with a subscriber on CID 1 that has two
+// subscriptions on foo and a publisher on CID 2 that has sent two PUBs.
+func monitoredBroker(t *testing.T) *Broker {
+	t.Helper()
+
+	b := NewBroker(subjectregistry.NewSubjectRegistry(), testConfig())
+	go b.Run()
+
+	sub := make(chan codec.OutboundCommands, 16)
+	b.Input() <- SessionUpEvent{CID: 1, Outbound: sub}
+	apply(b, 1, codec.Connect{Name: "subscriber"})
+	apply(b, 1, codec.Sub{Subject: []byte("foo"), SID: 1})
+	apply(b, 1, codec.Sub{Subject: []byte("foo.*"), SID: 2})
+	sessionUp(b, 2, 4)
+	apply(b, 2, codec.Pub{Subject: []byte("foo"), Payload: []byte("hello")})
+	apply(b, 2, codec.Pub{Subject: []byte("bar"), Payload: []byte("x")})
+	return b
+}
+
+func TestVarzCountsMessagesAndConnections(t *testing.T) {
+	b := monitoredBroker(t)
+
+	v, err := b.Varz(context.Background())
+	if err != nil {
+		t.Fatalf("Varz returned error: %v", err)
+	}
+	if v.Connections != 2 || v.TotalConnections != 2 || v.Subscriptions != 2 {
+		t.Fatalf("unexpected counts %d connections, %d total, %d subscriptions", v.Connections, v.TotalConnections, v.Subscriptions)
+	}
+	if v.InMsgs != 2 || v.InBytes != 6 || v.OutMsgs != 1 || v.OutBytes != 5 {
+		t.Fatalf("unexpected message counters in %d/%d out %d/%d", v.InMsgs, v.InBytes, v.OutMsgs, v.OutBytes)
+	}
+	if v.Mem == 0 || v.Uptime == "" {
+		t.Fatalf("expected memory and uptime, got %d and %q", v.Mem, v.Uptime)
+	}
+}
+
+func TestConnzReportsSessionsSortedAndPaged(t *testing.T) {
+	b := monitoredBroker(t)
+
+	c, err := b.Connz(context.Background(), ConnzOptions{})
+	if err != nil {
+		t.Fatalf("Connz returned error: %v", err)
+	}
+	if c.Total != 2 || len(c.Conns) != 2 || c.Conns[0].CID != 1 || c.Conns[1].CID != 2 {
+		t.Fatalf("expected CIDs [1 2], got %+v", c.Conns)
+	}
+	sub, pub := c.Conns[0], c.Conns[1]
+	if sub.Name != "subscriber" || sub.Subscriptions != 2 || sub.OutMsgs != 1 || sub.Pending != 4 {
+		t.Fatalf("unexpected subscriber info %+v", sub)
+	}
+	if pub.InMsgs != 2 || pub.InBytes != 6 || !pub.Connected {
+		t.Fatalf("unexpected publisher info %+v", pub)
+	}
+
+	c, err = b.Connz(context.Background(), ConnzOptions{Sort: SortByMsgsFrom, Limit: 1})
+	if err != nil {
+		t.Fatalf("Connz returned error: %v", err)
+	}
+	if c.Total != 2 || len(c.Conns) != 1 || c.Conns[0].CID != 2 {
+		t.Fatalf("expected only CID 2 sorted by msgs_from, got %+v", c.Conns)
+	}
+
+	c, err = b.Connz(context.Background(), ConnzOptions{Offset: 5})
+	if err != nil || len(c.Conns) != 0 {
+		t.Fatalf("expected empty page past the end, got %+v (%v)", c.Conns, err)
+	}
+
+	if _, err := b.Connz(context.Background(), ConnzOptions{Sort: "color"}); !errors.Is(err, ErrUnknownSort) {
+		t.Fatalf("expected ErrUnknownSort, got %v", err)
+	}
+}
+
+func TestSubszListsSubscriptionsOnRequest(t *testing.T) {
+	b := monitoredBroker(t)
+
+	sz, err := b.Subsz(context.Background(), SubszOptions{})
+	if err != nil {
+		t.Fatalf("Subsz returned error: %v", err)
+	}
+	if sz.NumSubscriptions != 2 || sz.Subscriptions != nil {
+		t.Fatalf("expected 2 subscriptions and no listing, got %+v", sz)
+	}
+	if sz.CacheMisses == 0 || sz.CacheSize != subjectregistry.DefaultLookupCacheSize {
+		t.Fatalf("expected cache stats from the PUB lookups, got %+v", sz)
+	}
+
+	sz, err = b.Subsz(context.Background(), SubszOptions{Subscriptions: true})
+	if err != nil {
+		t.Fatalf("Subsz returned error: %v", err)
+	}
+	want := []SubInfo{{Subject: "foo", CID: 1, SID: 1}, {Subject: "foo.*", CID: 1, SID: 2}}
+	if len(sz.Subscriptions) != 2 || sz.Subscriptions[0] != want[0] || sz.Subscriptions[1] != want[1] {
+		t.Fatalf("expected %v, got %v", want, sz.Subscriptions)
+	}
+}
+
+func TestQueryGivesUpWhenBrokerIsNotRunning(t *testing.T) {
+	b := NewBroker(subjectregistry.NewSubjectRegistry(), testConfig())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := b.Varz(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected deadline exceeded, got %v", err)
+	}
+}
+
+func TestPongRecordsRTT(t *testing.T) {
+	b := NewBroker(subjectregistry.NewSubjectRegistry(), testConfig())
+
+	outbound := make(chan codec.OutboundCommands, 4)
+	b.handleSessionUpEvent(SessionUpEvent{CID: 1, Outbound: outbound})
+	connect(t, b, 1)
+
+	session := b.sessions[1]
+	session.AwaitingPong = true
+	session.PingSentAt = time.Now().Add(-5 * time.Millisecond)
+	b.sessions[1] = session
+
+	b.handleCmdEvent(CmdEvent{CID: 1, Cmd: codec.Pong{}})
+	if rtt := b.sessions[1].RTT; rtt < 5*time.Millisecond {
+		t.Fatalf("expected RTT of at least 5ms, got %v", rtt)
+	}
+	if avg := b.sessions[1].RTTAvg; avg != b.sessions[1].RTT {
+		t.Fatalf("expected the first sample to start the average, got %v", avg)
+	}
+}
+
+func TestRTTMovingAverage(t *testing.T) {
+	var s ClientSession
+	s.recordRTT(80 * time.Millisecond)
+	s.recordRTT(160 * time.Millisecond)
+	if s.RTT != 160*time.Millisecond || s.RTTAvg != 90*time.Millisecond {
+		t.Fatalf("expected last 160ms and average 90ms, got %v and %v", s.RTT, s.RTTAvg)
+	}
+}
+
+func TestProbeRTTPingsAndWaitsForPong(t *testing.T) {
+	b := NewBroker(subjectregistry.NewSubjectRegistry(), testConfig())
+	go b.Run()
+	out := sessionUp(b, 1, 4)
+
+	type result struct {
+		probe RTTProbe
+		err   error
+	}
+	done := make(chan result, 1)
+	go func() {
+		probe, err := b.ProbeRTT(context.Background(), 1)
+		done <- result{probe, err}
+	}()
+
+	select {
+	case cmd := <-out:
+		if _, ok := cmd.(codec.Ping); !ok {
+			t.Fatalf("expected PING, got %#v", cmd)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for PING")
+	}
+	apply(b, 1, codec.Pong{})
+
+	select {
+	case res := <-done:
+		if res.err != nil || res.probe.CID != 1 || res.probe.RTT == "" || res.probe.RTTAvg == "" {
+			t.Fatalf("unexpected probe %+v (%v)", res.probe, res.err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for probe")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if _, err := b.ProbeRTT(ctx, 9); !errors.Is(err, ErrUnknownCID) {
+		t.Fatalf("expected ErrUnknownCID, got %v", err)
+	}
+}
+
+func TestMetricsCountsNoSubscribersAndProtocolErrors(t *testing.T) {
+	b := monitoredBroker(t)
+
+	b.ControlInput() <- ProtocolErrorEvent{CID: 2, Msg: "'Unknown Protocol Operation'"}
+
+	m, err := b.Metrics(context.Background())
+	if err != nil {
+		t.Fatalf("Metrics returned error: %v", err)
+	}
+	if m.InMsgs != 2 || m.NoSubscribers != 1 || m.ProtocolErrors != 1 {
+		t.Fatalf("unexpected counters %+v", m)
+	}
+	if m.Sessions != 1 || m.Subscriptions != 2 || m.InboxLatency <= 0 {
+		t.Fatalf("unexpected gauges %+v", m)
+	}
+}
+
+func TestMonitoringReportsFlushes(t *testing.T) {
+	b := NewBroker(subjectregistry.NewSubjectRegistry(), testConfig())
+	ws := &stats.Writer{}
+	ws.Flushes.Add(4)
+	ws.WrittenCmds.Add(10)
+	b.SetWriterStats(ws)
+	go b.Run()
+
+	st := &stats.Conn{}
+	st.Flushes.Add(3)
+	st.WrittenCmds.Add(9)
+	b.Input() <- SessionUpEvent{CID: 1, Outbound: make(chan codec.OutboundCommands, 4), Stats: st}
+
+	v, err := b.Varz(context.Background())
+	if err != nil {
+		t.Fatalf("Varz returned error: %v", err)
+	}
+	if v.Flushes != 4 || v.WrittenCmds != 10 {
+		t.Fatalf("expected 4 flushes of 10 commands, got %d of %d", v.Flushes, v.WrittenCmds)
+	}
+	m, err := b.Metrics(context.Background())
+	if err != nil {
+		t.Fatalf("Metrics returned error: %v", err)
+	}
+	if m.Flushes != 4 || m.WrittenCmds != 10 {
+		t.Fatalf("unexpected writer metrics %+v", m)
+	}
+	c, err := b.Connz(context.Background(), ConnzOptions{})
+	if err != nil {
+		t.Fatalf("Connz returned error: %v", err)
+	}
+	if got := c.Conns[0]; got.Flushes != 3 || got.WrittenCmds != 9 {
+		t.Fatalf("expected 3 flushes of 9 commands, got %d of %d", got.Flushes, got.WrittenCmds)
+	}
+}
+
+func TestMonitoringReportsRefusedConnections(t *testing.T) {
+	b := NewBroker(subjectregistry.NewSubjectRegistry(), testConfig())
+	as := &stats.Accept{}
+	as.Denied.Add(1)
+	as.RateLimited.Add(2)
+	as.MaxConnections.Add(3)
+	b.SetAcceptStats(as)
+	go b.Run()
+
+	v, err := b.Varz(context.Background())
+	if err != nil {
+		t.Fatalf("Varz returned error: %v", err)
+	}
+	if v.RefusedDenied != 1 || v.RefusedRateLimited != 2 || v.RefusedMaxConnections != 3 {
+		t.Fatalf("unexpected refused counters %d %d %d", v.RefusedDenied, v.RefusedRateLimited, v.RefusedMaxConnections)
+	}
+	m, err := b.Metrics(context.Background())
+	if err != nil {
+		t.Fatalf("Metrics returned error: %v", err)
+	}
+	if m.RefusedDenied != 1 || m.RefusedRateLimited != 2 || m.RefusedMaxConnections != 3 {
+		t.Fatalf("unexpected refused metrics %+v", m)
+	}
+}
+
+func TestMonitoringReportsRateLimiting(t *testing.T) {
+	b := NewBroker(subjectregistry.NewSubjectRegistry(), testConfig())
+	rs := &stats.RateLimit{}
+	rs.Throttles.Add(3)
+	rs.ThrottledNanos.Add(int64(1500 * time.Millisecond))
+	rs.Disconnects.Add(1)
+	b.SetRateLimitStats(rs)
+	go b.Run()
+
+	st := &stats.Conn{}
+	st.Throttles.Add(2)
+	st.ThrottledNanos.Add(int64(time.Second))
+	outbound := make(chan codec.OutboundCommands, 4)
+	b.Input() <- SessionUpEvent{CID: 1, Outbound: outbound, Stats: st}
+	sessionUp(b, 2, 4)
+
+	v, err := b.Varz(context.Background())
+	if err != nil {
+		t.Fatalf("Varz returned error: %v", err)
+	}
+	if v.RateLimitThrottles != 3 || v.RateLimitThrottled != "1.5s" || v.RateLimitDisconnects != 1 {
+		t.Fatalf("unexpected rate limit counters %d %q %d", v.RateLimitThrottles, v.RateLimitThrottled, v.RateLimitDisconnects)
+	}
+	m, err := b.Metrics(context.Background())
+	if err != nil {
+		t.Fatalf("Metrics returned error: %v", err)
+	}
+	if m.RateLimitThrottles != 3 || m.RateLimitThrottled != 1500*time.Millisecond || m.RateLimitDisconnects != 1 {
+		t.Fatalf("unexpected rate limit metrics %+v", m)
+	}
+
+	c, err := b.Connz(context.Background(), ConnzOptions{})
+	if err != nil {
+		t.Fatalf("Connz returned error: %v", err)
+	}
+	if got := c.Conns[0]; got.Throttles != 2 || got.ThrottledTime != "1s" {
+		t.Fatalf("expected 2 throttles for 1s, got %d for %q", got.Throttles, got.ThrottledTime)
+	}
+	if got := c.Conns[1]; got.Throttles != 0 || got.ThrottledTime != "" {
+		t.Fatalf("expected no throttling, got %d for %q", got.Throttles, got.ThrottledTime)
+	}
+}
+
+func TestPingRoundTripsThroughInbox(t *testing.T) {
+	b := NewBroker(subjectregistry.NewSubjectRegistry(), testConfig())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := b.Ping(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected deadline exceeded before Run, got %v", err)
+	}
+
+	go b.Run()
+	if err := b.Ping(context.Background()); err != nil {
+		t.Fatalf("expected running broker to answer, got %v", err)
+	}
+}
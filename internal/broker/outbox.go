@@ -0,0 +1,370 @@
+package broker
+
+import (
+	"fmt"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/elmq0022/pub-sub/internal/codec"
+	"github.com/elmq0022/pub-sub/internal/config"
+	"github.com/elmq0022/pub-sub/internal/stats"
+)
+
+// slowConsumerErr is sent to a client just before it is disconnected for
+// falling behind.
+const slowConsumerErr = "'Slow Consumer'"
+
+// dropLogInterval is how often an outbox logs MSGs dropped by the drop
+// policies. Each log line counts the drops since the last one.
+const dropLogInterval = 10 * time.Second
+
+// outbox guards a session's outbound channel so fanout workers can send to it
+// while the broker may close it, and applies the slow-consumer policy. Sends
+// are non-blocking, so holding the read lock is always brief and close never
+// waits long.
+type outbox struct {
+	mu     sync.RWMutex
+	ch     chan codec.OutboundCommands
+	closed bool
+	stats  *stats.Conn
+
+	maxMsgs  int
+	maxBytes int64
+	policy   config.SlowConsumerPolicy
+
+	// subs holds per-subscription pending state when MaxPendingPerSub is
+	// set. The broker adds and removes entries under the write lock.
+	maxPerSub int64
+	subs      map[int64]*subPending
+
+	// kept is scratch space for dropOldest, only used under the write lock.
+	kept []codec.OutboundCommands
+
+	// logger carries the session's CID. lastDropLog is when drops were last
+	// logged, in Unix nanoseconds, and unlogged counts drops since then.
+	logger      *slog.Logger
+	lastDropLog atomic.Int64
+	unlogged    atomic.Int64
+}
+
+func newOutbox(ch chan codec.OutboundCommands, st *stats.Conn, cfg config.Config) *outbox {
+	if st == nil {
+		st = &stats.Conn{}
+	}
+	maxMsgs := cfg.MaxPendingMsgs
+	if maxMsgs <= 0 || maxMsgs > cap(ch) {
+		maxMsgs = cap(ch)
+	}
+	return &outbox{
+		ch:       ch,
+		stats:    st,
+		maxMsgs:  maxMsgs,
+		maxBytes: int64(cfg.MaxPendingBytes),
+		policy:   cfg.SlowConsumerPolicy,
+
+		maxPerSub: int64(cfg.MaxPendingPerSub),
+		subs:      make(map[int64]*subPending),
+
+		logger: slog.New(slog.DiscardHandler),
+	}
+}
+
+// subPending tracks one subscription's undelivered MSGs. Queued MSGs point
+// at pending and decrement it when released, whether written or dropped.
+type subPending struct {
+	pending  atomic.Int64
+	dropped  atomic.Int64
+	notified atomic.Bool
+}
+
+// admit counts one more pending MSG unless the subscription is at limit.
+// A drop episode ends, and the next drop is reported again, only once the
+// subscription has drained to half its limit. Ending it on any admit would
+// send a notice for nearly every MSG while the writer keeps the
+// subscription hovering at the limit.
+func (sp *subPending) admit(limit int64) bool {
+	n := sp.pending.Add(1)
+	if n > limit {
+		sp.pending.Add(-1)
+		return false
+	}
+	if n-1 <= limit/2 && sp.notified.Load() {
+		sp.notified.Store(false)
+	}
+	return true
+}
+
+// addSub starts tracking sid, keeping any state it already has.
+func (o *outbox) addSub(sid int64) {
+	if o.maxPerSub <= 0 {
+		return
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if _, ok := o.subs[sid]; !ok {
+		o.subs[sid] = &subPending{}
+	}
+}
+
+func (o *outbox) removeSub(sid int64) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	delete(o.subs, sid)
+}
+
+func (o *outbox) sub(sid int64) *subPending {
+	if o.maxPerSub <= 0 {
+		return nil
+	}
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+
+	return o.subs[sid]
+}
+
+// pendingSize is what cmd counts against the pending byte limit.
+func pendingSize(cmd codec.OutboundCommands) int64 {
+	if msg, ok := cmd.(codec.Msg); ok {
+		return int64(len(msg.Payload))
+	}
+	return 0
+}
+
+// trySend queues cmd unless the outbox is closed or over its limits. A MSG
+// for a subscription at its own pending limit is dropped and the client is
+// told once per episode, without touching the rest of the connection. Under
+// the drop policies a MSG that does not fit is dropped or makes room by
+// dropping older MSGs. full is only true when the subscriber is too slow to
+// keep up and should be disconnected.
+func (o *outbox) trySend(cmd codec.OutboundCommands) (queued, full bool) {
+	msg, ok := cmd.(codec.Msg)
+	if !ok {
+		return o.send(cmd)
+	}
+	sp := o.sub(msg.SID)
+	if sp != nil {
+		if !sp.admit(o.maxPerSub) {
+			o.dropForSub(msg.SID, sp)
+			return false, false
+		}
+		msg.Pending = &sp.pending
+	}
+
+	queued, full = o.send(msg)
+	switch {
+	case queued:
+		o.stats.OutMsgs.Add(1)
+		o.stats.OutBytes.Add(int64(len(msg.Payload)))
+	case sp != nil:
+		// The caller releases its own copy, which carries no counter.
+		sp.pending.Add(-1)
+	}
+	return queued, full
+}
+
+// dropForSub counts a MSG dropped for sid and, once per drop episode,
+// queues an async -ERR naming it.
+func (o *outbox) dropForSub(sid int64, sp *subPending) {
+	sp.dropped.Add(1)
+	o.stats.DroppedMsgs.Add(1)
+	if sp.notified.Load() {
+		return
+	}
+
+	notice := codec.Err{Message: fmt.Sprintf("'Slow Consumer: sid %d dropping messages'", sid)}
+	if queued, _ := o.send(notice); queued {
+		sp.notified.Store(true)
+		o.logger.Warn("slow subscription dropping messages",
+			"sid", sid,
+			"max_pending_per_sub", o.maxPerSub,
+			"dropped_total", sp.dropped.Load(),
+		)
+	}
+}
+
+// logDrop counts n MSGs dropped by the connection-wide policy, the first of
+// them for sid, and logs them at most once per dropLogInterval. A flooded
+// connection drops on every MSG, so logging each would swamp the log.
+func (o *outbox) logDrop(sid int64, n int64) {
+	o.unlogged.Add(n)
+	now := time.Now().UnixNano()
+	last := o.lastDropLog.Load()
+	if now-last < int64(dropLogInterval) || !o.lastDropLog.CompareAndSwap(last, now) {
+		return
+	}
+	o.logger.Warn("slow consumer dropping messages",
+		"sid", sid,
+		"policy", o.policy,
+		"dropped", o.unlogged.Swap(0),
+		"pending", len(o.ch),
+		"pending_bytes", o.stats.PendingBytes.Load(),
+	)
+}
+
+// send applies the connection-wide limits and slow-consumer policy.
+func (o *outbox) send(cmd codec.OutboundCommands) (queued, full bool) {
+	size := pendingSize(cmd)
+
+	o.mu.RLock()
+	if o.closed {
+		o.mu.RUnlock()
+		return false, false
+	}
+	if o.fits(size, len(o.ch)) && o.enqueue(cmd, size) {
+		o.mu.RUnlock()
+		return true, false
+	}
+	o.mu.RUnlock()
+
+	msg, isMsg := cmd.(codec.Msg)
+	switch {
+	case o.policy == config.SlowConsumerDropNewest && isMsg:
+		o.stats.DroppedMsgs.Add(1)
+		o.logDrop(msg.SID, 1)
+		return false, false
+	case o.policy == config.SlowConsumerDropOldest:
+		return o.dropOldest(cmd, size)
+	default:
+		return false, true
+	}
+}
+
+// fits reports whether a command of size bytes can join queued others. A
+// single MSG larger than the byte limit is still accepted by an empty queue.
+func (o *outbox) fits(size int64, queued int) bool {
+	if queued >= o.maxMsgs {
+		return false
+	}
+	if o.maxBytes <= 0 || size == 0 {
+		return true
+	}
+	pending := o.stats.PendingBytes.Load()
+	return pending == 0 || pending+size <= o.maxBytes
+}
+
+func (o *outbox) enqueue(cmd codec.OutboundCommands, size int64) bool {
+	o.stats.PendingBytes.Add(size)
+	select {
+	case o.ch <- cmd:
+		return true
+	default:
+		o.stats.PendingBytes.Add(-size)
+		return false
+	}
+}
+
+// dropOldest takes everything still queued, drops MSGs from the front until
+// cmd fits and queues the rest back in order followed by cmd. The write lock
+// keeps other senders out meanwhile; the writer can only take commands from
+// the front, so ordering holds. Non-MSG commands are never dropped.
+func (o *outbox) dropOldest(cmd codec.OutboundCommands, size int64) (queued, full bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.closed {
+		return false, false
+	}
+
+	kept := o.drain()
+	dropped := 0
+	var firstSID int64
+	requeue := kept[:0]
+	for _, c := range kept {
+		if msg, ok := c.(codec.Msg); ok && !o.fits(size, len(kept)-dropped) {
+			if dropped == 0 {
+				firstSID = msg.SID
+			}
+			o.drop(msg)
+			dropped++
+			continue
+		}
+		requeue = append(requeue, c)
+	}
+	for _, c := range requeue {
+		o.ch <- c
+	}
+	o.release(kept)
+	if dropped > 0 {
+		o.logDrop(firstSID, int64(dropped))
+	}
+
+	if !o.fits(size, len(o.ch)) || !o.enqueue(cmd, size) {
+		return false, true
+	}
+	return true, false
+}
+
+func (o *outbox) drop(msg codec.Msg) {
+	o.stats.PendingBytes.Add(-int64(len(msg.Payload)))
+	o.stats.DroppedMsgs.Add(1)
+	msg.Release()
+}
+
+func (o *outbox) close() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if !o.closed {
+		o.closed = true
+		close(o.ch)
+	}
+}
+
+// closeSlow discards the MSGs still queued, queues a Slow Consumer error so
+// the client learns why it is being dropped, and closes the outbox.
+func (o *outbox) closeSlow() {
+	o.closeNow(slowConsumerErr)
+}
+
+// closeNow discards the MSGs still queued, queues errMsg as an -ERR unless
+// it is empty, and closes the outbox. Other queued commands such as +OK stay
+// in order ahead of the error.
+func (o *outbox) closeNow(errMsg string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.closed {
+		return
+	}
+	kept := o.drain()
+	for _, c := range kept {
+		if msg, ok := c.(codec.Msg); ok {
+			o.drop(msg)
+			continue
+		}
+		o.ch <- c
+	}
+	o.release(kept)
+
+	if errMsg != "" {
+		select {
+		case o.ch <- codec.Err{Message: errMsg}:
+		default:
+		}
+	}
+	o.closed = true
+	close(o.ch)
+}
+
+// drain takes every queued command out of the channel into o.kept. The
+// caller must hold the write lock and hand the slice back with release.
+func (o *outbox) drain() []codec.OutboundCommands {
+	kept := o.kept[:0]
+	for {
+		select {
+		case c := <-o.ch:
+			kept = append(kept, c)
+		default:
+			return kept
+		}
+	}
+}
+
+func (o *outbox) release(kept []codec.OutboundCommands) {
+	clear(kept)
+	o.kept = kept[:0]
+}
@@ -0,0 +1,330 @@
+package broker
+
+import (
+	"bytes"
+	"log/slog"
+	"strings"
+	"testing"
+
+	"github.com/elmq0022/pub-sub/internal/codec"
+	"github.com/elmq0022/pub-sub/internal/config"
+	"github.com/elmq0022/pub-sub/internal/stats"
+	"github.com/elmq0022/pub-sub/internal/subjectregistry"
+)
+
+func policyConfig(policy config.SlowConsumerPolicy, maxMsgs, maxBytes int) config.Config {
+	cfg := testConfig()
+	cfg.SlowConsumerPolicy = policy
+	cfg.MaxPendingMsgs = maxMsgs
+	cfg.MaxPendingBytes = maxBytes
+	return cfg
+}
+
+func testMsg(payload string) codec.Msg {
+	return codec.Msg{Subject: []byte("foo"), SID: 1, Payload: []byte(payload)}
+}
+
+func TestOutboxByteLimitReportsFullUnderDisconnect(t *testing.T) {
+	st := &stats.Conn{}
+	box := newOutbox(make(chan codec.OutboundCommands, 8), st, policyConfig(config.SlowConsumerDisconnect, 8, 10))
+
+	if queued, _ := box.trySend(testMsg("123456")); !queued {
+		t.Fatal("expected first MSG to be queued")
+	}
+	queued, full := box.trySend(testMsg("123456"))
+	if queued || !full {
+		t.Fatalf("expected MSG over the byte limit to report full, got queued=%v full=%v", queued, full)
+	}
+	if got := st.PendingBytes.Load(); got != 6 {
+		t.Fatalf("expected 6 pending bytes, got %d", got)
+	}
+}
+
+func TestOutboxAcceptsOversizedMsgWhenEmpty(t *testing.T) {
+	box := newOutbox(make(chan codec.OutboundCommands, 8), nil, policyConfig(config.SlowConsumerDisconnect, 8, 4))
+
+	if queued, full := box.trySend(testMsg("123456")); !queued || full {
+		t.Fatalf("expected oversized MSG to be queued on an empty outbox, got queued=%v full=%v", queued, full)
+	}
+}
+
+func TestOutboxDropNewestCountsDrops(t *testing.T) {
+	st := &stats.Conn{}
+	ch := make(chan codec.OutboundCommands, 2)
+	box := newOutbox(ch, st, policyConfig(config.SlowConsumerDropNewest, 2, 0))
+
+	box.trySend(testMsg("a"))
+	box.trySend(testMsg("b"))
+	queued, full := box.trySend(testMsg("c"))
+	if queued || full {
+		t.Fatalf("expected newest MSG to be dropped, got queued=%v full=%v", queued, full)
+	}
+	if got := st.DroppedMsgs.Load(); got != 1 {
+		t.Fatalf("expected 1 dropped message, got %d", got)
+	}
+	assertPayloads(t, ch, "a", "b")
+}
+
+func TestOutboxDropNewestStillReportsFullForControlCommands(t *testing.T) {
+	box := newOutbox(make(chan codec.OutboundCommands, 1), nil, policyConfig(config.SlowConsumerDropNewest, 1, 0))
+
+	box.trySend(testMsg("a"))
+	if _, full := box.trySend(codec.Ping{}); !full {
+		t.Fatal("expected a PING that does not fit to report full")
+	}
+}
+
+func TestOutboxDropOldestKeepsOrderAndControlCommands(t *testing.T) {
+	st := &stats.Conn{}
+	ch := make(chan codec.OutboundCommands, 3)
+	box := newOutbox(ch, st, policyConfig(config.SlowConsumerDropOldest, 3, 0))
+
+	box.trySend(testMsg("a"))
+	box.trySend(codec.OK{})
+	box.trySend(testMsg("b"))
+	queued, full := box.trySend(testMsg("c"))
+	if !queued || full {
+		t.Fatalf("expected newest MSG to be queued, got queued=%v full=%v", queued, full)
+	}
+	if got := st.DroppedMsgs.Load(); got != 1 {
+		t.Fatalf("expected 1 dropped message, got %d", got)
+	}
+
+	if _, ok := (<-ch).(codec.OK); !ok {
+		t.Fatal("expected +OK to survive drop_oldest")
+	}
+	assertPayloads(t, ch, "b", "c")
+}
+
+func TestOutboxLogsPolicyDropsRateLimited(t *testing.T) {
+	for _, policy := range []config.SlowConsumerPolicy{config.SlowConsumerDropNewest, config.SlowConsumerDropOldest} {
+		var logs bytes.Buffer
+		box := newOutbox(make(chan codec.OutboundCommands, 1), nil, policyConfig(policy, 1, 0))
+		box.logger = slog.New(slog.NewTextHandler(&logs, nil)).With("cid", 7)
+
+		for range 5 {
+			box.trySend(testMsg("x"))
+		}
+		if got := strings.Count(logs.String(), "slow consumer dropping messages"); got != 1 {
+			t.Fatalf("%s: expected one drop log for a burst, got %d:\n%s", policy, got, logs.String())
+		}
+		for _, want := range []string{"cid=7", "sid=1", "policy=" + string(policy), "dropped=1"} {
+			if !strings.Contains(logs.String(), want) {
+				t.Fatalf("%s: expected %q in %s", policy, want, logs.String())
+			}
+		}
+
+		// The next line after the interval counts every drop in between.
+		box.lastDropLog.Add(-int64(dropLogInterval))
+		box.trySend(testMsg("x"))
+		if !strings.Contains(logs.String(), "dropped=4") {
+			t.Fatalf("%s: expected the second log to count 4 drops, got %s", policy, logs.String())
+		}
+	}
+}
+
+func TestOutboxDropOldestFreesBytes(t *testing.T) {
+	st := &stats.Conn{}
+	ch := make(chan codec.OutboundCommands, 8)
+	box := newOutbox(ch, st, policyConfig(config.SlowConsumerDropOldest, 8, 10))
+
+	box.trySend(testMsg("1234"))
+	box.trySend(testMsg("5678"))
+	if queued, _ := box.trySend(testMsg("abcdef")); !queued {
+		t.Fatal("expected MSG to be queued after dropping older ones")
+	}
+	if got := st.PendingBytes.Load(); got != 10 {
+		t.Fatalf("expected 10 pending bytes, got %d", got)
+	}
+	assertPayloads(t, ch, "5678", "abcdef")
+}
+
+func TestSlowConsumerGetsErrBeforeDisconnect(t *testing.T) {
+	registry := subjectregistry.NewSubjectRegistry()
+	b := NewBroker(registry, policyConfig(config.SlowConsumerDisconnect, 2, 0))
+
+	sub := make(chan codec.OutboundCommands, 2)
+	st := &stats.Conn{}
+	b.handleSessionUpEvent(SessionUpEvent{CID: 1, Outbound: sub, Stats: st})
+	connect(t, b, 1)
+	b.handleSessionUpEvent(SessionUpEvent{CID: 2, Outbound: make(chan codec.OutboundCommands, 2)})
+	connect(t, b, 2)
+	b.handleCmdEvent(CmdEvent{CID: 1, Cmd: codec.Sub{Subject: []byte("foo"), SID: 1}})
+
+	for i := 0; i < 2; i++ {
+		b.handleCmdEvent(CmdEvent{CID: 2, Cmd: codec.Pub{Subject: []byte("foo"), Payload: []byte("x")}})
+	}
+
+	if _, ok := b.sessions[1]; ok {
+		t.Fatal("expected slow consumer to be disconnected")
+	}
+	assertOutboundOK(t, sub)
+	assertSlowConsumerErr(t, sub)
+	assertClosed(t, sub)
+	if got := st.DroppedMsgs.Load(); got != 1 {
+		t.Fatalf("expected the queued MSG to be counted as dropped, got %d", got)
+	}
+}
+
+func assertPayloads(t *testing.T, ch chan codec.OutboundCommands, want ...string) {
+	t.Helper()
+
+	for _, payload := range want {
+		msg, ok := readOutbound(t, ch)
+		if !ok {
+			t.Fatalf("expected MSG %q before channel close", payload)
+		}
+		m, ok := msg.(codec.Msg)
+		if !ok || string(m.Payload) != payload {
+			t.Fatalf("expected MSG %q, got %#v", payload, msg)
+		}
+	}
+	if len(ch) != 0 {
+		t.Fatalf("expected no more queued commands, got %d", len(ch))
+	}
+}
+
+func assertSlowConsumerErr(t *testing.T, ch <-chan codec.OutboundCommands) {
+	t.Helper()
+
+	msg, ok := readOutbound(t, ch)
+	if !ok {
+		t.Fatal("expected -ERR before channel close")
+	}
+	if e, ok := msg.(codec.Err); !ok || e.Message != "'Slow Consumer'" {
+		t.Fatalf("expected Slow Consumer error, got %#v", msg)
+	}
+}
+
+func TestSubscriptionOverPendingLimitDropsOnlyItsMessages(t *testing.T) {
+	cfg := policyConfig(config.SlowConsumerDisconnect, 16, 0)
+	cfg.MaxPendingPerSub = 2
+	b := NewBroker(subjectregistry.NewSubjectRegistry(), cfg)
+
+	sub := make(chan codec.OutboundCommands, 16)
+	st := &stats.Conn{}
+	b.handleSessionUpEvent(SessionUpEvent{CID: 1, Outbound: sub, Stats: st})
+	connect(t, b, 1)
+	b.handleSessionUpEvent(SessionUpEvent{CID: 2, Outbound: make(chan codec.OutboundCommands, 16)})
+	connect(t, b, 2)
+	b.handleCmdEvent(CmdEvent{CID: 1, Cmd: codec.Sub{Subject: []byte("firehose"), SID: 1}})
+	b.handleCmdEvent(CmdEvent{CID: 1, Cmd: codec.Sub{Subject: []byte("critical"), SID: 2}})
+	assertOutboundOK(t, sub)
+	assertOutboundOK(t, sub)
+
+	for i := 0; i < 5; i++ {
+		b.handleCmdEvent(CmdEvent{CID: 2, Cmd: codec.Pub{Subject: []byte("firehose"), Payload: []byte("f")}})
+	}
+	b.handleCmdEvent(CmdEvent{CID: 2, Cmd: codec.Pub{Subject: []byte("critical"), Payload: []byte("c")}})
+
+	if _, ok := b.sessions[1]; !ok {
+		t.Fatal("expected session to survive a slow subscription")
+	}
+	if got := st.DroppedMsgs.Load(); got != 3 {
+		t.Fatalf("expected 3 dropped messages, got %d", got)
+	}
+
+	var sids []int64
+	var errs []string
+	for len(sub) > 0 {
+		switch cmd := (<-sub).(type) {
+		case codec.Msg:
+			sids = append(sids, cmd.SID)
+			cmd.Release()
+		case codec.Err:
+			errs = append(errs, cmd.Message)
+		}
+	}
+	if len(sids) != 3 || sids[2] != 2 {
+		t.Fatalf("expected two firehose MSGs then the critical one, got sids %v", sids)
+	}
+	if len(errs) != 1 || errs[0] != "'Slow Consumer: sid 1 dropping messages'" {
+		t.Fatalf("expected one async drop notice, got %q", errs)
+	}
+}
+
+func TestSubscriptionPendingIsFreedWhenMsgsAreReleased(t *testing.T) {
+	cfg := policyConfig(config.SlowConsumerDisconnect, 16, 0)
+	cfg.MaxPendingPerSub = 1
+	ch := make(chan codec.OutboundCommands, 16)
+	box := newOutbox(ch, nil, cfg)
+	box.addSub(1)
+
+	if queued, _ := box.trySend(testMsg("a")); !queued {
+		t.Fatal("expected first MSG to be queued")
+	}
+	if queued, _ := box.trySend(testMsg("b")); queued {
+		t.Fatal("expected MSG over the subscription limit to be dropped")
+	}
+
+	// The writer releases each MSG it writes.
+	(<-ch).(codec.Msg).Release()
+	if _, ok := (<-ch).(codec.Err); !ok {
+		t.Fatal("expected the drop notice to follow the queued MSG")
+	}
+
+	if queued, _ := box.trySend(testMsg("c")); !queued {
+		t.Fatal("expected MSG to be queued once the subscription drained")
+	}
+	if got := box.subs[1].dropped.Load(); got != 1 {
+		t.Fatalf("expected 1 dropped message for the subscription, got %d", got)
+	}
+}
+
+func TestSustainedSubscriptionOverloadSendsOneNotice(t *testing.T) {
+	cfg := policyConfig(config.SlowConsumerDisconnect, 16, 0)
+	cfg.MaxPendingPerSub = 4
+	ch := make(chan codec.OutboundCommands, 16)
+	box := newOutbox(ch, nil, cfg)
+	var logs bytes.Buffer
+	box.logger = slog.New(slog.NewTextHandler(&logs, nil))
+	box.addSub(1)
+
+	// The publisher sends two MSGs for every one the writer gets through,
+	// so the subscription hovers at its limit.
+	notices := 0
+	for i := 0; i < 200; i++ {
+		for range 2 {
+			if queued, full := box.trySend(testMsg("x")); !queued {
+				if full {
+					t.Fatal("expected the connection to stay within its limits")
+				}
+			}
+		}
+		switch cmd := (<-ch).(type) {
+		case codec.Msg:
+			cmd.Release()
+		case codec.Err:
+			notices++
+		}
+	}
+	if notices != 1 {
+		t.Fatalf("expected one drop notice for the whole episode, got %d", notices)
+	}
+	if got := strings.Count(logs.String(), "slow subscription dropping messages"); got != 1 || !strings.Contains(logs.String(), "sid=1") {
+		t.Fatalf("expected one drop log for the whole episode, got %d:\n%s", got, logs.String())
+	}
+
+	// Draining below half the limit ends the episode, so the next drop is
+	// reported again.
+	for len(ch) > 0 {
+		if msg, ok := (<-ch).(codec.Msg); ok {
+			msg.Release()
+		}
+	}
+	for range 5 {
+		box.trySend(testMsg("x"))
+	}
+	notices = 0
+	for len(ch) > 0 {
+		switch cmd := (<-ch).(type) {
+		case codec.Msg:
+			cmd.Release()
+		case codec.Err:
+			notices++
+		}
+	}
+	if notices != 1 {
+		t.Fatalf("expected a new notice for a new episode, got %d", notices)
+	}
+}
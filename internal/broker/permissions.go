@@ -0,0 +1,130 @@
+package broker
+
+import (
+	"crypto/subtle"
+	"strings"
+
+	"github.com/elmq0022/pub-sub/internal/config"
+)
+
+// permissions is a user's config.Permissions with the patterns split into
+// tokens. A nil *permissions allows everything, which is what anonymous and
+// system sessions get.
+type permissions struct {
+	publish   subjectPermission
+	subscribe subjectPermission
+}
+
+type subjectPermission struct {
+	allow [][]string
+	deny  [][]string
+}
+
+func newPermissions(p config.Permissions) *permissions {
+	return &permissions{
+		publish:   newSubjectPermission(p.Publish),
+		subscribe: newSubjectPermission(p.Subscribe),
+	}
+}
+
+func newSubjectPermission(p config.SubjectPermission) subjectPermission {
+	var sp subjectPermission
+	for _, pattern := range p.Allow {
+		sp.allow = append(sp.allow, strings.Split(pattern, "."))
+	}
+	for _, pattern := range p.Deny {
+		sp.deny = append(sp.deny, strings.Split(pattern, "."))
+	}
+	return sp
+}
+
+func (p *permissions) canPublish(subject []byte) bool {
+	return p == nil || p.publish.permits(subject)
+}
+
+func (p *permissions) canSubscribe(subject []byte) bool {
+	return p == nil || p.subscribe.permits(subject)
+}
+
+// permits reports whether every subject that subject can stand for is
+// allowed. A wildcard subscription is denied if it could match any denied
+// subject, so a deny can never be worked around with a wildcard.
+func (p subjectPermission) permits(subject []byte) bool {
+	tokens := strings.Split(string(subject), ".")
+	for _, pattern := range p.deny {
+		if overlaps(pattern, tokens) {
+			return false
+		}
+	}
+	if len(p.allow) == 0 {
+		return true
+	}
+	for _, pattern := range p.allow {
+		if covers(pattern, tokens) {
+			return true
+		}
+	}
+	return false
+}
+
+// covers reports whether every subject matched by subject is also matched
+// by pattern.
+func covers(pattern, subject []string) bool {
+	for i, pt := range pattern {
+		if pt == ">" {
+			return len(subject) > i
+		}
+		if i >= len(subject) || subject[i] == ">" {
+			return false
+		}
+		if pt != "*" && pt != subject[i] {
+			return false
+		}
+	}
+	return len(pattern) == len(subject)
+}
+
+// overlaps reports whether some subject is matched by both a and b.
+func overlaps(a, b []string) bool {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if a[i] == ">" || b[i] == ">" {
+			return true
+		}
+		if a[i] != "*" && b[i] != "*" && a[i] != b[i] {
+			return false
+		}
+	}
+	return len(a) == len(b)
+}
+
+// compilePermissions builds the permissions of every user. Users without
+// any patterns get none, so they pay nothing per command.
+func compilePermissions(users []config.User) map[string]*permissions {
+	perms := make(map[string]*permissions, len(users))
+	for _, u := range users {
+		if isUnrestricted(u.Permissions) {
+			continue
+		}
+		perms[u.User] = newPermissions(u.Permissions)
+	}
+	return perms
+}
+
+func isUnrestricted(p config.Permissions) bool {
+	return len(p.Publish.Allow) == 0 && len(p.Publish.Deny) == 0 &&
+		len(p.Subscribe.Allow) == 0 && len(p.Subscribe.Deny) == 0
+}
+
+// findUser returns the configured user called name.
+func findUser(users []config.User, name string) (config.User, bool) {
+	for _, u := range users {
+		if u.User == name {
+			return u, true
+		}
+	}
+	return config.User{}, false
+}
+
+func passwordMatches(got, want string) bool {
+	return subtle.ConstantTimeCompare([]byte(got), []byte(want)) == 1
+}
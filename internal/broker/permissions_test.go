@@ -0,0 +1,180 @@
+package broker
+
+import (
+	"testing"
+	"time"
+
+	"github.com/elmq0022/pub-sub/internal/codec"
+	"github.com/elmq0022/pub-sub/internal/config"
+	"github.com/elmq0022/pub-sub/internal/subjectregistry"
+)
+
+func usersConfig() config.Config {
+	cfg := systemConfig()
+	cfg.Users = []config.User{
+		{User: "alice", Password: "a"},
+		{User: "bob", Password: "b", Permissions: config.Permissions{
+			Publish:   config.SubjectPermission{Allow: []string{"orders.>"}},
+			Subscribe: config.SubjectPermission{Allow: []string{"orders.*"}, Deny: []string{"orders.secret"}},
+		}},
+	}
+	return cfg
+}
+
+// login connects cid with user and pass and expects +OK.
+func login(t *testing.T, b *Broker, cid int64, user, pass string) chan codec.OutboundCommands {
+	t.Helper()
+
+	outbound := make(chan codec.OutboundCommands, 8)
+	b.handleSessionUpEvent(SessionUpEvent{CID: cid, Outbound: outbound})
+	b.handleCmdEvent(CmdEvent{CID: cid, Cmd: codec.Connect{User: user, Pass: pass}})
+	assertOutboundOK(t, outbound)
+	return outbound
+}
+
+func assertErr(t *testing.T, outbound <-chan codec.OutboundCommands, want string) {
+	t.Helper()
+
+	msg, _ := readOutbound(t, outbound)
+	if e, ok := msg.(codec.Err); !ok || e.Message != want {
+		t.Fatalf("expected -ERR %s, got %#v", want, msg)
+	}
+}
+
+func TestSubjectPermissionPatterns(t *testing.T) {
+	p := newSubjectPermission(config.SubjectPermission{
+		Allow: []string{"orders.*", "events.>"},
+		Deny:  []string{"orders.secret", "events.audit.>"},
+	})
+	tests := []struct {
+		subject string
+		want    bool
+	}{
+		{"orders.new", true},
+		{"orders.*", false}, // could match orders.secret
+		{"orders.secret", false},
+		{"orders.new.x", false},
+		{"events.a.b", true},
+		{"events.>", false}, // could match events.audit.x
+		{"events.audit.x", false},
+		{"events", false},
+		{">", false},
+		{"other", false},
+	}
+	for _, tt := range tests {
+		if got := p.permits([]byte(tt.subject)); got != tt.want {
+			t.Fatalf("permits(%q) = %v, want %v", tt.subject, got, tt.want)
+		}
+	}
+
+	open := newSubjectPermission(config.SubjectPermission{Deny: []string{"a.*"}})
+	if !open.permits([]byte("b.>")) || open.permits([]byte("a.x")) || open.permits([]byte(">")) {
+		t.Fatal("expected an empty allow list to allow everything not denied")
+	}
+}
+
+func TestUsersMustLogIn(t *testing.T) {
+	b := NewBroker(subjectregistry.NewSubjectRegistry(), usersConfig())
+
+	login(t, b, 1, "alice", "a")
+	if b.sessions[1].User != "alice" || b.sessions[1].System {
+		t.Fatalf("unexpected session %+v", b.sessions[1])
+	}
+	login(t, b, 2, "sys", "secret")
+
+	for cid, c := range map[int64]codec.Connect{
+		3: {},
+		4: {User: "alice", Pass: "b"},
+		5: {User: "carol", Pass: "c"},
+	} {
+		outbound := make(chan codec.OutboundCommands, 4)
+		b.handleSessionUpEvent(SessionUpEvent{CID: cid, Outbound: outbound})
+		b.handleCmdEvent(CmdEvent{CID: cid, Cmd: c})
+		assertErr(t, outbound, authorizationErr)
+		assertClosed(t, outbound)
+	}
+}
+
+func TestUserPermissionsLimitSubAndPub(t *testing.T) {
+	b := NewBroker(subjectregistry.NewSubjectRegistry(), usersConfig())
+	bob := login(t, b, 1, "bob", "b")
+
+	b.handleCmdEvent(CmdEvent{CID: 1, Cmd: codec.Sub{Subject: []byte("orders.new"), SID: 1}})
+	assertOutboundOK(t, bob)
+	b.handleCmdEvent(CmdEvent{CID: 1, Cmd: codec.Sub{Subject: []byte("orders.secret"), SID: 2}})
+	assertErr(t, bob, "'Permissions Violation for Subscription to orders.secret'")
+	b.handleCmdEvent(CmdEvent{CID: 1, Cmd: codec.Sub{Subject: []byte("orders.*"), SID: 3}})
+	assertErr(t, bob, "'Permissions Violation for Subscription to orders.*'")
+
+	b.handleCmdEvent(CmdEvent{CID: 1, Cmd: codec.Pub{Subject: []byte("payments.x"), Payload: []byte("x")}})
+	assertErr(t, bob, "'Permissions Violation for Publish to payments.x'")
+	b.handleCmdEvent(CmdEvent{CID: 1, Cmd: codec.Pub{Subject: []byte("orders.new"), Payload: []byte("x")}})
+	if msg, _ := readOutbound(t, bob); msg == nil {
+		t.Fatal("expected the allowed PUB to be delivered")
+	} else if _, ok := msg.(codec.Msg); !ok {
+		t.Fatalf("expected MSG, got %#v", msg)
+	}
+	if b.sessions[1].Subs != 1 {
+		t.Fatalf("expected 1 subscription, got %d", b.sessions[1].Subs)
+	}
+}
+
+func TestParallelPubIsCheckedAgainstUserPermissions(t *testing.T) {
+	cfg := usersConfig()
+	cfg.FanoutWorkers = 2
+	b := NewBroker(subjectregistry.NewSubjectRegistry(), cfg)
+	go b.Run()
+
+	outbound := make(chan codec.OutboundCommands, 4)
+	b.Input() <- SessionUpEvent{CID: 1, Outbound: outbound}
+	apply(b, 1, codec.Connect{User: "bob", Pass: "b"})
+	<-outbound
+	b.PublishInput(1) <- CmdEvent{CID: 1, Cmd: codec.Pub{Subject: []byte("payments.x"), Payload: []byte("x")}}
+
+	select {
+	case msg := <-outbound:
+		if e, ok := msg.(codec.Err); !ok || e.Message != "'Permissions Violation for Publish to payments.x'" {
+			t.Fatalf("expected publish permissions error, got %#v", msg)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for permissions error")
+	}
+}
+
+func TestReloadUsersRevokesLoginsAndSubscriptions(t *testing.T) {
+	registry := subjectregistry.NewSubjectRegistry()
+	b := NewBroker(registry, usersConfig())
+	alice := login(t, b, 1, "alice", "a")
+	bob := login(t, b, 2, "bob", "b")
+	b.handleCmdEvent(CmdEvent{CID: 2, Cmd: codec.Sub{Subject: []byte("orders.new"), SID: 1}})
+	assertOutboundOK(t, bob)
+	b.handleCmdEvent(CmdEvent{CID: 2, Cmd: codec.Sub{Subject: []byte("orders.old"), SID: 2}})
+	assertOutboundOK(t, bob)
+
+	cfg := usersConfig()
+	cfg.Users[0].Password = "rotated"
+	cfg.Users[1].Permissions.Subscribe.Deny = append(cfg.Users[1].Permissions.Subscribe.Deny, "orders.old")
+	b.reload(cfg)
+
+	assertErr(t, alice, authorizationErr)
+	assertClosed(t, alice)
+	assertErr(t, bob, "'Permissions Violation for Subscription to orders.old'")
+	if b.sessions[2].Subs != 1 {
+		t.Fatalf("expected 1 subscription left, got %d", b.sessions[2].Subs)
+	}
+	if subs, _ := registry.Lookup("orders.old"); len(subs) != 0 {
+		t.Fatalf("expected orders.old subscription removed, got %v", subs)
+	}
+	if subs, _ := registry.Lookup("orders.new"); len(subs) != 1 {
+		t.Fatalf("expected orders.new subscription kept, got %v", subs)
+	}
+}
+
+func TestReloadAddingUsersRevokesAnonymousSessions(t *testing.T) {
+	b := NewBroker(subjectregistry.NewSubjectRegistry(), systemConfig())
+	anon := login(t, b, 1, "", "")
+
+	b.reload(usersConfig())
+	assertErr(t, anon, authorizationErr)
+	assertClosed(t, anon)
+}
@@ -0,0 +1,94 @@
+package broker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/elmq0022/pub-sub/internal/codec"
+)
+
+// rttWeight is the weight of the newest sample in the RTT moving average,
+// as 1/rttWeight, the same smoothing TCP uses for its SRTT.
+const rttWeight = 8
+
+// ErrProbeNotSent is returned by ProbeRTT when the PING could not be queued
+// for the client.
+var ErrProbeNotSent = errors.New("ping could not be queued")
+
+// RTTProbe is the result of an RTT probe.
+type RTTProbe struct {
+	CID    int64  `json:"cid"`
+	RTT    string `json:"rtt"`
+	RTTAvg string `json:"rtt_avg"`
+}
+
+// recordRTT stores a PONG's round trip and folds it into the moving average.
+// The first sample starts the average.
+func (s *ClientSession) recordRTT(rtt time.Duration) {
+	s.RTT = rtt
+	if s.RTTAvg == 0 {
+		s.RTTAvg = rtt
+	} else {
+		s.RTTAvg += (rtt - s.RTTAvg) / rttWeight
+	}
+}
+
+// handlePong records the RTT of the outstanding PING, if any, and answers
+// the probes waiting on it.
+func (b *Broker) handlePong(cid int64, session ClientSession) {
+	if session.AwaitingPong {
+		session.recordRTT(time.Since(session.PingSentAt))
+		probe := RTTProbe{CID: cid, RTT: session.RTT.String(), RTTAvg: session.RTTAvg.String()}
+		for _, w := range session.rttWaiters {
+			w <- probe
+		}
+		session.rttWaiters = nil
+	}
+	session.AwaitingPong = false
+	b.sessions[cid] = session
+}
+
+// ProbeRTT pings cid now, instead of waiting for the next heartbeat, and
+// waits for its PONG. If a PING is already outstanding, its PONG answers the
+// probe instead of sending another.
+func (b *Broker) ProbeRTT(ctx context.Context, cid int64) (RTTProbe, error) {
+	reply := make(chan RTTProbe, 1)
+	err, qerr := query(ctx, b.control, func(b *Broker) error {
+		return b.probeRTT(cid, reply)
+	})
+	if qerr != nil {
+		return RTTProbe{}, qerr
+	}
+	if err != nil {
+		return RTTProbe{}, err
+	}
+
+	select {
+	case probe := <-reply:
+		return probe, nil
+	case <-ctx.Done():
+		return RTTProbe{}, ctx.Err()
+	}
+}
+
+// probeRTT registers reply to receive the next PONG from cid, sending a PING
+// unless one is outstanding. Waiters of a session that goes away are dropped
+// with it and their callers give up on their context.
+func (b *Broker) probeRTT(cid int64, reply chan<- RTTProbe) error {
+	session, ok := b.sessions[cid]
+	if !ok {
+		return fmt.Errorf("%w %d", ErrUnknownCID, cid)
+	}
+	if !session.AwaitingPong {
+		if !b.send(cid, session, codec.Ping{}) {
+			return ErrProbeNotSent
+		}
+		session.AwaitingPong = true
+		session.PingSentAt = time.Now()
+	}
+	session.rttWaiters = append(session.rttWaiters, reply)
+	b.sessions[cid] = session
+	return nil
+}
@@ -0,0 +1,138 @@
+package broker
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/elmq0022/pub-sub/internal/codec"
+	"github.com/elmq0022/pub-sub/internal/subjectregistry"
+)
+
+// System event subjects. Only sessions logged in as the system user can
+// subscribe to them, and the broker only delivers them to those sessions.
+const (
+	SysClientConnect    = "$SYS.ACCOUNT.CLIENT.CONNECT"
+	SysClientDisconnect = "$SYS.ACCOUNT.CLIENT.DISCONNECT"
+)
+
+// Reasons a session ended, reported in disconnect events.
+const (
+	ReasonClientClosed     = "Client Closed"
+	ReasonProtocolError    = "Protocol Error"
+	ReasonSlowConsumer     = "Slow Consumer"
+	ReasonHeartbeatTimeout = "Stale Connection"
+	ReasonAuthTimeout      = "Authentication Timeout"
+	ReasonAuthViolation    = "Authorization Violation"
+	ReasonKicked           = "Kicked"
+	ReasonDrained          = "Drained"
+	ReasonRateLimit        = "Rate Limit Exceeded"
+)
+
+// authorizationErr rejects a CONNECT with the system user's name and the
+// wrong password.
+const authorizationErr = "'Authorization Violation'"
+
+var sysPrefix = []byte("$SYS.")
+
+// isSystemSubject reports whether subject is in the reserved $SYS namespace.
+func isSystemSubject(subject []byte) bool {
+	return bytes.HasPrefix(subject, sysPrefix) || string(subject) == "$SYS"
+}
+
+func permissionsErr(op string, subject []byte) string {
+	return fmt.Sprintf("'Permissions Violation for %s to %s'", op, subject)
+}
+
+// ClientEvent is the JSON payload of the $SYS client connect and disconnect
+// events.
+type ClientEvent struct {
+	Type   string    `json:"type"`
+	Time   time.Time `json:"time"`
+	Client ConnInfo  `json:"client"`
+	Reason string    `json:"reason,omitempty"`
+}
+
+// authenticate checks CONNECT credentials against the system user and the
+// configured users, and returns who the session logged in as. Without any
+// users, clients other than the system user connect without credentials.
+func (b *Broker) authenticate(cmd codec.Connect) (system bool, user string, ok bool) {
+	if b.config.SystemUser != "" && cmd.User == b.config.SystemUser {
+		ok = passwordMatches(cmd.Pass, b.config.SystemPassword)
+		return ok, cmd.User, ok
+	}
+	if len(b.config.Users) == 0 {
+		return false, "", true
+	}
+	u, found := findUser(b.config.Users, cmd.User)
+	if !found {
+		return false, "", false
+	}
+	return false, u.User, passwordMatches(cmd.Pass, u.Password)
+}
+
+// systemSubs keeps the subscriptions that belong to system sessions. subs
+// may be shared with the registry cache, so a new slice is returned.
+func (b *Broker) systemSubs(subs []subjectregistry.Sub) []subjectregistry.Sub {
+	var res []subjectregistry.Sub
+	for _, sub := range subs {
+		if b.sessions[sub.CID].System {
+			res = append(res, sub)
+		}
+	}
+	return res
+}
+
+// publishConnect announces a session that has completed CONNECT. Sessions
+// are only announced from then on, because before it they have no name and
+// may never be accepted.
+func (b *Broker) publishConnect(cid int64, session ClientSession) {
+	b.publishSystem(SysClientConnect, ClientEvent{
+		Type:   "client_connect",
+		Time:   time.Now(),
+		Client: session.info(cid),
+	})
+}
+
+// publishDisconnect announces a session that has been removed, if it was
+// ever announced as connected.
+func (b *Broker) publishDisconnect(cid int64, session ClientSession, reason string) {
+	if session.State != StateConnected {
+		return
+	}
+	b.publishSystem(SysClientDisconnect, ClientEvent{
+		Type:   "client_disconnect",
+		Time:   time.Now(),
+		Client: session.info(cid),
+		Reason: reason,
+	})
+}
+
+// publishSystem delivers v as JSON to the sessions subscribed to subject,
+// through the same outboxes as client messages. Only system sessions get
+// it, whether subject is in $SYS or is a request's reply inbox that a
+// regular client could also match with a wildcard.
+func (b *Broker) publishSystem(subject string, v any) {
+	subs, err := b.registry.Lookup(subject)
+	if err != nil {
+		return
+	}
+	subs = b.systemSubs(subs)
+	if len(subs) == 0 {
+		return
+	}
+	payload, err := json.Marshal(v)
+	if err != nil {
+		return
+	}
+
+	pub := codec.Pub{Subject: []byte(subject), Len: int64(len(payload)), Payload: payload}
+	fanout(pub, subs, func(cid int64, msg codec.Msg) bool {
+		sub, ok := b.sessions[cid]
+		if !ok {
+			return false
+		}
+		return b.send(cid, sub, msg)
+	})
+}
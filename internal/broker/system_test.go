@@ -0,0 +1,250 @@
+package broker
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/elmq0022/pub-sub/internal/codec"
+	"github.com/elmq0022/pub-sub/internal/config"
+	"github.com/elmq0022/pub-sub/internal/subjectregistry"
+)
+
+func systemConfig() config.Config {
+	cfg := testConfig()
+	cfg.SystemUser = "sys"
+	cfg.SystemPassword = "secret"
+	return cfg
+}
+
+// systemSession connects cid as the system user subscribed to $SYS.>.
+func systemSession(t *testing.T, b *Broker, cid int64) chan codec.OutboundCommands {
+	t.Helper()
+
+	outbound := make(chan codec.OutboundCommands, 16)
+	b.handleSessionUpEvent(SessionUpEvent{CID: cid, Outbound: outbound})
+	b.handleCmdEvent(CmdEvent{CID: cid, Cmd: codec.Connect{User: "sys", Pass: "secret"}})
+	assertOutboundOK(t, outbound)
+	b.handleCmdEvent(CmdEvent{CID: cid, Cmd: codec.Sub{Subject: []byte("$SYS.>"), SID: 1}})
+	assertOutboundOK(t, outbound)
+	return outbound
+}
+
+func readClientEvent(t *testing.T, outbound <-chan codec.OutboundCommands, subject string) ClientEvent {
+	t.Helper()
+
+	cmd, _ := readOutbound(t, outbound)
+	msg, ok := cmd.(codec.Msg)
+	if !ok || string(msg.Subject) != subject {
+		t.Fatalf("expected MSG on %s, got %#v", subject, cmd)
+	}
+	var ev ClientEvent
+	if err := json.Unmarshal(msg.Payload, &ev); err != nil {
+		t.Fatalf("bad event payload %q: %v", msg.Payload, err)
+	}
+	return ev
+}
+
+func TestSystemSessionReceivesConnectAndDisconnectEvents(t *testing.T) {
+	b := NewBroker(subjectregistry.NewSubjectRegistry(), systemConfig())
+	sys := systemSession(t, b, 1)
+
+	// A regular client with a full wildcard must not see $SYS events.
+	wild := make(chan codec.OutboundCommands, 16)
+	b.handleSessionUpEvent(SessionUpEvent{CID: 2, Outbound: wild})
+	connect(t, b, 2)
+	b.handleCmdEvent(CmdEvent{CID: 2, Cmd: codec.Sub{Subject: []byte(">"), SID: 1}})
+	assertOutboundOK(t, wild)
+
+	ev := readClientEvent(t, sys, SysClientConnect)
+	if ev.Type != "client_connect" || ev.Client.CID != 2 {
+		t.Fatalf("unexpected connect event %+v", ev)
+	}
+
+	outbound := make(chan codec.OutboundCommands, 4)
+	b.handleSessionUpEvent(SessionUpEvent{CID: 3, Outbound: outbound})
+	b.handleCmdEvent(CmdEvent{CID: 3, Cmd: codec.Connect{Name: "orders"}})
+	assertOutboundOK(t, outbound)
+	ev = readClientEvent(t, sys, SysClientConnect)
+	if ev.Client.CID != 3 || ev.Client.Name != "orders" {
+		t.Fatalf("unexpected connect event %+v", ev)
+	}
+
+	b.handleProtocolErrorEvent(ProtocolErrorEvent{CID: 3, Msg: "'Unknown Protocol Operation'"})
+	ev = readClientEvent(t, sys, SysClientDisconnect)
+	if ev.Type != "client_disconnect" || ev.Client.CID != 3 || ev.Reason != ReasonProtocolError {
+		t.Fatalf("unexpected disconnect event %+v", ev)
+	}
+
+	b.handleSessionDownEvent(SessionDownEvent{CID: 2})
+	ev = readClientEvent(t, sys, SysClientDisconnect)
+	if ev.Client.CID != 2 || ev.Reason != ReasonClientClosed {
+		t.Fatalf("unexpected disconnect event %+v", ev)
+	}
+
+	if len(wild) != 0 {
+		t.Fatalf("expected no $SYS events for a regular client, got %d", len(wild))
+	}
+}
+
+func TestRateLimitDisconnectIsNotAProtocolError(t *testing.T) {
+	b := NewBroker(subjectregistry.NewSubjectRegistry(), systemConfig())
+	sys := systemSession(t, b, 1)
+
+	outbound := make(chan codec.OutboundCommands, 4)
+	b.handleSessionUpEvent(SessionUpEvent{CID: 2, Outbound: outbound})
+	connect(t, b, 2)
+	readClientEvent(t, sys, SysClientConnect)
+
+	b.handleRateLimitEvent(RateLimitEvent{CID: 2})
+	msg, _ := readOutbound(t, outbound)
+	if errMsg, ok := msg.(codec.Err); !ok || errMsg.Message != rateLimitErr {
+		t.Fatalf("expected rate limit error, got %#v", msg)
+	}
+	assertClosed(t, outbound)
+
+	ev := readClientEvent(t, sys, SysClientDisconnect)
+	if ev.Client.CID != 2 || ev.Reason != ReasonRateLimit {
+		t.Fatalf("unexpected disconnect event %+v", ev)
+	}
+	if got := b.stats.ProtocolErrors.Load(); got != 0 {
+		t.Fatalf("expected no protocol errors, got %d", got)
+	}
+}
+
+func TestUnconnectedSessionIsNotAnnounced(t *testing.T) {
+	b := NewBroker(subjectregistry.NewSubjectRegistry(), systemConfig())
+	sys := systemSession(t, b, 1)
+
+	outbound := make(chan codec.OutboundCommands, 4)
+	b.handleSessionUpEvent(SessionUpEvent{CID: 2, Outbound: outbound})
+	b.handleAuthTimeoutEvent(AuthTimeoutEvent{CID: 2})
+
+	if len(sys) != 0 {
+		t.Fatalf("expected no events for a session that never connected, got %d", len(sys))
+	}
+}
+
+func TestRegularClientCannotUseSystemSubjects(t *testing.T) {
+	registry := subjectregistry.NewSubjectRegistry()
+	b := NewBroker(registry, systemConfig())
+
+	outbound := make(chan codec.OutboundCommands, 4)
+	b.handleSessionUpEvent(SessionUpEvent{CID: 1, Outbound: outbound})
+	connect(t, b, 1)
+
+	b.handleCmdEvent(CmdEvent{CID: 1, Cmd: codec.Sub{Subject: []byte("$SYS.>"), SID: 1}})
+	msg, _ := readOutbound(t, outbound)
+	if e, ok := msg.(codec.Err); !ok || e.Message != "'Permissions Violation for Subscription to $SYS.>'" {
+		t.Fatalf("expected subscription permissions error, got %#v", msg)
+	}
+	if subs, _ := registry.Lookup("$SYS.ACCOUNT.CLIENT.CONNECT"); len(subs) != 0 {
+		t.Fatalf("expected rejected SUB not to be registered, got %d", len(subs))
+	}
+
+	b.handleCmdEvent(CmdEvent{CID: 1, Cmd: codec.Pub{Subject: []byte(SysClientConnect), Payload: []byte("{}")}})
+	msg, _ = readOutbound(t, outbound)
+	if e, ok := msg.(codec.Err); !ok || e.Message != "'Permissions Violation for Publish to $SYS.ACCOUNT.CLIENT.CONNECT'" {
+		t.Fatalf("expected publish permissions error, got %#v", msg)
+	}
+	if _, ok := b.sessions[1]; !ok {
+		t.Fatal("expected session to stay connected")
+	}
+}
+
+func TestSystemUserWithWrongPasswordIsDisconnected(t *testing.T) {
+	b := NewBroker(subjectregistry.NewSubjectRegistry(), systemConfig())
+
+	outbound := make(chan codec.OutboundCommands, 4)
+	b.handleSessionUpEvent(SessionUpEvent{CID: 1, Outbound: outbound})
+	b.handleCmdEvent(CmdEvent{CID: 1, Cmd: codec.Connect{User: "sys", Pass: "guess"}})
+
+	msg, _ := readOutbound(t, outbound)
+	if e, ok := msg.(codec.Err); !ok || e.Message != authorizationErr {
+		t.Fatalf("expected authorization error, got %#v", msg)
+	}
+	assertClosed(t, outbound)
+}
+
+func TestParallelPubToSystemSubjectIsCheckedByWorker(t *testing.T) {
+	b := NewBroker(subjectregistry.NewSubjectRegistry(), parallelConfig(2))
+	go b.Run()
+
+	pub := sessionUp(b, 1, 4)
+	b.PublishInput(1) <- CmdEvent{CID: 1, Cmd: codec.Pub{Subject: []byte("$SYS.X"), Payload: []byte("x")}}
+
+	select {
+	case msg := <-pub:
+		if e, ok := msg.(codec.Err); !ok || e.Message != "'Permissions Violation for Publish to $SYS.X'" {
+			t.Fatalf("expected publish permissions error, got %#v", msg)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for permissions error")
+	}
+}
+
+func TestParallelSystemPubsKeepPublisherOrder(t *testing.T) {
+	cfg := systemConfig()
+	cfg.FanoutWorkers = 2
+	b := NewBroker(subjectregistry.NewSubjectRegistry(), cfg)
+	go b.Run()
+
+	sys := make(chan codec.OutboundCommands, 512)
+	b.Input() <- SessionUpEvent{CID: 1, Outbound: sys}
+	apply(b, 1, codec.Connect{User: "sys", Pass: "secret"})
+	apply(b, 1, codec.Sub{Subject: []byte(">"), SID: 1})
+	assertOutboundOKWithin(t, sys)
+	assertOutboundOKWithin(t, sys)
+
+	pub := make(chan codec.OutboundCommands, 4)
+	b.Input() <- SessionUpEvent{CID: 2, Outbound: pub}
+	apply(b, 2, codec.Connect{User: "sys", Pass: "secret"})
+	readClientEvent(t, sys, SysClientConnect)
+
+	const n = 200
+	in := b.PublishInput(2)
+	for i := 0; i < n; i++ {
+		subject := []byte("foo")
+		if i%2 == 0 {
+			subject = []byte("$SYS.X")
+		}
+		payload := []byte(strconv.Itoa(i))
+		in <- CmdEvent{CID: 2, Cmd: codec.Pub{Subject: subject, Len: int64(len(payload)), Payload: payload}}
+	}
+
+	for i := 0; i < n; i++ {
+		select {
+		case cmd := <-sys:
+			msg, ok := cmd.(codec.Msg)
+			if !ok {
+				t.Fatalf("expected MSG, got %#v", cmd)
+			}
+			if got, _ := strconv.Atoi(string(msg.Payload)); got != i {
+				t.Fatalf("got message %d on %s, want %d", got, msg.Subject, i)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timed out after %d messages", i)
+		}
+	}
+}
+
+func TestSessionDownIsLoggedWithReason(t *testing.T) {
+	var logs bytes.Buffer
+	b := NewBroker(subjectregistry.NewSubjectRegistry(), testConfig())
+	b.SetLogger(slog.New(slog.NewTextHandler(&logs, nil)))
+
+	outbound := make(chan codec.OutboundCommands, 4)
+	b.handleSessionUpEvent(SessionUpEvent{CID: 4, Outbound: outbound})
+	b.handleProtocolErrorEvent(ProtocolErrorEvent{CID: 4, Msg: "'Unknown Protocol Operation'"})
+
+	got := logs.String()
+	for _, want := range []string{`msg="session up" cid=4`, `msg="session down" cid=4 reason="Protocol Error"`} {
+		if !strings.Contains(got, want) {
+			t.Fatalf("expected %q in log %q", want, got)
+		}
+	}
+}
@@ -0,0 +1,314 @@
+package codec
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Framing selects the wire format of a connection. Every connection starts
+// in FramingText and may switch to FramingBinary through CONNECT.
+type Framing uint8
+
+const (
+	FramingText Framing = iota
+	FramingBinary
+)
+
+// Binary frames start with a one byte opcode followed by the fields of the
+// command. Lengths and SIDs are unsigned varints.
+//
+//	PING, PONG, +OK: <op>
+//	PUB:   <op> <subject len> <subject> <payload len> <payload>
+//	SUB:   <op> <subject len> <subject> <sid>
+//	UNSUB: <op> <sid>
+//	MSG:   <op> <subject len> <subject> <sid> <payload len> <payload>
+//	-ERR:  <op> <message len> <message>
+//
+// PUB and MSG with a reply-to have their own opcodes, with the reply subject
+// before the payload:
+//
+//	PUB:   <op> <subject len> <subject> <reply len> <reply> <payload len> <payload>
+//	MSG:   <op> <subject len> <subject> <sid> <reply len> <reply> <payload len> <payload>
+const (
+	opPing byte = iota + 1
+	opPong
+	opPub
+	opSub
+	opUnsub
+	opMsg
+	opOK
+	opErr
+	opPubReply
+	opMsgReply
+)
+
+// msgOp is the MSG opcode for a message with the given reply-to.
+func msgOp(reply []byte) byte {
+	if len(reply) > 0 {
+		return opMsgReply
+	}
+	return opMsg
+}
+
+const maxSubjectBytes = 4096
+
+func (c *Codec) decodeBinary() (InboundCommands, error) {
+	op, err := c.brw.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+
+	switch op {
+	case opPing:
+		return Ping{}, nil
+	case opPong:
+		return Pong{}, nil
+	case opPub, opPubReply:
+		subject, err := c.readBinarySubject(false)
+		if err != nil {
+			return nil, err
+		}
+		var reply []byte
+		if op == opPubReply {
+			if reply, err = c.readBinaryReply(); err != nil {
+				return nil, err
+			}
+		}
+		size, err := binary.ReadUvarint(c.brw)
+		if err != nil {
+			return nil, eofOr(err, "bad payload")
+		}
+		if size > uint64(c.maxPayload) {
+			return nil, ErrMaxPayload
+		}
+		buf, err := c.readPayload(int64(size))
+		if err != nil {
+			return nil, err
+		}
+		payload := buf.bytes()
+		if payload == nil {
+			payload = []byte{}
+		}
+		return Pub{
+			Subject: subject,
+			Reply:   reply,
+			Len:     int64(size),
+			Payload: payload,
+			Buffer:  buf,
+		}, nil
+	case opSub:
+		subject, err := c.readBinarySubject(true)
+		if err != nil {
+			return nil, err
+		}
+		sid, err := c.readBinarySID()
+		if err != nil {
+			return nil, err
+		}
+		return Sub{Subject: subject, SID: sid}, nil
+	case opUnsub:
+		sid, err := c.readBinarySID()
+		if err != nil {
+			return nil, err
+		}
+		return Unsub{SID: sid}, nil
+	default:
+		return nil, fmt.Errorf("bad opcode %d", op)
+	}
+}
+
+func (c *Codec) readBinarySubject(wildcards bool) ([]byte, error) {
+	n, err := binary.ReadUvarint(c.brw)
+	if err != nil {
+		return nil, eofOr(err, "bad subject")
+	}
+	if n == 0 || n > maxSubjectBytes {
+		return nil, errors.New("bad subject")
+	}
+	if n > uint64(c.maxControlLine) {
+		return nil, ErrMaxControlLine
+	}
+	// c.ss.Subject only ever holds scratch space, never an interned slice.
+	scratch := c.ss.Subject[:0]
+	if cap(scratch) < int(n) {
+		scratch = make([]byte, 0, n)
+	}
+	scratch = scratch[:n]
+	c.ss.Subject = scratch
+	if _, err := io.ReadFull(c.brw, scratch); err != nil {
+		return nil, err
+	}
+	if !validSubject(scratch, wildcards) {
+		return nil, errors.New("bad subject")
+	}
+	return c.intern(scratch), nil
+}
+
+// readBinaryReply reads a reply subject into its own slice, since the
+// subject scratch space already holds the PUB subject.
+func (c *Codec) readBinaryReply() ([]byte, error) {
+	n, err := binary.ReadUvarint(c.brw)
+	if err != nil {
+		return nil, eofOr(err, "bad reply subject")
+	}
+	if n == 0 || n > maxSubjectBytes {
+		return nil, errors.New("bad reply subject")
+	}
+	if n > uint64(c.maxControlLine) {
+		return nil, ErrMaxControlLine
+	}
+	reply := make([]byte, n)
+	if _, err := io.ReadFull(c.brw, reply); err != nil {
+		return nil, err
+	}
+	if !validSubject(reply, false) {
+		return nil, errors.New("bad reply subject")
+	}
+	return reply, nil
+}
+
+func (c *Codec) readBinarySID() (int64, error) {
+	sid, err := binary.ReadUvarint(c.brw)
+	if err != nil {
+		return 0, eofOr(err, "bad sid")
+	}
+	if sid > 1<<63-1 {
+		return 0, errors.New("bad sid")
+	}
+	return int64(sid), nil
+}
+
+// eofOr keeps EOF errors intact so readers can tell a closed connection from
+// a malformed frame, and replaces anything else with a protocol error.
+func eofOr(err error, msg string) error {
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return err
+	}
+	return errors.New(msg)
+}
+
+// validSubject applies the same token rules as the text transition table:
+// dot separated, non-empty tokens of letters, digits and '$', '_' or '-',
+// with '*' as a whole token and '>' as the last token when wildcards are
+// allowed.
+func validSubject(subject []byte, wildcards bool) bool {
+	tokenStart := 0
+	for i := 0; i <= len(subject); i++ {
+		if i < len(subject) && subject[i] != '.' {
+			continue
+		}
+		token := subject[tokenStart:i]
+		if len(token) == 0 {
+			return false
+		}
+		if len(token) == 1 && (token[0] == '*' || token[0] == '>') {
+			if !wildcards || (token[0] == '>' && i != len(subject)) {
+				return false
+			}
+		} else {
+			for _, b := range token {
+				if !isTokenChar(b) {
+					return false
+				}
+			}
+		}
+		tokenStart = i + 1
+	}
+	return true
+}
+
+func isTokenChar(b byte) bool {
+	return (b >= '0' && b <= '9') || (b >= 'a' && b <= 'z') || (b >= 'A' && b <= 'Z') ||
+		b == '$' || b == '_' || b == '-'
+}
+
+// Encoder writes outbound commands using the connection's current framing.
+// It is owned by the writer loop.
+type Encoder struct {
+	w       *bufio.Writer
+	framing Framing
+	scratch [20]byte
+}
+
+func NewEncoder(w *bufio.Writer) *Encoder {
+	return &Encoder{w: w}
+}
+
+func (e *Encoder) Framing() Framing {
+	return e.framing
+}
+
+func (e *Encoder) Encode(cmd OutboundCommands) error {
+	if sw, ok := cmd.(SwitchFraming); ok {
+		e.framing = sw.Framing
+		return nil
+	}
+	if e.framing == FramingBinary {
+		return e.encodeBinary(cmd)
+	}
+	return cmd.EncodeTo(e.w)
+}
+
+func (e *Encoder) encodeBinary(cmd OutboundCommands) error {
+	if e.w == nil {
+		return errors.New("nil writer")
+	}
+
+	switch cmd := cmd.(type) {
+	case Ping:
+		return e.w.WriteByte(opPing)
+	case Pong:
+		return e.w.WriteByte(opPong)
+	case OK:
+		return e.w.WriteByte(opOK)
+	case Err:
+		if err := e.w.WriteByte(opErr); err != nil {
+			return err
+		}
+		return e.writeBytes([]byte(cmd.Message))
+	case Msg:
+		if len(cmd.Subject) == 0 {
+			return errors.New("empty subject")
+		}
+		if cmd.SID < 0 {
+			return errors.New("invalid sid")
+		}
+		if cmd.Frame != nil {
+			return writeFrame(e.w, cmd.Frame, FramingBinary, cmd.SID)
+		}
+		if err := e.w.WriteByte(msgOp(cmd.Reply)); err != nil {
+			return err
+		}
+		if err := e.writeBytes(cmd.Subject); err != nil {
+			return err
+		}
+		if err := e.writeUvarint(uint64(cmd.SID)); err != nil {
+			return err
+		}
+		if len(cmd.Reply) > 0 {
+			if err := e.writeBytes(cmd.Reply); err != nil {
+				return err
+			}
+		}
+		return e.writeBytes(cmd.Payload)
+	default:
+		return fmt.Errorf("no binary encoding for kind %d", cmd.Kind())
+	}
+}
+
+func (e *Encoder) writeUvarint(v uint64) error {
+	n := binary.PutUvarint(e.scratch[:], v)
+	_, err := e.w.Write(e.scratch[:n])
+	return err
+}
+
+func (e *Encoder) writeBytes(b []byte) error {
+	if err := e.writeUvarint(uint64(len(b))); err != nil {
+		return err
+	}
+	_, err := e.w.Write(b)
+	return err
+}
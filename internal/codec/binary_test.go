@@ -0,0 +1,259 @@
+package codec
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// binaryFrame builds a client-side binary frame for tests and benchmarks.
+func binaryFrame(op byte, fields ...any) []byte {
+	out := []byte{op}
+	for _, f := range fields {
+		switch v := f.(type) {
+		case string:
+			out = binary.AppendUvarint(out, uint64(len(v)))
+			out = append(out, v...)
+		case []byte:
+			out = binary.AppendUvarint(out, uint64(len(v)))
+			out = append(out, v...)
+		case int64:
+			out = binary.AppendUvarint(out, uint64(v))
+		}
+	}
+	return out
+}
+
+func newBinaryCodec(t testing.TB, input []byte) *Codec {
+	t.Helper()
+	c, err := NewCodec(bytes.NewBuffer(input))
+	require.NoError(t, err)
+	c.framing = FramingBinary
+	return c
+}
+
+func TestCodecDecodeBinarySuccess(t *testing.T) {
+	tests := []struct {
+		name  string
+		input []byte
+		want  Command
+	}{
+		{name: "ping", input: binaryFrame(opPing), want: Ping{}},
+		{name: "pong", input: binaryFrame(opPong), want: Pong{}},
+		{name: "pub", input: binaryFrame(opPub, "foo.bar", "hello"), want: Pub{Subject: []byte("foo.bar"), Len: 5, Payload: []byte("hello")}},
+		{name: "pub empty payload", input: binaryFrame(opPub, "foo", ""), want: Pub{Subject: []byte("foo"), Len: 0, Payload: []byte{}}},
+		{name: "pub binary payload", input: binaryFrame(opPub, "foo", []byte("a\r\nb\x00")), want: Pub{Subject: []byte("foo"), Len: 5, Payload: []byte("a\r\nb\x00")}},
+		{name: "pub with reply", input: binaryFrame(opPubReply, "$SYS.REQ.SERVER.PING", "_INBOX.a-1", "{}"), want: Pub{Subject: []byte("$SYS.REQ.SERVER.PING"), Reply: []byte("_INBOX.a-1"), Len: 2, Payload: []byte("{}")}},
+		{name: "sub", input: binaryFrame(opSub, "foo.*.>", int64(300)), want: Sub{Subject: []byte("foo.*.>"), SID: 300}},
+		{name: "unsub", input: binaryFrame(opUnsub, int64(9001)), want: Unsub{SID: 9001}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := newBinaryCodec(t, tt.input).Decode()
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, withoutBuffer(got))
+		})
+	}
+}
+
+func TestCodecDecodeBinaryErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   []byte
+		errText string
+	}{
+		{name: "unknown opcode", input: []byte{0xFF}, errText: "bad opcode"},
+		{name: "connect not allowed", input: []byte{0}, errText: "bad opcode"},
+		{name: "empty subject", input: binaryFrame(opPub, "", "x"), errText: "bad subject"},
+		{name: "wildcard in pub", input: binaryFrame(opPub, "foo.*", "x"), errText: "bad subject"},
+		{name: "gt not terminal", input: binaryFrame(opSub, "foo.>.bar", int64(1)), errText: "bad subject"},
+		{name: "wildcard in reply", input: binaryFrame(opPubReply, "foo", "_INBOX.*", "x"), errText: "bad reply subject"},
+		{name: "empty reply", input: binaryFrame(opPubReply, "foo", "", "x"), errText: "bad reply subject"},
+		{name: "empty token", input: binaryFrame(opSub, "foo..bar", int64(1)), errText: "bad subject"},
+		{name: "subject too long", input: binaryFrame(opSub, string(bytes.Repeat([]byte("a"), maxSubjectBytes+1)), int64(1)), errText: "bad subject"},
+		{name: "payload too large", input: append(binaryFrame(opPub, "foo"), binary.AppendUvarint(nil, uint64(DefaultMaxPayload)+1)...), errText: "payload too large"},
+		{name: "sid overflow", input: append([]byte{opUnsub}, binary.AppendUvarint(nil, 1<<63)...), errText: "bad sid"},
+		{name: "short payload", input: binaryFrame(opPub, "foo", "hello")[:8], errText: "EOF"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := newBinaryCodec(t, tt.input).Decode()
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), tt.errText)
+		})
+	}
+}
+
+func TestCodecDecodeSwitchesToBinaryAfterConnect(t *testing.T) {
+	input := []byte("CONNECT {\"name\":\"svc\",\"binary\":true}\r\n")
+	input = append(input, binaryFrame(opPub, "foo", "hi")...)
+	input = append(input, binaryFrame(opPing)...)
+
+	c, err := NewCodec(bytes.NewBuffer(input))
+	require.NoError(t, err)
+
+	got, err := c.Decode()
+	require.NoError(t, err)
+	assert.Equal(t, Connect{Name: "svc", Binary: true}, got)
+
+	got, err = c.Decode()
+	require.NoError(t, err)
+	assert.Equal(t, Pub{Subject: []byte("foo"), Len: 2, Payload: []byte("hi")}, withoutBuffer(got))
+
+	got, err = c.Decode()
+	require.NoError(t, err)
+	assert.Equal(t, Ping{}, got)
+
+	_, err = c.Decode()
+	assert.True(t, errors.Is(err, io.EOF))
+}
+
+func TestEncoderBinaryWireFormat(t *testing.T) {
+	tests := []struct {
+		name string
+		cmd  OutboundCommands
+		want []byte
+	}{
+		{name: "ping", cmd: Ping{}, want: []byte{opPing}},
+		{name: "pong", cmd: Pong{}, want: []byte{opPong}},
+		{name: "ok", cmd: OK{}, want: []byte{opOK}},
+		{name: "err", cmd: Err{Message: "boom"}, want: binaryFrame(opErr, "boom")},
+		{
+			name: "msg",
+			cmd:  Msg{Subject: []byte("foo.bar"), SID: 300, Payload: []byte("hello")},
+			want: binaryFrame(opMsg, "foo.bar", int64(300), "hello"),
+		},
+		{
+			name: "msg with reply",
+			cmd:  Msg{Subject: []byte("foo.bar"), Reply: []byte("_INBOX.1"), SID: 300, Payload: []byte("hello")},
+			want: binaryFrame(opMsgReply, "foo.bar", int64(300), "_INBOX.1", "hello"),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			w := bufio.NewWriter(&out)
+			enc := NewEncoder(w)
+			require.NoError(t, enc.Encode(SwitchFraming{Framing: FramingBinary}))
+
+			require.NoError(t, enc.Encode(tt.cmd))
+			require.NoError(t, w.Flush())
+			assert.Equal(t, tt.want, out.Bytes())
+		})
+	}
+}
+
+func TestEncoderSwitchFramingMidStream(t *testing.T) {
+	var out bytes.Buffer
+	w := bufio.NewWriter(&out)
+	enc := NewEncoder(w)
+
+	require.NoError(t, enc.Encode(OK{}))
+	require.NoError(t, enc.Encode(SwitchFraming{Framing: FramingBinary}))
+	assert.Equal(t, FramingBinary, enc.Framing())
+	require.NoError(t, enc.Encode(Ping{}))
+	require.NoError(t, w.Flush())
+
+	assert.Equal(t, append([]byte("+OK\r\n"), opPing), out.Bytes())
+}
+
+func TestEncoderBinaryMsgErrors(t *testing.T) {
+	enc := NewEncoder(bufio.NewWriter(io.Discard))
+	require.NoError(t, enc.Encode(SwitchFraming{Framing: FramingBinary}))
+
+	assert.Error(t, enc.Encode(Msg{SID: 1}))
+	assert.Error(t, enc.Encode(Msg{Subject: []byte("foo"), SID: -1}))
+}
+
+func BenchmarkCodecDecodeFraming(b *testing.B) {
+	payload1k := bytes.Repeat([]byte("x"), 1024)
+	benchmarks := []struct {
+		name   string
+		text   []byte
+		binary []byte
+	}{
+		{
+			name:   "sub",
+			text:   []byte("SUB foo.bar 42\r\n"),
+			binary: binaryFrame(opSub, "foo.bar", int64(42)),
+		},
+		{
+			name:   "pub_small",
+			text:   []byte("PUB foo.bar 5\r\nhello\r\n"),
+			binary: binaryFrame(opPub, "foo.bar", "hello"),
+		},
+		{
+			name:   "pub_1k",
+			text:   append(append([]byte("PUB foo.bar 1024\r\n"), payload1k...), "\r\n"...),
+			binary: binaryFrame(opPub, "foo.bar", payload1k),
+		},
+	}
+
+	for _, bm := range benchmarks {
+		for _, framing := range []struct {
+			name  string
+			frame []byte
+			mode  Framing
+		}{
+			{name: "text", frame: bm.text, mode: FramingText},
+			{name: "binary", frame: bm.binary, mode: FramingBinary},
+		} {
+			b.Run(fmt.Sprintf("%s/%s", bm.name, framing.name), func(b *testing.B) {
+				stream := bytes.Repeat(framing.frame, b.N)
+				c, err := NewCodec(bytes.NewBuffer(stream))
+				if err != nil {
+					b.Fatalf("NewCodec() error: %v", err)
+				}
+				c.framing = framing.mode
+
+				b.SetBytes(int64(len(framing.frame)))
+				b.ReportAllocs()
+				b.ResetTimer()
+
+				for i := 0; i < b.N; i++ {
+					cmd, err := c.Decode()
+					if err != nil {
+						b.Fatalf("Decode() error at iteration %d: %v", i, err)
+					}
+					releasePub(cmd)
+				}
+			})
+		}
+	}
+}
+
+func BenchmarkEncoderMsgFraming(b *testing.B) {
+	msg := Msg{Subject: []byte("foo.bar"), SID: 42, Payload: bytes.Repeat([]byte("x"), 128)}
+
+	for _, framing := range []struct {
+		name string
+		mode Framing
+	}{
+		{name: "text", mode: FramingText},
+		{name: "binary", mode: FramingBinary},
+	} {
+		b.Run(framing.name, func(b *testing.B) {
+			enc := NewEncoder(bufio.NewWriter(io.Discard))
+			_ = enc.Encode(SwitchFraming{Framing: framing.mode})
+
+			b.ReportAllocs()
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				if err := enc.Encode(msg); err != nil {
+					b.Fatalf("Encode() error: %v", err)
+				}
+			}
+		})
+	}
+}
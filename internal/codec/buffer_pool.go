@@ -0,0 +1,100 @@
+package codec
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// Buffer is a reference counted payload buffer taken from a size-classed
+// pool. The reader holds the first reference; the broker retains one per
+// delivered Msg and every holder calls Release once it is done with the bytes.
+// The last Release returns the buffer to its pool.
+//
+// A nil *Buffer is valid and all methods are no-ops, so payloads that did not
+// come from the pool need no special casing.
+type Buffer struct {
+	B     []byte
+	refs  atomic.Int32
+	class int
+}
+
+// bufferClasses are the pooled capacities. Payloads larger than the last
+// class get a one-off buffer that is left to the garbage collector.
+var bufferClasses = [...]int{
+	256,
+	1 << 10,
+	4 << 10,
+	16 << 10,
+	64 << 10,
+	256 << 10,
+	1 << 20,
+	4 << 20,
+	8 << 20,
+}
+
+var bufferPools [len(bufferClasses)]sync.Pool
+
+func init() {
+	for i, size := range bufferClasses {
+		bufferPools[i].New = func() any {
+			return &Buffer{B: make([]byte, size), class: i}
+		}
+	}
+}
+
+// getBuffer returns a buffer with one reference whose B has length n.
+func getBuffer(n int) *Buffer {
+	for i, size := range bufferClasses {
+		if n <= size {
+			buf := bufferPools[i].Get().(*Buffer)
+			buf.B = buf.B[:n]
+			buf.refs.Store(1)
+			return buf
+		}
+	}
+
+	buf := &Buffer{B: make([]byte, n), class: -1}
+	buf.refs.Store(1)
+	return buf
+}
+
+// bytes returns the payload, or nil for a nil buffer.
+func (b *Buffer) bytes() []byte {
+	if b == nil {
+		return nil
+	}
+	return b.B
+}
+
+// Refs reports the number of outstanding references.
+func (b *Buffer) Refs() int32 {
+	if b == nil {
+		return 0
+	}
+	return b.refs.Load()
+}
+
+func (b *Buffer) Retain() {
+	if b == nil {
+		return
+	}
+	b.refs.Add(1)
+}
+
+func (b *Buffer) Release() {
+	if b == nil {
+		return
+	}
+	refs := b.refs.Add(-1)
+	if refs > 0 {
+		return
+	}
+	if refs < 0 {
+		panic("codec: payload buffer released too many times")
+	}
+	if b.class < 0 {
+		return
+	}
+	b.B = b.B[:cap(b.B)]
+	bufferPools[b.class].Put(b)
+}
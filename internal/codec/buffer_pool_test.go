@@ -0,0 +1,117 @@
+package codec
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetBufferPicksSizeClass(t *testing.T) {
+	tests := []struct {
+		name      string
+		n         int
+		wantClass int
+		wantCap   int
+	}{
+		{name: "tiny", n: 1, wantClass: 0, wantCap: 256},
+		{name: "class boundary", n: 256, wantClass: 0, wantCap: 256},
+		{name: "next class", n: 257, wantClass: 1, wantCap: 1024},
+		{name: "max payload", n: int(DefaultMaxPayload), wantClass: len(bufferClasses) - 1, wantCap: int(DefaultMaxPayload)},
+		{name: "oversized", n: int(DefaultMaxPayload) + 1, wantClass: -1, wantCap: int(DefaultMaxPayload) + 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buf := getBuffer(tt.n)
+			defer buf.Release()
+
+			assert.Len(t, buf.B, tt.n)
+			assert.Equal(t, tt.wantClass, buf.class)
+			assert.Equal(t, tt.wantCap, cap(buf.B))
+		})
+	}
+}
+
+func TestBufferReleaseReturnsToPoolAfterLastReference(t *testing.T) {
+	buf := getBuffer(10)
+	buf.Retain()
+	buf.Retain()
+
+	buf.Release()
+	buf.Release()
+	assert.Equal(t, int32(1), buf.refs.Load())
+
+	buf.Release()
+	assert.Equal(t, int32(0), buf.refs.Load())
+	assert.Len(t, buf.B, cap(buf.B), "released buffer should be restored to full capacity")
+}
+
+func TestBufferReleaseTooManyTimesPanics(t *testing.T) {
+	buf := getBuffer(10)
+	buf.Release()
+	require.Panics(t, func() { buf.Release() })
+}
+
+func TestNilBufferIsNoop(t *testing.T) {
+	var buf *Buffer
+	assert.NotPanics(t, func() {
+		buf.Retain()
+		buf.Release()
+	})
+	assert.Nil(t, buf.bytes())
+}
+
+func TestCodecInternsSubjects(t *testing.T) {
+	c := newBinaryCodec(t, nil)
+	c.framing = FramingText
+	first := c.intern([]byte("foo.bar"))
+	second := c.intern([]byte("foo.bar"))
+	assert.Same(t, &first[0], &second[0])
+}
+
+func TestCodecInternTableIsBounded(t *testing.T) {
+	c := newBinaryCodec(t, nil)
+	for i := 0; i < maxInternedSubjects+10; i++ {
+		c.intern([]byte{byte(i), byte(i >> 8), byte(i >> 16)})
+	}
+	assert.Len(t, c.subjects, maxInternedSubjects)
+}
+
+func TestCodecDecodedSubjectsSurviveLaterCommands(t *testing.T) {
+	input := "PUB foo 1\r\na\r\nSUB bar 1\r\nPUB bar 1\r\nb\r\nPUB foo 1\r\nc\r\nCONNECT {\"binary\":true}\r\n"
+	stream := append([]byte(input),
+		binaryFrame(opPub, "foo", "d")...)
+	stream = append(stream, binaryFrame(opSub, "baz.qux", int64(2))...)
+	stream = append(stream, binaryFrame(opPub, "foo", "e")...)
+
+	c, err := NewCodec(bytes.NewBuffer(stream))
+	require.NoError(t, err)
+
+	var subjects [][]byte
+	for {
+		cmd, err := c.Decode()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		require.NoError(t, err)
+		switch cmd := cmd.(type) {
+		case Pub:
+			subjects = append(subjects, cmd.Subject)
+			releasePub(cmd)
+		case Sub:
+			subjects = append(subjects, cmd.Subject)
+		}
+	}
+
+	want := []string{"foo", "bar", "bar", "foo", "foo", "baz.qux", "foo"}
+	require.Len(t, subjects, len(want))
+	for i, s := range subjects {
+		assert.Equal(t, want[i], string(s), "subject %d", i)
+	}
+	assert.Equal(t, "foo", string(c.intern([]byte("foo"))))
+	assert.Equal(t, "bar", string(c.intern([]byte("bar"))))
+}
@@ -2,15 +2,48 @@ package codec
 
 import (
 	"bufio"
+	"bytes"
+	"encoding/json"
 	"errors"
 	"io"
 )
 
 type Codec struct {
-	brw *bufio.ReadWriter
+	brw      *bufio.ReadWriter
+	framing  Framing
+	ss       scratchSpace
+	subjects map[string][]byte
+
+	maxPayload     int64
+	maxControlLine int
+}
+
+const (
+	// DefaultMaxPayload is the largest PUB payload accepted unless
+	// SetMaxPayload says otherwise.
+	DefaultMaxPayload int64 = 8 * 1024 * 1024
+	// DefaultMaxControlLine bounds a text command line, excluding the payload.
+	DefaultMaxControlLine = 4096
+)
+
+var (
+	ErrMaxPayload     = errors.New("payload too large")
+	ErrMaxControlLine = errors.New("control line too long")
+)
+
+// ParseError is returned for a text command line that does not parse. Line
+// holds the bytes read so far, ending with the offending byte.
+type ParseError struct {
+	Line []byte
 }
 
-const maxPayloadBytes int64 = 8 * 1024 * 1024
+func (e *ParseError) Error() string {
+	return "bad parse"
+}
+
+// maxInternedSubjects bounds the per-connection subject table. Once it is
+// full, new subjects are copied instead of interned.
+const maxInternedSubjects = 4096
 
 func NewCodec(rw io.ReadWriter) (*Codec, error) {
 	if rw == nil {
@@ -25,36 +58,130 @@ func NewCodec(rw io.ReadWriter) (*Codec, error) {
 		)
 	}
 	return &Codec{
-		brw: brw,
+		brw:            brw,
+		subjects:       make(map[string][]byte),
+		maxPayload:     DefaultMaxPayload,
+		maxControlLine: DefaultMaxControlLine,
 	}, nil
 }
 
+// SetMaxPayload changes the largest accepted PUB payload. Zero or less keeps
+// the current limit.
+func (c *Codec) SetMaxPayload(n int64) {
+	if n > 0 {
+		c.maxPayload = n
+	}
+}
+
+// SetMaxControlLine changes the longest accepted command line, and the
+// longest subject in binary framing. Zero or less keeps the current limit.
+func (c *Codec) SetMaxControlLine(n int) {
+	if n > 0 {
+		c.maxControlLine = n
+	}
+}
+
 type scratchSpace struct {
 	Kind    Kind
 	Subject []byte
+	Reply   []byte
 	SID     []byte
 	Msg     []byte
 	nBytes  []byte
+	Options []byte
+	buf     *Buffer
+	// line is the raw command line, kept to report parse errors.
+	line []byte
+}
+
+func (ss *scratchSpace) reset() {
+	ss.Kind = 0
+	ss.Subject = ss.Subject[:0]
+	ss.Reply = ss.Reply[:0]
+	ss.SID = ss.SID[:0]
+	ss.Msg = nil
+	ss.nBytes = ss.nBytes[:0]
+	ss.Options = ss.Options[:0]
+	ss.buf = nil
+	ss.line = ss.line[:0]
+}
+
+// intern returns a shared immutable copy of subject. Scratch space is reused
+// between commands, so decoded subjects must never alias it, and the result
+// must never be stored back into the scratch space.
+func (c *Codec) intern(subject []byte) []byte {
+	if s, ok := c.subjects[string(subject)]; ok {
+		return s
+	}
+	s := append([]byte(nil), subject...)
+	if len(c.subjects) < maxInternedSubjects {
+		c.subjects[string(s)] = s
+	}
+	return s
+}
+
+// readPayload reads size bytes into a pooled buffer.
+func (c *Codec) readPayload(size int64) (*Buffer, error) {
+	if size == 0 {
+		return nil, nil
+	}
+	buf := getBuffer(int(size))
+	if _, err := io.ReadFull(c.brw, buf.B); err != nil {
+		buf.Release()
+		return nil, err
+	}
+	return buf, nil
 }
 
+// Decode reads the next inbound command. A CONNECT asking for binary framing
+// switches the codec so every following command is decoded as a binary frame.
 func (c *Codec) Decode() (InboundCommands, error) {
-	ss := scratchSpace{}
+	if c.framing == FramingBinary {
+		return c.decodeBinary()
+	}
+
+	ss := &c.ss
+	ss.reset()
+
+	cmd, err := c.decodeText(ss)
+	if err != nil {
+		ss.buf.Release()
+	}
+	return cmd, err
+}
 
+func (c *Codec) decodeText(ss *scratchSpace) (InboundCommands, error) {
 	state := ST_START
+	line := 0
 	for {
 		b, err := c.brw.ReadByte()
 		if err != nil {
 			return nil, err
 		}
+		if line++; line > c.maxControlLine {
+			return nil, ErrMaxControlLine
+		}
 
+		ss.line = append(ss.line, b)
 		state = transitionTable[state][b]
 
 		switch state {
 		case ST_ERROR:
-			return nil, errors.New("bad parse")
+			return nil, &ParseError{Line: bytes.Clone(ss.line)}
 		case ST_DONE:
-			cmd, err := createCmd(ss)
+			// The command gets the interned subject; ss keeps its own
+			// buffer, which the next command overwrites.
+			parsed := *ss
+			if len(ss.Subject) > 0 {
+				parsed.Subject = c.intern(ss.Subject)
+			}
+			cmd, err := createCmd(parsed)
+			if connect, ok := cmd.(Connect); ok && connect.Binary {
+				c.framing = FramingBinary
+			}
 			return cmd, err
+		case ST_CONNECT_LBRACE, ST_CONNECT_OPTS, ST_CONNECT_RBRACE:
+			ss.Options = append(ss.Options, b)
 		case ST_CMD_CONNECT:
 			ss.Kind = KindConnect
 		case ST_CMD_PING:
@@ -74,25 +201,29 @@ func (c *Codec) Decode() (InboundCommands, error) {
 
 		case ST_PUB_SUBJECT, ST_PUB_SUBJECT_DOT:
 			ss.Subject = append(ss.Subject, b)
-		case ST_PUB_NUM_BYTES:
+		case ST_PUB_NUM_BYTES, ST_PUB_REPLY_NUM_BYTES:
 			ss.nBytes = append(ss.nBytes, b)
+		case ST_PUB_REPLY, ST_PUB_REPLY_DOT, ST_PUB_REPLY_SPACE:
+			// Digits read as the size were the start of the reply-to.
+			ss.Reply = append(ss.Reply, ss.nBytes...)
+			ss.nBytes = ss.nBytes[:0]
+			if state != ST_PUB_REPLY_SPACE {
+				ss.Reply = append(ss.Reply, b)
+			}
 		case ST_PUB_PAYLOAD:
 			size, err := parseDigitsInt64(ss.nBytes)
 			if err != nil {
 				return nil, errors.New("bad payload")
 			}
-			if size > maxPayloadBytes {
-				return nil, errors.New("payload too large")
+			if size > c.maxPayload {
+				return nil, ErrMaxPayload
 			}
 
-			ss.Msg = make([]byte, 0, size)
-			for int64(len(ss.Msg)) < size {
-				payloadByte, err := c.brw.ReadByte()
-				if err != nil {
-					return nil, err
-				}
-				ss.Msg = append(ss.Msg, payloadByte)
+			ss.buf, err = c.readPayload(size)
+			if err != nil {
+				return nil, err
 			}
+			ss.Msg = ss.buf.bytes()
 
 			c, err := c.brw.ReadByte()
 			if err != nil {
@@ -112,16 +243,34 @@ func (c *Codec) Decode() (InboundCommands, error) {
 func createCmd(ss scratchSpace) (InboundCommands, error) {
 	switch ss.Kind {
 	case KindConnect:
-		return Connect{}, nil
+		var connect Connect
+		if len(ss.Options) > 2 {
+			if err := json.Unmarshal(ss.Options, &connect); err != nil {
+				return nil, errors.New("bad connect options")
+			}
+		}
+		return connect, nil
 	case KindPing:
 		return Ping{}, nil
 	case KindPong:
 		return Pong{}, nil
 	case KindPub:
+		payload := ss.Msg
+		if payload == nil {
+			payload = []byte{}
+		}
+		// Replies are usually unique inboxes, so they are copied out of the
+		// scratch space rather than interned.
+		var reply []byte
+		if len(ss.Reply) > 0 {
+			reply = bytes.Clone(ss.Reply)
+		}
 		return Pub{
 			Subject: ss.Subject,
-			Len:     int64(len(ss.Msg)),
-			Payload: ss.Msg,
+			Reply:   reply,
+			Len:     int64(len(payload)),
+			Payload: payload,
+			Buffer:  ss.buf,
 		}, nil
 	case KindSub:
 		sid, err := parseDigitsInt64(ss.SID)
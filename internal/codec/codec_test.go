@@ -46,11 +46,15 @@ func TestCodecDecodeSuccess(t *testing.T) {
 		want  Command
 	}{
 		{name: "connect", input: "CONNECT {}\r\n", want: Connect{}},
+		{name: "connect with options", input: "CONNECT {\"name\":\"svc\",\"verbose\":false}\r\n", want: Connect{Name: "svc"}},
+		{name: "connect with credentials", input: "CONNECT {\"user\":\"sys\",\"pass\":\"secret\"}\r\n", want: Connect{User: "sys", Pass: "secret"}},
 		{name: "ping", input: "PING\r\n", want: Ping{}},
 		{name: "pong", input: "PONG\r\n", want: Pong{}},
 		{name: "sub", input: "SUB foo.bar 42\r\n", want: Sub{Subject: []byte("foo.bar"), SID: 42}},
 		{name: "unsub", input: "UNSUB 9001\r\n", want: Unsub{SID: 9001}},
 		{name: "pub", input: "PUB foo.bar 5\r\nhello\r\n", want: Pub{Subject: []byte("foo.bar"), Len: 5, Payload: []byte("hello")}},
+		{name: "pub with reply", input: "PUB $SYS.REQ.SERVER.PING _INBOX.a-1 2\r\n{}\r\n", want: Pub{Subject: []byte("$SYS.REQ.SERVER.PING"), Reply: []byte("_INBOX.a-1"), Len: 2, Payload: []byte("{}")}},
+		{name: "pub with numeric reply", input: "PUB foo 42 5\r\nhello\r\n", want: Pub{Subject: []byte("foo"), Reply: []byte("42"), Len: 5, Payload: []byte("hello")}},
 	}
 
 	for _, tt := range tests {
@@ -60,7 +64,7 @@ func TestCodecDecodeSuccess(t *testing.T) {
 
 			got, err := c.Decode()
 			require.NoError(t, err)
-			assert.Equal(t, tt.want, got)
+			assert.Equal(t, tt.want, withoutBuffer(got))
 		})
 	}
 }
@@ -72,6 +76,7 @@ func TestCodecDecodeErrors(t *testing.T) {
 		errText string
 	}{
 		{name: "bad parse", input: "BROKEN\r\n", errText: "bad parse"},
+		{name: "bad connect json", input: "CONNECT {name}\r\n", errText: "bad connect options"},
 		{name: "bad payload digits", input: "PUB foo a\r\n", errText: "bad parse"},
 		{name: "payload too large", input: "PUB foo 8388609\r\n", errText: "payload too large"},
 		{name: "payload read short", input: "PUB foo 5\r\nhel", errText: "EOF"},
@@ -90,6 +95,18 @@ func TestCodecDecodeErrors(t *testing.T) {
 	}
 }
 
+func TestCodecDecodeParseErrorHasOffendingBytes(t *testing.T) {
+	c, err := NewCodec(bytes.NewBufferString("PING\r\nSUB foo bar\r\n"))
+	require.NoError(t, err)
+
+	_, err = c.Decode()
+	require.NoError(t, err)
+	_, err = c.Decode()
+	var perr *ParseError
+	require.ErrorAs(t, err, &perr)
+	assert.Equal(t, "SUB foo b", string(perr.Line))
+}
+
 func TestCreateCmd(t *testing.T) {
 	tests := []struct {
 		name    string
@@ -101,6 +118,7 @@ func TestCreateCmd(t *testing.T) {
 		{name: "ping", ss: scratchSpace{Kind: KindPing}, want: Ping{}},
 		{name: "pong", ss: scratchSpace{Kind: KindPong}, want: Pong{}},
 		{name: "pub", ss: scratchSpace{Kind: KindPub, Subject: []byte("s"), Msg: []byte("abc")}, want: Pub{Subject: []byte("s"), Len: 3, Payload: []byte("abc")}},
+		{name: "pub with reply", ss: scratchSpace{Kind: KindPub, Subject: []byte("s"), Reply: []byte("r"), Msg: []byte("abc")}, want: Pub{Subject: []byte("s"), Reply: []byte("r"), Len: 3, Payload: []byte("abc")}},
 		{name: "sub bad sid", ss: scratchSpace{Kind: KindSub, Subject: []byte("s"), SID: []byte("x")}, errText: "bad sid"},
 		{name: "unsub bad sid", ss: scratchSpace{Kind: KindUnsub, SID: []byte("x")}, errText: "bad sid"},
 		{name: "unknown kind", ss: scratchSpace{Kind: Kind(255)}, errText: "kind not implemented"},
@@ -175,7 +193,7 @@ func TestCodecDecodeSequentialCommands(t *testing.T) {
 	for i, want := range expected {
 		got, decodeErr := c.Decode()
 		require.NoError(t, decodeErr, "decode index %d", i)
-		assert.Equal(t, want, got, "decode index %d", i)
+		assert.Equal(t, want, withoutBuffer(got), "decode index %d", i)
 	}
 
 	_, err = c.Decode()
@@ -190,7 +208,7 @@ func TestCodecDecodePayloadBoundaries(t *testing.T) {
 
 		got, err := c.Decode()
 		require.NoError(t, err)
-		assert.Equal(t, Pub{Subject: []byte("foo"), Len: 0, Payload: []byte{}}, got)
+		assert.Equal(t, Pub{Subject: []byte("foo"), Len: 0, Payload: []byte{}}, withoutBuffer(got))
 	})
 
 	t.Run("one byte payload", func(t *testing.T) {
@@ -199,13 +217,13 @@ func TestCodecDecodePayloadBoundaries(t *testing.T) {
 
 		got, err := c.Decode()
 		require.NoError(t, err)
-		assert.Equal(t, Pub{Subject: []byte("foo"), Len: 1, Payload: []byte("a")}, got)
+		assert.Equal(t, Pub{Subject: []byte("foo"), Len: 1, Payload: []byte("a")}, withoutBuffer(got))
 	})
 
 	t.Run("max payload bytes", func(t *testing.T) {
-		payload := bytes.Repeat([]byte("a"), int(maxPayloadBytes))
+		payload := bytes.Repeat([]byte("a"), int(DefaultMaxPayload))
 		var input bytes.Buffer
-		_, _ = input.WriteString(fmt.Sprintf("PUB foo %d\r\n", maxPayloadBytes))
+		_, _ = input.WriteString(fmt.Sprintf("PUB foo %d\r\n", DefaultMaxPayload))
 		_, _ = input.Write(payload)
 		_, _ = input.WriteString("\r\n")
 
@@ -214,17 +232,74 @@ func TestCodecDecodePayloadBoundaries(t *testing.T) {
 
 		got, err := c.Decode()
 		require.NoError(t, err)
-		assert.Equal(t, Pub{Subject: []byte("foo"), Len: maxPayloadBytes, Payload: payload}, got)
+		assert.Equal(t, Pub{Subject: []byte("foo"), Len: DefaultMaxPayload, Payload: payload}, withoutBuffer(got))
 	})
 
 	t.Run("max payload plus one rejected", func(t *testing.T) {
-		c, err := NewCodec(bytes.NewBufferString(fmt.Sprintf("PUB foo %d\r\n", maxPayloadBytes+1)))
+		c, err := NewCodec(bytes.NewBufferString(fmt.Sprintf("PUB foo %d\r\n", DefaultMaxPayload+1)))
 		require.NoError(t, err)
 
 		_, err = c.Decode()
 		require.Error(t, err)
 		assert.Contains(t, err.Error(), "payload too large")
 	})
+
+	t.Run("configured max payload", func(t *testing.T) {
+		c, err := NewCodec(bytes.NewBufferString("PUB foo 5\r\nhello\r\n"))
+		require.NoError(t, err)
+		c.SetMaxPayload(4)
+
+		_, err = c.Decode()
+		assert.ErrorIs(t, err, ErrMaxPayload)
+	})
+}
+
+func TestCodecDecodeMaxControlLine(t *testing.T) {
+	t.Run("line at limit", func(t *testing.T) {
+		c, err := NewCodec(bytes.NewBufferString("SUB foo 1\r\n"))
+		require.NoError(t, err)
+		c.SetMaxControlLine(len("SUB foo 1\r\n"))
+
+		got, err := c.Decode()
+		require.NoError(t, err)
+		assert.Equal(t, Sub{Subject: []byte("foo"), SID: 1}, got)
+	})
+
+	t.Run("line over limit", func(t *testing.T) {
+		c, err := NewCodec(bytes.NewBufferString("SUB foo.bar.baz 1\r\n"))
+		require.NoError(t, err)
+		c.SetMaxControlLine(8)
+
+		_, err = c.Decode()
+		assert.ErrorIs(t, err, ErrMaxControlLine)
+	})
+
+	t.Run("payload does not count", func(t *testing.T) {
+		c, err := NewCodec(bytes.NewBufferString("PUB foo 32\r\n" + strings.Repeat("a", 32) + "\r\n"))
+		require.NoError(t, err)
+		c.SetMaxControlLine(16)
+
+		got, err := c.Decode()
+		require.NoError(t, err)
+		releasePub(got)
+	})
+}
+
+func releasePub(cmd InboundCommands) {
+	if pub, ok := cmd.(Pub); ok {
+		pub.Release()
+	}
+}
+
+// withoutBuffer drops the pooled buffer handle from a decoded Pub so tests
+// can compare it against a literal.
+func withoutBuffer(cmd Command) Command {
+	if pub, ok := cmd.(Pub); ok {
+		pub.Release()
+		pub.Buffer = nil
+		return pub
+	}
+	return cmd
 }
 
 type singleByteReadWriter struct {
@@ -255,7 +330,7 @@ func TestCodecDecodePubPayloadArrivesIncrementally(t *testing.T) {
 
 	got, err := c.Decode()
 	require.NoError(t, err)
-	assert.Equal(t, Pub{Subject: []byte("foo"), Len: 5, Payload: []byte("hello")}, got)
+	assert.Equal(t, Pub{Subject: []byte("foo"), Len: 5, Payload: []byte("hello")}, withoutBuffer(got))
 }
 
 func TestCodecDecodeWithChunkedReader(t *testing.T) {
@@ -268,7 +343,7 @@ func TestCodecDecodeWithChunkedReader(t *testing.T) {
 
 	got, err := c.Decode()
 	require.NoError(t, err)
-	assert.Equal(t, Pub{Subject: []byte("foo"), Len: 5, Payload: []byte("hello")}, got)
+	assert.Equal(t, Pub{Subject: []byte("foo"), Len: 5, Payload: []byte("hello")}, withoutBuffer(got))
 }
 
 func TestCodecDecodeLongRunMixedCommands(t *testing.T) {
@@ -297,7 +372,7 @@ func TestCodecDecodeLongRunMixedCommands(t *testing.T) {
 	for i, want := range expected {
 		got, decodeErr := c.Decode()
 		require.NoError(t, decodeErr, "decode index %d", i)
-		assert.Equal(t, want, got, "decode index %d", i)
+		assert.Equal(t, want, withoutBuffer(got), "decode index %d", i)
 	}
 }
 
@@ -328,9 +403,11 @@ func BenchmarkCodecDecode(b *testing.B) {
 			b.ResetTimer()
 
 			for i := 0; i < b.N; i++ {
-				if _, err := c.Decode(); err != nil {
+				cmd, err := c.Decode()
+				if err != nil {
 					b.Fatalf("Decode() error at iteration %d: %v", i, err)
 				}
+				releasePub(cmd)
 			}
 		})
 	}
@@ -350,9 +427,11 @@ func TestCodecDecodeAllocations(t *testing.T) {
 		require.NoError(t, err)
 
 		return testing.AllocsPerRun(runs, func() {
-			if _, err := c.Decode(); err != nil {
+			cmd, err := c.Decode()
+			if err != nil {
 				panic(err)
 			}
+			releasePub(cmd)
 		})
 	}
 
@@ -361,14 +440,22 @@ func TestCodecDecodeAllocations(t *testing.T) {
 		assert.LessOrEqual(t, allocs, float64(1), "expected near-zero allocations for PING decode")
 	})
 
+	// The remaining allocation is boxing the command into InboundCommands;
+	// subjects are interned and payloads come from the buffer pool.
 	t.Run("sub", func(t *testing.T) {
 		allocs := allocsPerDecode(t, "SUB foo.bar 42\r\n", 1000)
-		assert.LessOrEqual(t, allocs, float64(4), "unexpected allocation growth for SUB decode")
+		assert.LessOrEqual(t, allocs, float64(1), "unexpected allocation growth for SUB decode")
 	})
 
 	t.Run("pub small payload", func(t *testing.T) {
 		allocs := allocsPerDecode(t, "PUB foo 5\r\nhello\r\n", 1000)
-		assert.LessOrEqual(t, allocs, float64(5), "unexpected allocation growth for PUB decode")
+		assert.LessOrEqual(t, allocs, float64(1), "unexpected allocation growth for PUB decode")
+	})
+
+	t.Run("pub 64k payload", func(t *testing.T) {
+		payload := strings.Repeat("x", 64*1024)
+		allocs := allocsPerDecode(t, fmt.Sprintf("PUB foo %d\r\n%s\r\n", len(payload), payload), 100)
+		assert.LessOrEqual(t, allocs, float64(1), "unexpected allocation growth for large PUB decode")
 	})
 }
 
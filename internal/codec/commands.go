@@ -2,8 +2,10 @@ package codec
 
 import (
 	"bufio"
+	"encoding/json"
 	"errors"
 	"strconv"
+	"sync/atomic"
 )
 
 type Kind uint8
@@ -18,6 +20,8 @@ const (
 	KindMsg
 	KindOK
 	KindErr
+	KindSwitchFraming
+	KindInfo
 )
 
 type Command interface {
@@ -60,7 +64,15 @@ func (Pong) EncodeTo(w *bufio.Writer) error {
 	return err
 }
 
-type Connect struct{}
+// Connect carries the options object a client sends with CONNECT.
+// Binary asks the server to switch both directions to binary framing once
+// the CONNECT has been acknowledged. User and Pass log in as the system user.
+type Connect struct {
+	Name   string `json:"name,omitempty"`
+	Binary bool   `json:"binary,omitempty"`
+	User   string `json:"user,omitempty"`
+	Pass   string `json:"pass,omitempty"`
+}
 
 func (Connect) Kind() Kind        { return KindConnect }
 func (Connect) IsInboundCommand() {}
@@ -73,15 +85,22 @@ type Sub struct {
 func (Sub) Kind() Kind        { return KindSub }
 func (Sub) IsInboundCommand() {}
 
+// Pub's Payload aliases Buffer when it came from the pool. Whoever ends up
+// holding the Pub must call Release once it no longer needs the payload.
+// Reply, when set, is the subject the publisher expects answers on.
 type Pub struct {
 	Subject []byte
+	Reply   []byte
 	Len     int64
 	Payload []byte
+	Buffer  *Buffer
 }
 
 func (Pub) Kind() Kind        { return KindPub }
 func (Pub) IsInboundCommand() {}
 
+func (p Pub) Release() { p.Buffer.Release() }
+
 type Unsub struct {
 	SID int64
 }
@@ -90,15 +109,30 @@ func (Unsub) Kind() Kind        { return KindUnsub }
 func (Unsub) IsInboundCommand() {}
 
 // Msg is outbound-only and serialized by the writer actor as:
-// MSG <subject> <sid> <#bytes>\r\n[payload]\r\n
+// MSG <subject> <sid> [reply-to] <#bytes>\r\n[payload]\r\n
+// Buffer holds one reference on the publisher's payload which the writer
+// releases after encoding. Frame, when set, is the pre-encoded form shared by
+// every subscriber of the same publish. Pending, when set, counts the
+// subscription's undelivered messages and is decremented on Release.
 type Msg struct {
 	Subject []byte
+	Reply   []byte
 	SID     int64
 	Payload []byte
+	Buffer  *Buffer
+	Frame   *Frame
+	Pending *atomic.Int64
 }
 
 func (Msg) Kind() Kind { return KindMsg }
 
+func (m Msg) Release() {
+	m.Buffer.Release()
+	if m.Pending != nil {
+		m.Pending.Add(-1)
+	}
+}
+
 func (m Msg) EncodeTo(w *bufio.Writer) error {
 	if w == nil {
 		return errors.New("nil writer")
@@ -109,6 +143,9 @@ func (m Msg) EncodeTo(w *bufio.Writer) error {
 	if m.SID < 0 {
 		return errors.New("invalid sid")
 	}
+	if m.Frame != nil {
+		return writeFrame(w, m.Frame, FramingText, m.SID)
+	}
 
 	if _, err := w.WriteString("MSG "); err != nil {
 		return err
@@ -125,6 +162,14 @@ func (m Msg) EncodeTo(w *bufio.Writer) error {
 	if err := w.WriteByte(' '); err != nil {
 		return err
 	}
+	if len(m.Reply) > 0 {
+		if _, err := w.Write(m.Reply); err != nil {
+			return err
+		}
+		if err := w.WriteByte(' '); err != nil {
+			return err
+		}
+	}
 	if _, err := w.WriteString(strconv.Itoa(len(m.Payload))); err != nil {
 		return err
 	}
@@ -174,3 +219,45 @@ func (e Err) EncodeTo(w *bufio.Writer) error {
 	_, err := w.WriteString("\r\n")
 	return err
 }
+
+// Info is outbound-only and serialized as: INFO <json>\r\n
+// It is the first thing written to every connection, before CONNECT, so it
+// is always text framed.
+type Info struct {
+	MaxPayload int64 `json:"max_payload"`
+}
+
+func (Info) Kind() Kind { return KindInfo }
+
+func (i Info) EncodeTo(w *bufio.Writer) error {
+	if w == nil {
+		return errors.New("nil writer")
+	}
+	body, err := json.Marshal(i)
+	if err != nil {
+		return err
+	}
+	if _, err := w.WriteString("INFO "); err != nil {
+		return err
+	}
+	if _, err := w.Write(body); err != nil {
+		return err
+	}
+	_, err = w.WriteString("\r\n")
+	return err
+}
+
+// SwitchFraming is an outbound marker that tells the writer to encode every
+// following command with the given framing. It writes nothing itself.
+type SwitchFraming struct {
+	Framing Framing
+}
+
+func (SwitchFraming) Kind() Kind { return KindSwitchFraming }
+
+func (SwitchFraming) EncodeTo(w *bufio.Writer) error {
+	if w == nil {
+		return errors.New("nil writer")
+	}
+	return nil
+}
@@ -34,6 +34,16 @@ func TestOutboundEncodeToWritesExpectedWireFormat(t *testing.T) {
 			},
 			want: "MSG foo.bar 42 5\r\nhello\r\n",
 		},
+		{
+			name: "msg with reply",
+			cmd: Msg{
+				Subject: []byte("foo.bar"),
+				Reply:   []byte("_INBOX.1"),
+				SID:     42,
+				Payload: []byte("hello"),
+			},
+			want: "MSG foo.bar 42 _INBOX.1 5\r\nhello\r\n",
+		},
 		{
 			name: "msg with empty payload",
 			cmd: Msg{
@@ -58,6 +68,11 @@ func TestOutboundEncodeToWritesExpectedWireFormat(t *testing.T) {
 			cmd:  Err{},
 			want: "-ERR \r\n",
 		},
+		{
+			name: "info",
+			cmd:  Info{MaxPayload: 1024},
+			want: "INFO {\"max_payload\":1024}\r\n",
+		},
 	}
 
 	for _, tt := range tests {
@@ -85,6 +100,7 @@ func TestOutboundEncodeToErrors(t *testing.T) {
 			{name: "msg", cmd: Msg{Subject: []byte("foo"), SID: 1}},
 			{name: "ok", cmd: OK{}},
 			{name: "err", cmd: Err{Message: "boom"}},
+			{name: "info", cmd: Info{}},
 		}
 
 		for _, tt := range tests {
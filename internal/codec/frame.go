@@ -0,0 +1,136 @@
+package codec
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"net"
+	"strconv"
+)
+
+var crlf = []byte("\r\n")
+
+// Frame is the subscriber independent part of a MSG. The broker builds one
+// per publish and every subscriber's Msg points at it, so the subject and
+// size line are encoded once no matter how many subscribers there are. Only
+// the SID is written per subscriber.
+//
+// For each framing the wire bytes are head, SID, mid, payload, trailer:
+//
+//	text:   "MSG <subject> " <sid> " [reply-to ]<#bytes>\r\n" <payload> "\r\n"
+//	binary: <op> <subject len> <subject> <sid> [<reply len> <reply>] <payload len> <payload>
+type Frame struct {
+	textHead   []byte
+	textMid    []byte
+	binaryHead []byte
+	binaryMid  []byte
+	Payload    []byte
+}
+
+// NewFrame encodes the shared parts of a MSG. reply may be nil.
+func NewFrame(subject, reply, payload []byte) *Frame {
+	// Both framings share one backing array so a publish costs two small
+	// allocations regardless of fanout.
+	size := len("MSG ") + len(subject) + 1 +
+		1 + len(reply) + 1 + 20 + len(crlf) +
+		1 + binary.MaxVarintLen64 + len(subject) +
+		binary.MaxVarintLen64 + len(reply) +
+		binary.MaxVarintLen64
+	buf := make([]byte, 0, size)
+
+	buf = append(buf, "MSG "...)
+	buf = append(buf, subject...)
+	buf = append(buf, ' ')
+	textHead := buf[:len(buf):len(buf)]
+
+	start := len(buf)
+	buf = append(buf, ' ')
+	if len(reply) > 0 {
+		buf = append(buf, reply...)
+		buf = append(buf, ' ')
+	}
+	buf = strconv.AppendInt(buf, int64(len(payload)), 10)
+	buf = append(buf, crlf...)
+	textMid := buf[start:len(buf):len(buf)]
+
+	start = len(buf)
+	buf = append(buf, msgOp(reply))
+	buf = binary.AppendUvarint(buf, uint64(len(subject)))
+	buf = append(buf, subject...)
+	binaryHead := buf[start:len(buf):len(buf)]
+
+	start = len(buf)
+	if len(reply) > 0 {
+		buf = binary.AppendUvarint(buf, uint64(len(reply)))
+		buf = append(buf, reply...)
+	}
+	buf = binary.AppendUvarint(buf, uint64(len(payload)))
+	binaryMid := buf[start:len(buf):len(buf)]
+
+	return &Frame{
+		textHead:   textHead,
+		textMid:    textMid,
+		binaryHead: binaryHead,
+		binaryMid:  binaryMid,
+		Payload:    payload,
+	}
+}
+
+func (f *Frame) parts(framing Framing) (head, mid, trailer []byte) {
+	if framing == FramingBinary {
+		return f.binaryHead, f.binaryMid, nil
+	}
+	return f.textHead, f.textMid, crlf
+}
+
+func appendSID(dst []byte, framing Framing, sid int64) []byte {
+	if framing == FramingBinary {
+		return binary.AppendUvarint(dst, uint64(sid))
+	}
+	return strconv.AppendInt(dst, sid, 10)
+}
+
+// writeFrame copies a framed Msg into w.
+func writeFrame(w *bufio.Writer, f *Frame, framing Framing, sid int64) error {
+	if w == nil {
+		return errors.New("nil writer")
+	}
+	if sid < 0 {
+		return errors.New("invalid sid")
+	}
+
+	head, mid, trailer := f.parts(framing)
+	if _, err := w.Write(head); err != nil {
+		return err
+	}
+	// The SID is written byte by byte so its scratch space stays on the stack.
+	var scratch [20]byte
+	for _, c := range appendSID(scratch[:0], framing, sid) {
+		if err := w.WriteByte(c); err != nil {
+			return err
+		}
+	}
+	if _, err := w.Write(mid); err != nil {
+		return err
+	}
+	if _, err := w.Write(f.Payload); err != nil {
+		return err
+	}
+	_, err := w.Write(trailer)
+	return err
+}
+
+// Buffers returns m as a vector of slices suitable for a single writev.
+// The SID slice aliases the encoder's scratch space and is only valid until
+// the next call. Msgs without a Frame return nil.
+func (e *Encoder) Buffers(dst net.Buffers, m Msg) net.Buffers {
+	if m.Frame == nil || m.SID < 0 {
+		return nil
+	}
+	head, mid, trailer := m.Frame.parts(e.framing)
+	dst = append(dst, head, appendSID(e.scratch[:0], e.framing, m.SID), mid, m.Frame.Payload)
+	if len(trailer) > 0 {
+		dst = append(dst, trailer)
+	}
+	return dst
+}
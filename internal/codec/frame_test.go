@@ -0,0 +1,124 @@
+package codec
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func encodeWith(t testing.TB, framing Framing, cmd OutboundCommands) []byte {
+	t.Helper()
+
+	var out bytes.Buffer
+	w := bufio.NewWriter(&out)
+	enc := NewEncoder(w)
+	require.NoError(t, enc.Encode(SwitchFraming{Framing: framing}))
+	require.NoError(t, enc.Encode(cmd))
+	require.NoError(t, w.Flush())
+	return out.Bytes()
+}
+
+func TestFramedMsgMatchesUnframedEncoding(t *testing.T) {
+	tests := []struct {
+		name    string
+		subject string
+		reply   string
+		sid     int64
+		payload []byte
+	}{
+		{name: "small", subject: "foo.bar", sid: 42, payload: []byte("hello")},
+		{name: "empty payload", subject: "foo", sid: 0, payload: []byte{}},
+		{name: "large sid", subject: "a.b.c", sid: 1<<63 - 1, payload: []byte("x")},
+		{name: "large payload", subject: "big", sid: 7, payload: bytes.Repeat([]byte("z"), 70000)},
+		{name: "reply", subject: "svc.echo", reply: "_INBOX.abc", sid: 3, payload: []byte("ping")},
+	}
+
+	for _, tt := range tests {
+		for _, framing := range []Framing{FramingText, FramingBinary} {
+			t.Run(fmt.Sprintf("%s/%d", tt.name, framing), func(t *testing.T) {
+				plain := Msg{Subject: []byte(tt.subject), SID: tt.sid, Payload: tt.payload}
+				if tt.reply != "" {
+					plain.Reply = []byte(tt.reply)
+				}
+				framed := plain
+				framed.Frame = NewFrame(plain.Subject, plain.Reply, plain.Payload)
+
+				want := encodeWith(t, framing, plain)
+				assert.Equal(t, want, encodeWith(t, framing, framed))
+
+				enc := NewEncoder(bufio.NewWriter(io.Discard))
+				require.NoError(t, enc.Encode(SwitchFraming{Framing: framing}))
+				var joined bytes.Buffer
+				bufs := enc.Buffers(nil, framed)
+				_, err := bufs.WriteTo(&joined)
+				require.NoError(t, err)
+				assert.Equal(t, want, joined.Bytes())
+			})
+		}
+	}
+}
+
+func TestFrameIsSharedAcrossSIDs(t *testing.T) {
+	frame := NewFrame([]byte("foo"), nil, []byte("hi"))
+
+	assert.Equal(t, "MSG foo 1 2\r\nhi\r\n", string(encodeWith(t, FramingText, Msg{Subject: []byte("foo"), SID: 1, Frame: frame})))
+	assert.Equal(t, "MSG foo 22 2\r\nhi\r\n", string(encodeWith(t, FramingText, Msg{Subject: []byte("foo"), SID: 22, Frame: frame})))
+}
+
+func TestEncoderBuffersWithoutFrame(t *testing.T) {
+	enc := NewEncoder(bufio.NewWriter(io.Discard))
+	assert.Nil(t, enc.Buffers(nil, Msg{Subject: []byte("foo"), SID: 1}))
+	assert.Nil(t, enc.Buffers(nil, Msg{Subject: []byte("foo"), SID: -1, Frame: NewFrame([]byte("foo"), nil, nil)}))
+}
+
+func BenchmarkMsgFanoutEncode(b *testing.B) {
+	const subscribers = 100
+	subject := []byte("orders.eu.created")
+
+	for _, size := range []int{16, 1024, 64 * 1024} {
+		payload := bytes.Repeat([]byte("x"), size)
+
+		b.Run(fmt.Sprintf("per_subscriber/%d", size), func(b *testing.B) {
+			enc := NewEncoder(bufio.NewWriterSize(io.Discard, 32*1024))
+			b.SetBytes(int64(size * subscribers))
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				for sid := int64(0); sid < subscribers; sid++ {
+					_ = enc.Encode(Msg{Subject: subject, SID: sid, Payload: payload})
+				}
+			}
+		})
+
+		b.Run(fmt.Sprintf("shared_frame/%d", size), func(b *testing.B) {
+			enc := NewEncoder(bufio.NewWriterSize(io.Discard, 32*1024))
+			b.SetBytes(int64(size * subscribers))
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				frame := NewFrame(subject, nil, payload)
+				for sid := int64(0); sid < subscribers; sid++ {
+					_ = enc.Encode(Msg{Subject: subject, SID: sid, Payload: payload, Frame: frame})
+				}
+			}
+		})
+
+		b.Run(fmt.Sprintf("shared_frame_writev/%d", size), func(b *testing.B) {
+			enc := NewEncoder(bufio.NewWriter(io.Discard))
+			vec := make(net.Buffers, 0, 5)
+			b.SetBytes(int64(size * subscribers))
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				frame := NewFrame(subject, nil, payload)
+				for sid := int64(0); sid < subscribers; sid++ {
+					bufs := enc.Buffers(vec[:0], Msg{Subject: subject, SID: sid, Payload: payload, Frame: frame})
+					_, _ = bufs.WriteTo(io.Discard)
+				}
+			}
+		})
+	}
+}
@@ -9,7 +9,7 @@ const (
 	ST_CR_END
 	ST_DONE
 
-	// CONNECT {}\r\n
+	// CONNECT {<options json>}\r\n
 	ST_CMD_C
 	ST_CMD_CO
 	ST_CMD_CON
@@ -19,6 +19,7 @@ const (
 	ST_CMD_CONNECT
 	ST_CONNECT_SPACE
 	ST_CONNECT_LBRACE
+	ST_CONNECT_OPTS
 	ST_CONNECT_RBRACE
 
 	// PING\r\n
@@ -47,7 +48,7 @@ const (
 
 	ST_SUB_SID
 
-	// PUB <subject> <#bytes>\r\n[payload]\r\n
+	// PUB <subject> [reply-to] <#bytes>\r\n[payload]\r\n
 	// ST_CMD_P
 	ST_CMD_PU
 	ST_CMD_PUB
@@ -56,6 +57,10 @@ const (
 	ST_PUB_SUBJECT_SPACE
 	ST_PUB_SUBJECT_DOT
 	ST_PUB_NUM_BYTES
+	ST_PUB_REPLY
+	ST_PUB_REPLY_DOT
+	ST_PUB_REPLY_SPACE
+	ST_PUB_REPLY_NUM_BYTES
 	ST_PUB_CR
 	ST_PUB_PAYLOAD
 
@@ -76,6 +81,13 @@ const nStates = int(ST_UNSUB_SID) + 1
 var digits = []byte("0123456789")
 var alphas = []byte("ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz")
 
+// symbols are the other characters allowed in a subject token, so $SYS
+// subjects and _INBOX reply subjects can be written.
+var symbols = []byte("$_-")
+
+// tokenChars are every character allowed in a subject token.
+var tokenChars = append(append(append([]byte{}, alphas...), digits...), symbols...)
+
 func buildTransitionTable() [nStates][256]STATE {
 	var t [nStates][256]STATE
 	t[ST_START]['C'] = ST_CMD_C
@@ -87,7 +99,20 @@ func buildTransitionTable() [nStates][256]STATE {
 	t[ST_CMD_CONNEC]['T'] = ST_CMD_CONNECT
 	t[ST_CMD_CONNECT][' '] = ST_CONNECT_SPACE
 	t[ST_CONNECT_SPACE]['{'] = ST_CONNECT_LBRACE
+
+	// The options object is captured verbatim and validated as JSON once
+	// the line is complete; the table only ensures it ends with '}'.
+	for c := 0; c < 256; c++ {
+		if c == '\r' || c == '\n' {
+			continue
+		}
+		t[ST_CONNECT_LBRACE][c] = ST_CONNECT_OPTS
+		t[ST_CONNECT_OPTS][c] = ST_CONNECT_OPTS
+		t[ST_CONNECT_RBRACE][c] = ST_CONNECT_OPTS
+	}
 	t[ST_CONNECT_LBRACE]['}'] = ST_CONNECT_RBRACE
+	t[ST_CONNECT_OPTS]['}'] = ST_CONNECT_RBRACE
+	t[ST_CONNECT_RBRACE]['}'] = ST_CONNECT_RBRACE
 	t[ST_CONNECT_RBRACE]['\r'] = ST_CR_END
 	t[ST_CR_END]['\n'] = ST_DONE
 
@@ -109,10 +134,7 @@ func buildTransitionTable() [nStates][256]STATE {
 	t[ST_CMD_SUB][' '] = ST_SUB_SPACE
 
 	// from a space to the subject
-	for _, c := range alphas {
-		t[ST_SUB_SPACE][c] = ST_SUB_SUBJECT
-	}
-	for _, c := range digits {
+	for _, c := range tokenChars {
 		t[ST_SUB_SPACE][c] = ST_SUB_SUBJECT
 	}
 	// subjects can start with a wildcard
@@ -120,20 +142,14 @@ func buildTransitionTable() [nStates][256]STATE {
 	t[ST_SUB_SPACE]['>'] = ST_SUB_SUBJECT_GT
 
 	// through valid subject chars
-	for _, c := range alphas {
-		t[ST_SUB_SUBJECT][c] = ST_SUB_SUBJECT
-	}
-	for _, c := range digits {
+	for _, c := range tokenChars {
 		t[ST_SUB_SUBJECT][c] = ST_SUB_SUBJECT
 	}
 	t[ST_SUB_SUBJECT][' '] = ST_SUB_SUBJECT_SPACE
 
 	// dot can move to a subject or an * or a >
 	t[ST_SUB_SUBJECT]['.'] = ST_SUB_SUBJECT_DOT
-	for _, c := range alphas {
-		t[ST_SUB_SUBJECT_DOT][c] = ST_SUB_SUBJECT
-	}
-	for _, c := range digits {
+	for _, c := range tokenChars {
 		t[ST_SUB_SUBJECT_DOT][c] = ST_SUB_SUBJECT
 	}
 	t[ST_SUB_SUBJECT_DOT]['*'] = ST_SUB_SUBJECT_STAR
@@ -155,34 +171,41 @@ func buildTransitionTable() [nStates][256]STATE {
 	}
 	t[ST_SUB_SID]['\r'] = ST_CR_END
 
-	// PUB <subject> <#bytes>\r\n[payload]\r\n
+	// PUB <subject> [reply-to] <#bytes>\r\n[payload]\r\n
 	// ST_CMD_P
 	t[ST_CMD_P]['U'] = ST_CMD_PU
 	t[ST_CMD_PU]['B'] = ST_CMD_PUB
 	t[ST_CMD_PUB][' '] = ST_PUB_SPACE
 
-	for _, c := range alphas {
-		t[ST_PUB_SPACE][c] = ST_PUB_SUBJECT
-	}
-	for _, c := range digits {
+	for _, c := range tokenChars {
 		t[ST_PUB_SPACE][c] = ST_PUB_SUBJECT
-	}
-
-	for _, c := range alphas {
-		t[ST_PUB_SUBJECT][c] = ST_PUB_SUBJECT
-		t[ST_PUB_SUBJECT_DOT][c] = ST_PUB_SUBJECT
-	}
-	for _, c := range digits {
 		t[ST_PUB_SUBJECT][c] = ST_PUB_SUBJECT
 		t[ST_PUB_SUBJECT_DOT][c] = ST_PUB_SUBJECT
 	}
 	t[ST_PUB_SUBJECT]['.'] = ST_PUB_SUBJECT_DOT
 	t[ST_PUB_SUBJECT][' '] = ST_PUB_SUBJECT_SPACE
 
+	// The token after the subject is the size unless another token follows
+	// it, so an all-digit token stays ambiguous until the next space or CR.
+	// The decoder moves the digits into the reply-to when it turns out to be
+	// one.
+	for _, c := range tokenChars {
+		t[ST_PUB_SUBJECT_SPACE][c] = ST_PUB_REPLY
+		t[ST_PUB_NUM_BYTES][c] = ST_PUB_REPLY
+		t[ST_PUB_REPLY][c] = ST_PUB_REPLY
+		t[ST_PUB_REPLY_DOT][c] = ST_PUB_REPLY
+	}
 	for _, c := range digits {
 		t[ST_PUB_SUBJECT_SPACE][c] = ST_PUB_NUM_BYTES
 		t[ST_PUB_NUM_BYTES][c] = ST_PUB_NUM_BYTES
+		t[ST_PUB_REPLY_SPACE][c] = ST_PUB_REPLY_NUM_BYTES
+		t[ST_PUB_REPLY_NUM_BYTES][c] = ST_PUB_REPLY_NUM_BYTES
 	}
+	t[ST_PUB_NUM_BYTES]['.'] = ST_PUB_REPLY_DOT
+	t[ST_PUB_NUM_BYTES][' '] = ST_PUB_REPLY_SPACE
+	t[ST_PUB_REPLY]['.'] = ST_PUB_REPLY_DOT
+	t[ST_PUB_REPLY][' '] = ST_PUB_REPLY_SPACE
+	t[ST_PUB_REPLY_NUM_BYTES]['\r'] = ST_PUB_CR
 
 	// Will read the n bytes after parsing the
 	// first line of the publish command and finish
@@ -26,6 +26,8 @@ func TestTransitionTableAcceptsImplementedProtocols(t *testing.T) {
 		{name: "ping", input: "PING\r\n", wantState: ST_DONE},
 		{name: "pong", input: "PONG\r\n", wantState: ST_DONE},
 		{name: "connect empty json", input: "CONNECT {}\r\n", wantState: ST_DONE},
+		{name: "connect with options", input: "CONNECT {\"verbose\":false}\r\n", wantState: ST_DONE},
+		{name: "connect nested object", input: "CONNECT {\"a\":{\"b\":1}}\r\n", wantState: ST_DONE},
 		{name: "sub simple", input: "SUB foo 1\r\n", wantState: ST_DONE},
 		{name: "sub dotted", input: "SUB foo.bar 42\r\n", wantState: ST_DONE},
 		{name: "sub star wildcard", input: "SUB foo.* 7\r\n", wantState: ST_DONE},
@@ -33,6 +35,9 @@ func TestTransitionTableAcceptsImplementedProtocols(t *testing.T) {
 		{name: "sub root gt wildcard", input: "SUB > 9\r\n", wantState: ST_DONE},
 		{name: "pub header simple", input: "PUB foo 0\r\n", wantState: ST_PUB_PAYLOAD},
 		{name: "pub header dotted", input: "PUB foo.bar 12\r\n", wantState: ST_PUB_PAYLOAD},
+		{name: "pub header with reply-to", input: "PUB foo _INBOX.a1 5\r\n", wantState: ST_PUB_PAYLOAD},
+		{name: "pub header with numeric reply-to", input: "PUB foo 42 5\r\n", wantState: ST_PUB_PAYLOAD},
+		{name: "sub system subject", input: "SUB $SYS.> 1\r\n", wantState: ST_DONE},
 		{name: "unsub simple", input: "UNSUB 1\r\n", wantState: ST_DONE},
 	}
 
@@ -54,13 +59,17 @@ func TestTransitionTableRejectsUnsupportedOrMalformedProtocols(t *testing.T) {
 	}{
 		{name: "ping without cr", input: "PING\n"},
 		{name: "connect without required space", input: "CONNECT{}\r\n"},
-		{name: "connect with optional args unsupported", input: "CONNECT {\"verbose\":false}\r\n"},
+		{name: "connect options not closed", input: "CONNECT {\"verbose\":false\r\n"},
+		{name: "connect options with newline", input: "CONNECT {\n}\r\n"},
 		{name: "sub missing sid", input: "SUB foo\r\n"},
 		{name: "sub leading dot", input: "SUB .foo 1\r\n"},
 		{name: "sub empty token", input: "SUB foo..bar 1\r\n"},
 		{name: "sub gt not terminal", input: "SUB foo.>.bar 1\r\n"},
 		{name: "pub missing bytes", input: "PUB foo\r\n"},
-		{name: "pub with optional reply-to unsupported", input: "PUB foo reply 5\r\n"},
+		{name: "pub reply-to without bytes", input: "PUB foo reply\r\n"},
+		{name: "pub reply-to empty token", input: "PUB foo a..b 5\r\n"},
+		{name: "pub reply-to wildcard", input: "PUB foo a.* 5\r\n"},
+		{name: "pub extra argument", input: "PUB foo a b 5\r\n"},
 		{name: "unsub missing sid", input: "UNSUB\r\n"},
 		{name: "unsub with optional max msgs unsupported", input: "UNSUB 1 2\r\n"},
 	}
@@ -2,7 +2,13 @@ package config
 
 import (
 	"fmt"
+	"log/slog"
+	"net"
+	"net/netip"
+	"net/url"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 )
 
@@ -10,16 +16,178 @@ const (
 	defaultPort                  = "8080"
 	defaultHeartbeatTickInterval = 30 * time.Second
 	defaultHeartbeatTimeout      = 90 * time.Second
+	defaultUnixSocketMode        = os.FileMode(0o660)
+	defaultProxyHeaderTimeout    = 5 * time.Second
+	defaultWriteMaxBatch         = 256
+	defaultWriteMaxLatency       = 0
+	defaultLookupCacheSize       = 1024
+	defaultMaxPendingMsgs        = 256
+	defaultMaxPendingBytes       = 64 * 1024 * 1024
+	defaultMaxPayload            = 8 * 1024 * 1024
+	defaultMaxControlLine        = 4096
+	defaultAuthTimeout           = 2 * time.Second
+	defaultShutdownGrace         = 0
+	defaultTracePayload          = 64
+)
+
+// SlowConsumerPolicy decides what happens when a connection's outbound queue
+// is over its pending limits.
+type SlowConsumerPolicy string
+
+const (
+	// SlowConsumerDisconnect sends -ERR 'Slow Consumer' and closes the
+	// connection. It is also what the zero value means.
+	SlowConsumerDisconnect SlowConsumerPolicy = "disconnect"
+	// SlowConsumerDropNewest drops the message that does not fit.
+	SlowConsumerDropNewest SlowConsumerPolicy = "drop_newest"
+	// SlowConsumerDropOldest drops the oldest queued messages to make room.
+	SlowConsumerDropOldest SlowConsumerPolicy = "drop_oldest"
+)
+
+// RateLimitPolicy decides what a reader does when its connection or source
+// IP sends faster than the configured rate.
+type RateLimitPolicy string
+
+const (
+	// RateLimitThrottle pauses reading until the bucket refills, pushing
+	// back on the client through TCP flow control. It is also what the zero
+	// value means.
+	RateLimitThrottle RateLimitPolicy = "throttle"
+	// RateLimitDisconnect sends -ERR 'Rate Limit Exceeded' and closes the
+	// connection.
+	RateLimitDisconnect RateLimitPolicy = "disconnect"
+)
+
+// LogFormat is how log records are written.
+type LogFormat string
+
+const (
+	// LogFormatText writes key=value lines. It is also what the zero value
+	// means.
+	LogFormatText LogFormat = "text"
+	// LogFormatJSON writes one JSON object per line.
+	LogFormatJSON LogFormat = "json"
 )
 
 type Config struct {
 	Port                  string
+	Listeners             []Listener
 	HeartbeatTickInterval time.Duration
 	HeartbeatTimeout      time.Duration
+	ProxyHeaderTimeout    time.Duration
+	// AuthTimeout is how long a new connection has to send CONNECT before
+	// it is closed. Zero disables the timer.
+	AuthTimeout time.Duration
+
+	// WriteMaxBatch caps how many queued outbound commands a writer encodes
+	// before flushing. WriteMaxLatency lets a writer wait that long for more
+	// commands before flushing a partial batch; zero flushes as soon as the
+	// outbound queue is empty.
+	WriteMaxBatch   int
+	WriteMaxLatency time.Duration
+
+	// FanoutWorkers enables parallel publish fanout with that many workers
+	// reading path-copied registry snapshots. Zero keeps every publish on
+	// the single broker loop.
+	FanoutWorkers int
+
+	// LookupCacheSize bounds the registry's literal subject lookup cache.
+	// Zero disables it.
+	LookupCacheSize int
+
+	// MaxPendingMsgs bounds the outbound commands queued for one connection
+	// and sizes its outbound channel. MaxPendingBytes bounds the queued MSG
+	// payload bytes; zero disables the byte limit. SlowConsumerPolicy
+	// applies when a delivery would exceed either limit.
+	MaxPendingMsgs     int
+	MaxPendingBytes    int
+	SlowConsumerPolicy SlowConsumerPolicy
+
+	// MaxPendingPerSub bounds the undelivered MSGs of each subscription.
+	// A subscription past it has its messages dropped instead of the whole
+	// connection being treated as slow, so it should be set below
+	// MaxPendingMsgs. Zero disables it.
+	MaxPendingPerSub int
+
+	// MaxPayload is the largest PUB payload and is advertised in INFO.
+	// MaxControlLine bounds a command line excluding its payload.
+	// MaxConnections and MaxSubscriptions (per connection) are unlimited
+	// when zero.
+	MaxPayload       int
+	MaxControlLine   int
+	MaxConnections   int
+	MaxSubscriptions int
+
+	// Rate limits on inbound commands per second and PUB payload bytes per
+	// second, for each connection and for all connections sharing a source
+	// IP. Zero disables a limit.
+	RateLimitMsgs    int
+	RateLimitBytes   int
+	RateLimitIPMsgs  int
+	RateLimitIPBytes int
+	RateLimitPolicy  RateLimitPolicy
+
+	// AllowCIDRs, when not empty, is the only set of source networks that
+	// may connect. DenyCIDRs always wins over it. ConnRatePerIP limits new
+	// connections per second from one IP; zero disables it.
+	AllowCIDRs    []netip.Prefix
+	DenyCIDRs     []netip.Prefix
+	ConnRatePerIP int
+
+	// MonitorAddr is the host:port of the HTTP monitoring endpoint. It is
+	// disabled when empty.
+	MonitorAddr string
+	// MonitorAdmin adds the admin endpoints that kick and drain clients to
+	// the monitoring server. They share its listener with /metrics, so they
+	// only answer requests that send MonitorAdminToken as a bearer token,
+	// which is required when MonitorAdmin is set.
+	MonitorAdmin      bool
+	MonitorAdminToken string
+
+	// ShutdownGrace is how long the server keeps accepting connections
+	// after a shutdown signal while /readyz reports it is draining.
+	ShutdownGrace time.Duration
+
+	// SystemUser and SystemPassword are the credentials a client sends in
+	// CONNECT to use $SYS subjects. Nobody can when SystemUser is empty.
+	SystemUser     string
+	SystemPassword string
+
+	// Users are the client accounts and their permissions. Clients connect
+	// without credentials when there are none.
+	Users []User
+
+	// LogLevel is the lowest level that is logged and LogFormat how records
+	// are written to stderr.
+	LogLevel  slog.Level
+	LogFormat LogFormat
+
+	// Trace logs every command of every connection from startup. Tracing
+	// can also be turned on at runtime, globally or for one connection.
+	// TracePayload is how many payload bytes a traced PUB or MSG shows.
+	Trace        bool
+	TracePayload int
 }
 
+// Listener describes one socket the server accepts client connections on.
+// Network is "tcp" or "unix". Mode only applies to unix sockets.
+// ProxyProtocol requires every connection to start with a PROXY v1 or v2
+// header from a load balancer.
+type Listener struct {
+	Network       string
+	Address       string
+	Mode          os.FileMode
+	ProxyProtocol bool
+}
+
+// NewConfig reads the configuration from PUBSUB_* environment variables.
 func NewConfig() (Config, error) {
-	heartbeatTickInterval, err := envDuration(
+	return Load("", nil)
+}
+
+// build reads every setting from s, falling back to its default.
+func (s *source) build() (Config, error) {
+	heartbeatTickInterval, err := s.duration(
 		"PUBSUB_HEARTBEAT_TICK_INTERVAL",
 		defaultHeartbeatTickInterval,
 	)
@@ -27,7 +195,7 @@ func NewConfig() (Config, error) {
 		return Config{}, err
 	}
 
-	heartbeatTimeout, err := envDuration(
+	heartbeatTimeout, err := s.duration(
 		"PUBSUB_HEARTBEAT_TIMEOUT",
 		defaultHeartbeatTimeout,
 	)
@@ -35,31 +203,439 @@ func NewConfig() (Config, error) {
 		return Config{}, err
 	}
 
+	proxyHeaderTimeout, err := s.duration(
+		"PUBSUB_PROXY_HEADER_TIMEOUT",
+		defaultProxyHeaderTimeout,
+	)
+	if err != nil {
+		return Config{}, err
+	}
+
+	authTimeout, err := s.duration("PUBSUB_AUTH_TIMEOUT", defaultAuthTimeout)
+	if err != nil {
+		return Config{}, err
+	}
+
+	writeMaxBatch, err := s.int("PUBSUB_WRITE_MAX_BATCH", defaultWriteMaxBatch)
+	if err != nil {
+		return Config{}, err
+	}
+
+	writeMaxLatency, err := s.duration(
+		"PUBSUB_WRITE_MAX_LATENCY",
+		defaultWriteMaxLatency,
+	)
+	if err != nil {
+		return Config{}, err
+	}
+
+	fanoutWorkers, err := s.int("PUBSUB_FANOUT_WORKERS", 0)
+	if err != nil {
+		return Config{}, err
+	}
+
+	lookupCacheSize, err := s.int("PUBSUB_LOOKUP_CACHE_SIZE", defaultLookupCacheSize)
+	if err != nil {
+		return Config{}, err
+	}
+
+	maxPendingMsgs, err := s.int("PUBSUB_MAX_PENDING_MSGS", defaultMaxPendingMsgs)
+	if err != nil {
+		return Config{}, err
+	}
+
+	maxPendingBytes, err := s.int("PUBSUB_MAX_PENDING_BYTES", defaultMaxPendingBytes)
+	if err != nil {
+		return Config{}, err
+	}
+
+	maxPendingPerSub, err := s.int("PUBSUB_MAX_PENDING_PER_SUB", 0)
+	if err != nil {
+		return Config{}, err
+	}
+
+	maxPayload, err := s.int("PUBSUB_MAX_PAYLOAD", defaultMaxPayload)
+	if err != nil {
+		return Config{}, err
+	}
+
+	maxControlLine, err := s.int("PUBSUB_MAX_CONTROL_LINE", defaultMaxControlLine)
+	if err != nil {
+		return Config{}, err
+	}
+
+	maxConnections, err := s.int("PUBSUB_MAX_CONNECTIONS", 0)
+	if err != nil {
+		return Config{}, err
+	}
+
+	maxSubscriptions, err := s.int("PUBSUB_MAX_SUBSCRIPTIONS", 0)
+	if err != nil {
+		return Config{}, err
+	}
+
+	rateLimitMsgs, err := s.int("PUBSUB_RATE_LIMIT_MSGS", 0)
+	if err != nil {
+		return Config{}, err
+	}
+
+	rateLimitBytes, err := s.int("PUBSUB_RATE_LIMIT_BYTES", 0)
+	if err != nil {
+		return Config{}, err
+	}
+
+	rateLimitIPMsgs, err := s.int("PUBSUB_RATE_LIMIT_IP_MSGS", 0)
+	if err != nil {
+		return Config{}, err
+	}
+
+	rateLimitIPBytes, err := s.int("PUBSUB_RATE_LIMIT_IP_BYTES", 0)
+	if err != nil {
+		return Config{}, err
+	}
+
+	rateLimitPolicy, err := s.rateLimitPolicy("PUBSUB_RATE_LIMIT_POLICY", RateLimitThrottle)
+	if err != nil {
+		return Config{}, err
+	}
+
+	allowCIDRs, err := s.prefixes("PUBSUB_ALLOW_CIDRS")
+	if err != nil {
+		return Config{}, err
+	}
+
+	denyCIDRs, err := s.prefixes("PUBSUB_DENY_CIDRS")
+	if err != nil {
+		return Config{}, err
+	}
+
+	connRatePerIP, err := s.int("PUBSUB_CONN_RATE_PER_IP", 0)
+	if err != nil {
+		return Config{}, err
+	}
+
+	slowConsumerPolicy, err := s.slowConsumerPolicy(
+		"PUBSUB_SLOW_CONSUMER_POLICY",
+		SlowConsumerDisconnect,
+	)
+	if err != nil {
+		return Config{}, err
+	}
+
+	monitorAddr := s.string("PUBSUB_MONITOR_ADDR", "")
+	monitorAdmin, err := s.bool("PUBSUB_MONITOR_ADMIN", false)
+	if err != nil {
+		return Config{}, err
+	}
+	monitorAdminToken := s.string("PUBSUB_MONITOR_ADMIN_TOKEN", "")
+	if monitorAdmin && monitorAdminToken == "" {
+		return Config{}, fmt.Errorf("monitor admin requires a monitor admin token")
+	}
+	systemUser := s.string("PUBSUB_SYSTEM_USER", "")
+	systemPassword := s.string("PUBSUB_SYSTEM_PASSWORD", "")
+	users, err := s.users("PUBSUB_USERS")
+	if err != nil {
+		return Config{}, err
+	}
+	for _, u := range users {
+		if systemUser != "" && u.User == systemUser {
+			return Config{}, fmt.Errorf("user %q is the system user", u.User)
+		}
+	}
+
+	shutdownGrace, err := s.duration("PUBSUB_SHUTDOWN_GRACE", defaultShutdownGrace)
+	if err != nil {
+		return Config{}, err
+	}
+
+	logLevel, err := s.logLevel("PUBSUB_LOG_LEVEL", slog.LevelInfo)
+	if err != nil {
+		return Config{}, err
+	}
+	logFormat, err := s.logFormat("PUBSUB_LOG_FORMAT", LogFormatText)
+	if err != nil {
+		return Config{}, err
+	}
+	trace, err := s.bool("PUBSUB_TRACE", false)
+	if err != nil {
+		return Config{}, err
+	}
+	tracePayload, err := s.int("PUBSUB_TRACE_PAYLOAD", defaultTracePayload)
+	if err != nil {
+		return Config{}, err
+	}
+
+	port := s.string("PUBSUB_PORT", defaultPort)
+	listeners, err := s.listeners(
+		"PUBSUB_LISTENERS",
+		[]Listener{{Network: "tcp", Address: net.JoinHostPort("", port)}},
+	)
+	if err != nil {
+		return Config{}, err
+	}
+
 	return Config{
-		Port:                  envString("PUBSUB_PORT", defaultPort),
+		Port:                  port,
+		Listeners:             listeners,
 		HeartbeatTickInterval: heartbeatTickInterval,
 		HeartbeatTimeout:      heartbeatTimeout,
+		ProxyHeaderTimeout:    proxyHeaderTimeout,
+		AuthTimeout:           authTimeout,
+		WriteMaxBatch:         writeMaxBatch,
+		WriteMaxLatency:       writeMaxLatency,
+		FanoutWorkers:         fanoutWorkers,
+		LookupCacheSize:       lookupCacheSize,
+		MaxPendingMsgs:        maxPendingMsgs,
+		MaxPendingBytes:       maxPendingBytes,
+		SlowConsumerPolicy:    slowConsumerPolicy,
+		MaxPendingPerSub:      maxPendingPerSub,
+		MaxPayload:            maxPayload,
+		MaxControlLine:        maxControlLine,
+		MaxConnections:        maxConnections,
+		MaxSubscriptions:      maxSubscriptions,
+		RateLimitMsgs:         rateLimitMsgs,
+		RateLimitBytes:        rateLimitBytes,
+		RateLimitIPMsgs:       rateLimitIPMsgs,
+		RateLimitIPBytes:      rateLimitIPBytes,
+		RateLimitPolicy:       rateLimitPolicy,
+		AllowCIDRs:            allowCIDRs,
+		DenyCIDRs:             denyCIDRs,
+		ConnRatePerIP:         connRatePerIP,
+		MonitorAddr:           monitorAddr,
+		MonitorAdmin:          monitorAdmin,
+		MonitorAdminToken:     monitorAdminToken,
+		ShutdownGrace:         shutdownGrace,
+		SystemUser:            systemUser,
+		SystemPassword:        systemPassword,
+		Users:                 users,
+		LogLevel:              logLevel,
+		LogFormat:             logFormat,
+		Trace:                 trace,
+		TracePayload:          tracePayload,
 	}, nil
 }
 
-func envString(key, fallback string) string {
-	if value, ok := os.LookupEnv(key); ok {
+func (s *source) string(key, fallback string) string {
+	if value, _, ok := s.lookup(key); ok {
 		return value
 	}
 
 	return fallback
 }
 
-func envDuration(key string, fallback time.Duration) (time.Duration, error) {
-	value, ok := os.LookupEnv(key)
+func (s *source) duration(key string, fallback time.Duration) (time.Duration, error) {
+	value, name, ok := s.lookup(key)
 	if !ok {
 		return fallback, nil
 	}
 
 	duration, err := time.ParseDuration(value)
 	if err != nil {
-		return 0, fmt.Errorf("parse %s: %w", key, err)
+		return 0, fmt.Errorf("parse %s: %w", name, err)
 	}
 
 	return duration, nil
 }
+
+func (s *source) int(key string, fallback int) (int, error) {
+	value, name, ok := s.lookup(key)
+	if !ok {
+		return fallback, nil
+	}
+
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("parse %s: %w", name, err)
+	}
+
+	return n, nil
+}
+
+func (s *source) bool(key string, fallback bool) (bool, error) {
+	value, name, ok := s.lookup(key)
+	if !ok {
+		return fallback, nil
+	}
+
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("parse %s: %w", name, err)
+	}
+
+	return b, nil
+}
+
+// logLevel accepts debug, info, warn and error, optionally with an offset
+// such as debug-2.
+func (s *source) logLevel(key string, fallback slog.Level) (slog.Level, error) {
+	value, name, ok := s.lookup(key)
+	if !ok {
+		return fallback, nil
+	}
+
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(value)); err != nil {
+		return 0, fmt.Errorf("parse %s: %w", name, err)
+	}
+
+	return level, nil
+}
+
+func (s *source) logFormat(key string, fallback LogFormat) (LogFormat, error) {
+	value, name, ok := s.lookup(key)
+	if !ok {
+		return fallback, nil
+	}
+
+	switch format := LogFormat(value); format {
+	case LogFormatText, LogFormatJSON:
+		return format, nil
+	default:
+		return "", fmt.Errorf("parse %s: unknown format %q", name, value)
+	}
+}
+
+func (s *source) slowConsumerPolicy(key string, fallback SlowConsumerPolicy) (SlowConsumerPolicy, error) {
+	value, name, ok := s.lookup(key)
+	if !ok {
+		return fallback, nil
+	}
+
+	switch policy := SlowConsumerPolicy(value); policy {
+	case SlowConsumerDisconnect, SlowConsumerDropNewest, SlowConsumerDropOldest:
+		return policy, nil
+	default:
+		return "", fmt.Errorf("parse %s: unknown policy %q", name, value)
+	}
+}
+
+func (s *source) rateLimitPolicy(key string, fallback RateLimitPolicy) (RateLimitPolicy, error) {
+	value, name, ok := s.lookup(key)
+	if !ok {
+		return fallback, nil
+	}
+
+	switch policy := RateLimitPolicy(value); policy {
+	case RateLimitThrottle, RateLimitDisconnect:
+		return policy, nil
+	default:
+		return "", fmt.Errorf("parse %s: unknown policy %q", name, value)
+	}
+}
+
+// prefixes reads a comma separated list of CIDRs. A bare address is taken
+// as a single host prefix.
+func (s *source) prefixes(key string) ([]netip.Prefix, error) {
+	value, name, ok := s.lookup(key)
+	if !ok {
+		return nil, nil
+	}
+
+	var prefixes []netip.Prefix
+	for _, raw := range strings.Split(value, ",") {
+		raw = strings.TrimSpace(raw)
+		if raw == "" {
+			continue
+		}
+		p, err := ParsePrefix(raw)
+		if err != nil {
+			return nil, fmt.Errorf("parse %s: %w", name, err)
+		}
+		prefixes = append(prefixes, p)
+	}
+
+	return prefixes, nil
+}
+
+// ParsePrefix parses a CIDR such as 10.0.0.0/8 or a single address.
+func ParsePrefix(raw string) (netip.Prefix, error) {
+	if !strings.Contains(raw, "/") {
+		addr, err := netip.ParseAddr(raw)
+		if err != nil {
+			return netip.Prefix{}, err
+		}
+		addr = addr.Unmap()
+		return netip.PrefixFrom(addr, addr.BitLen()), nil
+	}
+	p, err := netip.ParsePrefix(raw)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	return p.Masked(), nil
+}
+
+// listeners reads a comma separated list of listener URLs, for example
+// "tcp://0.0.0.0:4222,unix:///run/pubsub.sock?mode=0600".
+func (s *source) listeners(key string, fallback []Listener) ([]Listener, error) {
+	value, name, ok := s.lookup(key)
+	if !ok {
+		return fallback, nil
+	}
+
+	var listeners []Listener
+	for _, raw := range strings.Split(value, ",") {
+		raw = strings.TrimSpace(raw)
+		if raw == "" {
+			continue
+		}
+		l, err := ParseListener(raw)
+		if err != nil {
+			return nil, fmt.Errorf("parse %s: %w", name, err)
+		}
+		listeners = append(listeners, l)
+	}
+	if len(listeners) == 0 {
+		return nil, fmt.Errorf("parse %s: no listeners", name)
+	}
+
+	return listeners, nil
+}
+
+// ParseListener parses a single listener URL of the form tcp://host:port or
+// unix:///path/to.sock with an optional octal mode query parameter.
+// Either form accepts proxy=true to require a PROXY protocol header.
+func ParseListener(raw string) (Listener, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return Listener{}, err
+	}
+
+	var l Listener
+	query := u.Query()
+	if p := query.Get("proxy"); p != "" {
+		l.ProxyProtocol, err = strconv.ParseBool(p)
+		if err != nil {
+			return Listener{}, fmt.Errorf("listener %q: bad proxy: %w", raw, err)
+		}
+	}
+
+	switch u.Scheme {
+	case "tcp":
+		if u.Host == "" {
+			return Listener{}, fmt.Errorf("listener %q: missing host:port", raw)
+		}
+		if _, _, err := net.SplitHostPort(u.Host); err != nil {
+			return Listener{}, fmt.Errorf("listener %q: %w", raw, err)
+		}
+		l.Network = "tcp"
+		l.Address = u.Host
+	case "unix":
+		if u.Path == "" {
+			return Listener{}, fmt.Errorf("listener %q: missing socket path", raw)
+		}
+		l.Network = "unix"
+		l.Address = u.Path
+		l.Mode = defaultUnixSocketMode
+		if m := query.Get("mode"); m != "" {
+			parsed, err := strconv.ParseUint(m, 8, 32)
+			if err != nil {
+				return Listener{}, fmt.Errorf("listener %q: bad mode: %w", raw, err)
+			}
+			l.Mode = os.FileMode(parsed) & os.ModePerm
+		}
+	default:
+		return Listener{}, fmt.Errorf("listener %q: unsupported network %q", raw, u.Scheme)
+	}
+
+	return l, nil
+}
@@ -1,6 +1,7 @@
 package config
 
 import (
+	"log/slog"
 	"testing"
 	"time"
 )
@@ -28,12 +29,160 @@ func TestNewConfigUsesDefaults(t *testing.T) {
 			cfg.HeartbeatTimeout,
 		)
 	}
+	if cfg.AuthTimeout != 2*time.Second {
+		t.Fatalf("expected default auth timeout 2s, got %v", cfg.AuthTimeout)
+	}
+	if cfg.WriteMaxBatch != 256 {
+		t.Fatalf("expected default write max batch 256, got %d", cfg.WriteMaxBatch)
+	}
+	if cfg.WriteMaxLatency != 0 {
+		t.Fatalf("expected default write max latency 0, got %v", cfg.WriteMaxLatency)
+	}
+	if cfg.FanoutWorkers != 0 {
+		t.Fatalf("expected parallel fanout to be off by default, got %d workers", cfg.FanoutWorkers)
+	}
+	if cfg.LookupCacheSize != 1024 {
+		t.Fatalf("expected default lookup cache size 1024, got %d", cfg.LookupCacheSize)
+	}
+	if cfg.MaxPendingMsgs != 256 || cfg.MaxPendingBytes != 64*1024*1024 {
+		t.Fatalf("unexpected default pending limits %d msgs %d bytes", cfg.MaxPendingMsgs, cfg.MaxPendingBytes)
+	}
+	if cfg.MaxPayload != 8*1024*1024 || cfg.MaxControlLine != 4096 {
+		t.Fatalf("unexpected default protocol limits payload %d control line %d", cfg.MaxPayload, cfg.MaxControlLine)
+	}
+	if cfg.MaxConnections != 0 || cfg.MaxSubscriptions != 0 {
+		t.Fatalf("expected connections and subscriptions to be unlimited, got %d and %d", cfg.MaxConnections, cfg.MaxSubscriptions)
+	}
+	if cfg.SlowConsumerPolicy != SlowConsumerDisconnect {
+		t.Fatalf("expected default slow consumer policy %q, got %q", SlowConsumerDisconnect, cfg.SlowConsumerPolicy)
+	}
+	if cfg.MonitorAddr != "" {
+		t.Fatalf("expected monitoring to be off by default, got %q", cfg.MonitorAddr)
+	}
+	if cfg.ShutdownGrace != 0 {
+		t.Fatalf("expected no shutdown grace by default, got %v", cfg.ShutdownGrace)
+	}
+}
+
+func TestNewConfigParsesRateLimits(t *testing.T) {
+	t.Setenv("PUBSUB_RATE_LIMIT_MSGS", "100")
+	t.Setenv("PUBSUB_RATE_LIMIT_IP_BYTES", "4096")
+	t.Setenv("PUBSUB_RATE_LIMIT_POLICY", "disconnect")
+
+	cfg, err := NewConfig()
+	if err != nil {
+		t.Fatalf("NewConfig returned error: %v", err)
+	}
+	if cfg.RateLimitMsgs != 100 || cfg.RateLimitIPBytes != 4096 {
+		t.Fatalf("unexpected rate limits %d msgs/s %d IP bytes/s", cfg.RateLimitMsgs, cfg.RateLimitIPBytes)
+	}
+	if cfg.RateLimitPolicy != RateLimitDisconnect {
+		t.Fatalf("expected policy %q, got %q", RateLimitDisconnect, cfg.RateLimitPolicy)
+	}
+
+	t.Setenv("PUBSUB_RATE_LIMIT_POLICY", "block")
+	if _, err := NewConfig(); err == nil {
+		t.Fatal("expected error for unknown rate limit policy")
+	}
+}
+
+func TestNewConfigParsesCIDRLists(t *testing.T) {
+	t.Setenv("PUBSUB_ALLOW_CIDRS", "10.0.0.0/8, 192.168.1.7")
+	t.Setenv("PUBSUB_DENY_CIDRS", "10.1.2.3/16")
+	t.Setenv("PUBSUB_CONN_RATE_PER_IP", "5")
+
+	cfg, err := NewConfig()
+	if err != nil {
+		t.Fatalf("NewConfig returned error: %v", err)
+	}
+	want := []string{"10.0.0.0/8", "192.168.1.7/32"}
+	if len(cfg.AllowCIDRs) != len(want) {
+		t.Fatalf("expected %d allow prefixes, got %v", len(want), cfg.AllowCIDRs)
+	}
+	for i, p := range cfg.AllowCIDRs {
+		if p.String() != want[i] {
+			t.Fatalf("expected allow prefix %s, got %s", want[i], p)
+		}
+	}
+	if len(cfg.DenyCIDRs) != 1 || cfg.DenyCIDRs[0].String() != "10.1.0.0/16" {
+		t.Fatalf("expected masked deny prefix 10.1.0.0/16, got %v", cfg.DenyCIDRs)
+	}
+	if cfg.ConnRatePerIP != 5 {
+		t.Fatalf("expected connection rate 5, got %d", cfg.ConnRatePerIP)
+	}
+
+	t.Setenv("PUBSUB_DENY_CIDRS", "10.0.0.0/33")
+	if _, err := NewConfig(); err == nil {
+		t.Fatal("expected error for invalid CIDR")
+	}
+}
+
+func TestNewConfigParsesSlowConsumerPolicy(t *testing.T) {
+	t.Setenv("PUBSUB_SLOW_CONSUMER_POLICY", "drop_oldest")
+	t.Setenv("PUBSUB_MAX_PENDING_PER_SUB", "32")
+
+	cfg, err := NewConfig()
+	if err != nil {
+		t.Fatalf("NewConfig returned error: %v", err)
+	}
+	if cfg.MaxPendingPerSub != 32 {
+		t.Fatalf("expected max pending per sub 32, got %d", cfg.MaxPendingPerSub)
+	}
+	if cfg.SlowConsumerPolicy != SlowConsumerDropOldest {
+		t.Fatalf("expected policy %q, got %q", SlowConsumerDropOldest, cfg.SlowConsumerPolicy)
+	}
+
+	t.Setenv("PUBSUB_SLOW_CONSUMER_POLICY", "ignore")
+	if _, err := NewConfig(); err == nil {
+		t.Fatal("expected error for unknown slow consumer policy")
+	}
+}
+
+func TestNewConfigParsesLogging(t *testing.T) {
+	cfg, err := NewConfig()
+	if err != nil {
+		t.Fatalf("NewConfig returned error: %v", err)
+	}
+	if cfg.LogLevel != slog.LevelInfo || cfg.LogFormat != LogFormatText {
+		t.Fatalf("expected info text logging by default, got %v %q", cfg.LogLevel, cfg.LogFormat)
+	}
+
+	t.Setenv("PUBSUB_LOG_LEVEL", "debug")
+	t.Setenv("PUBSUB_LOG_FORMAT", "json")
+	if cfg, err = NewConfig(); err != nil {
+		t.Fatalf("NewConfig returned error: %v", err)
+	}
+	if cfg.LogLevel != slog.LevelDebug || cfg.LogFormat != LogFormatJSON {
+		t.Fatalf("expected debug json logging, got %v %q", cfg.LogLevel, cfg.LogFormat)
+	}
+
+	if cfg.Trace || cfg.TracePayload != 64 {
+		t.Fatalf("expected tracing off with 64 payload bytes, got %v %d", cfg.Trace, cfg.TracePayload)
+	}
+
+	t.Setenv("PUBSUB_LOG_LEVEL", "loud")
+	if _, err := NewConfig(); err == nil {
+		t.Fatal("expected error for unknown log level")
+	}
+	t.Setenv("PUBSUB_LOG_LEVEL", "warn")
+	t.Setenv("PUBSUB_LOG_FORMAT", "xml")
+	if _, err := NewConfig(); err == nil {
+		t.Fatal("expected error for unknown log format")
+	}
 }
 
 func TestNewConfigUsesEnvOverrides(t *testing.T) {
 	t.Setenv("PUBSUB_PORT", "9090")
 	t.Setenv("PUBSUB_HEARTBEAT_TICK_INTERVAL", "5s")
 	t.Setenv("PUBSUB_HEARTBEAT_TIMEOUT", "12s")
+	t.Setenv("PUBSUB_WRITE_MAX_BATCH", "64")
+	t.Setenv("PUBSUB_WRITE_MAX_LATENCY", "2ms")
+	t.Setenv("PUBSUB_MONITOR_ADDR", "127.0.0.1:8222")
+	t.Setenv("PUBSUB_MONITOR_ADMIN", "true")
+	t.Setenv("PUBSUB_MONITOR_ADMIN_TOKEN", "admin-secret")
+	t.Setenv("PUBSUB_SHUTDOWN_GRACE", "10s")
+	t.Setenv("PUBSUB_SYSTEM_USER", "sys")
+	t.Setenv("PUBSUB_SYSTEM_PASSWORD", "secret")
 
 	cfg, err := NewConfig()
 	if err != nil {
@@ -57,6 +206,24 @@ func TestNewConfigUsesEnvOverrides(t *testing.T) {
 			cfg.HeartbeatTimeout,
 		)
 	}
+	if cfg.WriteMaxBatch != 64 {
+		t.Fatalf("expected overridden write max batch 64, got %d", cfg.WriteMaxBatch)
+	}
+	if cfg.WriteMaxLatency != 2*time.Millisecond {
+		t.Fatalf("expected overridden write max latency 2ms, got %v", cfg.WriteMaxLatency)
+	}
+	if cfg.MonitorAddr != "127.0.0.1:8222" {
+		t.Fatalf("expected overridden monitor address, got %q", cfg.MonitorAddr)
+	}
+	if !cfg.MonitorAdmin || cfg.MonitorAdminToken != "admin-secret" {
+		t.Fatalf("expected admin endpoints with a token, got %v %q", cfg.MonitorAdmin, cfg.MonitorAdminToken)
+	}
+	if cfg.ShutdownGrace != 10*time.Second {
+		t.Fatalf("expected overridden shutdown grace 10s, got %v", cfg.ShutdownGrace)
+	}
+	if cfg.SystemUser != "sys" || cfg.SystemPassword != "secret" {
+		t.Fatalf("expected system credentials sys/secret, got %q/%q", cfg.SystemUser, cfg.SystemPassword)
+	}
 }
 
 func TestNewConfigReturnsErrorForInvalidDuration(t *testing.T) {
@@ -67,3 +234,94 @@ func TestNewConfigReturnsErrorForInvalidDuration(t *testing.T) {
 		t.Fatal("expected NewConfig to fail for invalid duration")
 	}
 }
+
+func TestNewConfigRequiresAdminToken(t *testing.T) {
+	t.Setenv("PUBSUB_MONITOR_ADMIN", "true")
+
+	if _, err := NewConfig(); err == nil {
+		t.Fatal("expected NewConfig to fail for admin endpoints without a token")
+	}
+}
+
+func TestNewConfigReturnsErrorForInvalidBool(t *testing.T) {
+	t.Setenv("PUBSUB_MONITOR_ADMIN", "sometimes")
+
+	_, err := NewConfig()
+	if err == nil {
+		t.Fatal("expected NewConfig to fail for invalid bool")
+	}
+}
+
+func TestNewConfigReturnsErrorForInvalidInt(t *testing.T) {
+	t.Setenv("PUBSUB_WRITE_MAX_BATCH", "lots")
+
+	_, err := NewConfig()
+	if err == nil {
+		t.Fatal("expected NewConfig to fail for invalid integer")
+	}
+}
+
+func TestNewConfigDefaultListenerUsesPort(t *testing.T) {
+	t.Setenv("PUBSUB_PORT", "9090")
+
+	cfg, err := NewConfig()
+	if err != nil {
+		t.Fatalf("NewConfig returned error: %v", err)
+	}
+
+	want := Listener{Network: "tcp", Address: ":9090"}
+	if len(cfg.Listeners) != 1 || cfg.Listeners[0] != want {
+		t.Fatalf("expected listeners [%+v], got %+v", want, cfg.Listeners)
+	}
+}
+
+func TestNewConfigParsesListeners(t *testing.T) {
+	t.Setenv(
+		"PUBSUB_LISTENERS",
+		"tcp://0.0.0.0:4222, tcp://127.0.0.1:4223?proxy=true,unix:///tmp/pubsub.sock?mode=0600",
+	)
+
+	cfg, err := NewConfig()
+	if err != nil {
+		t.Fatalf("NewConfig returned error: %v", err)
+	}
+
+	want := []Listener{
+		{Network: "tcp", Address: "0.0.0.0:4222"},
+		{Network: "tcp", Address: "127.0.0.1:4223", ProxyProtocol: true},
+		{Network: "unix", Address: "/tmp/pubsub.sock", Mode: 0o600},
+	}
+	if len(cfg.Listeners) != len(want) {
+		t.Fatalf("expected %d listeners, got %+v", len(want), cfg.Listeners)
+	}
+	for i := range want {
+		if cfg.Listeners[i] != want[i] {
+			t.Fatalf("listener %d: expected %+v, got %+v", i, want[i], cfg.Listeners[i])
+		}
+	}
+}
+
+func TestParseListenerUnixDefaultMode(t *testing.T) {
+	l, err := ParseListener("unix:///run/pubsub.sock")
+	if err != nil {
+		t.Fatalf("ParseListener returned error: %v", err)
+	}
+	if l.Mode != 0o660 {
+		t.Fatalf("expected default mode 0660, got %o", l.Mode)
+	}
+}
+
+func TestParseListenerErrors(t *testing.T) {
+	for _, raw := range []string{
+		"udp://:4222",
+		"tcp://",
+		"tcp://localhost",
+		"unix://",
+		"unix:///tmp/x.sock?mode=999",
+		"tcp://:4222?proxy=maybe",
+	} {
+		if _, err := ParseListener(raw); err == nil {
+			t.Fatalf("expected ParseListener(%q) to fail", raw)
+		}
+	}
+}
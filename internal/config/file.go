@@ -0,0 +1,202 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// source looks settings up by their PUBSUB_* environment variable name.
+// overrides, keyed like the config file, win over the environment, which
+// wins over the file.
+type source struct {
+	path      string
+	file      map[string]string
+	overrides map[string]string
+	used      map[string]bool
+}
+
+// Load reads the configuration from the JSON file at path, if path is not
+// empty, then from PUBSUB_* environment variables and finally from
+// overrides, each taking precedence over the one before. File and override
+// keys are the variable names without the PUBSUB_ prefix in lower case,
+// such as "max_payload". An unknown key is an error.
+func Load(path string, overrides map[string]string) (Config, error) {
+	s := &source{
+		path:      path,
+		overrides: overrides,
+		used:      make(map[string]bool),
+	}
+	if path != "" {
+		file, err := readFile(path)
+		if err != nil {
+			return Config{}, err
+		}
+		s.file = file
+	}
+
+	cfg, err := s.build()
+	if err != nil {
+		return Config{}, err
+	}
+	for key := range s.file {
+		if !s.used[key] {
+			return Config{}, fmt.Errorf("%s: unknown setting %q", path, key)
+		}
+	}
+	for key := range s.overrides {
+		if !s.used[key] {
+			return Config{}, fmt.Errorf("unknown setting %q", key)
+		}
+	}
+	return cfg, nil
+}
+
+// lookup returns the value of the setting key and where it came from, for
+// error messages.
+func (s *source) lookup(key string) (value, name string, ok bool) {
+	fileKey := strings.ToLower(strings.TrimPrefix(key, "PUBSUB_"))
+	s.used[fileKey] = true
+
+	if value, ok := s.overrides[fileKey]; ok {
+		return value, fileKey, true
+	}
+	if value, ok := os.LookupEnv(key); ok {
+		return value, key, true
+	}
+	if value, ok := s.file[fileKey]; ok {
+		return value, fmt.Sprintf("%s in %s", fileKey, s.path), true
+	}
+	return "", "", false
+}
+
+// readFile decodes a flat JSON object of settings. Values may be strings,
+// numbers, booleans or, for lists such as listeners, arrays of strings;
+// they are kept in the same text form as the environment variables. Any
+// other array or object, such as users, is kept as JSON.
+func readFile(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var raw map[string]any
+	dec := json.NewDecoder(f)
+	dec.UseNumber()
+	if err := dec.Decode(&raw); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+
+	file := make(map[string]string, len(raw))
+	for key, v := range raw {
+		value, err := fileValue(v)
+		if err != nil {
+			return nil, fmt.Errorf("parse %s in %s: %w", key, path, err)
+		}
+		file[key] = value
+	}
+	return file, nil
+}
+
+func fileValue(v any) (string, error) {
+	switch v := v.(type) {
+	case string:
+		return v, nil
+	case json.Number:
+		return v.String(), nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case []any:
+		items := make([]string, len(v))
+		for i, item := range v {
+			s, ok := item.(string)
+			if !ok {
+				return marshalValue(v)
+			}
+			items[i] = s
+		}
+		return strings.Join(items, ","), nil
+	case map[string]any:
+		return marshalValue(v)
+	default:
+		return "", fmt.Errorf("unsupported value %v", v)
+	}
+}
+
+func marshalValue(v any) (string, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// liveSettings are the Config fields a running server applies at once on
+// reload.
+var liveSettings = []string{
+	"AuthTimeout",
+	"HeartbeatTimeout",
+	"MaxConnections",
+	"MaxSubscriptions",
+	"AllowCIDRs",
+	"DenyCIDRs",
+	"SystemUser",
+	"SystemPassword",
+	"Users",
+	"LogLevel",
+	"Trace",
+}
+
+// newConnSettings are the Config fields a running server applies on reload
+// to connections made after it. Open connections keep the outbound queue
+// and rate limits they started with.
+var newConnSettings = []string{
+	"MaxPendingBytes",
+	"SlowConsumerPolicy",
+	"MaxPendingPerSub",
+	"RateLimitMsgs",
+	"RateLimitBytes",
+	"RateLimitPolicy",
+}
+
+// Changes names the Config fields that differ between two configurations,
+// by when they take effect.
+type Changes struct {
+	Live     []string
+	NewConns []string
+	Restart  []string
+}
+
+// Reload compares the running configuration cur with next, read again
+// from the same sources. It returns cur with the live and new connection
+// settings taken from next, and the names of the settings that changed.
+// Restart settings keep their running values.
+func Reload(cur, next Config) (Config, Changes) {
+	applied := cur
+	var changes Changes
+	a := reflect.ValueOf(&applied).Elem()
+	c := reflect.ValueOf(cur)
+	n := reflect.ValueOf(next)
+	for i := 0; i < c.NumField(); i++ {
+		if reflect.DeepEqual(c.Field(i).Interface(), n.Field(i).Interface()) {
+			continue
+		}
+		name := c.Type().Field(i).Name
+		switch {
+		case slices.Contains(liveSettings, name):
+			changes.Live = append(changes.Live, name)
+		case slices.Contains(newConnSettings, name):
+			changes.NewConns = append(changes.NewConns, name)
+		default:
+			changes.Restart = append(changes.Restart, name)
+			continue
+		}
+		a.Field(i).Set(n.Field(i))
+	}
+	return applied, changes
+}
@@ -0,0 +1,204 @@
+package config
+
+import (
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeConfigFile(t *testing.T, body string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "pubsub.json")
+	if err := os.WriteFile(path, []byte(body), 0o600); err != nil {
+		t.Fatalf("write config file: %v", err)
+	}
+	return path
+}
+
+func TestLoadReadsFile(t *testing.T) {
+	path := writeConfigFile(t, `{
+		"listeners": ["tcp://127.0.0.1:4222", "unix:///tmp/pubsub.sock?mode=0600"],
+		"heartbeat_tick_interval": "5s",
+		"max_payload": 1024,
+		"allow_cidrs": ["10.0.0.0/8"],
+		"system_user": "sys",
+		"system_password": "secret",
+		"log_level": "debug",
+		"monitor_admin": true,
+		"monitor_admin_token": "admin-secret"
+	}`)
+
+	cfg, err := Load(path, nil)
+	if err != nil {
+		t.Fatalf("Load returned error: %v", err)
+	}
+	if len(cfg.Listeners) != 2 || cfg.Listeners[0].Address != "127.0.0.1:4222" || cfg.Listeners[1].Mode != 0o600 {
+		t.Fatalf("unexpected listeners %+v", cfg.Listeners)
+	}
+	if cfg.HeartbeatTickInterval != 5*time.Second {
+		t.Fatalf("expected heartbeat tick interval 5s, got %v", cfg.HeartbeatTickInterval)
+	}
+	if cfg.MaxPayload != 1024 {
+		t.Fatalf("expected max payload 1024, got %d", cfg.MaxPayload)
+	}
+	if len(cfg.AllowCIDRs) != 1 || cfg.AllowCIDRs[0].String() != "10.0.0.0/8" {
+		t.Fatalf("unexpected allow CIDRs %v", cfg.AllowCIDRs)
+	}
+	if cfg.SystemUser != "sys" || cfg.SystemPassword != "secret" {
+		t.Fatalf("unexpected system user %q/%q", cfg.SystemUser, cfg.SystemPassword)
+	}
+	if cfg.LogLevel != slog.LevelDebug || !cfg.MonitorAdmin {
+		t.Fatalf("expected debug logging and admin, got %v %v", cfg.LogLevel, cfg.MonitorAdmin)
+	}
+	if cfg.MaxPendingMsgs != 256 {
+		t.Fatalf("expected default max pending msgs 256, got %d", cfg.MaxPendingMsgs)
+	}
+}
+
+func TestLoadPrecedence(t *testing.T) {
+	path := writeConfigFile(t, `{"max_payload": 1024, "max_connections": 10, "max_subscriptions": 5}`)
+	t.Setenv("PUBSUB_MAX_CONNECTIONS", "20")
+	t.Setenv("PUBSUB_MAX_SUBSCRIPTIONS", "50")
+
+	cfg, err := Load(path, map[string]string{"max_subscriptions": "500"})
+	if err != nil {
+		t.Fatalf("Load returned error: %v", err)
+	}
+	if cfg.MaxPayload != 1024 {
+		t.Fatalf("expected file max payload 1024, got %d", cfg.MaxPayload)
+	}
+	if cfg.MaxConnections != 20 {
+		t.Fatalf("expected env max connections 20, got %d", cfg.MaxConnections)
+	}
+	if cfg.MaxSubscriptions != 500 {
+		t.Fatalf("expected override max subscriptions 500, got %d", cfg.MaxSubscriptions)
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	tests := []struct {
+		name      string
+		body      string
+		overrides map[string]string
+		want      string
+	}{
+		{name: "unknown key", body: `{"max_payloads": 1}`, want: `unknown setting "max_payloads"`},
+		{name: "unknown override", body: `{}`, overrides: map[string]string{"nope": "1"}, want: `unknown setting "nope"`},
+		{name: "bad value", body: `{"heartbeat_timeout": 90}`, want: "heartbeat_timeout in"},
+		{name: "bad list", body: `{"deny_cidrs": [1]}`, want: "deny_cidrs"},
+		{name: "bad json", body: `{`, want: "parse"},
+		{name: "no listeners", body: `{"listeners": []}`, want: "no listeners"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Load(writeConfigFile(t, tt.body), tt.overrides)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("expected error containing %q, got %v", tt.want, err)
+			}
+		})
+	}
+}
+
+func TestLoadMissingFile(t *testing.T) {
+	if _, err := Load(filepath.Join(t.TempDir(), "missing.json"), nil); err == nil {
+		t.Fatal("expected error for a missing file")
+	}
+}
+
+func TestReloadSplitsLiveAndRestartSettings(t *testing.T) {
+	cur, err := NewConfig()
+	if err != nil {
+		t.Fatalf("NewConfig returned error: %v", err)
+	}
+	next := cur
+	next.LogLevel = slog.LevelDebug
+	next.MaxSubscriptions = 10
+	next.SystemUser = "sys"
+	next.RateLimitMsgs = 100
+	next.Port = "4222"
+	next.FanoutWorkers = 4
+
+	applied, changes := Reload(cur, next)
+	if want := []string{"MaxSubscriptions", "SystemUser", "LogLevel"}; !slices.Equal(changes.Live, want) {
+		t.Fatalf("expected live %v, got %v", want, changes.Live)
+	}
+	if want := []string{"RateLimitMsgs"}; !slices.Equal(changes.NewConns, want) {
+		t.Fatalf("expected new connection settings %v, got %v", want, changes.NewConns)
+	}
+	if want := []string{"Port", "FanoutWorkers"}; !slices.Equal(changes.Restart, want) {
+		t.Fatalf("expected restart %v, got %v", want, changes.Restart)
+	}
+	if applied.LogLevel != slog.LevelDebug || applied.MaxSubscriptions != 10 || applied.SystemUser != "sys" || applied.RateLimitMsgs != 100 {
+		t.Fatalf("live settings not applied: %+v", applied)
+	}
+	if applied.Port != cur.Port || applied.FanoutWorkers != cur.FanoutWorkers {
+		t.Fatalf("restart settings applied: %+v", applied)
+	}
+
+	if _, changes := Reload(cur, cur); changes.Live != nil || changes.NewConns != nil || changes.Restart != nil {
+		t.Fatalf("expected no changes, got %+v", changes)
+	}
+}
+
+func TestLoadReadsUsers(t *testing.T) {
+	path := writeConfigFile(t, `{
+		"system_user": "sys",
+		"users": [
+			{"user": "alice", "password": "a"},
+			{"user": "bob", "password": "b", "permissions": {
+				"publish": {"allow": ["orders.>"]},
+				"subscribe": {"allow": ["orders.*", "_INBOX.>"], "deny": ["orders.secret"]}
+			}}
+		]
+	}`)
+
+	cfg, err := Load(path, nil)
+	if err != nil {
+		t.Fatalf("Load returned error: %v", err)
+	}
+	if len(cfg.Users) != 2 || cfg.Users[0].User != "alice" || cfg.Users[1].Password != "b" {
+		t.Fatalf("unexpected users %+v", cfg.Users)
+	}
+	perms := cfg.Users[1].Permissions
+	if !slices.Equal(perms.Publish.Allow, []string{"orders.>"}) || !slices.Equal(perms.Subscribe.Deny, []string{"orders.secret"}) {
+		t.Fatalf("unexpected permissions %+v", perms)
+	}
+}
+
+func TestLoadReadsUsersFromEnv(t *testing.T) {
+	t.Setenv("PUBSUB_USERS", `[{"user":"alice","password":"a"}]`)
+
+	cfg, err := NewConfig()
+	if err != nil {
+		t.Fatalf("NewConfig returned error: %v", err)
+	}
+	if len(cfg.Users) != 1 || cfg.Users[0].User != "alice" {
+		t.Fatalf("unexpected users %+v", cfg.Users)
+	}
+}
+
+func TestLoadRejectsBadUsers(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want string
+	}{
+		{name: "no name", body: `{"users": [{"password": "a"}]}`, want: "user without a name"},
+		{name: "duplicate", body: `{"users": [{"user": "a"}, {"user": "a"}]}`, want: `duplicate user "a"`},
+		{name: "system user", body: `{"system_user": "a", "users": [{"user": "a"}]}`, want: "is the system user"},
+		{name: "bad subject", body: `{"users": [{"user": "a", "permissions": {"publish": {"allow": ["a.>.b"]}}}]}`, want: `bad subject "a.>.b"`},
+		{name: "unknown field", body: `{"users": [{"user": "a", "pass": "x"}]}`, want: "pass"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Load(writeConfigFile(t, tt.body), nil)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("expected error containing %q, got %v", tt.want, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,85 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// User is a client account. When any user is configured, every client
+// other than the system user must send one of them in CONNECT.
+type User struct {
+	User        string      `json:"user"`
+	Password    string      `json:"password"`
+	Permissions Permissions `json:"permissions"`
+}
+
+// Permissions limits the subjects a user may publish and subscribe to.
+// The zero value allows everything outside $SYS.
+type Permissions struct {
+	Publish   SubjectPermission `json:"publish"`
+	Subscribe SubjectPermission `json:"subscribe"`
+}
+
+// SubjectPermission allows the subjects matching an Allow pattern, or every
+// subject when Allow is empty, except those matching a Deny pattern.
+// Patterns may use the * and > wildcards.
+type SubjectPermission struct {
+	Allow []string `json:"allow,omitempty"`
+	Deny  []string `json:"deny,omitempty"`
+}
+
+// users reads a JSON array of users. In the config file it is a plain
+// array rather than a string.
+func (s *source) users(key string) ([]User, error) {
+	value, name, ok := s.lookup(key)
+	if !ok || strings.TrimSpace(value) == "" {
+		return nil, nil
+	}
+
+	var users []User
+	dec := json.NewDecoder(strings.NewReader(value))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&users); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", name, err)
+	}
+
+	seen := make(map[string]bool, len(users))
+	for _, u := range users {
+		if u.User == "" {
+			return nil, fmt.Errorf("parse %s: user without a name", name)
+		}
+		if seen[u.User] {
+			return nil, fmt.Errorf("parse %s: duplicate user %q", name, u.User)
+		}
+		seen[u.User] = true
+		for _, patterns := range [][]string{
+			u.Permissions.Publish.Allow,
+			u.Permissions.Publish.Deny,
+			u.Permissions.Subscribe.Allow,
+			u.Permissions.Subscribe.Deny,
+		} {
+			for _, p := range patterns {
+				if !validPattern(p) {
+					return nil, fmt.Errorf("parse %s: user %q: bad subject %q", name, u.User, p)
+				}
+			}
+		}
+	}
+	return users, nil
+}
+
+// validPattern reports whether p is a subject with non-empty tokens and at
+// most one >, as its last token.
+func validPattern(p string) bool {
+	tokens := strings.Split(p, ".")
+	for i, t := range tokens {
+		if t == "" || strings.ContainsAny(t, " \t\r\n") {
+			return false
+		}
+		if t == ">" && i != len(tokens)-1 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,174 @@
+package monitor
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/elmq0022/pub-sub/internal/broker"
+	"github.com/elmq0022/pub-sub/internal/sessioncontroller"
+)
+
+// Admin acts on individual clients. *broker.Broker implements it.
+type Admin interface {
+	Kick(ctx context.Context, cid int64, reason string) (broker.ConnInfo, error)
+	Drain(ctx context.Context, cid int64) (broker.ConnInfo, error)
+	ProbeRTT(ctx context.Context, cid int64) (broker.RTTProbe, error)
+}
+
+// probeTimeout bounds how long an RTT probe waits for the client's PONG.
+const probeTimeout = 5 * time.Second
+
+// Tracer turns protocol tracing on and off. *sessioncontroller.SessionController
+// implements it.
+type Tracer interface {
+	SetTrace(on bool)
+	SetTraceCID(cid int64, on bool) error
+	Trace() sessioncontroller.TraceState
+}
+
+// SetAdminToken sets the bearer token that requests to the /admin endpoints
+// must send. Until it is set they answer every request with 401.
+func (s *Server) SetAdminToken(token string) {
+	s.adminToken = token
+}
+
+// EnableAdmin adds the endpoints that kick, drain and probe clients. They
+// change broker state, so they are only served when asked for.
+func (s *Server) EnableAdmin(a Admin) {
+	s.admin = a
+	s.handleAdmin("POST /admin/kick", s.handleKick)
+	s.handleAdmin("POST /admin/drain", s.handleDrain)
+	s.handleAdmin("POST /admin/rtt", s.handleProbeRTT)
+}
+
+// EnableTrace adds the endpoints that show and toggle protocol tracing.
+func (s *Server) EnableTrace(t Tracer) {
+	s.tracer = t
+	s.handleAdmin("GET /admin/trace", s.handleTrace)
+	s.handleAdmin("POST /admin/trace", s.handleSetTrace)
+}
+
+// handleAdmin registers h behind the admin token. The admin endpoints share
+// a listener with /metrics, which scrapers reach without credentials.
+func (s *Server) handleAdmin(pattern string, h http.HandlerFunc) {
+	s.mux.HandleFunc(pattern, func(w http.ResponseWriter, r *http.Request) {
+		if !s.authorized(r) {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h(w, r)
+	})
+}
+
+func (s *Server) authorized(r *http.Request) bool {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && s.adminToken != "" &&
+		subtle.ConstantTimeCompare([]byte(token), []byte(s.adminToken)) == 1
+}
+
+func (s *Server) handleTrace(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, s.tracer.Trace(), nil)
+}
+
+// handleSetTrace sets tracing for every connection, or for the one named by
+// cid, to on, and replies with the new state, or 404 if there is no such
+// connection.
+func (s *Server) handleSetTrace(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Query().Get("on") == "" {
+		http.Error(w, "missing on", http.StatusBadRequest)
+		return
+	}
+	on, err := boolParam(r, "on")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !r.URL.Query().Has("cid") {
+		s.tracer.SetTrace(on)
+		writeJSON(w, s.tracer.Trace(), nil)
+		return
+	}
+	cid, err := cidParam(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := s.tracer.SetTraceCID(cid, on); errors.Is(err, broker.ErrUnknownCID) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	writeJSON(w, s.tracer.Trace(), nil)
+}
+
+func (s *Server) handleKick(w http.ResponseWriter, r *http.Request) {
+	cid, err := cidParam(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), queryTimeout)
+	defer cancel()
+
+	info, err := s.admin.Kick(ctx, cid, r.URL.Query().Get("reason"))
+	writeAdmin(w, info, err)
+}
+
+func (s *Server) handleDrain(w http.ResponseWriter, r *http.Request) {
+	cid, err := cidParam(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), queryTimeout)
+	defer cancel()
+
+	info, err := s.admin.Drain(ctx, cid)
+	writeAdmin(w, info, err)
+}
+
+// handleProbeRTT pings a client and answers with its RTT once it replies.
+func (s *Server) handleProbeRTT(w http.ResponseWriter, r *http.Request) {
+	cid, err := cidParam(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), probeTimeout)
+	defer cancel()
+
+	probe, err := s.admin.ProbeRTT(ctx, cid)
+	if errors.Is(err, broker.ErrUnknownCID) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	writeJSON(w, probe, err)
+}
+
+// writeAdmin writes the client as it was before the operation, or 404 if
+// there was no such client.
+func writeAdmin(w http.ResponseWriter, info broker.ConnInfo, err error) {
+	if errors.Is(err, broker.ErrUnknownCID) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	writeJSON(w, info, err)
+}
+
+func cidParam(r *http.Request) (int64, error) {
+	raw := r.URL.Query().Get("cid")
+	cid, err := strconv.ParseInt(raw, 10, 64)
+	if err != nil || cid < 0 {
+		return 0, fmt.Errorf("invalid cid %q", raw)
+	}
+	return cid, nil
+}
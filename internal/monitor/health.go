@@ -0,0 +1,38 @@
+package monitor
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// livenessTimeout bounds the broker probe behind /healthz.
+const livenessTimeout = time.Second
+
+// SetReady marks the server ready for traffic, or not. It starts out not
+// ready; the caller sets it once the client listeners are open and clears
+// it when shutdown begins.
+func (s *Server) SetReady(ready bool) {
+	s.ready.Store(ready)
+}
+
+// handleHealthz reports whether the broker loop is still processing events,
+// by round-tripping a probe through its inbox.
+func (s *Server) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), livenessTimeout)
+	defer cancel()
+
+	if err := s.src.Ping(ctx); err != nil {
+		http.Error(w, "broker not responding: "+err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	_, _ = w.Write([]byte("ok\n"))
+}
+
+func (s *Server) handleReadyz(w http.ResponseWriter, _ *http.Request) {
+	if !s.ready.Load() {
+		http.Error(w, "not ready", http.StatusServiceUnavailable)
+		return
+	}
+	_, _ = w.Write([]byte("ok\n"))
+}
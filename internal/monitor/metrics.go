@@ -0,0 +1,65 @@
+package monitor
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/elmq0022/pub-sub/internal/broker"
+)
+
+// metricsContentType is the Prometheus text exposition format.
+const metricsContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+func (s *Server) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), queryTimeout)
+	defer cancel()
+
+	m, err := s.src.Metrics(ctx)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	w.Header().Set("Content-Type", metricsContentType)
+	counter(w, "pubsub_in_msgs_total", "PUBs received from clients.", m.InMsgs)
+	counter(w, "pubsub_in_bytes_total", "PUB payload bytes received from clients.", m.InBytes)
+	counter(w, "pubsub_out_msgs_total", "MSGs queued to clients.", m.OutMsgs)
+	counter(w, "pubsub_out_bytes_total", "MSG payload bytes queued to clients.", m.OutBytes)
+	counter(w, "pubsub_no_subscribers_total", "PUBs that matched no subscription.", m.NoSubscribers)
+	counter(w, "pubsub_slow_consumers_total", "Connections disconnected as slow consumers.", m.SlowConsumers)
+	counter(w, "pubsub_protocol_errors_total", "Connections closed for a protocol violation.", m.ProtocolErrors)
+	counter(w, "pubsub_heartbeat_timeouts_total", "Connections closed for not answering a PING.", m.HeartbeatTimeouts)
+	counter(w, "pubsub_flushes_total", "Writes to client sockets.", m.Flushes)
+	counter(w, "pubsub_written_cmds_total", "Commands written to client sockets.", m.WrittenCmds)
+	counter(w, "pubsub_rate_limit_throttles_total", "Reader pauses for going over a rate limit.", m.RateLimitThrottles)
+	secondsCounter(w, "pubsub_rate_limit_throttled_seconds_total", "Time readers spent paused by a rate limit.", m.RateLimitThrottled)
+	counter(w, "pubsub_rate_limit_disconnects_total", "Connections closed for going over a rate limit.", m.RateLimitDisconnects)
+	refused(w, m)
+	gauge(w, "pubsub_sessions", "Open client sessions.", float64(m.Sessions))
+	gauge(w, "pubsub_subscriptions", "Registered subscriptions.", float64(m.Subscriptions))
+	gauge(w, "pubsub_broker_inbox_latency_seconds", "Time a probe waited in the broker inbox.", m.InboxLatency.Seconds())
+}
+
+// refused writes the refused connections as one counter labeled by reason.
+func refused(w io.Writer, m broker.Metrics) {
+	const name = "pubsub_refused_connections_total"
+	fmt.Fprintf(w, "# HELP %s Connections closed before a session started.\n# TYPE %s counter\n", name, name)
+	fmt.Fprintf(w, "%s{reason=\"denied\"} %d\n", name, m.RefusedDenied)
+	fmt.Fprintf(w, "%s{reason=\"rate_limited\"} %d\n", name, m.RefusedRateLimited)
+	fmt.Fprintf(w, "%s{reason=\"max_connections\"} %d\n", name, m.RefusedMaxConnections)
+}
+
+func counter(w io.Writer, name, help string, v int64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n%s %d\n", name, help, name, name, v)
+}
+
+func secondsCounter(w io.Writer, name, help string, d time.Duration) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n%s %g\n", name, help, name, name, d.Seconds())
+}
+
+func gauge(w io.Writer, name, help string, v float64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %g\n", name, help, name, name, v)
+}
@@ -0,0 +1,189 @@
+// Package monitor serves the broker's state over HTTP, as JSON and in the
+// Prometheus text format, along with liveness and readiness probes.
+package monitor
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/elmq0022/pub-sub/internal/broker"
+)
+
+// queryTimeout bounds how long a request waits on the broker loop.
+const queryTimeout = 2 * time.Second
+
+// Source answers monitoring queries. *broker.Broker implements it.
+type Source interface {
+	Varz(ctx context.Context) (broker.Varz, error)
+	Connz(ctx context.Context, opts broker.ConnzOptions) (broker.Connz, error)
+	Subsz(ctx context.Context, opts broker.SubszOptions) (broker.Subsz, error)
+	Metrics(ctx context.Context) (broker.Metrics, error)
+	Ping(ctx context.Context) error
+}
+
+type Server struct {
+	addr string
+	src  Source
+	// admin and tracer are nil unless EnableAdmin and EnableTrace were
+	// called.
+	admin      Admin
+	tracer     Tracer
+	adminToken string
+	mux        *http.ServeMux
+	http       *http.Server
+	ln         net.Listener
+
+	ready atomic.Bool
+}
+
+func NewServer(addr string, src Source) *Server {
+	s := &Server{
+		addr: addr,
+		src:  src,
+		mux:  http.NewServeMux(),
+	}
+	s.mux.HandleFunc("GET /varz", s.handleVarz)
+	s.mux.HandleFunc("GET /connz", s.handleConnz)
+	s.mux.HandleFunc("GET /subsz", s.handleSubsz)
+	s.mux.HandleFunc("GET /metrics", s.handleMetrics)
+	s.mux.HandleFunc("GET /healthz", s.handleHealthz)
+	s.mux.HandleFunc("GET /readyz", s.handleReadyz)
+	s.http = &http.Server{Handler: s.mux, ReadHeaderTimeout: queryTimeout}
+	return s
+}
+
+// Handler returns the endpoints without a listener.
+func (s *Server) Handler() http.Handler {
+	return s.mux
+}
+
+// Listen opens the monitoring listener.
+func (s *Server) Listen() error {
+	ln, err := net.Listen("tcp", s.addr)
+	if err != nil {
+		return err
+	}
+	s.ln = ln
+	return nil
+}
+
+// Addr returns the bound address of the listener.
+func (s *Server) Addr() net.Addr {
+	return s.ln.Addr()
+}
+
+// Serve handles requests until the server is closed.
+func (s *Server) Serve() error {
+	if err := s.http.Serve(s.ln); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+func (s *Server) Close() error {
+	return s.http.Close()
+}
+
+func (s *Server) handleVarz(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), queryTimeout)
+	defer cancel()
+
+	v, err := s.src.Varz(ctx)
+	writeJSON(w, v, err)
+}
+
+func (s *Server) handleConnz(w http.ResponseWriter, r *http.Request) {
+	offset, limit, err := pageParams(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	opts := broker.ConnzOptions{
+		Offset: offset,
+		Limit:  limit,
+		Sort:   broker.ConnzSort(r.URL.Query().Get("sort")),
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), queryTimeout)
+	defer cancel()
+
+	c, err := s.src.Connz(ctx, opts)
+	if errors.Is(err, broker.ErrUnknownSort) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, c, err)
+}
+
+func (s *Server) handleSubsz(w http.ResponseWriter, r *http.Request) {
+	offset, limit, err := pageParams(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	subs, err := boolParam(r, "subs")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	opts := broker.SubszOptions{Subscriptions: subs, Offset: offset, Limit: limit}
+
+	ctx, cancel := context.WithTimeout(r.Context(), queryTimeout)
+	defer cancel()
+
+	sz, err := s.src.Subsz(ctx, opts)
+	writeJSON(w, sz, err)
+}
+
+// writeJSON writes v, or 503 if the broker did not answer.
+func writeJSON(w http.ResponseWriter, v any, err error) {
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	_ = enc.Encode(v)
+}
+
+func pageParams(r *http.Request) (offset, limit int, err error) {
+	if offset, err = intParam(r, "offset"); err != nil {
+		return 0, 0, err
+	}
+	if limit, err = intParam(r, "limit"); err != nil {
+		return 0, 0, err
+	}
+	return offset, limit, nil
+}
+
+func intParam(r *http.Request, key string) (int, error) {
+	raw := r.URL.Query().Get(key)
+	if raw == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(raw)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid %s %q", key, raw)
+	}
+	return n, nil
+}
+
+func boolParam(r *http.Request, key string) (bool, error) {
+	raw := r.URL.Query().Get(key)
+	if raw == "" {
+		return false, nil
+	}
+	v, err := strconv.ParseBool(raw)
+	if err != nil {
+		return false, fmt.Errorf("invalid %s %q", key, raw)
+	}
+	return v, nil
+}
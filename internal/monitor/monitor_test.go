@@ -0,0 +1,348 @@
+package monitor
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/elmq0022/pub-sub/internal/broker"
+	"github.com/elmq0022/pub-sub/internal/sessioncontroller"
+)
+
+type fakeSource struct {
+	connzOpts broker.ConnzOptions
+	subszOpts broker.SubszOptions
+	kicked    string
+	drained   int64
+	err       error
+}
+
+func (f *fakeSource) Varz(context.Context) (broker.Varz, error) {
+	return broker.Varz{Connections: 3}, f.err
+}
+
+func (f *fakeSource) Connz(_ context.Context, opts broker.ConnzOptions) (broker.Connz, error) {
+	f.connzOpts = opts
+	if opts.Sort == "color" {
+		return broker.Connz{}, broker.ErrUnknownSort
+	}
+	return broker.Connz{Total: 1, Conns: []broker.ConnInfo{{CID: 7}}}, f.err
+}
+
+func (f *fakeSource) Subsz(_ context.Context, opts broker.SubszOptions) (broker.Subsz, error) {
+	f.subszOpts = opts
+	return broker.Subsz{NumSubscriptions: 2}, f.err
+}
+
+func (f *fakeSource) Metrics(context.Context) (broker.Metrics, error) {
+	return broker.Metrics{
+		InMsgs:                5,
+		Flushes:               3,
+		RefusedMaxConnections: 4,
+		RateLimitThrottled:    250 * time.Millisecond,
+		Sessions:              2,
+		InboxLatency:          1500 * time.Microsecond,
+	}, f.err
+}
+
+func (f *fakeSource) Ping(context.Context) error {
+	return f.err
+}
+
+func (f *fakeSource) Kick(_ context.Context, cid int64, reason string) (broker.ConnInfo, error) {
+	if cid != 7 {
+		return broker.ConnInfo{}, broker.ErrUnknownCID
+	}
+	f.kicked = reason
+	return broker.ConnInfo{CID: cid}, f.err
+}
+
+func (f *fakeSource) ProbeRTT(_ context.Context, cid int64) (broker.RTTProbe, error) {
+	if cid != 7 {
+		return broker.RTTProbe{}, broker.ErrUnknownCID
+	}
+	return broker.RTTProbe{CID: cid, RTT: "1ms", RTTAvg: "2ms"}, f.err
+}
+
+func (f *fakeSource) Drain(_ context.Context, cid int64) (broker.ConnInfo, error) {
+	if cid != 7 {
+		return broker.ConnInfo{}, broker.ErrUnknownCID
+	}
+	f.drained = cid
+	return broker.ConnInfo{CID: cid}, f.err
+}
+
+func get(t *testing.T, h http.Handler, target string) *httptest.ResponseRecorder {
+	t.Helper()
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, target, nil))
+	return rec
+}
+
+func post(t *testing.T, h http.Handler, target string) *httptest.ResponseRecorder {
+	t.Helper()
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, target, nil))
+	return rec
+}
+
+// testAdminToken is the admin token of the servers built by withToken.
+const testAdminToken = "admin-secret"
+
+// withToken sets testAdminToken on s and returns its handler with every
+// request sending it.
+func withToken(s *Server) http.Handler {
+	s.SetAdminToken(testAdminToken)
+	h := s.Handler()
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.Header.Set("Authorization", "Bearer "+testAdminToken)
+		h.ServeHTTP(w, r)
+	})
+}
+
+func TestVarzServesJSON(t *testing.T) {
+	h := NewServer("", &fakeSource{}).Handler()
+
+	rec := get(t, h, "/varz")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rec.Code)
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+		t.Fatalf("expected JSON content type, got %q", ct)
+	}
+	var v broker.Varz
+	if err := json.Unmarshal(rec.Body.Bytes(), &v); err != nil || v.Connections != 3 {
+		t.Fatalf("unexpected body %s (%v)", rec.Body, err)
+	}
+}
+
+func TestConnzPassesPagingAndSort(t *testing.T) {
+	src := &fakeSource{}
+	h := NewServer("", src).Handler()
+
+	rec := get(t, h, "/connz?offset=10&limit=5&sort=rtt")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rec.Code)
+	}
+	want := broker.ConnzOptions{Offset: 10, Limit: 5, Sort: broker.SortByRTT}
+	if src.connzOpts != want {
+		t.Fatalf("expected options %+v, got %+v", want, src.connzOpts)
+	}
+
+	for _, target := range []string{"/connz?limit=-1", "/connz?offset=x", "/connz?sort=color"} {
+		if rec := get(t, h, target); rec.Code != http.StatusBadRequest {
+			t.Fatalf("%s: expected 400, got %d", target, rec.Code)
+		}
+	}
+}
+
+func TestSubszPassesListingOption(t *testing.T) {
+	src := &fakeSource{}
+	h := NewServer("", src).Handler()
+
+	if rec := get(t, h, "/subsz?subs=1&limit=20"); rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rec.Code)
+	}
+	want := broker.SubszOptions{Subscriptions: true, Limit: 20}
+	if src.subszOpts != want {
+		t.Fatalf("expected options %+v, got %+v", want, src.subszOpts)
+	}
+	if rec := get(t, h, "/subsz?subs=maybe"); rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d", rec.Code)
+	}
+}
+
+func TestBrokerTimeoutIsServiceUnavailable(t *testing.T) {
+	h := NewServer("", &fakeSource{err: context.DeadlineExceeded}).Handler()
+
+	if rec := get(t, h, "/varz"); rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503, got %d", rec.Code)
+	}
+}
+
+func TestMetricsServesPrometheusText(t *testing.T) {
+	h := NewServer("", &fakeSource{}).Handler()
+
+	rec := get(t, h, "/metrics")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rec.Code)
+	}
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Fatalf("expected exposition content type, got %q", ct)
+	}
+	body := rec.Body.String()
+	for _, want := range []string{
+		"# TYPE pubsub_in_msgs_total counter\npubsub_in_msgs_total 5\n",
+		"# TYPE pubsub_sessions gauge\npubsub_sessions 2\n",
+		"pubsub_broker_inbox_latency_seconds 0.0015\n",
+		"pubsub_no_subscribers_total 0\n",
+		"# TYPE pubsub_refused_connections_total counter\npubsub_refused_connections_total{reason=\"denied\"} 0\n",
+		"pubsub_refused_connections_total{reason=\"max_connections\"} 4\n",
+		"# TYPE pubsub_flushes_total counter\npubsub_flushes_total 3\n",
+		"# TYPE pubsub_rate_limit_throttled_seconds_total counter\npubsub_rate_limit_throttled_seconds_total 0.25\n",
+	} {
+		if !strings.Contains(body, want) {
+			t.Fatalf("expected %q in\n%s", want, body)
+		}
+	}
+}
+
+func TestHealthzFollowsBrokerProbe(t *testing.T) {
+	if rec := get(t, NewServer("", &fakeSource{}).Handler(), "/healthz"); rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rec.Code)
+	}
+
+	h := NewServer("", &fakeSource{err: context.DeadlineExceeded}).Handler()
+	if rec := get(t, h, "/healthz"); rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503 for a wedged broker, got %d", rec.Code)
+	}
+}
+
+func TestReadyzFollowsReadiness(t *testing.T) {
+	s := NewServer("", &fakeSource{})
+
+	if rec := get(t, s.Handler(), "/readyz"); rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503 before listeners are up, got %d", rec.Code)
+	}
+	s.SetReady(true)
+	if rec := get(t, s.Handler(), "/readyz"); rec.Code != http.StatusOK {
+		t.Fatalf("expected 200 once ready, got %d", rec.Code)
+	}
+	s.SetReady(false)
+	if rec := get(t, s.Handler(), "/readyz"); rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503 while draining, got %d", rec.Code)
+	}
+}
+
+func TestAdminEndpointsAreOffByDefault(t *testing.T) {
+	h := NewServer("", &fakeSource{}).Handler()
+
+	if rec := post(t, h, "/admin/kick?cid=7"); rec.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 without admin, got %d", rec.Code)
+	}
+}
+
+func TestAdminEndpointsRequireToken(t *testing.T) {
+	src := &fakeSource{}
+	s := NewServer("", src)
+	s.EnableAdmin(src)
+	s.EnableTrace(&fakeTracer{})
+	h := s.Handler()
+
+	if rec := post(t, h, "/admin/kick?cid=7"); rec.Code != http.StatusUnauthorized || src.kicked != "" {
+		t.Fatalf("expected 401 before a token is set, got %d", rec.Code)
+	}
+
+	s.SetAdminToken(testAdminToken)
+	for _, auth := range []string{"", "Bearer wrong", "Basic " + testAdminToken, testAdminToken} {
+		for _, target := range []string{"/admin/kick?cid=7", "/admin/trace?on=true"} {
+			rec := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodPost, target, nil)
+			if auth != "" {
+				req.Header.Set("Authorization", auth)
+			}
+			h.ServeHTTP(rec, req)
+			if rec.Code != http.StatusUnauthorized || rec.Header().Get("WWW-Authenticate") == "" {
+				t.Fatalf("%s with %q: expected 401, got %d", target, auth, rec.Code)
+			}
+		}
+	}
+	if src.kicked != "" {
+		t.Fatal("expected no kick without the token")
+	}
+
+	if rec := get(t, h, "/metrics"); rec.Code != http.StatusOK {
+		t.Fatalf("expected /metrics to need no token, got %d", rec.Code)
+	}
+}
+
+func TestAdminKickDrainAndProbe(t *testing.T) {
+	src := &fakeSource{}
+	s := NewServer("", src)
+	s.EnableAdmin(src)
+	h := withToken(s)
+
+	rec := post(t, h, "/admin/kick?cid=7&reason=misbehaving")
+	if rec.Code != http.StatusOK || src.kicked != "misbehaving" {
+		t.Fatalf("expected kick with reason, got %d (%q)", rec.Code, src.kicked)
+	}
+	var info broker.ConnInfo
+	if err := json.Unmarshal(rec.Body.Bytes(), &info); err != nil || info.CID != 7 {
+		t.Fatalf("unexpected body %s (%v)", rec.Body, err)
+	}
+
+	if rec := post(t, h, "/admin/drain?cid=7"); rec.Code != http.StatusOK || src.drained != 7 {
+		t.Fatalf("expected drain, got %d", rec.Code)
+	}
+	rec = post(t, h, "/admin/rtt?cid=7")
+	var probe broker.RTTProbe
+	if err := json.Unmarshal(rec.Body.Bytes(), &probe); err != nil || probe.RTTAvg != "2ms" {
+		t.Fatalf("unexpected probe body %s (%v)", rec.Body, err)
+	}
+	if rec := post(t, h, "/admin/rtt?cid=8"); rec.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 for unknown cid, got %d", rec.Code)
+	}
+	if rec := post(t, h, "/admin/drain?cid=8"); rec.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 for unknown cid, got %d", rec.Code)
+	}
+	if rec := post(t, h, "/admin/kick?cid=x"); rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for bad cid, got %d", rec.Code)
+	}
+	if rec := get(t, h, "/admin/kick?cid=7"); rec.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("expected 405 for GET, got %d", rec.Code)
+	}
+}
+
+type fakeTracer struct {
+	state sessioncontroller.TraceState
+}
+
+func (f *fakeTracer) SetTrace(on bool) { f.state.All = on }
+
+func (f *fakeTracer) SetTraceCID(cid int64, on bool) error {
+	if cid != 7 {
+		return broker.ErrUnknownCID
+	}
+	if on {
+		f.state.CIDs = append(f.state.CIDs, cid)
+	}
+	return nil
+}
+
+func (f *fakeTracer) Trace() sessioncontroller.TraceState { return f.state }
+
+func TestTraceToggles(t *testing.T) {
+	tr := &fakeTracer{}
+	s := NewServer("", &fakeSource{})
+	s.EnableTrace(tr)
+	h := withToken(s)
+
+	if rec := post(t, h, "/admin/trace?on=true"); rec.Code != http.StatusOK || !tr.state.All {
+		t.Fatalf("expected global trace on, got %d", rec.Code)
+	}
+	if rec := post(t, h, "/admin/trace?cid=7&on=1"); rec.Code != http.StatusOK || len(tr.state.CIDs) != 1 {
+		t.Fatalf("expected cid trace on, got %d", rec.Code)
+	}
+
+	rec := get(t, h, "/admin/trace")
+	var state sessioncontroller.TraceState
+	if err := json.Unmarshal(rec.Body.Bytes(), &state); err != nil || !state.All || state.CIDs[0] != 7 {
+		t.Fatalf("unexpected body %s (%v)", rec.Body, err)
+	}
+
+	if rec := post(t, h, "/admin/trace?cid=8&on=1"); rec.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 for unknown cid, got %d", rec.Code)
+	}
+
+	for _, target := range []string{"/admin/trace", "/admin/trace?on=maybe", "/admin/trace?on=1&cid=x"} {
+		if rec := post(t, h, target); rec.Code != http.StatusBadRequest {
+			t.Fatalf("%s: expected 400, got %d", target, rec.Code)
+		}
+	}
+}
@@ -0,0 +1,229 @@
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// v2Signature prefixes every PROXY protocol v2 header.
+var v2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// v1MaxLen is the longest possible v1 header including the trailing CRLF.
+const v1MaxLen = 107
+
+var ErrNoHeader = errors.New("proxyproto: missing PROXY header")
+
+// Header is the result of parsing a PROXY protocol header. Source and
+// Destination are nil when the proxy sent a LOCAL (v2) or UNKNOWN (v1)
+// header, in which case the connection's own addresses should be used.
+type Header struct {
+	Version     int
+	Source      net.Addr
+	Destination net.Addr
+}
+
+// ReadHeader consumes a v1 or v2 PROXY header from r.
+func ReadHeader(r *bufio.Reader) (Header, error) {
+	sig, err := r.Peek(len(v2Signature))
+	if err != nil {
+		return Header{}, err
+	}
+
+	if bytes.Equal(sig, v2Signature) {
+		return readV2(r)
+	}
+	if bytes.HasPrefix(sig, []byte("PROXY ")) {
+		return readV1(r)
+	}
+	return Header{}, ErrNoHeader
+}
+
+func readV1(r *bufio.Reader) (Header, error) {
+	line := make([]byte, 0, v1MaxLen)
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return Header{}, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+		if len(line) >= v1MaxLen {
+			return Header{}, errors.New("proxyproto: v1 header too long")
+		}
+	}
+	if len(line) < 2 || line[len(line)-2] != '\r' {
+		return Header{}, errors.New("proxyproto: v1 header missing CRLF")
+	}
+
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if len(fields) < 2 || fields[0] != "PROXY" {
+		return Header{}, errors.New("proxyproto: bad v1 header")
+	}
+
+	switch fields[1] {
+	case "UNKNOWN":
+		return Header{Version: 1}, nil
+	case "TCP4", "TCP6":
+	default:
+		return Header{}, fmt.Errorf("proxyproto: unsupported v1 protocol %q", fields[1])
+	}
+	if len(fields) != 6 {
+		return Header{}, errors.New("proxyproto: bad v1 header")
+	}
+
+	src, err := v1Addr(fields[1], fields[2], fields[4])
+	if err != nil {
+		return Header{}, err
+	}
+	dst, err := v1Addr(fields[1], fields[3], fields[5])
+	if err != nil {
+		return Header{}, err
+	}
+
+	return Header{Version: 1, Source: src, Destination: dst}, nil
+}
+
+func v1Addr(proto, ip, port string) (*net.TCPAddr, error) {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return nil, fmt.Errorf("proxyproto: bad v1 address %q", ip)
+	}
+	if (proto == "TCP4") != (parsed.To4() != nil) {
+		return nil, fmt.Errorf("proxyproto: address %q does not match %s", ip, proto)
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("proxyproto: bad v1 port %q", port)
+	}
+	return &net.TCPAddr{IP: parsed, Port: int(p)}, nil
+}
+
+func readV2(r *bufio.Reader) (Header, error) {
+	var fixed [16]byte
+	if _, err := io.ReadFull(r, fixed[:]); err != nil {
+		return Header{}, err
+	}
+
+	verCmd := fixed[12]
+	if verCmd>>4 != 2 {
+		return Header{}, fmt.Errorf("proxyproto: bad v2 version %d", verCmd>>4)
+	}
+	family := fixed[13]
+	length := int(binary.BigEndian.Uint16(fixed[14:16]))
+
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return Header{}, err
+	}
+
+	switch verCmd & 0x0F {
+	case 0x0: // LOCAL: health checks from the proxy itself
+		return Header{Version: 2}, nil
+	case 0x1: // PROXY
+	default:
+		return Header{}, fmt.Errorf("proxyproto: bad v2 command %d", verCmd&0x0F)
+	}
+
+	switch family {
+	case 0x11, 0x12: // TCP or UDP over IPv4
+		if len(body) < 12 {
+			return Header{}, errors.New("proxyproto: short v2 ipv4 address block")
+		}
+		return Header{
+			Version:     2,
+			Source:      &net.TCPAddr{IP: net.IP(body[0:4]), Port: int(binary.BigEndian.Uint16(body[8:10]))},
+			Destination: &net.TCPAddr{IP: net.IP(body[4:8]), Port: int(binary.BigEndian.Uint16(body[10:12]))},
+		}, nil
+	case 0x21, 0x22: // TCP or UDP over IPv6
+		if len(body) < 36 {
+			return Header{}, errors.New("proxyproto: short v2 ipv6 address block")
+		}
+		return Header{
+			Version:     2,
+			Source:      &net.TCPAddr{IP: net.IP(body[0:16]), Port: int(binary.BigEndian.Uint16(body[32:34]))},
+			Destination: &net.TCPAddr{IP: net.IP(body[16:32]), Port: int(binary.BigEndian.Uint16(body[34:36]))},
+		}, nil
+	default:
+		// AF_UNSPEC and AF_UNIX carry nothing useful for per-client limits,
+		// so keep the connection's own addresses.
+		return Header{Version: 2}, nil
+	}
+}
+
+// Conn is a net.Conn whose PROXY header has already been consumed.
+// RemoteAddr and LocalAddr report the addresses from the header when present.
+type Conn struct {
+	net.Conn
+	r      *bufio.Reader
+	header Header
+}
+
+// Accept reads the PROXY header from conn, giving up after timeout.
+// The returned Conn yields any bytes buffered past the header before reading
+// from the underlying connection again.
+func Accept(conn net.Conn, timeout time.Duration) (*Conn, error) {
+	if timeout > 0 {
+		if err := conn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+			return nil, err
+		}
+	}
+
+	r := bufio.NewReaderSize(conn, 256)
+	h, err := ReadHeader(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if timeout > 0 {
+		if err := conn.SetReadDeadline(time.Time{}); err != nil {
+			return nil, err
+		}
+	}
+
+	return &Conn{Conn: conn, r: r, header: h}, nil
+}
+
+func (c *Conn) Read(p []byte) (int, error) {
+	if c.r != nil {
+		if c.r.Buffered() > 0 {
+			return c.r.Read(p)
+		}
+		c.r = nil
+	}
+	return c.Conn.Read(p)
+}
+
+// NetConn returns the underlying connection. Only reads need to go through
+// c, and writing to the connection itself keeps io.Copy and net.Buffers on
+// its writev path.
+func (c *Conn) NetConn() net.Conn {
+	return c.Conn
+}
+
+func (c *Conn) Header() Header {
+	return c.header
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	if c.header.Source != nil {
+		return c.header.Source
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func (c *Conn) LocalAddr() net.Addr {
+	if c.header.Destination != nil {
+		return c.header.Destination
+	}
+	return c.Conn.LocalAddr()
+}
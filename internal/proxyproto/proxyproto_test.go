@@ -0,0 +1,170 @@
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadHeaderV1(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		wantSrc string
+		wantDst string
+	}{
+		{
+			name:    "tcp4",
+			input:   "PROXY TCP4 192.0.2.1 198.51.100.2 56324 4222\r\n",
+			wantSrc: "192.0.2.1:56324",
+			wantDst: "198.51.100.2:4222",
+		},
+		{
+			name:    "tcp6",
+			input:   "PROXY TCP6 2001:db8::1 2001:db8::2 40000 4222\r\n",
+			wantSrc: "[2001:db8::1]:40000",
+			wantDst: "[2001:db8::2]:4222",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := bufio.NewReader(strings.NewReader(tt.input + "PING\r\n"))
+			h, err := ReadHeader(r)
+			require.NoError(t, err)
+			assert.Equal(t, 1, h.Version)
+			assert.Equal(t, tt.wantSrc, h.Source.String())
+			assert.Equal(t, tt.wantDst, h.Destination.String())
+
+			rest, err := io.ReadAll(r)
+			require.NoError(t, err)
+			assert.Equal(t, "PING\r\n", string(rest))
+		})
+	}
+}
+
+func TestReadHeaderV1Unknown(t *testing.T) {
+	r := bufio.NewReader(strings.NewReader("PROXY UNKNOWN\r\n"))
+	h, err := ReadHeader(r)
+	require.NoError(t, err)
+	assert.Nil(t, h.Source)
+	assert.Nil(t, h.Destination)
+}
+
+func TestReadHeaderV1Errors(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+	}{
+		{name: "missing fields", input: "PROXY TCP4 192.0.2.1\r\n"},
+		{name: "bad ip", input: "PROXY TCP4 nope 198.51.100.2 1 2\r\n"},
+		{name: "family mismatch", input: "PROXY TCP4 2001:db8::1 198.51.100.2 1 2\r\n"},
+		{name: "bad port", input: "PROXY TCP4 192.0.2.1 198.51.100.2 99999 2\r\n"},
+		{name: "missing cr", input: "PROXY TCP4 192.0.2.1 198.51.100.2 1 2\n"},
+		{name: "too long", input: "PROXY " + strings.Repeat("A", 200) + "\r\n"},
+		{name: "not proxy", input: "CONNECT {}\r\nPING\r\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ReadHeader(bufio.NewReader(strings.NewReader(tt.input)))
+			require.Error(t, err)
+		})
+	}
+}
+
+func v2Header(cmd, family byte, body []byte) []byte {
+	var b bytes.Buffer
+	b.Write(v2Signature)
+	b.WriteByte(0x20 | cmd)
+	b.WriteByte(family)
+	_ = binary.Write(&b, binary.BigEndian, uint16(len(body)))
+	b.Write(body)
+	return b.Bytes()
+}
+
+func TestReadHeaderV2(t *testing.T) {
+	t.Run("tcp4 with tlv", func(t *testing.T) {
+		body := []byte{192, 0, 2, 1, 198, 51, 100, 2, 0xDC, 0x04, 0x10, 0x7E}
+		body = append(body, 0x04, 0x00, 0x01, 0xFF) // trailing TLV is skipped
+		r := bufio.NewReader(bytes.NewReader(append(v2Header(0x1, 0x11, body), "PING\r\n"...)))
+
+		h, err := ReadHeader(r)
+		require.NoError(t, err)
+		assert.Equal(t, 2, h.Version)
+		assert.Equal(t, "192.0.2.1:56324", h.Source.String())
+		assert.Equal(t, "198.51.100.2:4222", h.Destination.String())
+
+		rest, err := io.ReadAll(r)
+		require.NoError(t, err)
+		assert.Equal(t, "PING\r\n", string(rest))
+	})
+
+	t.Run("tcp6", func(t *testing.T) {
+		src := net.ParseIP("2001:db8::1").To16()
+		dst := net.ParseIP("2001:db8::2").To16()
+		body := append(append([]byte{}, src...), dst...)
+		body = append(body, 0x9C, 0x40, 0x10, 0x7E)
+
+		h, err := ReadHeader(bufio.NewReader(bytes.NewReader(v2Header(0x1, 0x21, body))))
+		require.NoError(t, err)
+		assert.Equal(t, "[2001:db8::1]:40000", h.Source.String())
+		assert.Equal(t, "[2001:db8::2]:4222", h.Destination.String())
+	})
+
+	t.Run("local command keeps connection address", func(t *testing.T) {
+		h, err := ReadHeader(bufio.NewReader(bytes.NewReader(v2Header(0x0, 0x00, nil))))
+		require.NoError(t, err)
+		assert.Nil(t, h.Source)
+	})
+
+	t.Run("short address block", func(t *testing.T) {
+		_, err := ReadHeader(bufio.NewReader(bytes.NewReader(v2Header(0x1, 0x11, []byte{1, 2, 3}))))
+		require.Error(t, err)
+	})
+
+	t.Run("bad version", func(t *testing.T) {
+		hdr := v2Header(0x1, 0x11, make([]byte, 12))
+		hdr[12] = 0x11
+		_, err := ReadHeader(bufio.NewReader(bytes.NewReader(hdr)))
+		require.Error(t, err)
+	})
+}
+
+func TestAcceptWrapsConn(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+
+	go func() {
+		_, _ = client.Write([]byte("PROXY TCP4 203.0.113.9 198.51.100.2 5000 4222\r\nPING\r\n"))
+	}()
+
+	conn, err := Accept(server, time.Second)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	assert.Equal(t, "203.0.113.9:5000", conn.RemoteAddr().String())
+	assert.Equal(t, "198.51.100.2:4222", conn.LocalAddr().String())
+
+	buf := make([]byte, 6)
+	_, err = io.ReadFull(conn, buf)
+	require.NoError(t, err)
+	assert.Equal(t, "PING\r\n", string(buf))
+}
+
+func TestAcceptTimesOut(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	_, err := Accept(server, 20*time.Millisecond)
+	require.Error(t, err)
+}
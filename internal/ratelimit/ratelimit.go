@@ -0,0 +1,255 @@
+// Package ratelimit provides the token buckets readers use to bound how fast
+// one connection, or every connection from one IP, may send.
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// Bucket is a token bucket refilled at rate tokens per second up to burst.
+// It starts full. Buckets are safe for concurrent use because per-IP buckets
+// are shared by every reader from that address.
+//
+// A nil *Bucket is valid and never limits, so a disabled limit needs no
+// special casing.
+type Bucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// NewBucket returns a bucket allowing rate tokens per second with a burst of
+// one second's worth, or nil when rate is zero or less.
+func NewBucket(rate int) *Bucket {
+	if rate <= 0 {
+		return nil
+	}
+	return &Bucket{
+		rate:   float64(rate),
+		burst:  float64(rate),
+		tokens: float64(rate),
+	}
+}
+
+func (b *Bucket) refill(now time.Time) {
+	if !b.last.IsZero() {
+		if elapsed := now.Sub(b.last).Seconds(); elapsed > 0 {
+			b.tokens = min(b.burst, b.tokens+elapsed*b.rate)
+		}
+	}
+	b.last = now
+}
+
+// Allow takes n tokens if they are available and reports whether it did. A
+// request larger than the burst is allowed once the bucket is full, leaving
+// it in debt, so an oversized message is slowed down rather than refused
+// forever.
+func (b *Bucket) Allow(now time.Time, n int) bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.refill(now)
+	if b.tokens < min(float64(n), b.burst) {
+		return false
+	}
+	b.tokens -= float64(n)
+	return true
+}
+
+// Reserve takes n tokens, borrowing against future refills if needed, and
+// returns how long the caller should pause until the bucket is out of debt.
+func (b *Bucket) Reserve(now time.Time, n int) time.Duration {
+	if b == nil {
+		return 0
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.refill(now)
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// Limit pairs a messages per second bucket with a bytes per second bucket.
+type Limit struct {
+	Msgs  *Bucket
+	Bytes *Bucket
+}
+
+// NewLimit returns a Limit, or nil when both rates are disabled.
+func NewLimit(msgsPerSec, bytesPerSec int) *Limit {
+	if msgsPerSec <= 0 && bytesPerSec <= 0 {
+		return nil
+	}
+	return &Limit{
+		Msgs:  NewBucket(msgsPerSec),
+		Bytes: NewBucket(bytesPerSec),
+	}
+}
+
+// Allow reports whether one message of size bytes fits both buckets.
+func (l *Limit) Allow(now time.Time, size int) bool {
+	if l == nil {
+		return true
+	}
+	return l.Msgs.Allow(now, 1) && l.Bytes.Allow(now, size)
+}
+
+// Reserve charges one message of size bytes and returns the longer of the
+// two pauses.
+func (l *Limit) Reserve(now time.Time, size int) time.Duration {
+	if l == nil {
+		return 0
+	}
+	return max(l.Msgs.Reserve(now, 1), l.Bytes.Reserve(now, size))
+}
+
+// Registry hands out one shared Limit per key, such as a client IP, and
+// forgets it once the last connection using it has released it.
+type Registry struct {
+	mu          sync.Mutex
+	msgsPerSec  int
+	bytesPerSec int
+	entries     map[string]*entry
+}
+
+type entry struct {
+	limit *Limit
+	refs  int
+}
+
+// NewRegistry returns a registry, or nil when both rates are disabled.
+func NewRegistry(msgsPerSec, bytesPerSec int) *Registry {
+	if msgsPerSec <= 0 && bytesPerSec <= 0 {
+		return nil
+	}
+	return &Registry{
+		msgsPerSec:  msgsPerSec,
+		bytesPerSec: bytesPerSec,
+		entries:     make(map[string]*entry),
+	}
+}
+
+// Acquire returns the Limit for key, creating it on first use. Every call
+// must be paired with Release.
+func (r *Registry) Acquire(key string) *Limit {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	e, ok := r.entries[key]
+	if !ok {
+		e = &entry{limit: NewLimit(r.msgsPerSec, r.bytesPerSec)}
+		r.entries[key] = e
+	}
+	e.refs++
+	return e.limit
+}
+
+func (r *Registry) Release(key string) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	e, ok := r.entries[key]
+	if !ok {
+		return
+	}
+	if e.refs--; e.refs <= 0 {
+		delete(r.entries, key)
+	}
+}
+
+// Len returns how many keys currently have a Limit.
+func (r *Registry) Len() int {
+	if r == nil {
+		return 0
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return len(r.entries)
+}
+
+// Keyed is a set of independent buckets, one per key, for limits such as new
+// connections per second from each IP. Keys whose bucket has refilled are
+// swept at most once a second, so a scan from many addresses cannot grow the
+// set without bound.
+type Keyed struct {
+	mu        sync.Mutex
+	rate      int
+	buckets   map[string]*Bucket
+	lastSweep time.Time
+}
+
+// NewKeyed returns a Keyed allowing rate events per second per key, or nil
+// when rate is zero or less.
+func NewKeyed(rate int) *Keyed {
+	if rate <= 0 {
+		return nil
+	}
+	return &Keyed{
+		rate:    rate,
+		buckets: make(map[string]*Bucket),
+	}
+}
+
+// Allow takes one token from key's bucket if one is available.
+func (k *Keyed) Allow(now time.Time, key string) bool {
+	if k == nil {
+		return true
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if now.Sub(k.lastSweep) >= time.Second {
+		k.sweep(now)
+	}
+	b, ok := k.buckets[key]
+	if !ok {
+		b = NewBucket(k.rate)
+		k.buckets[key] = b
+	}
+	return b.Allow(now, 1)
+}
+
+func (k *Keyed) sweep(now time.Time) {
+	for key, b := range k.buckets {
+		if b.full(now) {
+			delete(k.buckets, key)
+		}
+	}
+	k.lastSweep = now
+}
+
+// Len returns how many keys currently have a bucket.
+func (k *Keyed) Len() int {
+	if k == nil {
+		return 0
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	return len(k.buckets)
+}
+
+func (b *Bucket) full(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.refill(now)
+	return b.tokens >= b.burst
+}
@@ -0,0 +1,105 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBucketAllowRefillsOverTime(t *testing.T) {
+	b := NewBucket(2)
+	now := time.Unix(0, 0)
+
+	if !b.Allow(now, 1) || !b.Allow(now, 1) {
+		t.Fatal("expected the initial burst to be allowed")
+	}
+	if b.Allow(now, 1) {
+		t.Fatal("expected an empty bucket to refuse")
+	}
+	if !b.Allow(now.Add(500*time.Millisecond), 1) {
+		t.Fatal("expected half a second to refill one token")
+	}
+}
+
+func TestBucketAllowsOversizedRequestWhenFull(t *testing.T) {
+	b := NewBucket(10)
+	now := time.Unix(0, 0)
+
+	if !b.Allow(now, 25) {
+		t.Fatal("expected a full bucket to allow a request larger than the burst")
+	}
+	if b.Allow(now.Add(time.Second), 1) {
+		t.Fatal("expected the bucket to still be in debt after one second")
+	}
+}
+
+func TestBucketReserveReturnsPause(t *testing.T) {
+	b := NewBucket(10)
+	now := time.Unix(0, 0)
+
+	if wait := b.Reserve(now, 10); wait != 0 {
+		t.Fatalf("expected the burst to need no pause, got %v", wait)
+	}
+	if wait := b.Reserve(now, 5); wait != 500*time.Millisecond {
+		t.Fatalf("expected a 500ms pause, got %v", wait)
+	}
+}
+
+func TestNilBucketAndLimitNeverLimit(t *testing.T) {
+	var l *Limit
+	if !l.Allow(time.Now(), 1<<30) || l.Reserve(time.Now(), 1<<30) != 0 {
+		t.Fatal("expected a nil limit to allow everything")
+	}
+	if NewLimit(0, 0) != nil || NewRegistry(0, 0) != nil {
+		t.Fatal("expected disabled rates to produce nil limits")
+	}
+
+	l = NewLimit(0, 4)
+	now := time.Unix(0, 0)
+	if !l.Allow(now, 4) {
+		t.Fatal("expected the byte burst to be allowed")
+	}
+	if l.Allow(now, 1) {
+		t.Fatal("expected the byte limit to apply without a message limit")
+	}
+}
+
+func TestRegistrySharesLimitPerKeyUntilReleased(t *testing.T) {
+	r := NewRegistry(1, 0)
+
+	a := r.Acquire("10.0.0.1")
+	b := r.Acquire("10.0.0.1")
+	c := r.Acquire("10.0.0.2")
+	if a != b || a == c {
+		t.Fatal("expected one shared limit per key")
+	}
+
+	r.Release("10.0.0.1")
+	r.Release("10.0.0.2")
+	if got := r.Len(); got != 1 {
+		t.Fatalf("expected 1 key still in use, got %d", got)
+	}
+	r.Release("10.0.0.1")
+	if got := r.Len(); got != 0 {
+		t.Fatalf("expected released keys to be forgotten, got %d", got)
+	}
+}
+
+func TestKeyedLimitsEachKeyAndSweepsIdleOnes(t *testing.T) {
+	k := NewKeyed(1)
+	now := time.Unix(100, 0)
+
+	if !k.Allow(now, "a") || k.Allow(now, "a") {
+		t.Fatal("expected one event per second for a key")
+	}
+	if !k.Allow(now, "b") {
+		t.Fatal("expected keys to be limited independently")
+	}
+
+	// Both buckets have refilled by the next sweep.
+	if !k.Allow(now.Add(2*time.Second), "c") {
+		t.Fatal("expected a new key to be allowed")
+	}
+	if got := k.Len(); got != 1 {
+		t.Fatalf("expected idle keys to be swept, got %d", got)
+	}
+}
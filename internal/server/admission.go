@@ -0,0 +1,79 @@
+package server
+
+import (
+	"net"
+	"net/netip"
+	"time"
+
+	"github.com/elmq0022/pub-sub/internal/config"
+	"github.com/elmq0022/pub-sub/internal/ratelimit"
+	"github.com/elmq0022/pub-sub/internal/stats"
+)
+
+// admission decides whether a new connection may reach the session
+// controller, based on its source IP. It runs before a CID or any goroutine
+// is allocated, so refusing is cheap during scans and reconnect storms.
+type admission struct {
+	allow []netip.Prefix
+	deny  []netip.Prefix
+	rate  *ratelimit.Keyed
+	stats *stats.Accept
+}
+
+func newAdmission(cfg config.Config, st *stats.Accept) admission {
+	return admission{
+		allow: cfg.AllowCIDRs,
+		deny:  cfg.DenyCIDRs,
+		rate:  ratelimit.NewKeyed(cfg.ConnRatePerIP),
+		stats: st,
+	}
+}
+
+// admit reports whether a connection from addr may proceed. Addresses with
+// no IP, such as Unix socket peers, are always admitted.
+func (a admission) admit(addr net.Addr) bool {
+	ip, ok := addrIP(addr)
+	if !ok {
+		return true
+	}
+	if !a.allowed(ip) {
+		a.stats.Denied.Add(1)
+		return false
+	}
+	if !a.rate.Allow(time.Now(), ip.String()) {
+		a.stats.RateLimited.Add(1)
+		return false
+	}
+	return true
+}
+
+func (a admission) allowed(ip netip.Addr) bool {
+	for _, p := range a.deny {
+		if p.Contains(ip) {
+			return false
+		}
+	}
+	if len(a.allow) == 0 {
+		return true
+	}
+	for _, p := range a.allow {
+		if p.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func addrIP(addr net.Addr) (netip.Addr, bool) {
+	var ip net.IP
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		ip = a.IP
+	case *net.UDPAddr:
+		ip = a.IP
+	default:
+		return netip.Addr{}, false
+	}
+	parsed, ok := netip.AddrFromSlice(ip)
+	return parsed.Unmap(), ok
+}
@@ -0,0 +1,130 @@
+package server
+
+import (
+	"io"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/elmq0022/pub-sub/internal/config"
+	"github.com/elmq0022/pub-sub/internal/stats"
+)
+
+func TestAdmissionAppliesDenyBeforeAllow(t *testing.T) {
+	a := newAdmission(config.Config{
+		AllowCIDRs: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")},
+		DenyCIDRs:  []netip.Prefix{netip.MustParsePrefix("10.1.0.0/16")},
+	}, &stats.Accept{})
+
+	tests := []struct {
+		addr net.Addr
+		want bool
+	}{
+		{addr: &net.TCPAddr{IP: net.ParseIP("10.2.3.4")}, want: true},
+		{addr: &net.TCPAddr{IP: net.ParseIP("10.1.3.4")}, want: false},
+		{addr: &net.TCPAddr{IP: net.ParseIP("192.168.0.1")}, want: false},
+		{addr: &net.TCPAddr{IP: net.ParseIP("::ffff:10.2.3.4")}, want: true},
+		{addr: &net.UnixAddr{Name: "/tmp/pubsub.sock", Net: "unix"}, want: true},
+	}
+	for _, tt := range tests {
+		if got := a.admit(tt.addr); got != tt.want {
+			t.Fatalf("admit(%s) = %v, want %v", tt.addr, got, tt.want)
+		}
+	}
+	if got := a.stats.Denied.Load(); got != 2 {
+		t.Fatalf("expected 2 denied connections, got %d", got)
+	}
+}
+
+func TestServerClosesDeniedConnectionsBeforeStart(t *testing.T) {
+	starter := &recordingStarter{conns: make(chan net.Conn, 1)}
+	cfg := testConfig(config.Listener{Network: "tcp", Address: "127.0.0.1:0"})
+	cfg.DenyCIDRs = []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")}
+	s := NewServer(cfg, starter)
+	if err := s.Listen(); err != nil {
+		t.Fatalf("Listen returned error: %v", err)
+	}
+	defer s.Close()
+	go s.Serve()
+
+	assertClosedByServer(t, s.Addrs()[0])
+	assertNotStarted(t, starter)
+	if got := s.AcceptStats().Denied.Load(); got != 1 {
+		t.Fatalf("expected 1 denied connection, got %d", got)
+	}
+}
+
+func TestServerReloadDeniesNewConnections(t *testing.T) {
+	starter := &recordingStarter{conns: make(chan net.Conn, 1)}
+	cfg := testConfig(config.Listener{Network: "tcp", Address: "127.0.0.1:0"})
+	s := NewServer(cfg, starter)
+	if err := s.Listen(); err != nil {
+		t.Fatalf("Listen returned error: %v", err)
+	}
+	defer s.Close()
+	go s.Serve()
+
+	cfg.DenyCIDRs = []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")}
+	s.Reload(cfg)
+
+	assertClosedByServer(t, s.Addrs()[0])
+	assertNotStarted(t, starter)
+	if got := s.AcceptStats().Denied.Load(); got != 1 {
+		t.Fatalf("expected 1 denied connection, got %d", got)
+	}
+}
+
+func TestServerLimitsNewConnectionsPerIP(t *testing.T) {
+	starter := &recordingStarter{conns: make(chan net.Conn, 1)}
+	cfg := testConfig(config.Listener{Network: "tcp", Address: "127.0.0.1:0"})
+	cfg.ConnRatePerIP = 1
+	s := NewServer(cfg, starter)
+	if err := s.Listen(); err != nil {
+		t.Fatalf("Listen returned error: %v", err)
+	}
+	defer s.Close()
+	go s.Serve()
+
+	first, err := net.Dial("tcp", s.Addrs()[0].String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer first.Close()
+	select {
+	case conn := <-starter.conns:
+		_ = conn.Close()
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for accepted connection")
+	}
+
+	assertClosedByServer(t, s.Addrs()[0])
+	assertNotStarted(t, starter)
+	if got := s.AcceptStats().RateLimited.Load(); got != 1 {
+		t.Fatalf("expected 1 rate limited connection, got %d", got)
+	}
+}
+
+func assertClosedByServer(t *testing.T, addr net.Addr) {
+	t.Helper()
+
+	conn, err := net.Dial(addr.Network(), addr.String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("expected the server to close the connection, got %v", err)
+	}
+}
+
+func assertNotStarted(t *testing.T, starter *recordingStarter) {
+	t.Helper()
+
+	select {
+	case <-starter.conns:
+		t.Fatal("refused connection reached the session starter")
+	default:
+	}
+}
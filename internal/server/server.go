@@ -0,0 +1,249 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/elmq0022/pub-sub/internal/config"
+	"github.com/elmq0022/pub-sub/internal/proxyproto"
+	"github.com/elmq0022/pub-sub/internal/stats"
+)
+
+// SessionStarter is satisfied by the session controller. Every listener hands
+// accepted connections to the same starter so all clients share one broker.
+type SessionStarter interface {
+	Start(conn net.Conn)
+	// Active reports how many started sessions have not ended yet.
+	Active() int64
+}
+
+// maxConnectionsErr is written to a connection refused by MaxConnections.
+const maxConnectionsErr = "-ERR 'Maximum Connections Exceeded'\r\n"
+
+// rejectWriteTimeout bounds how long writing the refusal may take.
+const rejectWriteTimeout = time.Second
+
+type Server struct {
+	config    config.Config
+	sessions  SessionStarter
+	listeners []listener
+
+	// handshaking counts accepted connections still reading a PROXY header,
+	// which the session starter does not know about yet.
+	handshaking atomic.Int64
+
+	// admission and maxConns are swapped by Reload while accept loops
+	// read them.
+	admission   atomic.Pointer[admission]
+	maxConns    atomic.Int64
+	acceptStats stats.Accept
+
+	logger *slog.Logger
+}
+
+type listener struct {
+	net.Listener
+	proxyProtocol bool
+}
+
+func NewServer(cfg config.Config, sessions SessionStarter) *Server {
+	s := &Server{
+		config:   cfg,
+		sessions: sessions,
+		logger:   slog.Default(),
+	}
+	a := newAdmission(cfg, &s.acceptStats)
+	s.admission.Store(&a)
+	s.maxConns.Store(int64(cfg.MaxConnections))
+	return s
+}
+
+// Reload applies MaxConnections and the allowed and denied networks of cfg
+// to connections accepted after it returns. Connections already open are
+// not affected.
+func (s *Server) Reload(cfg config.Config) {
+	a := *s.admission.Load()
+	a.allow = cfg.AllowCIDRs
+	a.deny = cfg.DenyCIDRs
+	s.admission.Store(&a)
+	s.maxConns.Store(int64(cfg.MaxConnections))
+}
+
+// SetLogger replaces the logger, which is slog's default logger unless set.
+// It must be called before Serve.
+func (s *Server) SetLogger(l *slog.Logger) {
+	s.logger = l
+}
+
+// AcceptStats returns counters of connections refused before a session was
+// started.
+func (s *Server) AcceptStats() *stats.Accept {
+	return &s.acceptStats
+}
+
+// Listen opens every configured listener. If any listener fails to open, the
+// ones already opened are closed and the error is returned.
+func (s *Server) Listen() error {
+	if len(s.config.Listeners) == 0 {
+		return errors.New("no listeners configured")
+	}
+
+	for _, cfg := range s.config.Listeners {
+		ln, err := listen(cfg)
+		if err != nil {
+			_ = s.Close()
+			return err
+		}
+		s.listeners = append(s.listeners, listener{
+			Listener:      ln,
+			proxyProtocol: cfg.ProxyProtocol,
+		})
+	}
+	return nil
+}
+
+// Addrs returns the bound address of every open listener.
+func (s *Server) Addrs() []net.Addr {
+	addrs := make([]net.Addr, 0, len(s.listeners))
+	for _, ln := range s.listeners {
+		addrs = append(addrs, ln.Addr())
+	}
+	return addrs
+}
+
+// Serve runs one accept loop per listener and blocks until all of them have
+// returned, which happens once the listeners are closed.
+func (s *Server) Serve() {
+	var wg sync.WaitGroup
+	for _, ln := range s.listeners {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.acceptLoop(ln)
+		}()
+	}
+	wg.Wait()
+}
+
+func (s *Server) Close() error {
+	var errs []error
+	for _, ln := range s.listeners {
+		if err := ln.Close(); err != nil && !errors.Is(err, net.ErrClosed) {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (s *Server) acceptLoop(ln listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			s.logger.Error("accept error", "listener", ln.Addr().String(), "err", err)
+			continue
+		}
+
+		// Behind a PROXY listener the peer is the load balancer, so the
+		// client's address is only checked once the header has been read.
+		if !ln.proxyProtocol && !s.admission.Load().admit(conn.RemoteAddr()) {
+			_ = conn.Close()
+			continue
+		}
+
+		if s.atCapacity() {
+			s.acceptStats.MaxConnections.Add(1)
+			go reject(conn, maxConnectionsErr)
+			continue
+		}
+
+		if ln.proxyProtocol {
+			// Reading the header can take up to the timeout, so it must not
+			// hold up the accept loop for other clients.
+			s.handshaking.Add(1)
+			go s.startProxied(conn)
+			continue
+		}
+		s.sessions.Start(conn)
+	}
+}
+
+// startProxied consumes the PROXY header before the codec sees any bytes so
+// the session is registered with the real client address.
+func (s *Server) startProxied(conn net.Conn) {
+	defer s.handshaking.Add(-1)
+
+	pc, err := proxyproto.Accept(conn, s.config.ProxyHeaderTimeout)
+	if err != nil {
+		s.logger.Warn("bad proxy header", "addr", conn.RemoteAddr().String(), "err", err)
+		_ = conn.Close()
+		return
+	}
+	if !s.admission.Load().admit(pc.RemoteAddr()) {
+		_ = pc.Close()
+		return
+	}
+	s.sessions.Start(pc)
+}
+
+// atCapacity reports whether MaxConnections are already open. Accept loops
+// run concurrently, so the limit can be passed by one connection per
+// listener at most.
+func (s *Server) atCapacity() bool {
+	limit := s.maxConns.Load()
+	return limit > 0 && s.sessions.Active()+s.handshaking.Load() >= limit
+}
+
+// reject tells a client why it is refused before closing the connection.
+func reject(conn net.Conn, msg string) {
+	_ = conn.SetWriteDeadline(time.Now().Add(rejectWriteTimeout))
+	_, _ = io.WriteString(conn, msg)
+	_ = conn.Close()
+}
+
+func listen(cfg config.Listener) (net.Listener, error) {
+	switch cfg.Network {
+	case "tcp":
+		return net.Listen("tcp", cfg.Address)
+	case "unix":
+		return listenUnix(cfg)
+	default:
+		return nil, fmt.Errorf("unsupported listener network %q", cfg.Network)
+	}
+}
+
+func listenUnix(cfg config.Listener) (net.Listener, error) {
+	// A socket file left behind by a crashed process would make bind fail.
+	// Only remove it if it really is a socket so a misconfigured path can't
+	// delete a regular file.
+	if fi, err := os.Lstat(cfg.Address); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("listen unix %s: path exists and is not a socket", cfg.Address)
+		}
+		if err := os.Remove(cfg.Address); err != nil {
+			return nil, fmt.Errorf("listen unix %s: remove stale socket: %w", cfg.Address, err)
+		}
+	}
+
+	ln, err := net.Listen("unix", cfg.Address)
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.Mode != 0 {
+		if err := os.Chmod(cfg.Address, cfg.Mode); err != nil {
+			_ = ln.Close()
+			return nil, fmt.Errorf("listen unix %s: chmod: %w", cfg.Address, err)
+		}
+	}
+	return ln, nil
+}
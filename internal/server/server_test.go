@@ -0,0 +1,227 @@
+package server
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/elmq0022/pub-sub/internal/config"
+)
+
+type recordingStarter struct {
+	conns  chan net.Conn
+	active atomic.Int64
+}
+
+func (r *recordingStarter) Start(conn net.Conn) {
+	r.conns <- conn
+}
+
+func (r *recordingStarter) Active() int64 {
+	return r.active.Load()
+}
+
+func TestServerAcceptsOnTCPAndUnixListeners(t *testing.T) {
+	sock := filepath.Join(t.TempDir(), "pubsub.sock")
+	starter := &recordingStarter{conns: make(chan net.Conn, 2)}
+	s := NewServer(testConfig(
+		config.Listener{Network: "tcp", Address: "127.0.0.1:0"},
+		config.Listener{Network: "unix", Address: sock, Mode: 0o600},
+	), starter)
+
+	if err := s.Listen(); err != nil {
+		t.Fatalf("Listen returned error: %v", err)
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		s.Serve()
+	}()
+
+	fi, err := os.Stat(sock)
+	if err != nil {
+		t.Fatalf("stat socket: %v", err)
+	}
+	if fi.Mode().Perm() != 0o600 {
+		t.Fatalf("expected socket mode 0600, got %o", fi.Mode().Perm())
+	}
+
+	addrs := s.Addrs()
+	for _, addr := range addrs {
+		conn, err := net.Dial(addr.Network(), addr.String())
+		if err != nil {
+			t.Fatalf("dial %s: %v", addr, err)
+		}
+		defer conn.Close()
+	}
+
+	for range addrs {
+		select {
+		case conn := <-starter.conns:
+			_ = conn.Close()
+		case <-time.After(time.Second):
+			t.Fatal("timed out waiting for accepted connection")
+		}
+	}
+
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close returned error: %v", err)
+	}
+	wg.Wait()
+}
+
+func TestServerListenReplacesStaleUnixSocket(t *testing.T) {
+	sock := filepath.Join(t.TempDir(), "stale.sock")
+	stale, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	// Keep the file on disk as a crashed process would.
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	_ = stale.Close()
+
+	s := NewServer(testConfig(config.Listener{Network: "unix", Address: sock}), &recordingStarter{})
+	if err := s.Listen(); err != nil {
+		t.Fatalf("Listen returned error: %v", err)
+	}
+	_ = s.Close()
+}
+
+func TestServerListenRefusesNonSocketPath(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "regular")
+	if err := os.WriteFile(path, []byte("keep me"), 0o600); err != nil {
+		t.Fatalf("write file: %v", err)
+	}
+
+	s := NewServer(testConfig(config.Listener{Network: "unix", Address: path}), &recordingStarter{})
+	if err := s.Listen(); err == nil {
+		_ = s.Close()
+		t.Fatal("expected Listen to refuse a regular file")
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("regular file was removed: %v", err)
+	}
+}
+
+func TestServerListenClosesOpenedListenersOnFailure(t *testing.T) {
+	s := NewServer(testConfig(
+		config.Listener{Network: "tcp", Address: "127.0.0.1:0"},
+		config.Listener{Network: "bogus", Address: "x"},
+	), &recordingStarter{})
+	if err := s.Listen(); err == nil {
+		t.Fatal("expected Listen to fail")
+	}
+
+	for _, ln := range s.listeners {
+		if _, err := ln.Accept(); err == nil {
+			t.Fatal("expected listener to be closed")
+		}
+	}
+}
+
+func TestServerProxyListenerRecordsClientAddress(t *testing.T) {
+	starter := &recordingStarter{conns: make(chan net.Conn, 2)}
+	s := NewServer(testConfig(
+		config.Listener{Network: "tcp", Address: "127.0.0.1:0", ProxyProtocol: true},
+	), starter)
+	if err := s.Listen(); err != nil {
+		t.Fatalf("Listen returned error: %v", err)
+	}
+	go s.Serve()
+	defer s.Close()
+
+	addr := s.Addrs()[0]
+
+	// A client that never sends a header must not block the next one.
+	silent, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer silent.Close()
+
+	conn, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("PROXY TCP4 203.0.113.7 10.0.0.1 41000 4222\r\n")); err != nil {
+		t.Fatalf("write header: %v", err)
+	}
+
+	select {
+	case accepted := <-starter.conns:
+		defer accepted.Close()
+		if got := accepted.RemoteAddr().String(); got != "203.0.113.7:41000" {
+			t.Fatalf("expected proxied remote address, got %s", got)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for proxied connection")
+	}
+}
+
+func TestServerRefusesConnectionsPastMaxConnections(t *testing.T) {
+	starter := &recordingStarter{conns: make(chan net.Conn, 1)}
+	starter.active.Store(2)
+	cfg := testConfig(config.Listener{Network: "tcp", Address: "127.0.0.1:0"})
+	cfg.MaxConnections = 2
+	s := NewServer(cfg, starter)
+	if err := s.Listen(); err != nil {
+		t.Fatalf("Listen returned error: %v", err)
+	}
+	defer s.Close()
+	go s.Serve()
+
+	conn, err := net.Dial("tcp", s.Addrs()[0].String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+
+	r := bufio.NewReader(conn)
+	line, err := r.ReadString('\n')
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if line != "-ERR 'Maximum Connections Exceeded'\r\n" {
+		t.Fatalf("unexpected refusal %q", line)
+	}
+	if _, err := r.ReadByte(); err != io.EOF {
+		t.Fatalf("expected refused connection to be closed, got %v", err)
+	}
+
+	select {
+	case <-starter.conns:
+		t.Fatal("refused connection reached the session starter")
+	default:
+	}
+
+	// A slot opening up lets the next client in.
+	starter.active.Store(1)
+	next, err := net.Dial("tcp", s.Addrs()[0].String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer next.Close()
+	select {
+	case conn := <-starter.conns:
+		_ = conn.Close()
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for accepted connection")
+	}
+}
+
+func testConfig(listeners ...config.Listener) config.Config {
+	return config.Config{
+		Listeners:          listeners,
+		ProxyHeaderTimeout: time.Second,
+	}
+}
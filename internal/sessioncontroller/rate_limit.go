@@ -0,0 +1,92 @@
+package sessioncontroller
+
+import (
+	"net"
+	"time"
+
+	"github.com/elmq0022/pub-sub/internal/codec"
+	"github.com/elmq0022/pub-sub/internal/config"
+	"github.com/elmq0022/pub-sub/internal/ratelimit"
+)
+
+// connRateLimits are the per connection rate limit settings, swapped on
+// reload while sessions start.
+type connRateLimits struct {
+	msgs   int
+	bytes  int
+	policy config.RateLimitPolicy
+}
+
+// Reload applies the per connection rate limits of cfg to connections that
+// start after it returns. Connections already open keep their limits.
+func (s *SessionController) Reload(cfg config.Config) {
+	s.connLimits.Store(&connRateLimits{
+		msgs:   cfg.RateLimitMsgs,
+		bytes:  cfg.RateLimitBytes,
+		policy: cfg.RateLimitPolicy,
+	})
+}
+
+func (s *SessionController) setRateLimits(sess *session) {
+	limits := s.connLimits.Load()
+	sess.limits[0] = ratelimit.NewLimit(limits.msgs, limits.bytes)
+	if ip := remoteIP(sess.conn.RemoteAddr()); ip != "" {
+		sess.limits[1] = s.ipLimits.Acquire(ip)
+		sess.ip = ip
+	}
+	sess.ipLimits = s.ipLimits
+	sess.throttle = limits.policy != config.RateLimitDisconnect
+	sess.rateStats = &s.rateStats
+}
+
+// remoteIP returns the IP of a TCP peer, or "" for Unix sockets and other
+// addresses without one, which are then only limited per connection.
+func remoteIP(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil || net.ParseIP(host) == nil {
+		return ""
+	}
+	return host
+}
+
+// admit charges cmd against the connection and IP rate limits before it
+// reaches the broker. Every command counts as one message and PUB payloads
+// count as bytes. Under the throttle policy the reader sleeps until the
+// buckets are out of debt, so the client is slowed by TCP backpressure and
+// admit always returns true. Otherwise it returns false once either limit
+// is exceeded and releases the command.
+func (s *session) admit(cmd codec.InboundCommands) bool {
+	if s.limits[0] == nil && s.limits[1] == nil {
+		return true
+	}
+
+	size := 0
+	if pub, ok := cmd.(codec.Pub); ok {
+		size = len(pub.Payload)
+	}
+	now := time.Now()
+
+	if s.throttle {
+		wait := max(s.limits[0].Reserve(now, size), s.limits[1].Reserve(now, size))
+		if wait > 0 {
+			s.stats.Throttles.Add(1)
+			s.stats.ThrottledNanos.Add(int64(wait))
+			s.rateStats.Throttles.Add(1)
+			s.rateStats.ThrottledNanos.Add(int64(wait))
+			time.Sleep(wait)
+		}
+		return true
+	}
+
+	if s.limits[0].Allow(now, size) && s.limits[1].Allow(now, size) {
+		return true
+	}
+	s.rateStats.Disconnects.Add(1)
+	if pub, ok := cmd.(codec.Pub); ok {
+		pub.Release()
+	}
+	return false
+}
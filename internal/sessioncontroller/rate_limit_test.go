@@ -0,0 +1,149 @@
+package sessioncontroller
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/elmq0022/pub-sub/internal/broker"
+	"github.com/elmq0022/pub-sub/internal/config"
+)
+
+// addrConn reports a fixed remote address so tests can share a source IP.
+type addrConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (c addrConn) RemoteAddr() net.Addr { return c.remote }
+
+func TestReaderLoopDisconnectsOverRateLimit(t *testing.T) {
+	brokerInbox := make(chan broker.BrokerEvent, 8)
+	cfg := testConfig()
+	cfg.RateLimitMsgs = 2
+	cfg.RateLimitPolicy = config.RateLimitDisconnect
+	controller := NewSessionController(brokerInbox, cfg)
+	server, client := net.Pipe()
+	defer client.Close()
+
+	go controller.newSession(1, server).readerLoop()
+	go func() { _, _ = client.Write([]byte("PING\r\nPING\r\nPING\r\n")) }()
+
+	for i := 0; i < 2; i++ {
+		if _, ok := waitForBrokerEvent(t, brokerInbox).(broker.CmdEvent); !ok {
+			t.Fatalf("expected command %d within the limit to be dispatched", i)
+		}
+	}
+	ev := waitForBrokerEvent(t, brokerInbox)
+	if rateErr, ok := ev.(broker.RateLimitEvent); !ok || rateErr.CID != 1 {
+		t.Fatalf("expected rate limit event, got %#v", ev)
+	}
+	if got := controller.RateLimitStats().Disconnects.Load(); got != 1 {
+		t.Fatalf("expected 1 rate limit disconnect, got %d", got)
+	}
+}
+
+func TestReloadedRateLimitsApplyToNewSessions(t *testing.T) {
+	brokerInbox := make(chan broker.BrokerEvent, 8)
+	controller := NewSessionController(brokerInbox, testConfig())
+	cfg := testConfig()
+	cfg.RateLimitMsgs = 1
+	cfg.RateLimitPolicy = config.RateLimitDisconnect
+	controller.Reload(cfg)
+	server, client := net.Pipe()
+	defer client.Close()
+
+	go controller.newSession(1, server).readerLoop()
+	go func() { _, _ = client.Write([]byte("PING\r\nPING\r\n")) }()
+
+	if _, ok := waitForBrokerEvent(t, brokerInbox).(broker.CmdEvent); !ok {
+		t.Fatal("expected the first command to be dispatched")
+	}
+	ev := waitForBrokerEvent(t, brokerInbox)
+	if _, ok := ev.(broker.RateLimitEvent); !ok {
+		t.Fatalf("expected rate limit event after reload, got %#v", ev)
+	}
+}
+
+func TestRateLimitErrReachesClientAfterEarlierReplies(t *testing.T) {
+	cfg := testConfig()
+	cfg.RateLimitMsgs = 3
+	cfg.RateLimitPolicy = config.RateLimitDisconnect
+	client := startEndToEnd(t, cfg)
+	r := bufio.NewReader(client)
+	if _, err := r.ReadString('\n'); err != nil {
+		t.Fatalf("read INFO: %v", err)
+	}
+	if _, err := io.WriteString(client, "CONNECT {\"verbose\":true}\r\nSUB foo 1\r\nPING\r\nPING\r\n"); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	var got []string
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			break
+		}
+		got = append(got, line)
+	}
+	want := []string{"+OK\r\n", "+OK\r\n", "PONG\r\n", "-ERR 'Rate Limit Exceeded'\r\n"}
+	if strings.Join(got, "") != strings.Join(want, "") {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+}
+
+func TestReaderLoopThrottlesOverRateLimit(t *testing.T) {
+	brokerInbox := make(chan broker.BrokerEvent, 64)
+	cfg := testConfig()
+	cfg.RateLimitMsgs = 100
+	controller := NewSessionController(brokerInbox, cfg)
+	server, client := net.Pipe()
+	defer client.Close()
+
+	sess := controller.newSession(1, server)
+	go sess.readerLoop()
+
+	start := time.Now()
+	go func() { _, _ = client.Write([]byte(strings.Repeat("PING\r\n", 130))) }()
+	for i := 0; i < 130; i++ {
+		if _, ok := waitForBrokerEvent(t, brokerInbox).(broker.CmdEvent); !ok {
+			t.Fatalf("expected command %d to be dispatched", i)
+		}
+	}
+
+	// 100 commands fit the burst; the other 30 take about 300ms.
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+		t.Fatalf("expected reads to be throttled, took %v", elapsed)
+	}
+	if sess.stats.Throttles.Load() == 0 || controller.RateLimitStats().ThrottledNanos.Load() == 0 {
+		t.Fatal("expected throttle counters to be updated")
+	}
+}
+
+func TestSessionsFromOneIPShareLimitUntilDown(t *testing.T) {
+	brokerInbox := make(chan broker.BrokerEvent, 4)
+	cfg := testConfig()
+	cfg.RateLimitIPMsgs = 10
+	controller := NewSessionController(brokerInbox, cfg)
+
+	remote := &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1234}
+	first := controller.newSession(1, addrConn{Conn: newTestConn(nil), remote: remote})
+	remote2 := &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 5678}
+	second := controller.newSession(2, addrConn{Conn: newTestConn(nil), remote: remote2})
+
+	if first.limits[1] == nil || first.limits[1] != second.limits[1] {
+		t.Fatal("expected sessions from one IP to share a limit")
+	}
+	if first.limits[0] != nil {
+		t.Fatal("expected no per-connection limit when it is disabled")
+	}
+
+	first.sendSessionDownOnce()
+	second.sendSessionDownOnce()
+	if got := controller.ipLimits.Len(); got != 0 {
+		t.Fatalf("expected the IP limit to be released, got %d entries", got)
+	}
+}
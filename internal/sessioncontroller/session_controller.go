@@ -4,6 +4,7 @@ import (
 	"bufio"
 	"errors"
 	"io"
+	"log/slog"
 	"net"
 	"sync"
 	"sync/atomic"
@@ -11,71 +12,317 @@ import (
 
 	"github.com/elmq0022/pub-sub/internal/broker"
 	"github.com/elmq0022/pub-sub/internal/codec"
+	"github.com/elmq0022/pub-sub/internal/config"
+	"github.com/elmq0022/pub-sub/internal/proxyproto"
+	"github.com/elmq0022/pub-sub/internal/ratelimit"
+	"github.com/elmq0022/pub-sub/internal/stats"
 )
 
 type SessionController struct {
-	brokerInbox chan<- broker.BrokerEvent
-	nextCID     atomic.Int64
+	brokerInbox  chan<- broker.BrokerEvent
+	controlInbox chan<- broker.BrokerEvent
+	router       PublishRouter
+	config       config.Config
+	nextCID      atomic.Int64
+	active       atomic.Int64
+	writerStats  stats.Writer
+
+	ipLimits   *ratelimit.Registry
+	connLimits atomic.Pointer[connRateLimits]
+	rateStats  stats.RateLimit
+
+	logger *slog.Logger
+	trace  tracer
 }
 
-func NewSessionController(brokerInbox chan<- broker.BrokerEvent) *SessionController {
-	return &SessionController{
-		brokerInbox: brokerInbox,
+// PublishRouter is implemented by the broker when PUBs may bypass its inbox
+// and go to parallel fanout workers instead.
+type PublishRouter interface {
+	PublishInput(cid int64) chan<- broker.BrokerEvent
+	Parallel() bool
+}
+
+func NewSessionController(brokerInbox chan<- broker.BrokerEvent, cfg config.Config) *SessionController {
+	s := &SessionController{
+		brokerInbox:  brokerInbox,
+		controlInbox: brokerInbox,
+		config:       cfg,
+		ipLimits:     ratelimit.NewRegistry(cfg.RateLimitIPMsgs, cfg.RateLimitIPBytes),
+		logger:       slog.New(slog.DiscardHandler),
 	}
+	s.Reload(cfg)
+	s.trace.all.Store(cfg.Trace)
+	s.trace.maxPayload = cfg.TracePayload
+	return s
+}
+
+// SetLogger replaces the logger, which discards everything by default. It
+// must be called before the first Start.
+func (s *SessionController) SetLogger(l *slog.Logger) {
+	s.logger = l
+}
+
+// RouteControl sends session lifecycle events and protocol errors to control
+// instead of the broker inbox, so the broker can handle them ahead of queued
+// commands. It must be called before the first Start.
+func (s *SessionController) RouteControl(control chan<- broker.BrokerEvent) {
+	s.controlInbox = control
+}
+
+// RoutePublishes sends PUBs through r instead of the broker inbox. It must be
+// called before the first Start.
+func (s *SessionController) RoutePublishes(r PublishRouter) {
+	s.router = r
 }
 
 func (s *SessionController) nextClientID() int64 {
 	return s.nextCID.Add(1) - 1
 }
 
+// outboundSize is the capacity of each connection's outbound channel. It is
+// one more than the broker's pending message limit so a slow consumer can
+// still be sent its -ERR before being closed.
+func (s *SessionController) outboundSize() int {
+	if s.config.MaxPendingMsgs > 0 {
+		return s.config.MaxPendingMsgs + 1
+	}
+	return defaultOutboundSize
+}
+
+// Active reports how many sessions have started and not yet sent their
+// SessionDownEvent.
+func (s *SessionController) Active() int64 {
+	return s.active.Load()
+}
+
+// RateLimitStats returns the rate limiting counters summed over every
+// connection.
+func (s *SessionController) RateLimitStats() *stats.RateLimit {
+	return &s.rateStats
+}
+
+// WriterStats returns the flush counters summed over every connection.
+func (s *SessionController) WriterStats() *stats.Writer {
+	return &s.writerStats
+}
+
 func (s *SessionController) Start(conn net.Conn) {
 	cid := s.nextClientID()
-	outbound := make(chan codec.OutboundCommands, 256)
-	var downOnce sync.Once
+	outbound := make(chan codec.OutboundCommands, s.outboundSize())
+	sess := s.newSession(cid, conn)
+
+	// INFO goes out before anything the broker sends, while the channel is
+	// still only ours.
+	outbound <- codec.Info{MaxPayload: sess.maxPayload}
+	go sess.writerLoop(outbound)
+	s.controlInbox <- broker.SessionUpEvent{
+		CID:        cid,
+		RemoteAddr: conn.RemoteAddr(),
+		Outbound:   outbound,
+		Stats:      sess.stats,
+	}
+	go sess.readerLoop()
+}
+
+// session is the state shared by one connection's reader and writer loops.
+type session struct {
+	cid  int64
+	conn net.Conn
+	// out is what the writer writes to: conn, or the connection under it
+	// when only reads need the wrapper.
+	out         net.Conn
+	brokerInbox chan<- broker.BrokerEvent
+	// controlInbox receives SessionDown and ProtocolError events.
+	controlInbox chan<- broker.BrokerEvent
+	downOnce     sync.Once
+	active       *atomic.Int64
+	stats        *stats.Conn
+
+	// publishInbox receives PUBs. When it is not the broker inbox, every
+	// other command waits until the broker has applied it so PUBs never
+	// overtake an earlier SUB or UNSUB from the same connection.
+	publishInbox chan<- broker.BrokerEvent
+	waitApplied  bool
 
-	go writerLoop(cid, conn, s.brokerInbox, outbound, &downOnce)
-	s.brokerInbox <- broker.SessionUpEvent{
-		CID:      cid,
-		Outbound: outbound,
+	writerStats *stats.Writer
+	maxBatch    int
+	maxLatency  time.Duration
+
+	maxPayload     int64
+	maxControlLine int
+
+	// limits holds the connection's own rate limit and the one shared by
+	// its source IP; either may be nil.
+	logger *slog.Logger
+	trace  *tracer
+
+	limits    [2]*ratelimit.Limit
+	ipLimits  *ratelimit.Registry
+	ip        string
+	throttle  bool
+	rateStats *stats.RateLimit
+}
+
+func (s *SessionController) newSession(cid int64, conn net.Conn) *session {
+	sess := &session{
+		cid:          cid,
+		conn:         conn,
+		out:          writeConn(conn),
+		brokerInbox:  s.brokerInbox,
+		controlInbox: s.controlInbox,
+		active:       &s.active,
+		stats:        &stats.Conn{},
+		publishInbox: s.brokerInbox,
+		writerStats:  &s.writerStats,
+		maxBatch:     s.config.WriteMaxBatch,
+		maxLatency:   s.config.WriteMaxLatency,
+
+		maxPayload:     codec.DefaultMaxPayload,
+		maxControlLine: s.config.MaxControlLine,
+
+		logger: s.logger,
+		trace:  &s.trace,
 	}
-	go readerLoop(cid, conn, s.brokerInbox, &downOnce)
+	if s.config.MaxPayload > 0 {
+		sess.maxPayload = int64(s.config.MaxPayload)
+	}
+	s.setRateLimits(sess)
+	s.active.Add(1)
+	s.trace.open(cid)
+	if s.router != nil && s.router.Parallel() {
+		sess.publishInbox = s.router.PublishInput(cid)
+		sess.waitApplied = true
+	}
+	return sess
+}
+
+// writeConn returns the connection under a PROXY protocol wrapper, which
+// only changes reads. net.Buffers only uses writev on the concrete
+// *net.TCPConn and *net.UnixConn types and would otherwise write each
+// buffer separately.
+func writeConn(conn net.Conn) net.Conn {
+	if pc, ok := conn.(*proxyproto.Conn); ok {
+		return pc.NetConn()
+	}
+	return conn
 }
 
-func sendSessionDownOnce(cid int64, brokerInbox chan<- broker.BrokerEvent, once *sync.Once) {
-	once.Do(func() {
-		brokerInbox <- broker.SessionDownEvent{CID: cid}
+func (s *session) sendSessionDownOnce() {
+	s.downOnce.Do(func() {
+		s.active.Add(-1)
+		s.trace.close(s.cid)
+		if s.limits[1] != nil {
+			s.ipLimits.Release(s.ip)
+		}
+		s.controlInbox <- broker.SessionDownEvent{CID: s.cid}
 	})
 }
 
-func readerLoop(cid int64, conn net.Conn, brokerInbox chan<- broker.BrokerEvent, downOnce *sync.Once) {
-	c, err := codec.NewCodec(conn)
+func (s *session) readerLoop() {
+	c, err := codec.NewCodec(s.conn)
 
 	if err != nil {
-		sendSessionDownOnce(cid, brokerInbox, downOnce)
+		s.sendSessionDownOnce()
 		return
 	}
 
+	c.SetMaxPayload(s.maxPayload)
+	c.SetMaxControlLine(s.maxControlLine)
+
+	// After a protocol error or a rate limit refusal the broker queues an
+	// -ERR and closes the outbox, and the writer closes the conn and sends
+	// SessionDown once the -ERR is written. Doing either here would lose it.
+	handedOff := false
 	defer func() {
-		_ = conn.Close()
-		sendSessionDownOnce(cid, brokerInbox, downOnce)
+		if !handedOff {
+			_ = s.conn.Close()
+			s.sendSessionDownOnce()
+		}
 	}()
 
 	for {
 		cmd, err := c.Decode()
 		if err != nil {
 			if shouldEmitProtocolError(err) {
-				brokerInbox <- broker.ProtocolErrorEvent{
-					CID: cid,
-					Msg: "unparsable command",
+				s.logProtocolError(err)
+				s.controlInbox <- broker.ProtocolErrorEvent{
+					CID: s.cid,
+					Msg: protocolErrorMessage(err),
 				}
+				handedOff = true
 			}
 			return
 		}
 
-		brokerInbox <- broker.CmdEvent{
-			CID: cid,
+		if s.trace.enabled(s.cid) {
+			s.traceCmd("in", cmd)
+		}
+		if !s.admit(cmd) {
+			s.logger.Warn("rate limit exceeded", "cid", s.cid)
+			// The broker inbox keeps it behind this reader's earlier
+			// commands, so their replies are queued before the -ERR.
+			s.brokerInbox <- broker.RateLimitEvent{CID: s.cid}
+			handedOff = true
+			return
+		}
+		s.dispatch(cmd)
+	}
+}
+
+func (s *session) dispatch(cmd codec.InboundCommands) {
+	if _, ok := cmd.(codec.Pub); ok {
+		s.publishInbox <- broker.CmdEvent{
+			CID: s.cid,
+			Cmd: cmd,
+		}
+		return
+	}
+
+	if !s.waitApplied {
+		s.brokerInbox <- broker.CmdEvent{
+			CID: s.cid,
 			Cmd: cmd,
 		}
+		return
+	}
+
+	done := make(chan struct{})
+	s.brokerInbox <- broker.CmdEvent{
+		CID:  s.cid,
+		Cmd:  cmd,
+		Done: done,
+	}
+	<-done
+}
+
+// maxLoggedBytes bounds how much of an unparsable command line is logged.
+const maxLoggedBytes = 128
+
+// logProtocolError logs why the input could not be decoded and, for a text
+// command that did not parse, the bytes up to the offending one.
+func (s *session) logProtocolError(err error) {
+	var perr *codec.ParseError
+	if !errors.As(err, &perr) {
+		s.logger.Warn("protocol error", "cid", s.cid, "err", err)
+		return
+	}
+	line := perr.Line
+	if len(line) > maxLoggedBytes {
+		line = line[len(line)-maxLoggedBytes:]
+	}
+	s.logger.Warn("protocol error", "cid", s.cid, "err", err, "bytes", string(line))
+}
+
+// protocolErrorMessage is the -ERR text sent before closing a connection
+// whose input could not be decoded.
+func protocolErrorMessage(err error) string {
+	switch {
+	case errors.Is(err, codec.ErrMaxPayload):
+		return "'Maximum Payload Violation'"
+	case errors.Is(err, codec.ErrMaxControlLine):
+		return "'Maximum Control Line Exceeded'"
+	default:
+		return "unparsable command"
 	}
 }
 
@@ -95,28 +342,149 @@ func shouldEmitProtocolError(err error) bool {
 	return true
 }
 
-func writerLoop(
-	cid int64,
-	conn net.Conn,
-	brokerInbox chan<- broker.BrokerEvent,
-	outbound <-chan codec.OutboundCommands,
-	downOnce *sync.Once,
-) {
-	b := bufio.NewWriterSize(conn, 32*1024)
+const (
+	defaultOutboundSize = 256
+
+	writerBufferSize = 32 * 1024
+	writeTimeout     = 5 * time.Second
+
+	// writevMinPayload is the payload size above which a framed Msg is sent
+	// straight from the shared frame with writev instead of being copied
+	// into the bufio.Writer first.
+	writevMinPayload = 4 * 1024
+)
+
+// writerLoop encodes commands in batches. After the first command of a batch
+// it keeps encoding whatever is already queued, up to maxBatch commands, and
+// optionally waits up to maxLatency for more before flushing once. A burst of
+// messages therefore costs one write syscall instead of one per message.
+func (s *session) writerLoop(outbound <-chan codec.OutboundCommands) {
+	b := bufio.NewWriterSize(s.out, writerBufferSize)
+	enc := codec.NewEncoder(b)
+	var vec [5][]byte
 
 	defer func() {
-		_ = conn.Close()
-		sendSessionDownOnce(cid, brokerInbox, downOnce)
+		_ = s.conn.Close()
+		s.sendSessionDownOnce()
 	}()
 
-	const timeout = 5 * time.Second
+	maxBatch := max(s.maxBatch, 1)
 	for cmd := range outbound {
-		_ = conn.SetWriteDeadline(time.Now().Add(timeout))
-		if err := cmd.EncodeTo(b); err != nil {
+		_ = s.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+
+		n, open, err := s.writeBatch(b, enc, vec[:0], cmd, outbound, maxBatch)
+		if err != nil {
 			return
 		}
-		if err := b.Flush(); err != nil {
+		if b.Buffered() > 0 {
+			if err := b.Flush(); err != nil {
+				return
+			}
+			s.countFlush()
+		}
+		s.countWrittenCmds(n)
+		if !open {
 			return
 		}
 	}
 }
+
+// writeBatch encodes cmd and any commands that follow it without blocking,
+// returning how many were written and whether outbound is still open.
+func (s *session) writeBatch(
+	b *bufio.Writer,
+	enc *codec.Encoder,
+	vec net.Buffers,
+	cmd codec.OutboundCommands,
+	outbound <-chan codec.OutboundCommands,
+	maxBatch int,
+) (int, bool, error) {
+	var deadline <-chan time.Time
+	n := 0
+	for {
+		if err := s.writeCmd(b, enc, cmd, vec); err != nil {
+			return n, true, err
+		}
+		n++
+		if n >= maxBatch {
+			return n, true, nil
+		}
+
+		var ok bool
+		select {
+		case cmd, ok = <-outbound:
+			if !ok {
+				return n, false, nil
+			}
+			continue
+		default:
+		}
+
+		if s.maxLatency <= 0 {
+			return n, true, nil
+		}
+		if deadline == nil {
+			timer := time.NewTimer(s.maxLatency)
+			defer timer.Stop()
+			deadline = timer.C
+		}
+		select {
+		case cmd, ok = <-outbound:
+			if !ok {
+				return n, false, nil
+			}
+		case <-deadline:
+			return n, true, nil
+		}
+	}
+}
+
+func (s *session) writeCmd(
+	b *bufio.Writer,
+	enc *codec.Encoder,
+	cmd codec.OutboundCommands,
+	vec net.Buffers,
+) (err error) {
+	msg, ok := cmd.(codec.Msg)
+	if ok {
+		s.stats.PendingBytes.Add(-int64(len(msg.Payload)))
+		defer msg.Release()
+	}
+	if s.trace.enabled(s.cid) {
+		// Deferred after the Msg release so it runs first, while the
+		// payload is still held.
+		defer func() {
+			if err == nil {
+				s.traceCmd("out", cmd)
+			}
+		}()
+	}
+	if !ok || msg.Frame == nil || len(msg.Payload) < writevMinPayload {
+		return enc.Encode(cmd)
+	}
+
+	// Anything already buffered must reach the socket first to keep the
+	// writer's ordering guarantee.
+	if b.Buffered() > 0 {
+		if err := b.Flush(); err != nil {
+			return err
+		}
+		s.countFlush()
+	}
+	bufs := enc.Buffers(vec, msg)
+	if _, err := bufs.WriteTo(s.out); err != nil {
+		return err
+	}
+	s.countFlush()
+	return nil
+}
+
+func (s *session) countFlush() {
+	s.stats.Flushes.Add(1)
+	s.writerStats.Flushes.Add(1)
+}
+
+func (s *session) countWrittenCmds(n int) {
+	s.stats.WrittenCmds.Add(int64(n))
+	s.writerStats.WrittenCmds.Add(int64(n))
+}
@@ -1,18 +1,26 @@
 package sessioncontroller
 
 import (
+	"bufio"
+	"bytes"
 	"io"
+	"log/slog"
 	"net"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/elmq0022/pub-sub/internal/broker"
 	"github.com/elmq0022/pub-sub/internal/codec"
+	"github.com/elmq0022/pub-sub/internal/config"
+	"github.com/elmq0022/pub-sub/internal/proxyproto"
+	"github.com/elmq0022/pub-sub/internal/subjectregistry"
 )
 
 func TestSessionControllerNextClientIDConcurrent(t *testing.T) {
-	controller := NewSessionController(nil)
+	controller := NewSessionController(nil, testConfig())
 
 	const total = 128
 	got := make(chan int64, total)
@@ -48,11 +56,10 @@ func TestSessionControllerNextClientIDConcurrent(t *testing.T) {
 func TestReaderLoopClosesConnBeforeSendingSessionDown(t *testing.T) {
 	conn := newTestConn(io.EOF)
 	brokerInbox := make(chan broker.BrokerEvent)
-	var downOnce sync.Once
 	done := make(chan struct{})
 
 	go func() {
-		readerLoop(42, conn, brokerInbox, &downOnce)
+		newTestSession(42, conn, brokerInbox).readerLoop()
 		close(done)
 	}()
 
@@ -80,13 +87,12 @@ func TestWriterLoopClosesConnBeforeSendingSessionDown(t *testing.T) {
 	conn := newTestConn(nil)
 	brokerInbox := make(chan broker.BrokerEvent)
 	outbound := make(chan codec.OutboundCommands)
-	var downOnce sync.Once
 	done := make(chan struct{})
 
 	close(outbound)
 
 	go func() {
-		writerLoop(7, conn, brokerInbox, outbound, &downOnce)
+		newTestSession(7, conn, brokerInbox).writerLoop(outbound)
 		close(done)
 	}()
 
@@ -110,11 +116,284 @@ func TestWriterLoopClosesConnBeforeSendingSessionDown(t *testing.T) {
 	waitForDone(t, done)
 }
 
+func TestStartSendsSessionUpWithRemoteAddr(t *testing.T) {
+	brokerInbox := make(chan broker.BrokerEvent, 1)
+	controller := NewSessionController(brokerInbox, testConfig())
+	conn := newTestConn(nil)
+	defer conn.Close()
+
+	controller.Start(conn)
+
+	ev := waitForBrokerEvent(t, brokerInbox)
+	up, ok := ev.(broker.SessionUpEvent)
+	if !ok {
+		t.Fatalf("expected SessionUpEvent, got %T", ev)
+	}
+	if up.RemoteAddr == nil || up.RemoteAddr.String() != "remote" {
+		t.Fatalf("expected remote address %q, got %v", "remote", up.RemoteAddr)
+	}
+}
+
+func TestRouteControlSendsLifecycleEventsToControl(t *testing.T) {
+	brokerInbox := make(chan broker.BrokerEvent)
+	control := make(chan broker.BrokerEvent, 2)
+	controller := NewSessionController(brokerInbox, testConfig())
+	controller.RouteControl(control)
+
+	sess := controller.newSession(5, newTestConn(nil))
+	sess.sendSessionDownOnce()
+
+	ev := waitForBrokerEvent(t, control)
+	if _, ok := ev.(broker.SessionDownEvent); !ok {
+		t.Fatalf("expected SessionDownEvent on control, got %T", ev)
+	}
+}
+
+func TestStartWritesInfoWithMaxPayloadFirst(t *testing.T) {
+	brokerInbox := make(chan broker.BrokerEvent, 2)
+	cfg := testConfig()
+	cfg.MaxPayload = 1024
+	controller := NewSessionController(brokerInbox, cfg)
+	server, client := net.Pipe()
+	defer client.Close()
+
+	controller.Start(server)
+
+	line, err := bufio.NewReader(client).ReadString('\n')
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if line != "INFO {\"max_payload\":1024}\r\n" {
+		t.Fatalf("unexpected first line %q", line)
+	}
+}
+
+func TestReaderLoopReportsMaxPayloadViolation(t *testing.T) {
+	brokerInbox := make(chan broker.BrokerEvent, 2)
+	cfg := testConfig()
+	cfg.MaxPayload = 4
+	server, client := net.Pipe()
+	defer client.Close()
+
+	sess := NewSessionController(brokerInbox, cfg).newSession(1, server)
+	go sess.readerLoop()
+	go func() { _, _ = client.Write([]byte("PUB foo 5\r\nhello\r\n")) }()
+
+	ev := waitForBrokerEvent(t, brokerInbox)
+	protoErr, ok := ev.(broker.ProtocolErrorEvent)
+	if !ok {
+		t.Fatalf("expected ProtocolErrorEvent, got %T", ev)
+	}
+	if protoErr.Msg != "'Maximum Payload Violation'" {
+		t.Fatalf("unexpected protocol error %q", protoErr.Msg)
+	}
+}
+
+func TestReaderLoopLogsOffendingBytes(t *testing.T) {
+	brokerInbox := make(chan broker.BrokerEvent, 2)
+	var logs bytes.Buffer
+	controller := NewSessionController(brokerInbox, testConfig())
+	controller.SetLogger(slog.New(slog.NewTextHandler(&logs, nil)))
+	server, client := net.Pipe()
+	defer client.Close()
+
+	sess := controller.newSession(3, server)
+	go sess.readerLoop()
+	go func() { _, _ = client.Write([]byte("SUB foo !\r\n")) }()
+
+	if _, ok := waitForBrokerEvent(t, brokerInbox).(broker.ProtocolErrorEvent); !ok {
+		t.Fatal("expected ProtocolErrorEvent")
+	}
+	if got := logs.String(); !strings.Contains(got, `msg="protocol error" cid=3 err="bad parse" bytes="SUB foo !"`) {
+		t.Fatalf("unexpected log %q", got)
+	}
+}
+
+func TestWriterLoopReleasesMsgPayloadAfterEncoding(t *testing.T) {
+	c, err := codec.NewCodec(bufio.NewReadWriter(
+		bufio.NewReader(bytes.NewBufferString("PUB foo 5\r\nhello\r\n")),
+		bufio.NewWriter(io.Discard),
+	))
+	if err != nil {
+		t.Fatalf("NewCodec returned error: %v", err)
+	}
+	cmd, err := c.Decode()
+	if err != nil {
+		t.Fatalf("Decode returned error: %v", err)
+	}
+	pub := cmd.(codec.Pub)
+
+	conn := newTestConn(nil)
+	brokerInbox := make(chan broker.BrokerEvent, 1)
+	outbound := make(chan codec.OutboundCommands, 1)
+
+	outbound <- codec.Msg{Subject: pub.Subject, SID: 1, Payload: pub.Payload, Buffer: pub.Buffer}
+	close(outbound)
+
+	newTestSession(3, conn, brokerInbox).writerLoop(outbound)
+
+	if refs := pub.Buffer.Refs(); refs != 0 {
+		t.Fatalf("expected writer to release the payload, got %d references", refs)
+	}
+}
+
+func TestWriterLoopWritesFramedMsgsInOrder(t *testing.T) {
+	server, client := net.Pipe()
+	defer client.Close()
+
+	large := bytes.Repeat([]byte("x"), writevMinPayload)
+	small := codec.NewFrame([]byte("foo"), nil, []byte("hi"))
+	big := codec.NewFrame([]byte("foo"), nil, large)
+
+	outbound := make(chan codec.OutboundCommands, 4)
+	outbound <- codec.Ping{}
+	outbound <- codec.Msg{Subject: []byte("foo"), SID: 1, Payload: []byte("hi"), Frame: small}
+	outbound <- codec.Msg{Subject: []byte("foo"), SID: 2, Payload: large, Frame: big}
+	outbound <- codec.Msg{Subject: []byte("foo"), SID: 3, Payload: []byte("hi"), Frame: small}
+	close(outbound)
+
+	brokerInbox := make(chan broker.BrokerEvent, 1)
+	go newTestSession(1, server, brokerInbox).writerLoop(outbound)
+
+	var want bytes.Buffer
+	want.WriteString("PING\r\nMSG foo 1 2\r\nhi\r\n")
+	want.WriteString("MSG foo 2 4096\r\n")
+	want.Write(large)
+	want.WriteString("\r\nMSG foo 3 2\r\nhi\r\n")
+
+	got, err := io.ReadAll(client)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if !bytes.Equal(want.Bytes(), got) {
+		t.Fatalf("unexpected wire output:\nwant %q\ngot  %q", want.String()[:64], string(got[:min(64, len(got))]))
+	}
+}
+
+func TestWriterLoopCoalescesQueuedCommandsIntoOneFlush(t *testing.T) {
+	conn := newTestConn(nil)
+	brokerInbox := make(chan broker.BrokerEvent, 1)
+	outbound := make(chan codec.OutboundCommands, 1000)
+	for i := 0; i < 1000; i++ {
+		outbound <- codec.Msg{Subject: []byte("foo"), SID: int64(i), Payload: []byte("hi")}
+	}
+	close(outbound)
+
+	sess := newTestSession(1, conn, brokerInbox)
+	sess.maxBatch = 1000
+	sess.writerLoop(outbound)
+
+	if got := sess.stats.WrittenCmds.Load(); got != 1000 {
+		t.Fatalf("expected 1000 written commands, got %d", got)
+	}
+	// 1000 small MSGs fit in a few 32KB buffers: the bufio.Writer spills on
+	// its own when full and the loop flushes the remainder once.
+	if got := sess.stats.Flushes.Load(); got != 1 {
+		t.Fatalf("expected a single explicit flush, got %d", got)
+	}
+	if got := conn.writes.Load(); got > 2 {
+		t.Fatalf("expected at most 2 socket writes, got %d", got)
+	}
+}
+
+func TestWriterLoopFlushesAtMaxBatch(t *testing.T) {
+	conn := newTestConn(nil)
+	brokerInbox := make(chan broker.BrokerEvent, 1)
+	outbound := make(chan codec.OutboundCommands, 10)
+	for i := 0; i < 10; i++ {
+		outbound <- codec.Ping{}
+	}
+	close(outbound)
+
+	sess := newTestSession(1, conn, brokerInbox)
+	sess.maxBatch = 4
+	sess.writerLoop(outbound)
+
+	if got := sess.stats.Flushes.Load(); got != 3 {
+		t.Fatalf("expected 3 flushes for 10 commands in batches of 4, got %d", got)
+	}
+	if got := sess.writerStats.WrittenCmds.Load(); got != 10 {
+		t.Fatalf("expected controller totals to count 10 commands, got %d", got)
+	}
+}
+
+func TestWriterLoopWaitsUpToMaxLatencyForMore(t *testing.T) {
+	conn := newTestConn(nil)
+	brokerInbox := make(chan broker.BrokerEvent, 1)
+	outbound := make(chan codec.OutboundCommands)
+
+	sess := newTestSession(1, conn, brokerInbox)
+	sess.maxBatch = 100
+	sess.maxLatency = time.Second
+	done := make(chan struct{})
+	go func() {
+		sess.writerLoop(outbound)
+		close(done)
+	}()
+
+	outbound <- codec.Ping{}
+	outbound <- codec.Ping{}
+	outbound <- codec.Ping{}
+	close(outbound)
+	waitForBrokerEvent(t, brokerInbox)
+	waitForDone(t, done)
+
+	if got := sess.stats.Flushes.Load(); got != 1 {
+		t.Fatalf("expected commands within max latency to share one flush, got %d", got)
+	}
+}
+
+func TestWriterWritesUnderProxyProtocolConn(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer client.Close()
+	if _, err := client.Write([]byte("PROXY TCP4 10.0.0.1 10.0.0.2 5000 4222\r\n")); err != nil {
+		t.Fatalf("write header: %v", err)
+	}
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatalf("accept: %v", err)
+	}
+	pc, err := proxyproto.Accept(conn, time.Second)
+	if err != nil {
+		t.Fatalf("proxyproto.Accept: %v", err)
+	}
+	defer pc.Close()
+
+	sess := newTestSession(1, pc, make(chan broker.BrokerEvent, 1))
+	if _, ok := sess.out.(*net.TCPConn); !ok {
+		t.Fatalf("expected the writer to use the *net.TCPConn for writev, got %T", sess.out)
+	}
+	if sess.conn != pc {
+		t.Fatal("expected the reader to keep the PROXY protocol conn")
+	}
+}
+
+func newTestSession(cid int64, conn net.Conn, brokerInbox chan<- broker.BrokerEvent) *session {
+	controller := NewSessionController(brokerInbox, testConfig())
+	return controller.newSession(cid, conn)
+}
+
+func testConfig() config.Config {
+	return config.Config{
+		WriteMaxBatch: 256,
+	}
+}
+
 type testConn struct {
 	closed   chan struct{}
 	readErr  error
 	closeMu  sync.Mutex
 	isClosed bool
+	writes   atomic.Int64
 }
 
 func newTestConn(readErr error) *testConn {
@@ -138,6 +417,7 @@ func (c *testConn) Write(p []byte) (int, error) {
 	case <-c.closed:
 		return 0, net.ErrClosed
 	default:
+		c.writes.Add(1)
 		return len(p), nil
 	}
 }
@@ -201,3 +481,82 @@ func waitForDone(t *testing.T, ch <-chan struct{}) {
 		t.Fatal("timed out waiting for goroutine completion")
 	}
 }
+
+func TestProtocolErrorReachesClientBeforeClose(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  config.Config
+		line string
+		want string
+	}{
+		{
+			name: "payload",
+			cfg:  config.Config{WriteMaxBatch: 256, MaxPayload: 8},
+			line: "PUB foo 64\r\n",
+			want: "-ERR 'Maximum Payload Violation'\r\n",
+		},
+		{
+			name: "control line",
+			cfg:  config.Config{WriteMaxBatch: 256, MaxControlLine: 32},
+			line: "SUB " + strings.Repeat("a", 64) + " 1\r\n",
+			want: "-ERR 'Maximum Control Line Exceeded'\r\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := startEndToEnd(t, tt.cfg)
+			r := bufio.NewReader(client)
+			if _, err := r.ReadString('\n'); err != nil {
+				t.Fatalf("read INFO: %v", err)
+			}
+			if _, err := io.WriteString(client, "CONNECT {}\r\n"+tt.line); err != nil {
+				t.Fatalf("write: %v", err)
+			}
+
+			var got []string
+			for {
+				line, err := r.ReadString('\n')
+				if err != nil {
+					break
+				}
+				got = append(got, line)
+			}
+			if len(got) == 0 || got[len(got)-1] != tt.want {
+				t.Fatalf("got %q, want it to end with %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// startEndToEnd runs a broker and a session controller behind a loopback
+// listener and returns a connected client.
+func startEndToEnd(t *testing.T, cfg config.Config) net.Conn {
+	t.Helper()
+
+	b := broker.NewBroker(subjectregistry.NewSubjectRegistry(), cfg)
+	go b.Run()
+	s := NewSessionController(b.Input(), cfg)
+	s.RouteControl(b.ControlInput())
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { _ = ln.Close() })
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		s.Start(conn)
+	}()
+
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	t.Cleanup(func() { _ = client.Close() })
+	_ = client.SetDeadline(time.Now().Add(2 * time.Second))
+	return client
+}
@@ -0,0 +1,181 @@
+package sessioncontroller
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	"github.com/elmq0022/pub-sub/internal/broker"
+	"github.com/elmq0022/pub-sub/internal/codec"
+)
+
+// tracer decides which sessions log their protocol traffic. It is shared by
+// every session of a controller and changed at runtime, so the check on the
+// hot path is two atomic loads while nothing is traced.
+type tracer struct {
+	all atomic.Bool
+	// n is len(cids), read without the lock.
+	n    atomic.Int64
+	mu   sync.RWMutex
+	cids map[int64]struct{}
+	// live holds the CIDs of open sessions. Only they can be traced, so an
+	// entry in cids never outlives its session.
+	live map[int64]struct{}
+
+	maxPayload int
+}
+
+func (t *tracer) enabled(cid int64) bool {
+	if t.all.Load() {
+		return true
+	}
+	if t.n.Load() == 0 {
+		return false
+	}
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	_, ok := t.cids[cid]
+	return ok
+}
+
+// setCID turns tracing of cid on or off. It reports false if cid is not an
+// open session.
+func (t *tracer) setCID(cid int64, on bool) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if _, ok := t.live[cid]; !ok {
+		return false
+	}
+	if on {
+		if t.cids == nil {
+			t.cids = make(map[int64]struct{})
+		}
+		t.cids[cid] = struct{}{}
+	} else {
+		delete(t.cids, cid)
+	}
+	t.n.Store(int64(len(t.cids)))
+	return true
+}
+
+// open makes cid traceable.
+func (t *tracer) open(cid int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.live == nil {
+		t.live = make(map[int64]struct{})
+	}
+	t.live[cid] = struct{}{}
+}
+
+// close forgets cid and stops tracing it.
+func (t *tracer) close(cid int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	delete(t.live, cid)
+	delete(t.cids, cid)
+	t.n.Store(int64(len(t.cids)))
+}
+
+// TraceState is which connections are being traced.
+type TraceState struct {
+	All  bool    `json:"all"`
+	CIDs []int64 `json:"cids"`
+}
+
+// SetTrace turns tracing of every connection on or off. Connections traced
+// on their own stay traced.
+func (s *SessionController) SetTrace(on bool) {
+	s.trace.all.Store(on)
+}
+
+// SetTraceCID turns tracing of one open connection on or off, and returns
+// broker.ErrUnknownCID for any other CID. The setting is forgotten when the
+// connection ends.
+func (s *SessionController) SetTraceCID(cid int64, on bool) error {
+	if !s.trace.setCID(cid, on) {
+		return fmt.Errorf("%w %d", broker.ErrUnknownCID, cid)
+	}
+	return nil
+}
+
+// Trace reports what is being traced, with CIDs in order.
+func (s *SessionController) Trace() TraceState {
+	s.trace.mu.RLock()
+	cids := make([]int64, 0, len(s.trace.cids))
+	for cid := range s.trace.cids {
+		cids = append(cids, cid)
+	}
+	s.trace.mu.RUnlock()
+	slices.Sort(cids)
+	return TraceState{All: s.trace.all.Load(), CIDs: cids}
+}
+
+// traceCmd logs one decoded inbound or encoded outbound command in its text
+// form. PUB and MSG payloads are cut to the tracer's maxPayload bytes.
+func (s *session) traceCmd(dir string, cmd codec.Command) {
+	line, payload := traceLine(cmd)
+	if line == "" {
+		return
+	}
+	attrs := []any{"cid", s.cid, "dir", dir, "cmd", line}
+	if payload != nil && s.trace.maxPayload > 0 {
+		attrs = append(attrs, "payload", truncate(payload, s.trace.maxPayload))
+	}
+	s.logger.Info("trace", attrs...)
+}
+
+func truncate(payload []byte, n int) string {
+	if len(payload) <= n {
+		return string(payload)
+	}
+	return string(payload[:n]) + "..."
+}
+
+// traceLine renders cmd as its text protocol line, without CRLF, and returns
+// the payload separately. CONNECT passwords are never logged.
+func traceLine(cmd codec.Command) (string, []byte) {
+	switch c := cmd.(type) {
+	case codec.Connect:
+		if c.Pass != "" {
+			c.Pass = "[REDACTED]"
+		}
+		opts, _ := json.Marshal(c)
+		return "CONNECT " + string(opts), nil
+	case codec.Ping:
+		return "PING", nil
+	case codec.Pong:
+		return "PONG", nil
+	case codec.Sub:
+		return "SUB " + string(c.Subject) + " " + strconv.FormatInt(c.SID, 10), nil
+	case codec.Unsub:
+		return "UNSUB " + strconv.FormatInt(c.SID, 10), nil
+	case codec.Pub:
+		return "PUB " + string(c.Subject) + withReply(c.Reply) + " " + strconv.Itoa(len(c.Payload)), c.Payload
+	case codec.Msg:
+		return "MSG " + string(c.Subject) + " " + strconv.FormatInt(c.SID, 10) + withReply(c.Reply) +
+			" " + strconv.Itoa(len(c.Payload)), c.Payload
+	case codec.OK:
+		return "+OK", nil
+	case codec.Err:
+		return "-ERR " + c.Message, nil
+	case codec.Info:
+		info, _ := json.Marshal(c)
+		return "INFO " + string(info), nil
+	}
+	// SwitchFraming writes nothing, so there is nothing to trace.
+	return "", nil
+}
+
+func withReply(reply []byte) string {
+	if len(reply) == 0 {
+		return ""
+	}
+	return " " + string(reply)
+}
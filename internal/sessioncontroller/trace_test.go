@@ -0,0 +1,104 @@
+package sessioncontroller
+
+import (
+	"bytes"
+	"errors"
+	"log/slog"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/elmq0022/pub-sub/internal/broker"
+	"github.com/elmq0022/pub-sub/internal/codec"
+)
+
+func TestTraceLogsInboundAndOutboundCommands(t *testing.T) {
+	brokerInbox := make(chan broker.BrokerEvent, 2)
+	var logs bytes.Buffer
+	cfg := testConfig()
+	cfg.TracePayload = 3
+	controller := NewSessionController(brokerInbox, cfg)
+	controller.SetLogger(slog.New(slog.NewTextHandler(&logs, nil)))
+
+	server, client := net.Pipe()
+	defer client.Close()
+	sess := controller.newSession(5, server)
+	if err := controller.SetTraceCID(5, true); err != nil {
+		t.Fatalf("SetTraceCID: %v", err)
+	}
+	go sess.readerLoop()
+	go func() { _, _ = client.Write([]byte("PUB foo _INBOX.1 5\r\nhello\r\n")) }()
+	if _, ok := waitForBrokerEvent(t, brokerInbox).(broker.CmdEvent); !ok {
+		t.Fatal("expected CmdEvent")
+	}
+
+	outbound := make(chan codec.OutboundCommands, 2)
+	outbound <- codec.Msg{Subject: []byte("foo"), SID: 1, Payload: []byte("hi")}
+	close(outbound)
+	controller.newSession(5, newTestConn(nil)).writerLoop(outbound)
+
+	got := logs.String()
+	for _, want := range []string{
+		`cid=5 dir=in cmd="PUB foo _INBOX.1 5" payload=hel...`,
+		`cid=5 dir=out cmd="MSG foo 1 2" payload=hi`,
+	} {
+		if !strings.Contains(got, want) {
+			t.Fatalf("expected %q in log %q", want, got)
+		}
+	}
+}
+
+func TestTraceIsOffUnlessEnabled(t *testing.T) {
+	controller := NewSessionController(make(chan broker.BrokerEvent, 1), testConfig())
+	if controller.trace.enabled(1) {
+		t.Fatal("expected tracing off by default")
+	}
+
+	sess := controller.newSession(1, newTestConn(nil))
+	controller.newSession(2, newTestConn(nil))
+	if err := controller.SetTraceCID(1, true); err != nil {
+		t.Fatalf("SetTraceCID: %v", err)
+	}
+	if !controller.trace.enabled(1) || controller.trace.enabled(2) {
+		t.Fatal("expected only cid 1 traced")
+	}
+	controller.SetTrace(true)
+	if !controller.trace.enabled(2) {
+		t.Fatal("expected every cid traced")
+	}
+	if got := controller.Trace(); !got.All || len(got.CIDs) != 1 || got.CIDs[0] != 1 {
+		t.Fatalf("unexpected trace state %+v", got)
+	}
+
+	controller.SetTrace(false)
+	sess.sendSessionDownOnce()
+	if controller.trace.enabled(1) {
+		t.Fatal("expected per-cid trace to end with the session")
+	}
+}
+
+func TestTraceCIDMustBeAnOpenSession(t *testing.T) {
+	controller := NewSessionController(make(chan broker.BrokerEvent, 1), testConfig())
+
+	if err := controller.SetTraceCID(9, true); !errors.Is(err, broker.ErrUnknownCID) {
+		t.Fatalf("expected ErrUnknownCID for a CID never used, got %v", err)
+	}
+	sess := controller.newSession(9, newTestConn(nil))
+	sess.sendSessionDownOnce()
+	if err := controller.SetTraceCID(9, true); !errors.Is(err, broker.ErrUnknownCID) {
+		t.Fatalf("expected ErrUnknownCID for a closed session, got %v", err)
+	}
+	if controller.trace.n.Load() != 0 || len(controller.Trace().CIDs) != 0 {
+		t.Fatalf("expected nothing traced, got %+v", controller.Trace())
+	}
+}
+
+func TestTraceLineRedactsPassword(t *testing.T) {
+	line, _ := traceLine(codec.Connect{User: "sys", Pass: "secret"})
+	if strings.Contains(line, "secret") || !strings.Contains(line, `"user":"sys"`) {
+		t.Fatalf("unexpected trace line %q", line)
+	}
+	if line, _ := traceLine(codec.SwitchFraming{}); line != "" {
+		t.Fatalf("expected SwitchFraming not to be traced, got %q", line)
+	}
+}
@@ -0,0 +1,73 @@
+package stats
+
+import "sync/atomic"
+
+// Conn holds per-connection counters. The reader and writer loops update them
+// with atomics and the broker only reads them when reporting, so they are the
+// one piece of session state shared outside the broker.
+type Conn struct {
+	// Flushes counts bufio flushes and direct writev calls to the socket.
+	Flushes atomic.Int64
+	// WrittenCmds counts outbound commands written to the socket. Dividing
+	// it by Flushes gives the average batch size.
+	WrittenCmds atomic.Int64
+
+	// PendingBytes is the MSG payload bytes queued for the writer. The
+	// broker adds to it when queueing and the writer subtracts when writing.
+	PendingBytes atomic.Int64
+	// DroppedMsgs counts MSGs discarded by the slow-consumer policy.
+	DroppedMsgs atomic.Int64
+
+	// InMsgs and InBytes count PUBs from the connection and their payload
+	// bytes. OutMsgs and OutBytes count MSGs queued to it.
+	InMsgs   atomic.Int64
+	InBytes  atomic.Int64
+	OutMsgs  atomic.Int64
+	OutBytes atomic.Int64
+
+	// Throttles counts reader pauses for going over a rate limit and
+	// ThrottledNanos their total length.
+	Throttles      atomic.Int64
+	ThrottledNanos atomic.Int64
+}
+
+// Broker aggregates message counters across every connection, including
+// ones that have closed.
+type Broker struct {
+	InMsgs   atomic.Int64
+	InBytes  atomic.Int64
+	OutMsgs  atomic.Int64
+	OutBytes atomic.Int64
+	// NoSubscribers counts PUBs whose subject matched no subscription.
+	NoSubscribers atomic.Int64
+	// SlowConsumers counts connections disconnected as slow consumers.
+	SlowConsumers atomic.Int64
+	// ProtocolErrors counts connections closed for a protocol violation and
+	// HeartbeatTimeouts ones that did not answer a PING in time.
+	ProtocolErrors    atomic.Int64
+	HeartbeatTimeouts atomic.Int64
+}
+
+// Writer aggregates flush counters across every connection.
+type Writer struct {
+	Flushes     atomic.Int64
+	WrittenCmds atomic.Int64
+}
+
+// RateLimit aggregates rate limiting across every connection.
+type RateLimit struct {
+	Throttles      atomic.Int64
+	ThrottledNanos atomic.Int64
+	// Disconnects counts connections closed for going over a rate limit.
+	Disconnects atomic.Int64
+}
+
+// Accept counts connections the server refused before starting a session.
+type Accept struct {
+	// Denied counts connections from addresses outside the CIDR lists.
+	Denied atomic.Int64
+	// RateLimited counts connections over the per-IP connection rate.
+	RateLimited atomic.Int64
+	// MaxConnections counts connections refused by MaxConnections.
+	MaxConnections atomic.Int64
+}
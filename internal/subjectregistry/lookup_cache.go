@@ -0,0 +1,100 @@
+package subjectregistry
+
+import "container/list"
+
+// DefaultLookupCacheSize is the number of subjects NewSubjectRegistry caches.
+const DefaultLookupCacheSize = 1024
+
+// CacheStats reports lookup cache effectiveness.
+type CacheStats struct {
+	Hits    uint64
+	Misses  uint64
+	Entries int
+	Size    int
+}
+
+// lookupCache is a bounded LRU from literal subject to lookup result.
+// Every registry mutation bumps generation; entries from an older generation
+// are treated as misses and refreshed, so invalidation is O(1).
+type lookupCache struct {
+	size       int
+	generation uint64
+	entries    map[string]*list.Element
+	order      *list.List
+	hits       uint64
+	misses     uint64
+}
+
+type cacheEntry struct {
+	subject    string
+	subs       []Sub
+	generation uint64
+}
+
+func newLookupCache(size int) *lookupCache {
+	if size <= 0 {
+		return nil
+	}
+	return &lookupCache{
+		size:    size,
+		entries: make(map[string]*list.Element, size),
+		order:   list.New(),
+	}
+}
+
+func (c *lookupCache) invalidate() {
+	if c == nil {
+		return
+	}
+	c.generation++
+}
+
+func (c *lookupCache) get(subject string) ([]Sub, bool) {
+	if c == nil {
+		return nil, false
+	}
+	el, ok := c.entries[subject]
+	if !ok || el.Value.(*cacheEntry).generation != c.generation {
+		c.misses++
+		return nil, false
+	}
+	c.hits++
+	c.order.MoveToFront(el)
+	return el.Value.(*cacheEntry).subs, true
+}
+
+func (c *lookupCache) put(subject string, subs []Sub) {
+	if c == nil {
+		return
+	}
+	if el, ok := c.entries[subject]; ok {
+		entry := el.Value.(*cacheEntry)
+		entry.subs = subs
+		entry.generation = c.generation
+		c.order.MoveToFront(el)
+		return
+	}
+
+	if c.order.Len() >= c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).subject)
+	}
+	c.entries[subject] = c.order.PushFront(&cacheEntry{
+		subject:    subject,
+		subs:       subs,
+		generation: c.generation,
+	})
+}
+
+func (c *lookupCache) stats() CacheStats {
+	if c == nil {
+		return CacheStats{}
+	}
+	return CacheStats{
+		Hits:    c.hits,
+		Misses:  c.misses,
+		Entries: c.order.Len(),
+		Size:    c.size,
+	}
+}
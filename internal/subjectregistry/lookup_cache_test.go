@@ -0,0 +1,103 @@
+package subjectregistry
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestLookupCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	c := newLookupCache(2)
+	c.put("a", []Sub{sub(1, 1)})
+	c.put("b", []Sub{sub(2, 2)})
+
+	if _, ok := c.get("a"); !ok {
+		t.Fatal("expected hit for a")
+	}
+	c.put("c", []Sub{sub(3, 3)})
+
+	if _, ok := c.get("b"); ok {
+		t.Fatal("expected b to be evicted as least recently used")
+	}
+	if _, ok := c.get("a"); !ok {
+		t.Fatal("expected a to survive eviction")
+	}
+	if got := c.stats(); got.Entries != 2 || got.Size != 2 {
+		t.Fatalf("unexpected stats %+v", got)
+	}
+}
+
+func TestLookupCacheInvalidateMakesEntriesStale(t *testing.T) {
+	c := newLookupCache(4)
+	c.put("a", nil)
+	c.invalidate()
+
+	if _, ok := c.get("a"); ok {
+		t.Fatal("expected stale entry to miss")
+	}
+	c.put("a", []Sub{sub(1, 1)})
+	subs, ok := c.get("a")
+	if !ok || len(subs) != 1 {
+		t.Fatalf("expected refreshed entry, got %v %v", subs, ok)
+	}
+	if got := c.stats(); got.Hits != 1 || got.Misses != 1 {
+		t.Fatalf("expected 1 hit and 1 miss, got %+v", got)
+	}
+}
+
+func TestNilLookupCacheIsNoop(t *testing.T) {
+	c := newLookupCache(0)
+	c.put("a", nil)
+	c.invalidate()
+	if _, ok := c.get("a"); ok {
+		t.Fatal("expected disabled cache to miss")
+	}
+	if got := c.stats(); got != (CacheStats{}) {
+		t.Fatalf("expected zero stats, got %+v", got)
+	}
+}
+
+func TestRegistryLookupUsesCacheUntilMutation(t *testing.T) {
+	tr := NewSubjectRegistryWithCache(8)
+	tr.AddSub("foo.*", sub(1, 1))
+
+	for i := 0; i < 3; i++ {
+		if got, _ := tr.Lookup("foo.bar"); len(got) != 1 {
+			t.Fatalf("expected 1 match, got %v", got)
+		}
+	}
+	if got := tr.CacheStats(); got.Hits != 2 || got.Misses != 1 {
+		t.Fatalf("expected 2 hits and 1 miss, got %+v", got)
+	}
+
+	mutations := []func(){
+		func() { tr.AddSub("foo.bar", sub(2, 2)) },
+		func() { _ = tr.RemoveSub(2, 2) },
+		func() { _ = tr.RemoveCID(1) },
+	}
+	wantLens := []int{2, 1, 0}
+	for i, mutate := range mutations {
+		mutate()
+		if got, _ := tr.Lookup("foo.bar"); len(got) != wantLens[i] {
+			t.Fatalf("after mutation %d: expected %d matches, got %v", i, wantLens[i], got)
+		}
+	}
+}
+
+func BenchmarkLookupHotSubject(b *testing.B) {
+	for _, cacheSize := range []int{0, DefaultLookupCacheSize} {
+		b.Run(fmt.Sprintf("cache=%d", cacheSize), func(b *testing.B) {
+			tr := NewSubjectRegistryWithCache(cacheSize)
+			for i := int64(0); i < 100; i++ {
+				tr.AddSub(fmt.Sprintf("orders.%d.created", i), sub(i, 1))
+			}
+			tr.AddSub("orders.*.created", sub(200, 1))
+			tr.AddSub("orders.>", sub(201, 1))
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				_, _ = tr.Lookup("orders.42.created")
+			}
+		})
+	}
+}
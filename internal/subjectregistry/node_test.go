@@ -15,7 +15,7 @@ func TestRemoveSub_NilNode(t *testing.T) {
 }
 
 func TestRemoveSub_EmptySlice(t *testing.T) {
-	n := newNode(nil, "")
+	n := newNode(0)
 	// subs is nil/empty - should not panic and remain empty
 	n.removeSub(1, 1)
 	if len(n.subs) != 0 {
@@ -24,7 +24,7 @@ func TestRemoveSub_EmptySlice(t *testing.T) {
 }
 
 func TestRemoveSub_OneElement_NoMatch(t *testing.T) {
-	n := newNode(nil, "")
+	n := newNode(0)
 	n.subs = []Sub{sub(2, 2)}
 
 	n.removeSub(1, 1)
@@ -35,7 +35,7 @@ func TestRemoveSub_OneElement_NoMatch(t *testing.T) {
 }
 
 func TestRemoveSub_OneElement_Match(t *testing.T) {
-	n := newNode(nil, "")
+	n := newNode(0)
 	n.subs = []Sub{sub(1, 1)}
 
 	n.removeSub(1, 1)
@@ -46,7 +46,7 @@ func TestRemoveSub_OneElement_Match(t *testing.T) {
 }
 
 func TestRemoveSub_ManyElements_AllMatch(t *testing.T) {
-	n := newNode(nil, "")
+	n := newNode(0)
 	n.subs = []Sub{sub(1, 1), sub(1, 1), sub(1, 1)}
 
 	n.removeSub(1, 1)
@@ -57,7 +57,7 @@ func TestRemoveSub_ManyElements_AllMatch(t *testing.T) {
 }
 
 func TestRemoveSub_ManyElements_NoneMatch(t *testing.T) {
-	n := newNode(nil, "")
+	n := newNode(0)
 	n.subs = []Sub{sub(2, 2), sub(3, 3), sub(4, 4)}
 
 	n.removeSub(1, 1)
@@ -68,7 +68,7 @@ func TestRemoveSub_ManyElements_NoneMatch(t *testing.T) {
 }
 
 func TestRemoveSub_ManyElements_SomeMatch_MatchAtStart(t *testing.T) {
-	n := newNode(nil, "")
+	n := newNode(0)
 	n.subs = []Sub{sub(1, 1), sub(1, 1), sub(2, 2), sub(3, 3)}
 
 	n.removeSub(1, 1)
@@ -84,7 +84,7 @@ func TestRemoveSub_ManyElements_SomeMatch_MatchAtStart(t *testing.T) {
 }
 
 func TestRemoveSub_ManyElements_SomeMatch_MatchAtEnd(t *testing.T) {
-	n := newNode(nil, "")
+	n := newNode(0)
 	n.subs = []Sub{sub(2, 2), sub(3, 3), sub(1, 1), sub(1, 1)}
 
 	n.removeSub(1, 1)
@@ -100,7 +100,7 @@ func TestRemoveSub_ManyElements_SomeMatch_MatchAtEnd(t *testing.T) {
 }
 
 func TestRemoveSub_ManyElements_SomeMatch_MatchInterleaved(t *testing.T) {
-	n := newNode(nil, "")
+	n := newNode(0)
 	n.subs = []Sub{sub(2, 2), sub(1, 1), sub(3, 3), sub(1, 1), sub(4, 4)}
 
 	n.removeSub(1, 1)
@@ -117,7 +117,7 @@ func TestRemoveSub_ManyElements_SomeMatch_MatchInterleaved(t *testing.T) {
 
 // Only CID matches but SID differs - should not remove.
 func TestRemoveSub_PartialKeyMatch_CIDOnly(t *testing.T) {
-	n := newNode(nil, "")
+	n := newNode(0)
 	n.subs = []Sub{sub(1, 99)}
 
 	n.removeSub(1, 1)
@@ -129,7 +129,7 @@ func TestRemoveSub_PartialKeyMatch_CIDOnly(t *testing.T) {
 
 // Only SID matches but CID differs - should not remove.
 func TestRemoveSub_PartialKeyMatch_SIDOnly(t *testing.T) {
-	n := newNode(nil, "")
+	n := newNode(0)
 	n.subs = []Sub{sub(99, 1)}
 
 	n.removeSub(1, 1)
@@ -0,0 +1,84 @@
+package subjectregistry
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestSnapshotChangesCopyOnlyThePath(t *testing.T) {
+	tr := NewSubjectRegistry()
+	tr.AddSub("a.x", sub(1, 1))
+	tr.AddSub("b.y", sub(2, 1))
+	tr.AddSub("b.z", sub(3, 1))
+
+	before := tr.root
+	snap := tr.Snapshot().(*SubjectRegistry)
+	tr.AddSub("b.y", sub(4, 1))
+
+	if tr.root == before || snap.root != before {
+		t.Fatal("expected the root to be copied and the snapshot to keep the old one")
+	}
+	if tr.root.children["a"] != before.children["a"] {
+		t.Fatal("expected the untouched subtree to be shared")
+	}
+	if tr.root.children["b"] == before.children["b"] {
+		t.Fatal("expected the changed path to be copied")
+	}
+	if tr.root.children["b"].children["z"] != before.children["b"].children["z"] {
+		t.Fatal("expected the untouched sibling to be shared")
+	}
+
+	// Later changes in the same generation reuse the copies.
+	copied := tr.root.children["b"]
+	tr.AddSub("b.y", sub(5, 1))
+	if tr.root.children["b"] != copied {
+		t.Fatal("expected a writable node to be changed in place")
+	}
+}
+
+func TestSnapshotIsIsolatedFromRemovalsAndPruning(t *testing.T) {
+	tr := NewSubjectRegistry()
+	tr.AddSub("a.b.c", sub(1, 1))
+	tr.AddSub("a.b.d", sub(1, 2))
+
+	snap := tr.Snapshot()
+	if err := tr.RemoveSub(1, 1); err != nil {
+		t.Fatalf("RemoveSub: %v", err)
+	}
+	if err := tr.RemoveCID(1); err != nil {
+		t.Fatalf("RemoveCID: %v", err)
+	}
+
+	if len(tr.root.children) != 0 {
+		t.Fatalf("expected the registry to prune every node, got %v", tr.root.children)
+	}
+	for _, subject := range []string{"a.b.c", "a.b.d"} {
+		if got, _ := snap.Lookup(subject); len(got) != 1 {
+			t.Fatalf("snapshot Lookup(%q) = %v, want one sub", subject, got)
+		}
+	}
+}
+
+// BenchmarkSubUnsubChurn measures a SUB and an UNSUB against a large
+// registry with a snapshot after each, as the broker does in parallel
+// fanout mode.
+func BenchmarkSubUnsubChurn(b *testing.B) {
+	for _, size := range []int{1_000, 100_000} {
+		b.Run(fmt.Sprintf("subs=%d", size), func(b *testing.B) {
+			tr := NewSubjectRegistry()
+			for i := 0; i < size; i++ {
+				tr.AddSub(fmt.Sprintf("tenant.%d.orders.%d", i%1000, i), sub(int64(i), 1))
+			}
+			tr.Snapshot()
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				_ = tr.AddSub("tenant.42.orders.new", sub(-1, 1))
+				tr.Snapshot()
+				_ = tr.RemoveSub(-1, 1)
+				tr.Snapshot()
+			}
+		})
+	}
+}
@@ -2,6 +2,8 @@ package subjectregistry
 
 import (
 	"errors"
+	"maps"
+	"slices"
 	"strings"
 )
 
@@ -10,62 +12,123 @@ type Sub struct {
 	SID int64
 }
 
+// Subscription is a registered Sub together with the subject it was added
+// under, for reporting.
+type Subscription struct {
+	Subject string
+	Sub
+}
+
 type node struct {
-	key      string
-	parent   *node
+	// gen is the registry generation the node was created or copied in.
+	gen      uint64
 	children map[string]*node
 	subs     []Sub
 }
 
-func newNode(parent *node, key string) *node {
+func newNode(gen uint64) *node {
 	return &node{
-		key:      key,
-		parent:   parent,
+		gen:      gen,
 		children: make(map[string]*node)}
 }
 
+// SubjectRegistry is a subject trie. Snapshots share its nodes: taking one
+// starts a new generation, and nodes from an older generation are copied
+// before they are changed, so only the path to a changed node is copied.
 type SubjectRegistry struct {
 	root  *node
-	index map[int64]map[int64]*node
+	gen   uint64
+	index map[int64]map[int64]string
+	cache *lookupCache
 }
 
 type Registry interface {
+	Lookuper
 	AddSub(subject string, s Sub) error
-	Lookup(subject string) ([]Sub, error)
 	RemoveSub(CID, SID int64) error
 	RemoveCID(CID int64) error
+	HasSub(CID, SID int64) bool
+	Snapshot() Lookuper
+	Count() int
+	Subscriptions() []Subscription
+	CacheStats() CacheStats
+}
+
+// Lookuper is the read-only view of a registry.
+type Lookuper interface {
+	Lookup(subject string) ([]Sub, error)
 }
 
 func NewSubjectRegistry() *SubjectRegistry {
+	return NewSubjectRegistryWithCache(DefaultLookupCacheSize)
+}
+
+// NewSubjectRegistryWithCache caches the results of up to cacheSize distinct
+// subjects. A size of zero disables the cache.
+func NewSubjectRegistryWithCache(cacheSize int) *SubjectRegistry {
 	return &SubjectRegistry{
-		root:  newNode(nil, ""),
-		index: make(map[int64]map[int64]*node),
+		root:  newNode(0),
+		index: make(map[int64]map[int64]string),
+		cache: newLookupCache(cacheSize),
 	}
 }
 
+// CacheStats returns the lookup cache counters.
+func (t *SubjectRegistry) CacheStats() CacheStats {
+	return t.cache.stats()
+}
+
 func (t *SubjectRegistry) AddSub(subject string, s Sub) error {
+	t.root = t.writable(t.root)
 	cur := t.root
 
 	parts := strings.Split(subject, ".")
 	for _, part := range parts {
-		if cur.children[part] == nil {
-			cur.children[part] = newNode(cur, part)
+		child := cur.children[part]
+		if child == nil {
+			child = newNode(t.gen)
+		} else {
+			child = t.writable(child)
 		}
-		cur = cur.children[part]
+		cur.children[part] = child
+		cur = child
 	}
 	if t.index[s.CID] == nil {
-		t.index[s.CID] = make(map[int64]*node)
+		t.index[s.CID] = make(map[int64]string)
 	}
-	t.index[s.CID][s.SID] = cur
+	t.index[s.CID][s.SID] = subject
 	cur.subs = append(cur.subs, s)
+	t.cache.invalidate()
 	return nil
 }
 
+// writable returns n if it belongs to the current generation and otherwise
+// a copy that does. The caller must link the copy into its writable parent.
+// A copy shares the children but not their map, so it costs the node's
+// fanout, not the size of the subtree.
+func (t *SubjectRegistry) writable(n *node) *node {
+	if n.gen == t.gen {
+		return n
+	}
+	c := &node{gen: t.gen, children: maps.Clone(n.children)}
+	if len(n.subs) > 0 {
+		c.subs = slices.Clone(n.subs)
+	}
+	return c
+}
+
+// Lookup returns every subscription matching subject. Results may be served
+// from the cache and shared between calls, so callers must not modify them.
 func (t *SubjectRegistry) Lookup(subject string) ([]Sub, error) {
+	if subs, ok := t.cache.get(subject); ok {
+		return subs, nil
+	}
+
 	parts := strings.Split(subject, ".")
 
 	var res []Sub
 	match(parts, t.root, &res)
+	t.cache.put(subject, res)
 	return res, nil
 }
 
@@ -88,18 +151,57 @@ func match(parts []string, n *node, res *[]Sub) {
 	}
 }
 
+// Snapshot returns a view of the trie as it is now that is never mutated,
+// so any number of goroutines may call Lookup on it while the registry
+// keeps changing. It takes constant time: the current nodes are frozen by
+// moving to a new generation, and later changes copy the nodes on their
+// path instead of changing them. Snapshots have no CID index because they
+// cannot remove subs, and no lookup cache because the cache is not safe for
+// concurrent use.
+func (t *SubjectRegistry) Snapshot() Lookuper {
+	t.gen++
+	return &SubjectRegistry{root: t.root}
+}
+
+// HasSub reports whether CID has a subscription with SID.
+func (t *SubjectRegistry) HasSub(CID, SID int64) bool {
+	_, ok := t.index[CID][SID]
+	return ok
+}
+
+// Count returns the number of registered subscriptions.
+func (t *SubjectRegistry) Count() int {
+	n := 0
+	for _, bySID := range t.index {
+		n += len(bySID)
+	}
+	return n
+}
+
+// Subscriptions lists every registered subscription in no particular order.
+func (t *SubjectRegistry) Subscriptions() []Subscription {
+	res := make([]Subscription, 0, t.Count())
+	for cid, bySID := range t.index {
+		for sid, subject := range bySID {
+			res = append(res, Subscription{Subject: subject, Sub: Sub{CID: cid, SID: sid}})
+		}
+	}
+	return res
+}
+
 func (t *SubjectRegistry) RemoveSub(CID, SID int64) error {
-	if t.index[CID] == nil || t.index[CID][SID] == nil {
+	subject, ok := t.index[CID][SID]
+	if !ok {
 		return errors.New("no subscription")
 	}
 
-	n := t.index[CID][SID]
 	delete(t.index[CID], SID)
 	if len(t.index[CID]) == 0 {
 		delete(t.index, CID)
 	}
 
-	t.removeSubFromNodeAndPrune(n, CID, SID)
+	t.removeSubAndPrune(subject, CID, SID)
+	t.cache.invalidate()
 
 	return nil
 }
@@ -110,21 +212,42 @@ func (t *SubjectRegistry) RemoveCID(CID int64) error {
 		return nil
 	}
 
-	for sid, n := range bySID {
-		t.removeSubFromNodeAndPrune(n, CID, sid)
+	for sid, subject := range bySID {
+		t.removeSubAndPrune(subject, CID, sid)
 	}
 	delete(t.index, CID)
+	t.cache.invalidate()
 
 	return nil
 }
 
-func (t *SubjectRegistry) removeSubFromNodeAndPrune(n *node, CID, SID int64) {
-	n.removeSub(CID, SID)
+// removeSubAndPrune walks down to subject's node, making the path writable,
+// removes the sub and then removes the nodes left empty from the bottom up.
+func (t *SubjectRegistry) removeSubAndPrune(subject string, CID, SID int64) {
+	parts := strings.Split(subject, ".")
+	path := make([]*node, 0, len(parts)+1)
+
+	t.root = t.writable(t.root)
+	cur := t.root
+	path = append(path, cur)
+	for _, part := range parts {
+		child := cur.children[part]
+		if child == nil {
+			return
+		}
+		child = t.writable(child)
+		cur.children[part] = child
+		cur = child
+		path = append(path, cur)
+	}
+	cur.removeSub(CID, SID)
 
-	for n != nil && n.parent != nil && len(n.subs) == 0 && len(n.children) == 0 {
-		parent := n.parent
-		delete(parent.children, n.key)
-		n = parent
+	for i := len(parts); i > 0; i-- {
+		n := path[i]
+		if len(n.subs) > 0 || len(n.children) > 0 {
+			break
+		}
+		delete(path[i-1].children, parts[i-1])
 	}
 }
 
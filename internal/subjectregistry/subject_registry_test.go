@@ -136,6 +136,31 @@ func TestRootGreaterThan(t *testing.T) {
 	}
 }
 
+func TestSnapshotIsIsolatedFromLaterChanges(t *testing.T) {
+	tr := subjectregistry.NewSubjectRegistry()
+	tr.AddSub("foo.bar", subjectregistry.Sub{CID: 1, SID: 1})
+	tr.AddSub("foo.*", subjectregistry.Sub{CID: 2, SID: 2})
+
+	snap := tr.Snapshot()
+
+	tr.AddSub("foo.bar", subjectregistry.Sub{CID: 3, SID: 3})
+	tr.RemoveCID(2)
+
+	got, err := snap.Lookup("foo.bar")
+	if err != nil {
+		t.Fatalf("snapshot Lookup unexpected error: %v", err)
+	}
+	got = sorted(got)
+	if len(got) != 2 || got[0].SID != 1 || got[1].SID != 2 {
+		t.Fatalf("snapshot got %v, want SIDs [1 2]", got)
+	}
+
+	got = sorted(mustLookup(t, tr, "foo.bar"))
+	if len(got) != 2 || got[0].SID != 1 || got[1].SID != 3 {
+		t.Fatalf("registry got %v, want SIDs [1 3]", got)
+	}
+}
+
 // helpers
 
 func makeSubFull(cid, sid int64) subjectregistry.Sub {
@@ -191,6 +216,18 @@ func TestRemoveSub_SecondRemoveFails(t *testing.T) {
 	}
 }
 
+func TestHasSub(t *testing.T) {
+	tr := subjectregistry.NewSubjectRegistry()
+	mustAddSub(t, tr, "foo.bar", makeSubFull(1, 1))
+	if !tr.HasSub(1, 1) || tr.HasSub(1, 2) || tr.HasSub(2, 1) {
+		t.Fatal("expected only CID 1 SID 1 to be subscribed")
+	}
+	mustRemoveSub(t, tr, 1, 1)
+	if tr.HasSub(1, 1) {
+		t.Fatal("expected HasSub to be false after RemoveSub")
+	}
+}
+
 // --- basic removal ---
 
 func TestRemoveSub_SubNoLongerMatches(t *testing.T) {
@@ -443,3 +480,25 @@ func TestRemoveCID_LeavesOtherClients(t *testing.T) {
 		}
 	}
 }
+
+func TestSubscriptionsListsSubjectsAndCount(t *testing.T) {
+	tr := subjectregistry.NewSubjectRegistry()
+	tr.AddSub("foo.bar", subjectregistry.Sub{CID: 1, SID: 1})
+	tr.AddSub("foo.*", subjectregistry.Sub{CID: 1, SID: 2})
+	tr.AddSub(">", subjectregistry.Sub{CID: 2, SID: 1})
+	tr.RemoveSub(1, 2)
+
+	if got := tr.Count(); got != 2 {
+		t.Fatalf("Count() = %d, want 2", got)
+	}
+
+	got := tr.Subscriptions()
+	sort.Slice(got, func(i, j int) bool { return got[i].CID < got[j].CID })
+	want := []subjectregistry.Subscription{
+		{Subject: "foo.bar", Sub: subjectregistry.Sub{CID: 1, SID: 1}},
+		{Subject: ">", Sub: subjectregistry.Sub{CID: 2, SID: 1}},
+	}
+	if len(got) != len(want) || got[0] != want[0] || got[1] != want[1] {
+		t.Fatalf("Subscriptions() = %v, want %v", got, want)
+	}
+}